@@ -32,7 +32,7 @@ func main() {
 
 	// 3. Launch Core Services
 	fmt.Println("🚀 Launching Spirit services...")
-	go launchService("nodus", "/nodus", 500*time.Millisecond)
+	go launchService("nodus", "/nodus", 500*time.Millisecond, "daemon")
 	go launchService("nexus", "/nexus", 1*time.Second)
 	go launchService("hypervisor", "/hypervisor", 1500*time.Millisecond)
 
@@ -67,7 +67,7 @@ func mountSystem() error {
 	return nil
 }
 
-func launchService(name, path string, delay time.Duration) {
+func launchService(name, path string, delay time.Duration, args ...string) {
 	time.Sleep(delay)
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -78,7 +78,7 @@ func launchService(name, path string, delay time.Duration) {
 	fmt.Printf("🔄 Starting %s...\n", name)
 
 	for {
-		cmd := exec.Command(path)
+		cmd := exec.Command(path, args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		cmd.Env = []string{
@@ -1,20 +1,32 @@
 //go:build linux
 
 // Package main implements a simple Nodus CLI for Spirit
-// This is a pure Go version without libp2p CGO dependencies
+// This is a pure Go version without CGO dependencies
 package main
 
 import (
+	"context"
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"spirit/internal/nodus"
 )
 
 const (
-	version       = "1.0.0"
-	discoveryPort = 7331
+	version = "1.0.0"
 )
 
 func main() {
@@ -25,16 +37,48 @@ func main() {
 
 	cmd := os.Args[1]
 	switch cmd {
+	case "daemon":
+		daemon()
 	case "discover":
 		discover()
 	case "peers":
 		listPeers()
+	case "connect":
+		connect()
 	case "mount":
 		mount()
+	case "unmount":
+		unmount()
+	case "volume":
+		volume()
 	case "status":
 		status()
 	case "sync":
 		syncData()
+	case "identity":
+		identity()
+	case "trust":
+		trust()
+	case "key":
+		key()
+	case "replicas":
+		replicas()
+	case "pin":
+		pin()
+	case "unpin":
+		unpin()
+	case "pins":
+		listPins()
+	case "history":
+		history()
+	case "restore":
+		restore()
+	case "nbd":
+		nbd()
+	case "trash":
+		trash()
+	case "boot":
+		boot()
 	case "version":
 		fmt.Printf("Nodus v%s\n", version)
 	default:
@@ -51,79 +95,984 @@ func printUsage() {
 Usage: nodus <command>
 
 Commands:
+  daemon    - Run the Nodus daemon (node, FUSE mount, control socket)
   discover  - Find peers on LAN
   peers     - List connected peers
-  mount     - Mount Nodus volume
-  sync      - Sync data to network
-  status    - Show status
+  connect   - Connect to a peer by multiaddr
+  mount     - Mount a Nodus volume (mount [<volume>] [<path>])
+  unmount   - Unmount a volume (unmount <path>)
+  volume    - Manage named volumes (create <name> [--quota SIZE] [--replication N] [--encrypted] | list | delete <name>)
+  sync      - Replay offline changes and sync data to network
+  status    - Show status, cache hit rates and traffic
+  identity  - Show node identity (identity rotate: new key)
+  trust     - Manage trusted peers (add <id> [level] [name] | remove <id> | list)
+  key       - Manage encryption keys (init | device | grant <pubkey> [name] | list)
+  replicas  - Show where each block of a file lives
+  pin       - Keep a file cached, even across restarts (pin <file>)
+  unpin     - Release a pinned file (unpin <file>)
+  pins      - List pinned files
+  history   - List the versions of a file (history <file>)
+  restore   - Make an earlier version current (restore <file> <version>)
+  nbd       - Manage device images exported over NBD (create <name> <size> | list)
+  trash     - Recently deleted files (list | restore <file>)
+  boot      - Network boot bundles (publish --kernel <file> --initramfs <file> [--rootfs <file>] [--cmdline ARGS] | fetch --out <dir> | list) [--channel NAME]
   version   - Show version
 `)
 }
 
-func discover() {
-	fmt.Println("\033[33m[*] Discovering peers on LAN...\033[0m")
-	fmt.Printf("    Broadcast UDP:%d...\n", discoveryPort)
+func daemon() {
+	cfg := loadConfig()
 
-	// Try to send UDP broadcast
-	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{
-		IP:   net.IPv4bcast,
-		Port: discoveryPort,
-	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := nodus.NewDaemon(ctx, cfg)
 	if err != nil {
-		fmt.Printf("\033[31m[✗] Broadcast failed: %v\033[0m\n", err)
-		return
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
 	}
-	defer conn.Close()
+	fmt.Printf("🚀 Nodus daemon started as %s\n", d.Node().ID())
 
-	// Send discovery message
-	msg := []byte("CROM_SPIRIT_SEEK")
-	conn.Write(msg)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
 
-	// Wait briefly for responses
-	time.Sleep(500 * time.Millisecond)
+	if err := d.Run(ctx); err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("👋 Nodus daemon stopped")
+}
 
-	fmt.Println("\033[32m[✓] Discovery complete\033[0m")
-	fmt.Println("    Peers found: 0 (standalone mode)")
+// client returns a control client for the configured daemon socket
+func client() *nodus.ControlClient {
+	return nodus.NewControlClient(loadConfig().ControlSocket)
+}
+
+// fail reports a control API error and exits
+func fail(err error) {
+	if errors.Is(err, nodus.ErrDaemonNotRunning) {
+		fmt.Println("\033[31m[✗] Nodus daemon not running\033[0m")
+		fmt.Println("    Start it with \033[36mnodus daemon\033[0m")
+	} else {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+	}
+	os.Exit(1)
+}
+
+func discover() {
+	fmt.Println("\033[33m[*] Peers found on LAN (mDNS) or added manually...\033[0m")
+	peers, err := client().Discovered()
+	if err != nil {
+		fail(err)
+	}
+	if len(peers) == 0 {
+		fmt.Println("    Peers found: 0")
+		fmt.Println("    Trust a peer with \033[36mnodus trust add <peer-id>\033[0m so discovery connects to it")
+		return
+	}
+	for _, p := range peers {
+		state := "\033[31mdisconnected\033[0m"
+		if p.Connected {
+			state = "\033[32mconnected\033[0m"
+		}
+		fmt.Printf("  %-8s %s  %s\n", p.Level, p.ID, state)
+	}
+	fmt.Printf("\033[32m[✓] Peers found: %d\033[0m\n", len(peers))
 }
 
 func listPeers() {
+	peers, err := client().Peers()
+	if err != nil {
+		fail(err)
+	}
+
 	fmt.Println("Connected Peers:")
-	fmt.Println("  (No peers connected)")
-	fmt.Println("")
-	fmt.Println("Use \033[36mnodus discover\033[0m to find peers")
+	if len(peers) == 0 {
+		fmt.Println("  (No peers connected)")
+		fmt.Println("")
+		fmt.Println("Use \033[36mnodus discover\033[0m to find peers")
+		return
+	}
+	for _, p := range peers {
+		fmt.Printf("  %-8s %s\n", p.Level, p.ID)
+		for _, addr := range p.Addrs {
+			fmt.Printf("           %s\n", addr)
+		}
+	}
+}
+
+func connect() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: nodus connect <multiaddr>/p2p/<peer-id>")
+		os.Exit(1)
+	}
+	p, err := client().Connect(os.Args[2])
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("\033[32m[✓] Connected to %s (%s)\033[0m\n", p.ID, p.Level)
 }
 
 func mount() {
-	mountPoint := "/mnt/nodus"
-	if len(os.Args) > 2 {
+	// One argument is a mount point for the default volume
+	volume, mountPoint := "", ""
+	switch len(os.Args) {
+	case 2:
+	case 3:
 		mountPoint = os.Args[2]
+	default:
+		volume, mountPoint = os.Args[2], os.Args[3]
 	}
 
 	fmt.Println("\033[33m[*] Mounting Nodus volume...\033[0m")
+	path, err := client().Mount(volume, mountPoint)
+	if err != nil {
+		fail(err)
+	}
+	if volume != "" {
+		fmt.Printf("\033[32m[✓] Volume '%s' mounted at %s\033[0m\n", volume, path)
+		return
+	}
+	fmt.Printf("\033[32m[✓] Volume mounted at %s\033[0m\n", path)
+}
 
-	// Create mount point if needed
-	os.MkdirAll(mountPoint, 0755)
+func unmount() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: nodus unmount <path>")
+		os.Exit(1)
+	}
+	if err := client().Unmount(os.Args[2]); err != nil {
+		fail(err)
+	}
+	fmt.Printf("\033[32m[✓] Unmounted %s\033[0m\n", os.Args[2])
+}
+
+func volume() {
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+
+	switch sub {
+	case "create":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: nodus volume create <name> [--quota SIZE] [--replication N] [--encrypted]")
+			os.Exit(1)
+		}
+		spec, err := parseVolumeSpec(os.Args[4:])
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		info, err := client().CreateVolume(os.Args[3], spec)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[32m[✓] Volume '%s' created (%s)\033[0m\n", info.Name, describeVolume(info.VolumeSpec))
+		fmt.Printf("    Mount with: nodus mount %s <path>\n", info.Name)
 
-	// Note: actual mounting requires syscalls - for now just confirm
-	fmt.Printf("\033[32m[✓] Mount point ready: %s\033[0m\n", mountPoint)
-	fmt.Println("    (Use tmpfs cache in standalone mode)")
+	case "list":
+		volumes, err := client().Volumes()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("Volumes:")
+		if len(volumes) == 0 {
+			fmt.Println("  (none)")
+			return
+		}
+		for _, v := range volumes {
+			fmt.Printf("  %-20s %6d files %8d MB  %s\n", v.Name, v.Files, v.Used>>20, describeVolume(v.VolumeSpec))
+		}
+
+	case "delete":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: nodus volume delete <name>")
+			os.Exit(1)
+		}
+		if err := client().DeleteVolume(os.Args[3]); err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[32m[✓] Volume '%s' deleted (its files are in the trash)\033[0m\n", os.Args[3])
+
+	default:
+		fmt.Println("Usage: nodus volume create|list|delete")
+		os.Exit(1)
+	}
+}
+
+// parseVolumeSpec reads the options of volume create
+func parseVolumeSpec(args []string) (nodus.VolumeSpec, error) {
+	var spec nodus.VolumeSpec
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--encrypted":
+			spec.Encrypted = true
+		case "--quota", "--replication":
+			if i+1 == len(args) {
+				return spec, fmt.Errorf("%s needs a value", args[i])
+			}
+			value := args[i+1]
+			var err error
+			if args[i] == "--quota" {
+				spec.Quota, err = parseSize(value)
+			} else if spec.Replication, err = strconv.Atoi(value); err != nil || spec.Replication < 1 {
+				err = fmt.Errorf("invalid replication factor %q", value)
+			}
+			if err != nil {
+				return spec, err
+			}
+			i++
+		default:
+			return spec, fmt.Errorf("unknown option %q", args[i])
+		}
+	}
+	return spec, nil
+}
+
+// describeVolume summarizes a volume's settings
+func describeVolume(spec nodus.VolumeSpec) string {
+	quota := "no quota"
+	if spec.Quota > 0 {
+		quota = fmt.Sprintf("quota %d MB", spec.Quota>>20)
+	}
+	replication := "default replicas"
+	if spec.Replication > 0 {
+		replication = fmt.Sprintf("%d replicas", spec.Replication)
+	}
+	encryption := "encryption off"
+	if spec.Encrypted {
+		encryption = "encryption on"
+	}
+	return quota + ", " + replication + ", " + encryption
 }
 
 func status() {
-	hostname, _ := os.Hostname()
+	s, err := client().Status()
+	if err != nil {
+		if errors.Is(err, nodus.ErrDaemonNotRunning) {
+			fmt.Println("Nodus Status:")
+			fmt.Println("  Mode:    \033[31mOffline\033[0m")
+			fmt.Println("  Start the daemon with \033[36mnodus daemon\033[0m")
+			return
+		}
+		fail(err)
+	}
+
+	mountPoint := s.MountPoint
+	if mountPoint == "" {
+		mountPoint = "(not mounted)"
+	}
+	encryption := "off"
+	if s.Encrypted {
+		encryption = "on"
+	}
 
 	fmt.Println("Nodus Status:")
-	fmt.Println("  Mode:    \033[32mStandalone\033[0m")
-	fmt.Printf("  Node:    %s\n", hostname)
-	fmt.Println("  Cache:   /mnt/nodus")
-	fmt.Println("  Peers:   0")
-	fmt.Println("  Network: Not connected")
+	fmt.Println("  Mode:    \033[32mOnline\033[0m")
+	fmt.Printf("  Node:    %s\n", s.ID)
+	fmt.Printf("  Uptime:  %s\n", s.Uptime)
+	fmt.Printf("  Mount:   %s\n", mountPoint)
+	for _, m := range s.Mounts {
+		if m.Volume != "" {
+			fmt.Printf("  Volume:  %s at %s\n", m.Volume, m.Path)
+		}
+	}
+	fmt.Printf("  Files:   %d (encryption %s, %d replicas)\n", s.Files, encryption, s.ReplicationFactor)
+	fmt.Printf("  Cache:   %d/%d MB RAM (%d blocks, %d MB pinned, %s)", s.Cache.Used>>20, s.Cache.Capacity>>20, s.Cache.Entries, s.Cache.Pinned>>20, s.Cache.Policy)
+	if s.Cache.DiskCapacity > 0 {
+		fmt.Printf(", %d/%d MB disk (%d blocks)", s.Cache.DiskUsed>>20, s.Cache.DiskCapacity>>20, s.Cache.DiskEntries)
+	}
+	fmt.Println()
+	fmt.Printf("  Hits:    %.1f%% (%d RAM, %d disk, %d misses, %d/%d evicted)\n", s.Cache.HitRatio()*100,
+		s.Cache.Hits, s.Cache.DiskHits, s.Cache.Misses, s.Cache.Evictions, s.Cache.DiskEvictions)
+	fmt.Printf("  Traffic: %d MB in, %d MB out\n", s.Traffic.Total.In>>20, s.Traffic.Total.Out>>20)
+	fmt.Printf("  Peers:   %d\n", s.Peers)
+	for _, addr := range s.Addrs {
+		fmt.Printf("  Listen:  %s\n", addr)
+	}
+	if s.MetricsAddr != "" {
+		fmt.Printf("  Metrics: http://%s/metrics\n", s.MetricsAddr)
+	}
+	if s.NBDListen != "" {
+		fmt.Printf("  NBD:     %s\n", s.NBDListen)
+	}
+	if s.GatewayAddr != "" {
+		fmt.Printf("  Gateway: http://%s/v/%s/\n", s.GatewayAddr, nodus.DefaultVolume)
+	}
+	if len(s.Scores) > 0 {
+		fmt.Println("  Peer scores:")
+		for _, sc := range s.Scores {
+			t := s.Traffic.Peers[sc.Peer.String()]
+			fmt.Printf("    %s  %6.1f  %4dms  %6.1f MB/s  %d/%d failed  %d/%d KB in/out\n",
+				sc.Peer.ShortString(), sc.Score(), sc.Latency.Milliseconds(), sc.Bandwidth/(1<<20), sc.Failures, sc.Requests, t.In>>10, t.Out>>10)
+		}
+	}
 }
 
 func syncData() {
 	fmt.Println("\033[33m[*] Syncing to network...\033[0m")
-	time.Sleep(200 * time.Millisecond)
-	fmt.Println("\033[32m[✓] Sync complete (no changes)\033[0m")
+	result, err := client().Sync()
+	if err != nil {
+		fail(err)
+	}
+	for _, e := range result.Errors {
+		fmt.Printf("\033[31m[✗] %s\033[0m\n", e)
+	}
+	for _, op := range result.Ops {
+		target := op.Path
+		if op.From != "" {
+			target = op.From + " -> " + op.Path
+		}
+		color, mark := "\033[33m", "*"
+		if op.State == nodus.OpFailed {
+			color, mark = "\033[31m", "✗"
+		}
+		fmt.Printf("%s[%s] %-7s %-6s %s (%s)", color, mark, op.State, op.Kind, target, op.Time.Format("2006-01-02 15:04"))
+		if op.Error != "" {
+			fmt.Printf(": %s", op.Error)
+		}
+		fmt.Println("\033[0m")
+	}
+	j := result.Journal
+	fmt.Printf("Journal: %d pending, %d acked, %d failed\n", j.Pending, j.Acked, j.Failed)
+	if result.Peers == 0 {
+		fmt.Printf("\033[32m[✓] Sync complete (%d files, no changes)\033[0m\n", result.Files)
+		return
+	}
+	fmt.Printf("\033[32m[✓] Sync complete (%d files, %d new replica holders)\033[0m\n", result.Files, result.Peers)
+}
+
+func identity() {
+	cfg := loadConfig()
+
+	if len(os.Args) > 2 && os.Args[2] == "rotate" {
+		record, err := nodus.RotateIdentity(cfg.StateDir)
+		if err != nil {
+			fmt.Printf("\033[31m[✗] Rotation failed: %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		oldID, newID, _ := record.Peers()
+		fmt.Println("\033[32m[✓] Identity rotated\033[0m")
+		fmt.Printf("    Old: %s\n", oldID)
+		fmt.Printf("    New: %s\n", newID)
+		fmt.Println("    Restart the daemon to use the new key")
+		return
+	}
+
+	key, err := nodus.LoadIdentity(cfg.StateDir)
+	if err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+	fingerprint, _ := nodus.Fingerprint(key.GetPublic())
+
+	fmt.Println("Nodus Identity:")
+	fmt.Printf("  Peer ID:     %s\n", id)
+	fmt.Printf("  Key:         Ed25519 %s\n", fingerprint)
+	fmt.Printf("  State:       %s\n", cfg.StateDir)
+
+	// The daemon knows the addresses it actually bound; the config may say :0
+	status, err := client().Status()
+	if errors.Is(err, nodus.ErrDaemonNotRunning) {
+		fmt.Println("  Listen (configured, daemon not running):")
+		for _, addr := range cfg.ListenAddrs {
+			fmt.Printf("    %s/p2p/%s\n", addr, id)
+		}
+		return
+	}
+	if err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+	if status.ID != id.String() {
+		fmt.Printf("\033[33m[*] Daemon still runs as %s; restart it to use this key\033[0m\n", status.ID)
+	}
+	fmt.Println("  Listen:")
+	for _, addr := range status.Addrs {
+		fmt.Printf("    %s\n", addr)
+	}
+}
+
+func trust() {
+	cfg := loadConfig()
+	store, err := nodus.LoadTrustStore(cfg.StateDir)
+	if err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+
+	switch sub {
+	case "add":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: nodus trust add <peer-id> [cloud|network|trusted] [name]")
+			os.Exit(1)
+		}
+		id, err := peer.Decode(os.Args[3])
+		if err != nil {
+			fmt.Printf("\033[31m[✗] Invalid peer ID: %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		level := nodus.TrustTrusted
+		if len(os.Args) > 4 {
+			if level, err = nodus.ParseTrustLevel(os.Args[4]); err != nil {
+				fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+				os.Exit(1)
+			}
+		}
+		name := ""
+		if len(os.Args) > 5 {
+			name = strings.Join(os.Args[5:], " ")
+		}
+		if err := store.Add(id, level, name); err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("\033[32m[✓] %s added as %s\033[0m\n", id, level)
+		reloadTrust()
+
+	case "remove":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: nodus trust remove <peer-id>")
+			os.Exit(1)
+		}
+		id, err := peer.Decode(os.Args[3])
+		if err != nil {
+			fmt.Printf("\033[31m[✗] Invalid peer ID: %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		removed, err := store.Remove(id)
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		if !removed {
+			fmt.Printf("    %s was not trusted\n", id)
+			return
+		}
+		fmt.Printf("\033[32m[✓] %s removed\033[0m\n", id)
+		reloadTrust()
+
+	case "list":
+		entries := store.List()
+		fmt.Println("Trusted Peers:")
+		if len(entries) == 0 {
+			fmt.Println("  (none)")
+			return
+		}
+		for _, e := range entries {
+			fmt.Printf("  %-8s %s  %s\n", e.Level, e.ID, e.Name)
+		}
+
+	default:
+		fmt.Println("Usage: nodus trust add|remove|list")
+		os.Exit(1)
+	}
+}
+
+// reloadTrust applies an allowlist edit to a running daemon right away;
+// without one, the edit applies when the daemon next starts
+func reloadTrust() {
+	if err := client().ReloadTrust(); err != nil && !errors.Is(err, nodus.ErrDaemonNotRunning) {
+		fmt.Printf("\033[33m[*] The daemon will pick up the change shortly: %v\033[0m\n", err)
+	}
+}
+
+func key() {
+	cfg := loadConfig()
+
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+
+	switch sub {
+	case "init":
+		if err := nodus.InitKeyring(cfg.StateDir); err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("\033[32m[✓] Master key created; new files will be encrypted\033[0m")
+
+	case "device":
+		device, err := nodus.LoadDeviceKey(cfg.StateDir)
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(hex.EncodeToString(device.PublicKey().Bytes()))
+
+	case "grant":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: nodus key grant <device-pubkey> [name]")
+			os.Exit(1)
+		}
+		raw, err := hex.DecodeString(os.Args[3])
+		if err != nil {
+			fmt.Printf("\033[31m[✗] Invalid device key: %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		devicePub, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			fmt.Printf("\033[31m[✗] Invalid device key: %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		master, err := nodus.LoadMasterKey(cfg.StateDir)
+		if err == nil && master == nil {
+			err = fmt.Errorf("no keyring; run 'nodus key init' first")
+		}
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		kr, _ := nodus.LoadKeyring(cfg.StateDir)
+		name := ""
+		if len(os.Args) > 4 {
+			name = strings.Join(os.Args[4:], " ")
+		}
+		if err := kr.Grant(master, devicePub, name); err == nil {
+			err = nodus.SaveKeyring(cfg.StateDir, kr)
+		}
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("\033[32m[✓] Device granted\033[0m")
+		fmt.Printf("    Copy %s/keyring.json to the device\n", cfg.StateDir)
+
+	case "list":
+		kr, err := nodus.LoadKeyring(cfg.StateDir)
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Devices sharing the master key:")
+		if kr == nil || len(kr.Wraps) == 0 {
+			fmt.Println("  (encryption not set up)")
+			return
+		}
+		for _, w := range kr.Wraps {
+			fmt.Printf("  %s  %s\n", w.Device, w.Name)
+		}
+
+	default:
+		fmt.Println("Usage: nodus key init|device|grant|list")
+		os.Exit(1)
+	}
+}
+
+func replicas() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: nodus replicas <file>")
+		os.Exit(1)
+	}
+	name := os.Args[2]
+	cfg := loadConfig()
+
+	report, err := nodus.NewControlClient(cfg.ControlSocket).Replicas(name)
+	if err == nil {
+		printReplicas(name, cfg.ReplicationFactor, report)
+		return
+	}
+	if !errors.Is(err, nodus.ErrDaemonNotRunning) {
+		fail(err)
+	}
+
+	tracker, err := nodus.LoadReplicaTracker(cfg.StateDir)
+	if err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+
+	// Without the daemon we only know recorded acks: count every holder plus our own copy
+	report, ok := tracker.Report(name, cfg.ReplicationFactor,
+		func(peer.ID) bool { return true },
+		func(nodus.BlockHash) bool { return true })
+	if !ok {
+		fmt.Printf("    '%s' is not replicated by this node\n", name)
+		return
+	}
+	printReplicas(name, cfg.ReplicationFactor, report)
+}
+
+func printReplicas(name string, factor int, report []nodus.BlockReplicas) {
+	met := 0
+	for _, r := range report {
+		if r.Met {
+			met++
+		}
+	}
+
+	fmt.Printf("Replicas of '%s' (target %d):\n", name, factor)
+	for _, r := range report {
+		mark := "\033[32m✓\033[0m"
+		if !r.Met {
+			mark = "\033[31m✗\033[0m"
+		}
+		fmt.Printf("  %s block %-4d %s  %d/%d", mark, r.Index, r.Hash.String()[:12], r.Live, factor)
+		for _, id := range r.Holders {
+			fmt.Printf("  %s", id.ShortString())
+		}
+		fmt.Println()
+	}
+	fmt.Printf("  %d/%d blocks meet the target\n", met, len(report))
+}
+
+func pin() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: nodus pin <file>")
+		os.Exit(1)
+	}
+	if err := client().Pin(os.Args[2]); err != nil {
+		fail(err)
+	}
+	fmt.Printf("\033[32m[✓] '%s' pinned\033[0m\n", os.Args[2])
+}
+
+func unpin() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: nodus unpin <file>")
+		os.Exit(1)
+	}
+	if err := client().Unpin(os.Args[2]); err != nil {
+		fail(err)
+	}
+	fmt.Printf("\033[32m[✓] '%s' unpinned\033[0m\n", os.Args[2])
+}
+
+func listPins() {
+	pins, err := client().Pins()
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Println("Pinned Files:")
+	if len(pins) == 0 {
+		fmt.Println("  (none)")
+		return
+	}
+	for _, p := range pins {
+		if !p.Held {
+			fmt.Printf("  %-13s %s  \033[33m(waiting for peers)\033[0m\n", p.Reason, p.Name)
+			continue
+		}
+		fmt.Printf("  %-13s %s  %d KB, %d blocks\n", p.Reason, p.Name, p.Size>>10, p.Blocks)
+	}
+}
+
+func history() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: nodus history <file>")
+		os.Exit(1)
+	}
+	name := os.Args[2]
+	versions, err := client().History(name)
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("History of '%s' (newest first):\n", name)
+	for _, v := range versions {
+		mark := " "
+		if v.Current {
+			mark = "\033[32m*\033[0m"
+		}
+		when := "unknown time"
+		if v.Mtime != 0 {
+			when = time.Unix(0, v.Mtime).Format("2006-01-02 15:04:05")
+		}
+		writer := "unknown"
+		if id, err := peer.Decode(v.Writer); err == nil {
+			writer = id.ShortString()
+		}
+		size := fmt.Sprintf("%d KB", v.Size>>10)
+		if v.Kind != "" {
+			size = v.Kind
+		}
+		fmt.Printf("  %s %s  %s  %-8s by %s  %s\n", mark, v.ID[:12], when, size, writer, v.Version)
+	}
+}
+
+func restore() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: nodus restore <file> <version>")
+		os.Exit(1)
+	}
+	name := os.Args[2]
+	info, err := client().Restore(name, os.Args[3])
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("\033[32m[✓] '%s' restored as version %s\033[0m\n", name, info.ID[:12])
+}
+
+func trash() {
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+
+	switch sub {
+	case "list":
+		entries, err := client().Trash()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("Trash:")
+		if len(entries) == 0 {
+			fmt.Println("  (empty)")
+			return
+		}
+		for _, e := range entries {
+			size := fmt.Sprintf("%d KB", e.Size>>10)
+			if e.Kind != "" {
+				size = e.Kind
+			}
+			by := "unknown"
+			if id, err := peer.Decode(e.By); err == nil {
+				by = id.ShortString()
+			}
+			fmt.Printf("  %-32s %-8s deleted %s by %s\n", e.Name, size, e.Deleted.Format("2006-01-02 15:04:05"), by)
+		}
+
+	case "restore":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: nodus trash restore <file>")
+			os.Exit(1)
+		}
+		info, err := client().RestoreTrash(os.Args[3])
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[32m[✓] '%s' restored as version %s\033[0m\n", os.Args[3], info.ID[:12])
+
+	default:
+		fmt.Println("Usage: nodus trash list|restore <file>")
+		os.Exit(1)
+	}
+}
+
+func boot() {
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+	flags, err := parseFlags(os.Args[min(3, len(os.Args)):], "--channel", "--kernel", "--initramfs", "--rootfs", "--cmdline", "--out")
+	if err != nil {
+		fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+		os.Exit(1)
+	}
+	channel := flags["--channel"]
+	if channel == "" {
+		channel = nodus.DefaultBootChannel
+	}
+
+	switch sub {
+	case "publish":
+		src := nodus.BootSources{Kernel: flags["--kernel"], Initramfs: flags["--initramfs"], Rootfs: flags["--rootfs"], Cmdline: flags["--cmdline"]}
+		if src.Kernel == "" || src.Initramfs == "" {
+			fmt.Println("Usage: nodus boot publish --kernel <file> --initramfs <file> [--rootfs <file>] [--cmdline ARGS] [--channel NAME]")
+			os.Exit(1)
+		}
+		fmt.Println("\033[33m[*] Hashing and signing boot images...\033[0m")
+		b, err := client().PublishBoot(channel, src)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[32m[✓] Channel '%s' published at serial %d\033[0m\n", b.Channel, b.Serial)
+
+	case "fetch":
+		if flags["--out"] == "" {
+			fmt.Println("Usage: nodus boot fetch --out <dir> [--channel NAME]")
+			os.Exit(1)
+		}
+		out, err := filepath.Abs(flags["--out"])
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[33m[*] Fetching boot channel '%s'...\033[0m\n", channel)
+		b, err := client().FetchBoot(channel, out)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[32m[✓] Serial %d signed by %s, verified and written to %s\033[0m\n", b.Serial, b.Signer.ShortString(), out)
+
+	case "list":
+		bundles, err := client().BootBundles()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("Boot channels:")
+		if len(bundles) == 0 {
+			fmt.Println("  (none)")
+			return
+		}
+		for _, b := range bundles {
+			size := b.Kernel.Manifest.Size + b.Initramfs.Manifest.Size
+			if b.Rootfs != nil {
+				size += b.Rootfs.Manifest.Size
+			}
+			fmt.Printf("  %-16s serial %-4d %6d MB  published %s by %s\n", b.Channel, b.Serial, size>>20,
+				b.Published.Local().Format("2006-01-02 15:04:05"), b.Signer.ShortString())
+		}
+
+	default:
+		fmt.Println("Usage: nodus boot publish|fetch|list")
+		os.Exit(1)
+	}
+}
+
+// parseFlags reads "--name value" pairs, accepting only the given names
+func parseFlags(args []string, names ...string) (map[string]string, error) {
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i += 2 {
+		if !slices.Contains(names, args[i]) {
+			return nil, fmt.Errorf("unknown option %q", args[i])
+		}
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("%s needs a value", args[i])
+		}
+		flags[args[i]] = args[i+1]
+	}
+	return flags, nil
+}
+
+func nbd() {
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+
+	switch sub {
+	case "create":
+		if len(os.Args) < 5 {
+			fmt.Println("Usage: nodus nbd create <name> <size>  (size in bytes or with K/M/G suffix)")
+			os.Exit(1)
+		}
+		size, err := parseSize(os.Args[4])
+		if err != nil {
+			fmt.Printf("\033[31m[✗] %v\033[0m\n", err)
+			os.Exit(1)
+		}
+		info, err := client().CreateDevice(os.Args[3], size)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("\033[32m[✓] Device '%s' created (%d MB)\033[0m\n", info.Name, info.Size>>20)
+		if listen := loadConfig().NBDListen; strings.Contains(listen, "/") {
+			fmt.Printf("    Attach with: nbd-client -unix %s -N %s /dev/nbd0\n", listen, info.Name)
+		} else if host, port, err := net.SplitHostPort(listen); err == nil {
+			fmt.Printf("    Attach with: nbd-client %s %s -N %s /dev/nbd0\n", host, port, info.Name)
+		}
+
+	case "list":
+		devices, err := client().Devices()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println("NBD Devices:")
+		if len(devices) == 0 {
+			fmt.Println("  (none)")
+			return
+		}
+		for _, d := range devices {
+			fmt.Printf("  %-24s %8d MB\n", d.Name, d.Size>>20)
+		}
+
+	default:
+		fmt.Println("Usage: nodus nbd create|list")
+		os.Exit(1)
+	}
+}
+
+// parseSize reads a byte count with an optional K, M, G or T suffix
+func parseSize(s string) (uint64, error) {
+	shift := 0
+	if i := strings.IndexAny(strings.ToUpper(s), "KMGT"); i > 0 && i == len(s)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", s[i]&^0x20) + 1)
+		s = s[:i]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// loadConfig overlays /etc/spirit/nodus.conf onto the default node config
+func loadConfig() nodus.Config {
+	cfg := nodus.DefaultConfig()
+	conf := readConfig()
+	if dir := conf["state_dir"]; dir != "" {
+		cfg.StateDir = dir
+	}
+	if listen := conf["listen"]; listen != "" {
+		cfg.ListenAddrs = strings.Fields(strings.ReplaceAll(listen, ",", " "))
+	}
+	cfg.OpenNetwork = conf["open_network"] == "true"
+	if factor, err := strconv.Atoi(conf["replication_factor"]); err == nil && factor > 0 {
+		cfg.ReplicationFactor = factor
+	}
+	if v := conf["dht_server"]; v != "" {
+		cfg.DHTServer = v == "true"
+	}
+	if mb, err := strconv.ParseInt(conf["cache_size"], 10, 64); err == nil && mb > 0 {
+		cfg.CacheSize = mb << 20
+	}
+	if policy := conf["cache_policy"]; policy != "" {
+		cfg.CachePolicy = policy
+	}
+	if mb, err := strconv.ParseInt(conf["peer_quota"], 10, 64); err == nil && mb >= 0 {
+		cfg.PeerQuota = mb << 20
+	}
+	if dir := conf["disk_cache_dir"]; dir != "" {
+		cfg.DiskCacheDir = dir
+	}
+	if mb, err := strconv.ParseInt(conf["disk_cache_size"], 10, 64); err == nil && mb >= 0 {
+		cfg.DiskCacheSize = mb << 20
+	}
+	if socket := conf["control_socket"]; socket != "" {
+		cfg.ControlSocket = socket
+	}
+	if mountPoint, ok := conf["mount_point"]; ok {
+		cfg.MountPoint = mountPoint
+	}
+	if addr, ok := conf["metrics_addr"]; ok {
+		cfg.MetricsAddr = addr
+	}
+	if addr, ok := conf["nbd_listen"]; ok {
+		cfg.NBDListen = addr
+	}
+	if addr, ok := conf["gateway_listen"]; ok {
+		cfg.GatewayAddr = addr
+	}
+	if d, err := time.ParseDuration(conf["write_back_delay"]); err == nil && d >= 0 {
+		cfg.WriteBackDelay = d
+	}
+	if d, err := time.ParseDuration(conf["sync_timeout"]); err == nil && d > 0 {
+		cfg.SyncTimeout = d
+	}
+	if d, err := time.ParseDuration(conf["trash_retention"]); err == nil && d >= 0 {
+		cfg.TrashRetention = d
+	}
+	if keys := conf["boot_keys"]; keys != "" {
+		cfg.BootKeys = strings.Fields(strings.ReplaceAll(keys, ",", " "))
+	}
+	return cfg
 }
 
 // Helper to check if we're in the Spirit environment
@@ -0,0 +1,802 @@
+// Package nodus - Content-addressed block storage
+package nodus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// BlockSize is the fixed size files are chunked into (last block may be shorter)
+const BlockSize = 256 * 1024 // 256KB
+
+// manifestsDir holds, in the state directory, a record per known path naming
+// its current manifest and history by ID, and each manifest once under its ID
+const manifestsDir = "manifests"
+
+// snapshotFile held every manifest and all history in one file before
+// manifests were stored per path
+const snapshotFile = "manifests.json"
+
+var (
+	// ErrBlockNotFound is returned when a block is not held locally
+	ErrBlockNotFound = errors.New("block not found")
+	// ErrHashMismatch is returned when block content does not match its hash
+	ErrHashMismatch = errors.New("block hash mismatch")
+)
+
+// BlockHash is the SHA-256 address of a block
+type BlockHash [sha256.Size]byte
+
+// HashBlock computes the address of a block
+func HashBlock(data []byte) BlockHash {
+	return BlockHash(sha256.Sum256(data))
+}
+
+// ParseBlockHash parses a hex-encoded block hash
+func ParseBlockHash(s string) (BlockHash, error) {
+	var h BlockHash
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, fmt.Errorf("invalid block hash: %w", err)
+	}
+	if len(b) != len(h) {
+		return h, fmt.Errorf("invalid block hash length: %d", len(b))
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// String returns the hex encoding of the hash
+func (h BlockHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// MarshalText encodes the hash as hex (used by JSON)
+func (h BlockHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText decodes a hex hash (used by JSON)
+func (h *BlockHash) UnmarshalText(text []byte) error {
+	parsed, err := ParseBlockHash(string(text))
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// BlockRef points to one block of a file
+type BlockRef struct {
+	Hash BlockHash `json:"hash"`
+	Size uint32    `json:"size"`
+}
+
+// FileManifest describes a file as an ordered list of blocks. Directories and
+// symlinks are manifests too: they have no blocks and are signed by their author.
+type FileManifest struct {
+	Name   string     `json:"name"` // slash-separated path
+	Size   uint64     `json:"size"` // plaintext size
+	Blocks []BlockRef `json:"blocks"`
+	Salt   []byte     `json:"salt,omitempty"` // per-file key salt, set when blocks are encrypted
+
+	Version VersionVector `json:"version,omitempty"` // writes per peer, to order versions
+	Writer  peer.ID       `json:"writer,omitempty"`  // peer that wrote this version
+
+	Kind      string      `json:"kind,omitempty"`   // "" for files, KindDir, KindSymlink or KindTombstone
+	Target    string      `json:"target,omitempty"` // symlink target, or where a tombstoned file moved
+	Volume    *VolumeSpec `json:"volume,omitempty"` // settings, on the root directory of a named volume
+	Signer    peer.ID     `json:"signer,omitempty"`
+	Signature []byte      `json:"sig,omitempty"`
+
+	Meta // mode, ownership, times and xattrs
+}
+
+// Encrypted reports whether the file's blocks are sealed
+func (m *FileManifest) Encrypted() bool {
+	return len(m.Salt) > 0
+}
+
+// blockOverhead is the stored size minus the plaintext size of each block
+func (m *FileManifest) blockOverhead() uint32 {
+	if m.Encrypted() {
+		return BlockOverhead
+	}
+	return 0
+}
+
+// ID returns the content hash of the manifest
+func (m *FileManifest) ID() BlockHash {
+	data, _ := m.Marshal()
+	return HashBlock(data)
+}
+
+// blockSpan returns the indexes of the first and last blocks covering [off, off+length)
+func (m *FileManifest) blockSpan(off, length int64) (first, last int) {
+	if off < 0 || length <= 0 || uint64(off) >= m.Size {
+		return 0, -1
+	}
+	end := off + length
+	if uint64(end) > m.Size {
+		end = int64(m.Size)
+	}
+	return int(off / BlockSize), int((end - 1) / BlockSize)
+}
+
+// Marshal encodes the manifest for storage and transfer
+func (m *FileManifest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// UnmarshalManifest decodes and sanity-checks a manifest
+func UnmarshalManifest(data []byte) (*FileManifest, error) {
+	var m FileManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := checkPath(m.Name); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := m.checkMeta(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Volume != nil && (m.Kind != KindDir || m.Name != volumeRoot(volumeOf(m.Name))) {
+		return nil, fmt.Errorf("invalid manifest: volume settings on '%s'", m.Name)
+	}
+	if m.Kind != "" {
+		if err := m.checkObject(); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+		return &m, nil
+	}
+
+	overhead := m.blockOverhead()
+	full := BlockSize + overhead
+
+	var total uint64
+	for i, ref := range m.Blocks {
+		if ref.Size <= overhead || ref.Size > full {
+			return nil, fmt.Errorf("invalid manifest: bad block size %d", ref.Size)
+		}
+		// Only the last block may be short, so offsets map directly to block indexes
+		if ref.Size != full && i != len(m.Blocks)-1 {
+			return nil, fmt.Errorf("invalid manifest: short block %d", i)
+		}
+		total += uint64(ref.Size - overhead)
+	}
+	if total != m.Size {
+		return nil, fmt.Errorf("invalid manifest: blocks sum to %d, size is %d", total, m.Size)
+	}
+	return &m, nil
+}
+
+// Chunk splits data into fixed-size blocks
+func Chunk(data []byte) ([]BlockRef, [][]byte) {
+	var refs []BlockRef
+	var blocks [][]byte
+	for off := 0; off < len(data); off += BlockSize {
+		end := off + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		block := data[off:end]
+		refs = append(refs, BlockRef{Hash: HashBlock(block), Size: uint32(len(block))})
+		blocks = append(blocks, block)
+	}
+	return refs, blocks
+}
+
+// BlockStore keeps blocks in the LRU cache and tracks file manifests.
+// Identical blocks are stored once regardless of how many files use them.
+// With a master key set, new files are sealed and only ciphertext is stored.
+type BlockStore struct {
+	mu        sync.RWMutex
+	blocks    *Cache
+	manifests map[string]*FileManifest
+	history   map[string][]*FileManifest // versions seen per path, oldest first
+	self      peer.ID                    // writer of local versions
+	master    *MasterKey
+	observer  storeObserver
+
+	saveMu sync.Mutex // orders writes of path records
+	dir    string     // manifests directory, empty to keep manifests in memory only
+}
+
+// NewBlockStore creates a block store on top of the given cache that keeps
+// manifests in memory only
+func NewBlockStore(cache *Cache) *BlockStore {
+	return &BlockStore{
+		blocks:    cache,
+		manifests: make(map[string]*FileManifest),
+		history:   make(map[string][]*FileManifest),
+	}
+}
+
+// pathRecord is the on-disk form of one path: its current manifest, unless
+// deleted, and its history, oldest first, as manifest IDs
+type pathRecord struct {
+	Name    string   `json:"name"`
+	Current string   `json:"current,omitempty"`
+	History []string `json:"history"`
+}
+
+// storeSnapshot is the single manifests file kept before manifests were
+// stored per path, read once to migrate it
+type storeSnapshot struct {
+	Manifests []json.RawMessage            `json:"manifests"`
+	History   map[string][]json.RawMessage `json:"history"` // oldest first
+}
+
+// LoadBlockStore creates a block store that persists manifests and history
+// in stateDir, loading those saved there (empty if missing)
+func LoadBlockStore(cache *Cache, stateDir string) (*BlockStore, error) {
+	s := NewBlockStore(cache)
+	s.dir = filepath.Join(stateDir, manifestsDir)
+	if err := s.loadRecords(); err != nil {
+		return nil, err
+	}
+	if err := s.migrateSnapshot(filepath.Join(stateDir, snapshotFile)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadRecords loads every path record and the manifests it names
+func (s *BlockStore) loadRecords() error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "paths"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue // a write interrupted by a crash
+		}
+		rec, err := readPathRecord(filepath.Join(s.dir, "paths", e.Name()))
+		if err != nil {
+			return err
+		}
+		for _, id := range rec.History {
+			m, err := s.loadObject(rec.Name, id)
+			if err != nil {
+				return err
+			}
+			s.recordVersion(m)
+		}
+		if rec.Current != "" {
+			m, err := s.loadObject(rec.Name, rec.Current)
+			if err != nil {
+				return err
+			}
+			s.manifests[m.Name] = m
+			s.recordVersion(m)
+		}
+	}
+	return nil
+}
+
+// loadObject reads the manifest stored under id, checking it is a version of name
+func (s *BlockStore) loadObject(name, id string) (*FileManifest, error) {
+	data, err := os.ReadFile(s.objectPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s of '%s': %w", id, name, err)
+	}
+	m, err := UnmarshalManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.Name != name || m.ID().String() != id {
+		return nil, fmt.Errorf("invalid manifest %s: doesn't match '%s'", id, name)
+	}
+	return m, nil
+}
+
+// migrateSnapshot loads the single manifests file of older versions, if
+// there is one, stores its paths as records and removes it
+func (s *BlockStore) migrateSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap storeSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid manifests: %w", err)
+	}
+	for name, records := range snap.History {
+		for _, r := range records {
+			m, err := UnmarshalManifest(r)
+			if err != nil {
+				return err
+			}
+			if m.Name != name {
+				return fmt.Errorf("invalid history: '%s' recorded under '%s'", m.Name, name)
+			}
+			s.recordVersion(m)
+		}
+	}
+	for _, r := range snap.Manifests {
+		m, err := UnmarshalManifest(r)
+		if err != nil {
+			return err
+		}
+		s.manifests[m.Name] = m
+		s.recordVersion(m)
+	}
+
+	for name := range s.history {
+		if err := s.save(name); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// readPathRecord reads one path record
+func readPathRecord(path string) (*pathRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec pathRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid manifest record %s: %w", filepath.Base(path), err)
+	}
+	return &rec, nil
+}
+
+// recordPath returns the file holding the record of name
+func (s *BlockStore) recordPath(name string) string {
+	return filepath.Join(s.dir, "paths", HashBlock([]byte(name)).String()+".json")
+}
+
+// objectPath returns the file holding the manifest with the given ID
+func (s *BlockStore) objectPath(id string) string {
+	return filepath.Join(s.dir, "objects", id+".json")
+}
+
+// save persists the record of one path, writing the manifests it names that
+// aren't stored yet and removing those it no longer names. Writes are
+// ordered by saveMu, so a slow one never overwrites a newer record.
+func (s *BlockStore) save(name string) error {
+	if s.dir == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	rec, objects, err := s.record(name)
+	if err != nil {
+		return err
+	}
+	for id, data := range objects {
+		path := s.objectPath(id)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	path := s.recordPath(name)
+	old, err := readPathRecord(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(rec.History) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	// A manifest's ID covers its name, so no other path shares it
+	if old != nil {
+		for _, id := range append(old.History, old.Current) {
+			if _, ok := objects[id]; !ok && id != "" {
+				os.Remove(s.objectPath(id))
+			}
+		}
+	}
+	return nil
+}
+
+// record encodes the record of one path and the manifests it names
+func (s *BlockStore) record(name string) (*pathRecord, map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec := &pathRecord{Name: name}
+	objects := make(map[string][]byte)
+	add := func(m *FileManifest) (string, error) {
+		data, err := m.Marshal()
+		if err != nil {
+			return "", err
+		}
+		id := HashBlock(data).String()
+		objects[id] = data
+		return id, nil
+	}
+	for _, m := range s.history[name] {
+		id, err := add(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		rec.History = append(rec.History, id)
+	}
+	if m := s.manifests[name]; m != nil {
+		id, err := add(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		rec.Current = id
+	}
+	return rec, objects, nil
+}
+
+// saveOrWarn persists the record of one path, warning on failure
+func (s *BlockStore) saveOrWarn(name string) {
+	if err := s.save(name); err != nil {
+		fmt.Printf("⚠️  Failed to save manifests of '%s': %v\n", name, err)
+	}
+}
+
+// setObserver registers the observer told about newly stored content
+func (s *BlockStore) setObserver(o storeObserver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer = o
+}
+
+// notifyBlock tells the observer about a newly stored block
+func (s *BlockStore) notifyBlock(h BlockHash) {
+	s.mu.RLock()
+	o := s.observer
+	s.mu.RUnlock()
+	if o != nil {
+		o.blockStored(h)
+	}
+}
+
+// SetMasterKey enables encryption of new files and decryption of sealed ones
+func (s *BlockStore) SetMasterKey(k *MasterKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.master = k
+}
+
+// masterKey returns the current master key (nil if encryption is off)
+func (s *BlockStore) masterKey() *MasterKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.master
+}
+
+// fileKey returns the key m's blocks are sealed with, derived from the key
+// of its volume
+func (s *BlockStore) fileKey(m *FileManifest) ([]byte, error) {
+	key := s.masterKey()
+	if key == nil {
+		return nil, ErrNoMasterKey
+	}
+	if volume := volumeOf(m.Name); volume != "" {
+		var err error
+		if key, err = key.volumeKey(volume); err != nil {
+			return nil, err
+		}
+	}
+	return key.fileKey(m.Salt)
+}
+
+// PutBlock stores a copy of a block and returns its address
+func (s *BlockStore) PutBlock(data []byte) (BlockHash, error) {
+	return s.putBlock(data, "")
+}
+
+// putBlock is PutBlock charging the block to owner's cache quota
+func (s *BlockStore) putBlock(data []byte, owner string) (BlockHash, error) {
+	h := HashBlock(data)
+	if !s.blocks.Has(h.String()) {
+		if err := s.blocks.PutOwned(h.String(), append([]byte(nil), data...), owner); err != nil {
+			return h, err
+		}
+		s.notifyBlock(h)
+	}
+	return h, nil
+}
+
+// PutVerifiedBlock stores a block only if it matches the expected hash
+func (s *BlockStore) PutVerifiedBlock(h BlockHash, data []byte) error {
+	return s.putVerifiedBlock(h, data, "")
+}
+
+// putVerifiedBlock is PutVerifiedBlock charging the block to owner's cache quota
+func (s *BlockStore) putVerifiedBlock(h BlockHash, data []byte, owner string) error {
+	if HashBlock(data) != h {
+		return ErrHashMismatch
+	}
+	if err := s.blocks.PutOwned(h.String(), data, owner); err != nil {
+		return err
+	}
+	s.notifyBlock(h)
+	return nil
+}
+
+// GetBlock returns a block by address
+func (s *BlockStore) GetBlock(h BlockHash) ([]byte, error) {
+	data := s.blocks.Get(h.String())
+	if data == nil {
+		return nil, ErrBlockNotFound
+	}
+	return data, nil
+}
+
+// HasBlock reports whether a block is held locally
+func (s *BlockStore) HasBlock(h BlockHash) bool {
+	return s.blocks.Has(h.String())
+}
+
+// PutFile chunks data into blocks and records the file's manifest.
+// A file keeps its salt and metadata across rewrites so unchanged blocks
+// keep their address.
+func (s *BlockStore) PutFile(name string, data []byte) (*FileManifest, error) {
+	return s.putFile(name, data, "", nil)
+}
+
+// putFile is PutFile charging the blocks to owner's cache quota. A new
+// file gets meta, or default metadata when meta is nil.
+func (s *BlockStore) putFile(name string, data []byte, owner string, meta *Meta) (*FileManifest, error) {
+	m, err := s.storeFile(name, data, owner, meta)
+	if err != nil {
+		return nil, err
+	}
+	s.PutManifest(m)
+	return m, nil
+}
+
+// storeFile stores the blocks of a new version of a file and returns its
+// manifest without recording it, so callers can still back out
+func (s *BlockStore) storeFile(name string, data []byte, owner string, meta *Meta) (*FileManifest, error) {
+	m, err := s.storeUnversioned(name, data, owner, meta)
+	if err != nil {
+		return nil, err
+	}
+	s.stamp(m)
+	return m, nil
+}
+
+// storeUnversioned is storeFile without stamping the manifest as a local
+// write, for content whose writer didn't version it
+func (s *BlockStore) storeUnversioned(name string, data []byte, owner string, meta *Meta) (*FileManifest, error) {
+	m, err := s.newVersion(name, meta)
+	if err != nil {
+		return nil, err
+	}
+	m.Size = uint64(len(data))
+
+	_, blocks := Chunk(data)
+	refs, err := s.putBlocks(m, blocks, owner)
+	if err != nil {
+		return nil, err
+	}
+	m.Blocks = refs
+	return m, nil
+}
+
+// newVersion starts the manifest of a new version of a file, without size
+// or blocks. A file keeps its salt and metadata across rewrites so unchanged
+// blocks keep their address.
+func (s *BlockStore) newVersion(name string, meta *Meta) (*FileManifest, error) {
+	m := &FileManifest{Name: name}
+	prev := s.Manifest(name)
+	if prev != nil && prev.Kind == "" && meta == nil {
+		m.Meta = prev.Meta.clone()
+		m.Mtime = time.Now().UnixNano()
+		m.Ctime = m.Mtime
+	} else {
+		m.Meta = newMeta("", meta)
+	}
+
+	seal, err := s.seals(name)
+	if err != nil {
+		return nil, err
+	}
+	if seal {
+		if prev != nil && prev.Encrypted() {
+			m.Salt = prev.Salt
+		} else {
+			salt, err := newFileSalt()
+			if err != nil {
+				return nil, err
+			}
+			m.Salt = salt
+		}
+	}
+	return m, nil
+}
+
+// putBlocks stores plaintext blocks of m, sealed with its file key when it
+// has a salt, and returns their references
+func (s *BlockStore) putBlocks(m *FileManifest, blocks [][]byte, owner string) ([]BlockRef, error) {
+	var fileKey []byte
+	if m.Encrypted() {
+		var err error
+		if fileKey, err = s.fileKey(m); err != nil {
+			return nil, err
+		}
+	}
+
+	var refs []BlockRef
+	for _, block := range blocks {
+		if fileKey != nil {
+			sealed, err := sealBlock(fileKey, block)
+			if err != nil {
+				return nil, err
+			}
+			block = sealed
+		}
+		h, err := s.putBlock(block, owner)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, BlockRef{Hash: h, Size: uint32(len(block))})
+	}
+	return refs, nil
+}
+
+// PutManifest records a manifest (its blocks may still be missing)
+func (s *BlockStore) PutManifest(m *FileManifest) {
+	s.mu.Lock()
+	s.manifests[m.Name] = m
+	s.recordVersion(m)
+	o := s.observer
+	s.mu.Unlock()
+	s.saveOrWarn(m.Name)
+
+	if o != nil {
+		o.manifestStored(m)
+	}
+}
+
+// Manifest returns the manifest for a file (nil if unknown)
+func (s *BlockStore) Manifest(name string) *FileManifest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.manifests[name]
+}
+
+// fetchList lists the blocks of m a read must fetch from peers, counting
+// them as cache misses
+func (s *BlockStore) fetchList(m *FileManifest) []BlockRef {
+	missing := s.MissingBlocks(m)
+	s.blocks.countMisses(len(missing))
+	return missing
+}
+
+// MissingBlocks lists the blocks of a manifest not held locally
+func (s *BlockStore) MissingBlocks(m *FileManifest) []BlockRef {
+	var missing []BlockRef
+	seen := make(map[BlockHash]bool)
+	for _, ref := range m.Blocks {
+		if seen[ref.Hash] {
+			continue
+		}
+		seen[ref.Hash] = true
+		if !s.HasBlock(ref.Hash) {
+			missing = append(missing, ref)
+		}
+	}
+	return missing
+}
+
+// ReadBlock returns the plaintext of block i of m, decrypting if needed
+func (s *BlockStore) ReadBlock(m *FileManifest, i int) ([]byte, error) {
+	ref := m.Blocks[i]
+	block, err := s.GetBlock(ref.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("block %s: %w", ref.Hash.String()[:12], err)
+	}
+	if !m.Encrypted() {
+		return block, nil
+	}
+
+	fileKey, err := s.fileKey(m)
+	if err != nil {
+		return nil, err
+	}
+	return openBlock(fileKey, block)
+}
+
+// Assemble rebuilds a file's plaintext from its blocks
+func (s *BlockStore) Assemble(m *FileManifest) ([]byte, error) {
+	data := make([]byte, 0, m.Size)
+	for i := range m.Blocks {
+		block, err := s.ReadBlock(m, i)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, block...)
+	}
+	return data, nil
+}
+
+// ReadFile returns a file's content if its manifest and all blocks are local
+func (s *BlockStore) ReadFile(name string) ([]byte, error) {
+	m := s.Manifest(name)
+	if m == nil {
+		return nil, ErrBlockNotFound
+	}
+	return s.Assemble(m)
+}
+
+// DeleteFile forgets a file's manifest; shared blocks age out of the cache.
+// Its history stays, so a file created again later supersedes it.
+func (s *BlockStore) DeleteFile(name string) bool {
+	s.mu.Lock()
+	if _, ok := s.manifests[name]; !ok {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.manifests, name)
+	s.mu.Unlock()
+
+	s.saveOrWarn(name)
+	return true
+}
+
+// pinBlocks pins every block of m in the cache; on failure no pins are left behind
+func (s *BlockStore) pinBlocks(m *FileManifest) error {
+	refs := uniqueBlocks(m)
+	for i, ref := range refs {
+		if err := s.blocks.Pin(ref.Hash.String()); err != nil {
+			for _, done := range refs[:i] {
+				s.blocks.Unpin(done.Hash.String())
+			}
+			return fmt.Errorf("failed to pin '%s': %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// unpinBlocks releases the pins taken by pinBlocks
+func (s *BlockStore) unpinBlocks(m *FileManifest) {
+	for _, ref := range uniqueBlocks(m) {
+		s.blocks.Unpin(ref.Hash.String())
+	}
+}
+
+// Files returns the names of all known files
+func (s *BlockStore) Files() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.manifests))
+	for name := range s.manifests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,681 @@
+// Package nodus - Boot channels: signed kernel, initramfs and rootfs bundles for network boot
+package nodus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultBootChannel is the channel nodes boot from unless told otherwise
+const DefaultBootChannel = "stable"
+
+const (
+	bootFile = "boot.json"
+
+	// bootContext prefixes the bytes signed for a boot bundle
+	bootContext = "spirit-nodus/boot:"
+
+	// bootInterval is how often bundles are pulled from peers and their
+	// images re-pinned
+	bootInterval = 5 * time.Minute
+
+	// bootChunk is how much of an image is read from the network at once
+	bootChunk = stripeBlocks * BlockSize
+)
+
+// PinBoot is the pin reason of boot images
+const PinBoot = "boot"
+
+var (
+	// ErrBootUntrusted is returned for a bundle not signed by a trusted key
+	ErrBootUntrusted = errors.New("boot bundle not signed by a trusted key")
+	// ErrBootCorrupt is returned when a fetched image doesn't match its bundle
+	ErrBootCorrupt = errors.New("boot image does not match its bundle")
+)
+
+// BootImage is one file of a bundle, at the version that was published
+type BootImage struct {
+	SHA256   string        `json:"sha256"` // hex digest of the content
+	Manifest *FileManifest `json:"manifest"`
+}
+
+// BootBundle names what a channel boots, signed by its publisher. A higher
+// serial supersedes a lower one.
+type BootBundle struct {
+	Channel   string     `json:"channel"`
+	Serial    uint64     `json:"serial"`
+	Kernel    BootImage  `json:"kernel"`
+	Initramfs BootImage  `json:"initramfs"`
+	Rootfs    *BootImage `json:"rootfs,omitempty"`
+	Cmdline   string     `json:"cmdline,omitempty"`
+	Published time.Time  `json:"published"`
+	Signer    peer.ID    `json:"signer"`
+	Signature []byte     `json:"signature,omitempty"`
+}
+
+// BootSources names the files a bundle is published from
+type BootSources struct {
+	Kernel    string `json:"kernel"`
+	Initramfs string `json:"initramfs"`
+	Rootfs    string `json:"rootfs,omitempty"`
+	Cmdline   string `json:"cmdline,omitempty"`
+}
+
+// bootFileImage is an image with the name it is fetched as
+type bootFileImage struct {
+	file  string
+	image *BootImage
+}
+
+// images returns the bundle's images with their names in a fetch directory
+func (b *BootBundle) images() []bootFileImage {
+	images := []bootFileImage{{"kernel", &b.Kernel}, {"initramfs", &b.Initramfs}}
+	if b.Rootfs != nil {
+		images = append(images, bootFileImage{"rootfs", b.Rootfs})
+	}
+	return images
+}
+
+// payload is the byte string the publisher signs
+func (b *BootBundle) payload() ([]byte, error) {
+	unsigned := *b
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(bootContext), data...), nil
+}
+
+// newer reports whether b supersedes cur (which may be nil)
+func (b *BootBundle) newer(cur *BootBundle) bool {
+	if cur == nil || b.Serial != cur.Serial {
+		return cur == nil || b.Serial > cur.Serial
+	}
+	return b.Published.After(cur.Published)
+}
+
+// Verify checks the bundle's images and its signature. Whether the signer
+// is trusted is up to the node.
+func (b *BootBundle) Verify() error {
+	if err := checkVolumeName(b.Channel); err != nil {
+		return fmt.Errorf("invalid boot bundle: %w", err)
+	}
+	for _, fi := range b.images() {
+		img := fi.image
+		if img.Manifest == nil || img.Manifest.Kind != "" {
+			return fmt.Errorf("invalid boot bundle: %s is not a file", fi.file)
+		}
+		// Booting nodes hold no key yet
+		if img.Manifest.Encrypted() {
+			return fmt.Errorf("invalid boot bundle: %s is encrypted", fi.file)
+		}
+		if sum, err := hex.DecodeString(img.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid boot bundle: bad %s digest", fi.file)
+		}
+	}
+
+	pub, err := b.Signer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("invalid boot bundle signer: %w", err)
+	}
+	payload, err := b.payload()
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(payload, b.Signature); err != nil || !ok {
+		return fmt.Errorf("boot bundle not signed by %s", b.Signer.ShortString())
+	}
+	return nil
+}
+
+// parseBootBundles decodes bundles, validating their image manifests like
+// any manifest from a peer
+func parseBootBundles(data []byte) ([]*BootBundle, error) {
+	var bundles []*BootBundle
+	if err := json.Unmarshal(data, &bundles); err != nil {
+		return nil, fmt.Errorf("invalid boot bundles: %w", err)
+	}
+	for _, b := range bundles {
+		if b == nil {
+			return nil, fmt.Errorf("invalid boot bundles: empty entry")
+		}
+		for _, fi := range b.images() {
+			if fi.image.Manifest == nil {
+				continue // Verify rejects it
+			}
+			encoded, err := fi.image.Manifest.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			if fi.image.Manifest, err = UnmarshalManifest(encoded); err != nil {
+				return nil, fmt.Errorf("boot bundle '%s' %s: %w", b.Channel, fi.file, err)
+			}
+		}
+	}
+	return bundles, nil
+}
+
+// bootSet holds the newest bundle of each channel, persisted so nodes keep
+// serving them across restarts, and the images pinned for them
+type bootSet struct {
+	mu      sync.Mutex
+	path    string
+	bundles map[string]*BootBundle
+	held    map[string]*BootBundle // bundle whose images are pinned, by channel
+
+	pinning sync.Mutex // serializes holdBoot
+}
+
+// loadBootSet loads the boot bundles from stateDir (empty if missing)
+func loadBootSet(stateDir string) (*bootSet, error) {
+	s := &bootSet{
+		path:    filepath.Join(stateDir, bootFile),
+		bundles: make(map[string]*BootBundle),
+		held:    make(map[string]*BootBundle),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bundles, err := parseBootBundles(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bundles {
+		if err := b.Verify(); err != nil {
+			return nil, err
+		}
+		s.bundles[b.Channel] = b
+	}
+	return s, nil
+}
+
+// save persists the bundles; caller must hold mu
+func (s *bootSet) save() error {
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
+
+// listLocked returns the bundles by channel; caller must hold mu
+func (s *bootSet) listLocked() []*BootBundle {
+	bundles := make([]*BootBundle, 0, len(s.bundles))
+	for _, b := range s.bundles {
+		bundles = append(bundles, b)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Channel < bundles[j].Channel })
+	return bundles
+}
+
+// list returns the bundles by channel
+func (s *bootSet) list() []*BootBundle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+// get returns the bundle of a channel (nil if none is known)
+func (s *bootSet) get(channel string) *BootBundle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bundles[channel]
+}
+
+// put records b if it supersedes the channel's bundle, reporting whether it did
+func (s *bootSet) put(b *BootBundle) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !b.newer(s.bundles[b.Channel]) {
+		return false
+	}
+	s.bundles[b.Channel] = b
+	if err := s.save(); err != nil {
+		fmt.Printf("⚠️  Failed to save boot bundles: %v\n", err)
+	}
+	return true
+}
+
+// bootTrusted reports whether bundles signed by id are accepted: this node,
+// trusted peers and the configured boot keys
+func (n *Node) bootTrusted(id peer.ID) bool {
+	if n.TrustLevel(id) >= TrustTrusted { // the same rule as checkSigner
+		return true
+	}
+	for _, key := range n.cfg.BootKeys {
+		if key == id.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptBoot verifies a bundle and records it if it supersedes the
+// channel's, pinning its images in the background
+func (n *Node) acceptBoot(b *BootBundle) (bool, error) {
+	if err := b.Verify(); err != nil {
+		return false, err
+	}
+	if !n.bootTrusted(b.Signer) {
+		return false, fmt.Errorf("'%s' from %s: %w", b.Channel, b.Signer.ShortString(), ErrBootUntrusted)
+	}
+	if !n.boot.put(b) {
+		return false, nil
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), bootInterval)
+		defer cancel()
+		n.holdBoot(ctx)
+	}()
+	return true, nil
+}
+
+// holdBoot fetches and pins the images of every channel's bundle, releasing
+// the images of the bundles they replaced
+func (n *Node) holdBoot(ctx context.Context) {
+	n.boot.pinning.Lock()
+	defer n.boot.pinning.Unlock()
+
+	for _, b := range n.boot.list() {
+		n.boot.mu.Lock()
+		old := n.boot.held[b.Channel]
+		n.boot.mu.Unlock()
+		if old == b {
+			continue
+		}
+
+		if err := n.pinBootImages(ctx, b); err != nil {
+			fmt.Printf("⚠️  Boot channel '%s' not pinned: %v\n", b.Channel, err)
+			continue
+		}
+		if old != nil {
+			for _, fi := range old.images() {
+				n.store.unpinBlocks(fi.image.Manifest)
+			}
+		}
+		n.boot.mu.Lock()
+		n.boot.held[b.Channel] = b
+		n.boot.mu.Unlock()
+		fmt.Printf("📌 Boot channel '%s' pinned (serial %d)\n", b.Channel, b.Serial)
+	}
+}
+
+// pinBootImages fetches all blocks of b's images and pins them; on failure
+// no pins are left behind
+func (n *Node) pinBootImages(ctx context.Context, b *BootBundle) error {
+	images := b.images()
+	for _, fi := range images {
+		m := fi.image.Manifest
+		if len(m.Blocks) == 0 {
+			continue
+		}
+		if err := n.fetchSpan(ctx, m, 0, len(m.Blocks)-1); err != nil {
+			return fmt.Errorf("%s: %w", fi.file, err)
+		}
+	}
+	for i, fi := range images {
+		if err := n.store.pinBlocks(fi.image.Manifest); err != nil {
+			for _, done := range images[:i] {
+				n.store.unpinBlocks(done.image.Manifest)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// bootPins lists the pinned boot images, and those still being fetched
+func (n *Node) bootPins() []PinInfo {
+	n.boot.mu.Lock()
+	defer n.boot.mu.Unlock()
+
+	var pins []PinInfo
+	for channel, b := range n.boot.bundles {
+		held := n.boot.held[channel] == b
+		for _, fi := range b.images() {
+			m := fi.image.Manifest
+			pins = append(pins, PinInfo{Name: m.Name, Reason: PinBoot, Size: m.Size, Blocks: len(m.Blocks), Held: held})
+		}
+	}
+	return pins
+}
+
+// copyImage streams m's content to w, fetching blocks as needed, and
+// returns its hex SHA-256
+func (n *Node) copyImage(ctx context.Context, m *FileManifest, w io.Writer) (string, error) {
+	h := sha256.New()
+	out := io.MultiWriter(h, w)
+	for off := int64(0); off < int64(m.Size); off += bootChunk {
+		data, err := n.ReadAt(ctx, m, off, bootChunk)
+		if err != nil {
+			return "", err
+		}
+		if _, err := out.Write(data); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PublishBoot signs a bundle of the current versions of the given files and
+// sends it to peers. Images must not be encrypted, since booting nodes hold
+// no key yet; an unencrypted volume is a good place for them.
+func (n *Node) PublishBoot(ctx context.Context, channel string, src BootSources) (*BootBundle, error) {
+	if err := checkVolumeName(channel); err != nil {
+		return nil, err
+	}
+	if src.Kernel == "" || src.Initramfs == "" {
+		return nil, fmt.Errorf("%w: a bundle needs a kernel and an initramfs", os.ErrInvalid)
+	}
+
+	b := &BootBundle{Channel: channel, Serial: 1, Cmdline: src.Cmdline, Signer: n.host.ID()}
+	if cur := n.boot.get(channel); cur != nil {
+		b.Serial = cur.Serial + 1
+	}
+	image := func(name string) (*BootImage, error) {
+		m, err := n.OpenFile(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if m.Kind != "" {
+			return nil, fmt.Errorf("boot image '%s': %w", name, ErrIsDir)
+		}
+		if m.Encrypted() {
+			return nil, fmt.Errorf("%w: boot image '%s' is encrypted", os.ErrInvalid, name)
+		}
+		sum, err := n.copyImage(ctx, m, io.Discard)
+		if err != nil {
+			return nil, fmt.Errorf("boot image '%s': %w", name, err)
+		}
+		return &BootImage{SHA256: sum, Manifest: m}, nil
+	}
+	kernel, err := image(src.Kernel)
+	if err != nil {
+		return nil, err
+	}
+	initramfs, err := image(src.Initramfs)
+	if err != nil {
+		return nil, err
+	}
+	b.Kernel, b.Initramfs = *kernel, *initramfs
+	if src.Rootfs != "" {
+		if b.Rootfs, err = image(src.Rootfs); err != nil {
+			return nil, err
+		}
+	}
+
+	key := n.host.Peerstore().PrivKey(n.host.ID())
+	if key == nil {
+		return nil, fmt.Errorf("no private key for %s", n.host.ID())
+	}
+	b.Published = time.Now().UTC()
+	payload, err := b.payload()
+	if err != nil {
+		return nil, err
+	}
+	if b.Signature, err = key.Sign(payload); err != nil {
+		return nil, err
+	}
+	if _, err := n.acceptBoot(b); err != nil {
+		return nil, err
+	}
+
+	for _, id := range n.peersAtLeast(TrustCloud) {
+		go n.sendBoot(id, b)
+	}
+	return b, nil
+}
+
+// sendBoot pushes a bundle to a peer
+func (n *Node) sendBoot(peerID peer.ID, b *BootBundle) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	data, err := json.Marshal([]*BootBundle{b})
+	if err != nil {
+		return err
+	}
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileBroadcast)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	if _, err := roundTrip(stream, frame{Type: msgBoot, Payload: data}); err != nil {
+		fmt.Printf("⚠️  Boot bundle '%s' to %s failed: %v\n", b.Channel, peerID.ShortString(), err)
+		return err
+	}
+	return nil
+}
+
+// serveBoot accepts bundles pushed by a peer
+func (n *Node) serveBoot(remote peer.ID, req frame) frame {
+	bundles, err := parseBootBundles(req.Payload)
+	if err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+	for _, b := range bundles {
+		ok, err := n.acceptBoot(b)
+		if err != nil {
+			return errorFrame(msgAck, StatusForbidden, err.Error())
+		}
+		if ok {
+			fmt.Printf("🥾 Boot channel '%s' at serial %d from %s\n", b.Channel, b.Serial, remote.ShortString())
+		}
+	}
+	return frame{Type: msgAck}
+}
+
+// serveBootRequest answers a request for one channel's bundle, or every
+// bundle when the payload is empty
+func (n *Node) serveBootRequest(req frame) frame {
+	bundles := n.boot.list()
+	if channel := string(req.Payload); channel != "" {
+		bundles = nil
+		if b := n.boot.get(channel); b != nil {
+			bundles = []*BootBundle{b}
+		}
+	}
+	if len(bundles) == 0 {
+		return errorFrame(msgBoot, StatusNotFound, string(req.Payload))
+	}
+	data, err := json.Marshal(bundles)
+	if err != nil {
+		return errorFrame(msgBoot, StatusError, err.Error())
+	}
+	return frame{Type: msgBoot, Payload: data}
+}
+
+// requestBoot asks a peer for its bundles ("" for every channel)
+func (n *Node) requestBoot(ctx context.Context, peerID peer.ID, channel string) ([]*BootBundle, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	reply, err := roundTrip(stream, frame{Type: msgBootRequest, Payload: []byte(channel)})
+	if err != nil {
+		return nil, err
+	}
+	return parseBootBundles(reply.Payload)
+}
+
+// pullBoot asks connected peers for their bundles ("" for every channel)
+// and keeps the newest trusted one of each
+func (n *Node) pullBoot(ctx context.Context, channel string) {
+	var wg sync.WaitGroup
+	for _, id := range n.peersAtLeast(TrustCloud) {
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			bundles, err := n.requestBoot(ctx, id, channel)
+			if err != nil {
+				return
+			}
+			for _, b := range bundles {
+				if _, err := n.acceptBoot(b); err != nil {
+					fmt.Printf("⚠️  Boot bundle from %s rejected: %v\n", id.ShortString(), err)
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+// BootBundles lists the newest bundle of each known channel
+func (n *Node) BootBundles() []*BootBundle {
+	return n.boot.list()
+}
+
+// LatestBoot asks peers for a channel's newest bundle and returns the
+// newest one accepted
+func (n *Node) LatestBoot(ctx context.Context, channel string) (*BootBundle, error) {
+	if err := checkVolumeName(channel); err != nil {
+		return nil, err
+	}
+	n.pullBoot(ctx, channel)
+	b := n.boot.get(channel)
+	if b == nil {
+		return nil, fmt.Errorf("boot channel '%s': %w", channel, os.ErrNotExist)
+	}
+	return b, nil
+}
+
+// CopyBootImage writes one image of a channel's bundle to w. The bundle
+// must still be the channel's newest at serial, so the images a client
+// fetches one by one all come from the same bundle.
+func (n *Node) CopyBootImage(ctx context.Context, channel string, serial uint64, file string, w io.Writer) error {
+	image, err := n.channelImage(channel, serial, file)
+	if err != nil {
+		return err
+	}
+	_, err = n.copyImage(ctx, image.Manifest, w)
+	return err
+}
+
+// channelImage returns one image of a channel's bundle, while it is the newest at serial
+func (n *Node) channelImage(channel string, serial uint64, file string) (*BootImage, error) {
+	b := n.boot.get(channel)
+	if b == nil || b.Serial != serial {
+		return nil, fmt.Errorf("boot channel '%s' at serial %d: %w", channel, serial, os.ErrNotExist)
+	}
+	for _, fi := range b.images() {
+		if fi.file == file {
+			return fi.image, nil
+		}
+	}
+	return nil, fmt.Errorf("boot image %s: %w", file, os.ErrNotExist)
+}
+
+// FetchBoot writes the images of a channel's newest bundle to dir, see WriteBoot
+func (n *Node) FetchBoot(ctx context.Context, channel, dir string) (*BootBundle, error) {
+	b, err := n.LatestBoot(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteBoot(dir, b, func(file string, w io.Writer) error {
+		return n.CopyBootImage(ctx, channel, b.Serial, file, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteBoot writes the images of b, read by copy, to dir along with the
+// bundle itself as bundle.json. Each image is checked against the bundle's
+// digest before it takes its final name. The daemon serves the images and
+// the CLI calls this, so files are written with the caller's permissions.
+func WriteBoot(dir string, b *BootBundle, copy func(file string, w io.Writer) error) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	temps := make(map[string]string)
+	defer func() {
+		for _, tmp := range temps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, fi := range b.images() {
+		tmp, err := writeBootImage(fi, dir, copy)
+		if err != nil {
+			return err
+		}
+		temps[fi.file] = tmp
+	}
+
+	for file, tmp := range temps {
+		if err := os.Rename(tmp, filepath.Join(dir, file)); err != nil {
+			return err
+		}
+		delete(temps, file)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "bundle.json"), data, 0644)
+}
+
+// writeBootImage writes an image to a temporary file in dir and checks it
+// against the bundle, returning the file's path
+func writeBootImage(fi bootFileImage, dir string, copy func(file string, w io.Writer) error) (string, error) {
+	f, err := os.CreateTemp(dir, "."+fi.file+"-*")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	err = copy(fi.file, io.MultiWriter(h, f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); err == nil && sum != fi.image.SHA256 {
+		err = fmt.Errorf("%w (sha256 %s, want %s)", ErrBootCorrupt, sum[:12], fi.image.SHA256[:12])
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("boot image %s: %w", fi.file, err)
+	}
+	return f.Name(), nil
+}
+
+// StartBoot pulls boot bundles from peers and keeps their images pinned,
+// until ctx is cancelled
+func (n *Node) StartBoot(ctx context.Context) {
+	ticker := time.NewTicker(bootInterval)
+	defer ticker.Stop()
+
+	for {
+		n.pullBoot(ctx, "")
+		n.holdBoot(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after 10s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// publishTestBoot writes boot images to n and publishes them on channel
+func publishTestBoot(t *testing.T, n *Node, channel string) (*BootBundle, map[string][]byte) {
+	t.Helper()
+	images := map[string][]byte{
+		"kernel":    testData(300<<10, 1),
+		"initramfs": testData(BlockSize+123, 2),
+		"rootfs":    testData(600<<10, 3),
+	}
+	for name, data := range images {
+		if _, err := n.WriteFile("boot/"+name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := n.PublishBoot(context.Background(), channel, BootSources{
+		Kernel:    "boot/kernel",
+		Initramfs: "boot/initramfs",
+		Rootfs:    "boot/rootfs",
+		Cmdline:   "quiet",
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	return b, images
+}
+
+func TestBootFetchFromPeers(t *testing.T) {
+	publisher := newTestNode(t)
+	seed := newTestNode(t)
+	linkNodes(t, publisher, seed, TrustTrusted, TrustTrusted)
+	// The booting node only knows the publisher's key and reaches the seed
+	booting := newTestNode(t, func(cfg *Config) { cfg.BootKeys = []string{publisher.ID()} })
+	linkNodes(t, booting, seed, TrustCloud, TrustNetwork)
+
+	published, images := publishTestBoot(t, publisher, "stable")
+	waitFor(t, "the seed to pin the bundle", func() bool {
+		seed.boot.mu.Lock()
+		defer seed.boot.mu.Unlock()
+		return seed.boot.held["stable"] != nil
+	})
+	for _, fi := range published.images() {
+		for _, ref := range fi.image.Manifest.Blocks {
+			if !seed.store.blocks.Pinned(ref.Hash.String()) {
+				t.Fatalf("seed didn't pin %s", fi.file)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	got, err := booting.FetchBoot(context.Background(), "stable", dir)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if got.Serial != published.Serial || got.Cmdline != "quiet" {
+		t.Fatalf("fetched serial %d cmdline %q", got.Serial, got.Cmdline)
+	}
+	for name, want := range images {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("%s differs: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bundle.json")); err != nil {
+		t.Fatalf("bundle not written: %v", err)
+	}
+
+	// Without the key the same bundle is refused
+	stranger := newTestNode(t)
+	linkNodes(t, stranger, seed, TrustCloud, TrustNetwork)
+	if _, err := stranger.FetchBoot(context.Background(), "stable", t.TempDir()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("fetch without the publisher's key: %v, want not found", err)
+	}
+}
+
+func TestBootFetchThroughDaemon(t *testing.T) {
+	n := newTestNode(t)
+	published, images := publishTestBoot(t, n, "stable")
+	_, client := testControl(t, n)
+
+	// The client writes the images the daemon streams
+	dir := filepath.Join(t.TempDir(), "boot")
+	got, err := client.FetchBoot("stable", dir)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if got.Serial != published.Serial {
+		t.Fatalf("fetched serial %d, want %d", got.Serial, published.Serial)
+	}
+	for name, want := range images {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("%s differs: %v", name, err)
+		}
+	}
+
+	// Images of a bundle that is no longer the newest aren't served
+	var sink bytes.Buffer
+	if err := client.download("/v1/boot/image?channel=stable&serial=99&file=kernel", &sink); err == nil {
+		t.Fatal("image of another serial served")
+	}
+}
+
+func TestBootRejectsTamperedBundles(t *testing.T) {
+	publisher := newTestNode(t)
+	booting := newTestNode(t, func(cfg *Config) { cfg.BootKeys = []string{publisher.ID()} })
+	published, _ := publishTestBoot(t, publisher, "stable")
+
+	if _, err := booting.acceptBoot(published); err != nil {
+		t.Fatalf("genuine bundle refused: %v", err)
+	}
+
+	evil := *published
+	evil.Serial++
+	evil.Cmdline = "init=/bin/sh"
+	if err := evil.Verify(); err == nil {
+		t.Fatal("tampered bundle verifies")
+	}
+	if _, err := booting.acceptBoot(&evil); err == nil {
+		t.Fatal("tampered bundle accepted")
+	}
+
+	// Validly signed by a key nobody trusts
+	other := newTestNode(t)
+	foreign, _ := publishTestBoot(t, other, "stable")
+	if _, err := booting.acceptBoot(foreign); !errors.Is(err, ErrBootUntrusted) {
+		t.Fatalf("untrusted signer: %v, want ErrBootUntrusted", err)
+	}
+	if b := booting.boot.get("stable"); b != published {
+		t.Fatal("channel no longer holds the genuine bundle")
+	}
+}
+
+func TestBootImageCheckedBeforeWritten(t *testing.T) {
+	n := newTestNode(t)
+	published, _ := publishTestBoot(t, n, "stable")
+
+	// The kernel's content under the initramfs digest
+	fi := bootFileImage{"kernel", &BootImage{SHA256: published.Initramfs.SHA256, Manifest: published.Kernel.Manifest}}
+	dir := t.TempDir()
+	copy := func(_ string, w io.Writer) error {
+		return n.CopyBootImage(context.Background(), "stable", published.Serial, "kernel", w)
+	}
+	if _, err := writeBootImage(fi, dir, copy); !errors.Is(err, ErrBootCorrupt) {
+		t.Fatalf("mismatched image: %v, want ErrBootCorrupt", err)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Fatalf("corrupt image left %d files behind", len(left))
+	}
+}
+
+func TestBootRefusesEncryptedImages(t *testing.T) {
+	n := newTestNode(t)
+	key, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.store.SetMasterKey(key)
+	if _, err := n.WriteFile("vmlinuz", testData(1000, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.PublishBoot(context.Background(), "beta", BootSources{Kernel: "vmlinuz", Initramfs: "vmlinuz"}); err == nil {
+		t.Fatal("bundle of encrypted images published")
+	}
+}
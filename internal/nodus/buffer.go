@@ -0,0 +1,177 @@
+// Package nodus - Block-level write buffer for files open for writing
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// bufferFetchTimeout bounds fetching the unchanged blocks a buffered write
+// still needs when it is stored
+const bufferFetchTimeout = 2 * time.Minute
+
+// writeBuffer holds the writes to one file as whole modified blocks on top of
+// the version they started from, so a write only touches the blocks it
+// covers and a truncate allocates nothing
+type writeBuffer struct {
+	node   *Node
+	base   *FileManifest  // version the writes apply to
+	size   int64          // current size
+	kept   int64          // bytes of base still in the file; the rest reads as zeros
+	blocks map[int][]byte // modified blocks, BlockSize each and zero past size
+}
+
+// newWriteBuffer starts buffering writes on top of base
+func (n *Node) newWriteBuffer(base *FileManifest) *writeBuffer {
+	return &writeBuffer{
+		node:   n,
+		base:   base,
+		size:   int64(base.Size),
+		kept:   int64(base.Size),
+		blocks: make(map[int][]byte),
+	}
+}
+
+// Size returns the current size of the file
+func (b *writeBuffer) Size() int64 {
+	return b.size
+}
+
+// block returns the current content of block i as a BlockSize buffer; a
+// modified block is returned itself, anything else as a fresh copy
+func (b *writeBuffer) block(ctx context.Context, i int) ([]byte, error) {
+	if buf, ok := b.blocks[i]; ok {
+		return buf, nil
+	}
+	buf := make([]byte, BlockSize)
+	start := int64(i) * BlockSize
+	if start >= b.kept {
+		return buf, nil
+	}
+	data, err := b.node.ReadAt(ctx, b.base, start, BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if keep := b.kept - start; keep < int64(len(data)) {
+		data = data[:keep]
+	}
+	copy(buf, data)
+	return buf, nil
+}
+
+// ReadAt reads up to size bytes at off
+func (b *writeBuffer) ReadAt(ctx context.Context, off int64, size int) ([]byte, error) {
+	if off >= b.size {
+		return nil, nil
+	}
+	end := min(off+int64(size), b.size)
+	data := make([]byte, 0, end-off)
+	for off < end {
+		i := int(off / BlockSize)
+		buf, err := b.block(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		start := off - int64(i)*BlockSize
+		n := min(int64(BlockSize)-start, end-off)
+		data = append(data, buf[start:start+n]...)
+		off += n
+	}
+	return data, nil
+}
+
+// WriteAt writes p at off, reading only the blocks it covers partially
+func (b *writeBuffer) WriteAt(ctx context.Context, p []byte, off int64) error {
+	end := off + int64(len(p))
+	for len(p) > 0 {
+		i := int(off / BlockSize)
+		start := off - int64(i)*BlockSize
+		var buf []byte
+		if _, ok := b.blocks[i]; !ok && start == 0 && len(p) >= BlockSize {
+			buf = make([]byte, BlockSize) // overwritten whole
+		} else {
+			var err error
+			if buf, err = b.block(ctx, i); err != nil {
+				return err
+			}
+		}
+		n := copy(buf[start:], p)
+		b.blocks[i] = buf
+		p = p[n:]
+		off += int64(n)
+	}
+	if end > b.size {
+		b.size = end
+	}
+	return nil
+}
+
+// Truncate changes the size; bytes past a shrunk size read as zeros if the
+// file grows again
+func (b *writeBuffer) Truncate(size int64) {
+	if size < b.size {
+		b.kept = min(b.kept, size)
+		for i, buf := range b.blocks {
+			start := int64(i) * BlockSize
+			if start >= size {
+				delete(b.blocks, i)
+			} else if cut := size - start; cut < BlockSize {
+				clear(buf[cut:])
+			}
+		}
+	}
+	b.size = size
+}
+
+// save stores the buffered content as a new version of name and starts
+// buffering on top of it. Blocks that weren't written keep their address,
+// so only the modified blocks are sealed and stored again.
+func (b *writeBuffer) save(ctx context.Context, name string) (*FileManifest, error) {
+	n := b.node
+	if err := n.checkWrite(name, b.size); err != nil {
+		return nil, err
+	}
+	m, err := n.store.newVersion(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.Size = uint64(b.size)
+
+	// The base's blocks are only valid under the same file key
+	reuse := bytes.Equal(m.Salt, b.base.Salt) && volumeOf(m.Name) == volumeOf(b.base.Name)
+	count := int((b.size + BlockSize - 1) / BlockSize)
+	refs := make([]BlockRef, 0, count)
+	for i := 0; i < count; i++ {
+		start := int64(i) * BlockSize
+		length := min(int64(BlockSize), b.size-start)
+		_, modified := b.blocks[i]
+		if !modified && reuse && i < len(b.base.Blocks) && start+length <= b.kept &&
+			length == min(int64(BlockSize), int64(b.base.Size)-start) {
+			// Unchanged: the new version holds the block too, so it must be local
+			if err := n.fetchSpan(ctx, b.base, i, i); err != nil {
+				return nil, err
+			}
+			refs = append(refs, b.base.Blocks[i])
+			continue
+		}
+
+		buf, err := b.block(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := n.store.putBlocks(m, [][]byte{buf[:length]}, "")
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, stored...)
+	}
+	m.Blocks = refs
+
+	n.store.stamp(m)
+	if err := n.commitWrite(m); err != nil {
+		return nil, err
+	}
+	*b = *n.newWriteBuffer(m)
+	return m, nil
+}
@@ -0,0 +1,92 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestWriteBufferTouchesOnlyWrittenBlocks(t *testing.T) {
+	n := newTestNode(t)
+	ctx := context.Background()
+
+	want := testData(4*BlockSize+100, 1)
+	base, err := n.WriteFile("vm.img", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := n.newWriteBuffer(base)
+	patch := []byte("patched")
+	if err := b.WriteAt(ctx, patch, BlockSize+10); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[BlockSize+10:], patch)
+	if len(b.blocks) != 1 {
+		t.Fatalf("%d blocks buffered, want 1", len(b.blocks))
+	}
+
+	got, err := b.ReadAt(ctx, BlockSize, 64)
+	if err != nil || !bytes.Equal(got, want[BlockSize:BlockSize+64]) {
+		t.Fatalf("buffered read: %v", err)
+	}
+
+	m, err := b.save(ctx, "vm.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ref := range m.Blocks {
+		if changed := ref.Hash != base.Blocks[i].Hash; changed != (i == 1) {
+			t.Errorf("block %d changed: %v", i, changed)
+		}
+	}
+	data, err := n.store.ReadFile("vm.img")
+	if err != nil || !bytes.Equal(data, want) {
+		t.Fatalf("stored content differs: %v", err)
+	}
+}
+
+func TestWriteBufferTruncate(t *testing.T) {
+	n := newTestNode(t)
+	ctx := context.Background()
+
+	base, err := n.WriteFile("log.bin", testData(2*BlockSize+500, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testData(2*BlockSize+500, 2)[:BlockSize+20]
+
+	b := n.newWriteBuffer(base)
+	b.Truncate(BlockSize + 20)
+	// Growing again must not bring back the cut bytes
+	b.Truncate(3 * BlockSize)
+	if len(b.blocks) != 0 {
+		t.Fatalf("truncate buffered %d blocks", len(b.blocks))
+	}
+	want = append(want, make([]byte, 3*BlockSize-len(want))...)
+	if err := b.WriteAt(ctx, []byte("tail"), 3*BlockSize-4); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[3*BlockSize-4:], "tail")
+
+	got, err := b.ReadAt(ctx, 0, 3*BlockSize)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("buffered content differs: %v", err)
+	}
+	m, err := b.save(ctx, "log.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Blocks[0].Hash != base.Blocks[0].Hash {
+		t.Error("untouched first block was stored again")
+	}
+	data, err := n.store.ReadFile("log.bin")
+	if err != nil || !bytes.Equal(data, want) {
+		t.Fatalf("stored content differs: %v", err)
+	}
+
+	b.Truncate(0)
+	if m, err = b.save(ctx, "log.bin"); err != nil || m.Size != 0 || len(m.Blocks) != 0 {
+		t.Fatalf("truncate to zero: %v", err)
+	}
+}
@@ -2,17 +2,81 @@
 package nodus
 
 import (
-	"container/list"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
-// Cache is a thread-safe LRU cache
+// ErrCacheFull is returned when an entry can't fit because the rest of the cache is pinned
+var ErrCacheFull = errors.New("cache full: remaining entries are pinned")
+
+// ErrQuotaExceeded is returned when an owner's entries would exceed its byte budget
+var ErrQuotaExceeded = errors.New("cache quota exceeded")
+
+// ItemTooLargeError is returned for an entry bigger than the per-item limit
+type ItemTooLargeError struct {
+	Key   string
+	Size  int64
+	Limit int64
+}
+
+func (e *ItemTooLargeError) Error() string {
+	return fmt.Sprintf("%s is %d bytes, over the %d byte item limit", e.Key, e.Size, e.Limit)
+}
+
+// Cache is a thread-safe RAM cache with a pluggable eviction policy (LRU by
+// default). With a disk tier, entries evicted from RAM spill to disk and are
+// promoted back to RAM when read again. Pinned entries are never evicted from
+// the cache: without a disk tier they stay in RAM, with one they may move to
+// disk, where they are kept until unpinned.
+//
+// Entries stored on behalf of an owner (a peer) count against that owner's
+// quota in both tiers, from when they are stored until they leave the cache.
 type Cache struct {
-	mu       sync.RWMutex
-	capacity int64 // max bytes
-	used     int64 // current bytes used
-	items    map[string]*list.Element
-	order    *list.List
+	mu         sync.RWMutex
+	capacity   int64 // max bytes
+	used       int64 // current bytes used
+	pinnedUsed int64 // bytes held by pinned entries in RAM
+	maxItem    int64 // largest single entry (0 for capacity)
+	quota      int64 // bytes per owner (0 for unlimited)
+	items      map[string]*cacheEntry
+	pins       map[string]int         // pin count per key
+	charges    map[string]ownerCharge // owner of each key held for a peer, in either tier
+	owned      map[string]int64       // bytes per owner
+	policy     EvictionPolicy
+	disk       *diskCache // nil for RAM only
+
+	hits      atomic.Uint64 // served from RAM
+	diskHits  atomic.Uint64 // served from disk
+	misses    atomic.Uint64 // lookups and reads that had to go to peers
+	evictions atomic.Uint64 // RAM entries evicted to make room
+}
+
+// CacheStats is a snapshot of cache counters and usage
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	DiskHits      uint64 `json:"disk_hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	DiskEvictions uint64 `json:"disk_evictions"`
+
+	Used         int64 `json:"used"`
+	Capacity     int64 `json:"capacity"`
+	Entries      int   `json:"entries"`
+	Pinned       int64 `json:"pinned"`
+	DiskUsed     int64 `json:"disk_used"`
+	DiskCapacity int64 `json:"disk_capacity"`
+	DiskEntries  int   `json:"disk_entries"`
+}
+
+// HitRatio returns the share of lookups served from either tier
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.DiskHits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.DiskHits) / float64(total)
 }
 
 type cacheEntry struct {
@@ -20,99 +84,479 @@ type cacheEntry struct {
 	data []byte
 }
 
+// ownerCharge is what one key counts against its owner's quota
+type ownerCharge struct {
+	owner string
+	size  int64
+}
+
 // NewCache creates a new LRU cache with the given capacity in bytes
 func NewCache(capacity int64) *Cache {
 	return &Cache{
 		capacity: capacity,
-		items:    make(map[string]*list.Element),
-		order:    list.New(),
+		items:    make(map[string]*cacheEntry),
+		pins:     make(map[string]int),
+		charges:  make(map[string]ownerCharge),
+		owned:    make(map[string]int64),
+		policy:   newLRUPolicy(),
+	}
+}
+
+// NewTieredCache creates a RAM cache backed by a persistent disk tier in dir.
+// Entries already on disk from a previous run are available immediately.
+func NewTieredCache(capacity int64, dir string, diskCapacity int64) (*Cache, error) {
+	disk, err := openDiskCache(dir, diskCapacity)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCache(capacity)
+	c.disk = disk
+	return c, nil
+}
+
+// SetPolicy replaces the eviction policy; current entries start out equal
+func (c *Cache) SetPolicy(policy EvictionPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.items {
+		policy.Add(key)
 	}
+	c.policy = policy
+}
+
+// SetMaxItemSize limits the size of a single entry (0 for the cache capacity)
+func (c *Cache) SetMaxItemSize(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxItem = size
+}
+
+// SetQuota limits the bytes each owner's entries may take (0 for unlimited)
+func (c *Cache) SetQuota(bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quota = bytes
+}
+
+// OwnerUsage returns the bytes held for owner in both tiers and the per-owner quota
+func (c *Cache) OwnerUsage(owner string) (used, quota int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.owned[owner], c.quota
 }
 
 // Get retrieves an item from cache (nil if not found)
 func (c *Cache) Get(key string) []byte {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if entry, ok := c.items[key]; ok {
+		c.policy.Touch(key)
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return entry.data
+	}
+	c.mu.Unlock()
+
+	if c.disk == nil {
+		c.misses.Add(1)
+		return nil
+	}
+	data := c.disk.get(key)
+	if data == nil {
+		c.misses.Add(1)
+		c.release([]string{key}) // an unreadable entry is dropped from disk
+	} else {
+		c.diskHits.Add(1)
+		// Promote; the disk copy stays so a later eviction costs no write.
+		// If RAM is all pinned the data is still served from disk.
+		c.mu.Lock()
+		evicted, _ := c.promoteLocked(key, data)
+		c.mu.Unlock()
+		c.spill(evicted)
+	}
+	return data
+}
+
+// Has reports whether key is cached in either tier without promoting it
+func (c *Cache) Has(key string) bool {
+	c.mu.RLock()
+	_, ok := c.items[key]
+	c.mu.RUnlock()
+	return ok || (c.disk != nil && c.disk.has(key))
+}
+
+// Put adds an item to cache, evicting unpinned entries if necessary.
+// It returns an *ItemTooLargeError for items over the per-item limit and
+// ErrCacheFull if the item can't fit beside the pinned entries.
+func (c *Cache) Put(key string, data []byte) error {
+	return c.PutOwned(key, data, "")
+}
 
-	if elem, ok := c.items[key]; ok {
-		// Move to front (most recently used)
-		c.order.MoveToFront(elem)
-		return elem.Value.(*cacheEntry).data
+// PutOwned is Put on behalf of owner, charging the entry to owner's quota
+// until it leaves both tiers. It returns ErrQuotaExceeded once owner's
+// entries would exceed the quota. An entry we already hold ourselves stays
+// ours and is not charged.
+func (c *Cache) PutOwned(key string, data []byte, owner string) error {
+	evicted, err := c.putRAM(key, data, owner)
+	if err != nil {
+		c.spill(evicted)
+		return err
 	}
+	if c.disk != nil {
+		// The disk copy may hold an older value for this key
+		c.disk.delete(key)
+	}
+	c.spill(evicted)
 	return nil
 }
 
-// Put adds an item to cache, evicting old entries if necessary
-func (c *Cache) Put(key string, data []byte) {
+// putRAM adds an item to the RAM tier and returns the entries it evicted
+func (c *Cache) putRAM(key string, data []byte, owner string) ([]*cacheEntry, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.putLocked(key, data, owner)
+}
 
+// putLocked implements putRAM; caller must hold mu
+func (c *Cache) putLocked(key string, data []byte, owner string) ([]*cacheEntry, error) {
 	dataSize := int64(len(data))
+	if limit := c.itemLimit(); dataSize > limit {
+		return nil, &ItemTooLargeError{Key: key, Size: dataSize, Limit: limit}
+	}
 
-	// If item already exists, update it
-	if elem, ok := c.items[key]; ok {
-		oldEntry := elem.Value.(*cacheEntry)
-		c.used -= int64(len(oldEntry.data))
-		oldEntry.data = data
-		c.used += dataSize
-		c.order.MoveToFront(elem)
-		return
+	old, exists := c.items[key]
+	oldSize := int64(0)
+	if exists {
+		oldSize = int64(len(old.data))
+	}
+	prev, charged := c.charges[key]
+	if exists && !charged {
+		owner = ""
+	}
+
+	if owner != "" && c.quota > 0 {
+		total := c.owned[owner] + dataSize
+		if charged && prev.owner == owner {
+			total -= prev.size
+		}
+		if total > c.quota {
+			return nil, fmt.Errorf("%s (%d bytes) for %s: %w", key, dataSize, owner, ErrQuotaExceeded)
+		}
+	}
+
+	// Without a disk tier everything unpinned can go; check the rest leaves room first
+	if c.disk == nil {
+		needed := c.pinnedUsed + dataSize
+		if c.pins[key] > 0 {
+			needed -= oldSize
+		}
+		if needed > c.capacity {
+			return nil, fmt.Errorf("%s (%d bytes): %w", key, dataSize, ErrCacheFull)
+		}
 	}
 
 	// Evict until we have space
-	for c.used+dataSize > c.capacity && c.order.Len() > 0 {
-		c.evictOldest()
+	var evicted []*cacheEntry
+	for c.used-oldSize+dataSize > c.capacity {
+		victim, ok := c.victimLocked(key)
+		if !ok {
+			return evicted, fmt.Errorf("%s (%d bytes): %w", key, dataSize, ErrCacheFull)
+		}
+		evicted = append(evicted, c.evict(victim))
+		c.evictions.Add(1)
+	}
+
+	// If item already exists, update it
+	if exists {
+		c.used += dataSize - oldSize
+		if c.pins[key] > 0 {
+			c.pinnedUsed += dataSize - oldSize
+		}
+		old.data = data
+		c.charge(key, owner, dataSize)
+		c.policy.Touch(key)
+		return evicted, nil
 	}
 
-	// Add new entry
-	entry := &cacheEntry{key: key, data: data}
-	elem := c.order.PushFront(entry)
-	c.items[key] = elem
+	// Add new entry; a pinned one coming back from disk is held here now
+	c.items[key] = &cacheEntry{key: key, data: data}
 	c.used += dataSize
+	if c.pins[key] > 0 {
+		c.pinnedUsed += dataSize
+		if c.disk != nil {
+			c.disk.unpin(key)
+		}
+	}
+	c.charge(key, owner, dataSize)
+	c.policy.Add(key)
+	return evicted, nil
+}
+
+// victimLocked picks the RAM entry to evict next, other than key. Unpinned
+// entries go first; a pinned one can go only once the disk tier has pinned
+// room for it. Caller must hold mu.
+func (c *Cache) victimLocked(key string) (string, bool) {
+	if victim, ok := c.policy.Victim(func(k string) bool { return k == key || c.pins[k] > 0 }); ok {
+		return victim, true
+	}
+	if c.disk == nil {
+		return "", false
+	}
+	full := make(map[string]bool) // pinned entries the disk tier had no room for
+	for {
+		victim, ok := c.policy.Victim(func(k string) bool { return k == key || c.pins[k] == 0 || full[k] })
+		if !ok {
+			return "", false
+		}
+		gone, ok := c.disk.pin(victim, int64(len(c.items[victim].data)))
+		for _, k := range gone {
+			if _, ok := c.items[k]; !ok {
+				c.uncharge(k)
+			}
+		}
+		if ok {
+			return victim, true
+		}
+		full[victim] = true
+	}
 }
 
-// evictOldest removes the least recently used item
-func (c *Cache) evictOldest() {
-	oldest := c.order.Back()
-	if oldest == nil {
+// promoteLocked moves an entry read from disk into RAM, keeping its owner;
+// caller must hold mu
+func (c *Cache) promoteLocked(key string, data []byte) ([]*cacheEntry, error) {
+	return c.putLocked(key, data, c.charges[key].owner)
+}
+
+// itemLimit returns the largest entry accepted; caller must hold mu
+func (c *Cache) itemLimit() int64 {
+	if c.maxItem > 0 && c.maxItem < c.capacity {
+		return c.maxItem
+	}
+	return c.capacity
+}
+
+// charge makes key count size bytes against owner's quota, or against
+// nobody's for owner ""; caller must hold mu
+func (c *Cache) charge(key, owner string, size int64) {
+	c.uncharge(key)
+	if owner == "" {
 		return
 	}
+	c.charges[key] = ownerCharge{owner: owner, size: size}
+	c.owned[owner] += size
+}
 
-	entry := oldest.Value.(*cacheEntry)
-	c.order.Remove(oldest)
-	delete(c.items, entry.key)
-	c.used -= int64(len(entry.data))
+// uncharge drops key's charge; caller must hold mu
+func (c *Cache) uncharge(key string) {
+	prev, ok := c.charges[key]
+	if !ok {
+		return
+	}
+	delete(c.charges, key)
+	if c.owned[prev.owner] -= prev.size; c.owned[prev.owner] <= 0 {
+		delete(c.owned, prev.owner)
+	}
 }
 
-// Delete removes a specific key from cache
-func (c *Cache) Delete(key string) bool {
+// release drops the charges of keys that left the disk tier, unless they
+// are still in RAM
+func (c *Cache) release(keys []string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := c.items[key]; !ok {
+			c.uncharge(key)
+		}
+	}
+}
 
-	elem, ok := c.items[key]
-	if !ok {
-		return false
+// Pin keeps key cached until unpinned, in whichever tier holds it.
+// Pins are counted, so each Pin needs its own Unpin.
+func (c *Cache) Pin(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[key]; ok {
+		c.pinLocked(key)
+		return nil
+	}
+	if c.disk == nil || !c.disk.pinCached(key) {
+		return fmt.Errorf("%s is not cached", key)
 	}
+	c.pins[key]++
+	return nil
+}
 
-	entry := elem.Value.(*cacheEntry)
-	c.order.Remove(elem)
+// checkPinRoom reports whether size more bytes could be pinned across both tiers
+func (c *Cache) checkPinRoom(size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pinned, capacity := c.pinnedLocked(), c.capacity
+	if c.disk != nil {
+		capacity += c.disk.capacity
+	}
+	if pinned+size > capacity {
+		return fmt.Errorf("%d bytes with %d of %d pinned: %w", size, pinned, capacity, ErrCacheFull)
+	}
+	return nil
+}
+
+// pinnedLocked returns the bytes pinned in both tiers; caller must hold mu
+func (c *Cache) pinnedLocked() int64 {
+	if c.disk == nil {
+		return c.pinnedUsed
+	}
+	return c.pinnedUsed + c.disk.pinnedSize()
+}
+
+// pinLocked adds a pin to a key in RAM; caller must hold mu
+func (c *Cache) pinLocked(key string) {
+	if c.pins[key] == 0 {
+		c.pinnedUsed += int64(len(c.items[key].data))
+	}
+	c.pins[key]++
+}
+
+// Unpin removes one pin from key; it becomes evictable once no pins remain
+func (c *Cache) Unpin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.pins[key] {
+	case 0:
+		return
+	case 1:
+		delete(c.pins, key)
+		if entry, ok := c.items[key]; ok {
+			c.pinnedUsed -= int64(len(entry.data))
+		} else if c.disk != nil {
+			c.disk.unpin(key)
+		}
+	default:
+		c.pins[key]--
+	}
+}
+
+// Pinned reports whether key is pinned
+func (c *Cache) Pinned(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pins[key] > 0
+}
+
+// PinnedKeys returns every pinned key
+func (c *Cache) PinnedKeys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.pins))
+	for k := range c.pins {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// OwnedKeys returns every key held on behalf of a peer, in either tier
+func (c *Cache) OwnedKeys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.charges))
+	for k := range c.charges {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// PinnedSize returns the bytes held by pinned entries in both tiers and their count
+func (c *Cache) PinnedSize() (int64, int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pinnedLocked(), len(c.pins)
+}
+
+// spill writes entries evicted from RAM to the disk tier. Owners stay
+// charged for what lands on disk and stop being charged for what doesn't.
+func (c *Cache) spill(evicted []*cacheEntry) {
+	var dropped []string
+	for _, entry := range evicted {
+		if c.disk == nil {
+			dropped = append(dropped, entry.key)
+			continue
+		}
+		gone, err := c.disk.put(entry.key, entry.data)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+		}
+		dropped = append(dropped, gone...)
+	}
+	if len(dropped) > 0 {
+		c.release(dropped)
+	}
+}
+
+// evict removes an entry chosen by the policy from RAM and returns it; its
+// charge, and its pin, stay for the disk tier; caller must hold mu
+func (c *Cache) evict(key string) *cacheEntry {
+	c.policy.Evict(key)
+	return c.removeLocked(key)
+}
+
+// removeLocked takes an entry out of RAM without telling the policy;
+// caller must hold mu
+func (c *Cache) removeLocked(key string) *cacheEntry {
+	entry := c.items[key]
 	delete(c.items, key)
 	c.used -= int64(len(entry.data))
+	if c.pins[key] > 0 {
+		c.pinnedUsed -= int64(len(entry.data))
+	}
+	return entry
+}
+
+// Delete removes a specific key from cache, pinned or not
+func (c *Cache) Delete(key string) bool {
+	onDisk := c.disk != nil && c.disk.delete(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uncharge(key)
+	if _, ok := c.items[key]; !ok {
+		delete(c.pins, key)
+		return onDisk
+	}
+	c.policy.Remove(key)
+	c.removeLocked(key)
+	delete(c.pins, key)
 	return true
 }
 
 // Keys returns all cached keys
 func (c *Cache) Keys() []string {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-
 	keys := make([]string, 0, len(c.items))
 	for k := range c.items {
 		keys = append(keys, k)
 	}
+	c.mu.RUnlock()
+
+	if c.disk != nil {
+		for _, k := range c.disk.keys() {
+			if !c.inRAM(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
 	return keys
 }
 
+// inRAM reports whether key is in the RAM tier
+func (c *Cache) inRAM(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.items[key]
+	return ok
+}
+
 // Size returns current cache usage in bytes
 func (c *Cache) Size() int64 {
 	c.mu.RLock()
@@ -132,12 +576,70 @@ func (c *Cache) Capacity() int64 {
 	return c.capacity
 }
 
+// DiskUsage returns the disk tier's bytes used, capacity and entry count
+// (all zero without a disk tier)
+func (c *Cache) DiskUsage() (used, capacity int64, entries int) {
+	if c.disk == nil {
+		return 0, 0, 0
+	}
+	used, entries = c.disk.usage()
+	return used, c.disk.capacity, entries
+}
+
+// countMisses records n entries a read had to fetch because no tier held them
+func (c *Cache) countMisses(n int) {
+	c.misses.Add(uint64(n))
+}
+
+// Stats returns the hit, miss and eviction counters with current usage
+func (c *Cache) Stats() CacheStats {
+	s := CacheStats{
+		Hits:      c.hits.Load(),
+		DiskHits:  c.diskHits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Capacity:  c.capacity,
+	}
+	c.mu.RLock()
+	s.Used, s.Entries, s.Pinned = c.used, len(c.items), c.pinnedLocked()
+	c.mu.RUnlock()
+	if c.disk != nil {
+		s.DiskEvictions = c.disk.evictions.Load()
+	}
+	s.DiskUsed, s.DiskCapacity, s.DiskEntries = c.DiskUsage()
+	return s
+}
+
+// Flush writes every RAM entry to the disk tier so a restart starts warm
+func (c *Cache) Flush() {
+	if c.disk == nil {
+		return
+	}
+	c.mu.RLock()
+	entries := make([]*cacheEntry, 0, len(c.items))
+	for _, entry := range c.items {
+		entries = append(entries, entry)
+	}
+	c.mu.RUnlock()
+
+	c.spill(entries)
+}
+
 // Clear empties the cache
 func (c *Cache) Clear() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	c.items = make(map[string]*list.Element)
-	c.order = list.New()
+	for key := range c.items {
+		c.policy.Remove(key)
+	}
+	c.items = make(map[string]*cacheEntry)
+	c.pins = make(map[string]int)
+	c.charges = make(map[string]ownerCharge)
+	c.owned = make(map[string]int64)
 	c.used = 0
+	c.pinnedUsed = 0
+	c.mu.Unlock()
+
+	if c.disk != nil {
+		c.disk.clear()
+	}
 }
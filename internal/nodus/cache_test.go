@@ -0,0 +1,282 @@
+package nodus
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// filled returns n bytes of seed
+func filled(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed
+	}
+	return data
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCache(300)
+	for i, key := range []string{"a", "b", "c"} {
+		if err := c.Put(key, filled(100, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Get("a")
+	if err := c.Put("d", filled(100, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Has("b") {
+		t.Error("least recently used entry survived")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if !c.Has(key) {
+			t.Errorf("%s evicted", key)
+		}
+	}
+	if c.Size() != 300 {
+		t.Errorf("size %d, want 300", c.Size())
+	}
+}
+
+func TestCachePinnedEntriesStay(t *testing.T) {
+	c := NewCache(200)
+	c.Put("a", filled(100, 1))
+	c.Put("b", filled(100, 2))
+	if err := c.Pin("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pin("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("c", filled(100, 3)); !errors.Is(err, ErrCacheFull) {
+		t.Fatalf("put beside full pins: %v, want ErrCacheFull", err)
+	}
+
+	// Pins are counted
+	c.Pin("a")
+	c.Unpin("a")
+	c.Unpin("b")
+	if err := c.Put("c", filled(100, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Has("a") || c.Has("b") {
+		t.Error("eviction ignored the remaining pin")
+	}
+	if err := c.checkPinRoom(101); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("pin room: %v, want ErrCacheFull", err)
+	}
+}
+
+func TestCachePinsBeyondRAM(t *testing.T) {
+	c, err := NewTieredCache(200, t.TempDir(), 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Twice the RAM tier, all pinned
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := c.Put(key, filled(100, byte(i))); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		if err := c.Pin(key); err != nil {
+			t.Fatalf("pin %s: %v", key, err)
+		}
+	}
+	if c.Count() != 2 {
+		t.Fatalf("%d entries in RAM, want 2", c.Count())
+	}
+	if pinned, count := c.PinnedSize(); pinned != 400 || count != 4 {
+		t.Fatalf("%d bytes in %d pins, want 400 in 4", pinned, count)
+	}
+
+	// Unpinned entries make way for pinned ones on disk too
+	c.Put("u0", filled(100, 8))
+	c.Put("u1", filled(100, 9))
+	c.Put("u2", filled(100, 10))
+	for i := 0; i < 4; i++ {
+		if data := c.Get(fmt.Sprintf("k%d", i)); len(data) != 100 || data[0] != byte(i) {
+			t.Fatalf("pinned k%d lost", i)
+		}
+	}
+	if err := c.checkPinRoom(200); err != nil {
+		t.Errorf("pin room beside RAM and disk: %v", err)
+	}
+	if err := c.checkPinRoom(201); !errors.Is(err, ErrCacheFull) {
+		t.Errorf("pin room past both tiers: %v, want ErrCacheFull", err)
+	}
+
+	// Unpinned, a disk entry can be evicted again
+	for i := 0; i < 4; i++ {
+		c.Unpin(fmt.Sprintf("k%d", i))
+	}
+	if pinned, _ := c.PinnedSize(); pinned != 0 {
+		t.Fatalf("%d bytes still pinned", pinned)
+	}
+	for i := 0; i < 6; i++ {
+		c.Put(fmt.Sprintf("v%d", i), filled(100, byte(20+i)))
+	}
+	if c.Has("k0") {
+		t.Error("unpinned entry never evicted")
+	}
+}
+
+func TestCacheItemLimits(t *testing.T) {
+	c := NewCache(100)
+	var tooLarge *ItemTooLargeError
+	if err := c.Put("big", filled(101, 1)); !errors.As(err, &tooLarge) || tooLarge.Limit != 100 {
+		t.Fatalf("oversized put: %v", err)
+	}
+	c.SetMaxItemSize(10)
+	if err := c.Put("mid", filled(11, 1)); !errors.As(err, &tooLarge) || tooLarge.Limit != 10 {
+		t.Fatalf("put over the item limit: %v", err)
+	}
+	if c.Count() != 0 {
+		t.Errorf("%d entries after refused puts", c.Count())
+	}
+}
+
+func TestCacheQuotaCountsBothTiers(t *testing.T) {
+	c, err := NewTieredCache(200, t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetQuota(300)
+
+	for i := 0; i < 3; i++ {
+		if err := c.PutOwned(fmt.Sprintf("p%d", i), filled(100, byte(i)), "peer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One entry has spilled to disk and is still charged
+	if c.Count() != 2 {
+		t.Fatalf("%d entries in RAM, want 2", c.Count())
+	}
+	if used, _ := c.OwnerUsage("peer"); used != 300 {
+		t.Fatalf("owner charged %d, want 300", used)
+	}
+	if err := c.PutOwned("p3", filled(100, 3), "peer"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("put over quota: %v, want ErrQuotaExceeded", err)
+	}
+
+	// Promotion from disk keeps the owner; replacing an entry recharges it
+	if c.Get("p0") == nil {
+		t.Fatal("spilled entry lost")
+	}
+	if err := c.PutOwned("p1", filled(50, 9), "peer"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := c.OwnerUsage("peer"); used != 250 {
+		t.Fatalf("owner charged %d after promote and replace, want 250", used)
+	}
+
+	// Our own entries stay ours
+	c.Put("mine", filled(100, 7))
+	if err := c.PutOwned("mine", filled(100, 7), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := c.OwnerUsage("other"); used != 0 {
+		t.Errorf("our entry charged %d to a peer", used)
+	}
+
+	c.Delete("p0")
+	c.Delete("p1")
+	c.Delete("p2")
+	if used, _ := c.OwnerUsage("peer"); used != 0 {
+		t.Errorf("owner charged %d after deleting everything", used)
+	}
+}
+
+func TestCacheChargeEndsWhenDropped(t *testing.T) {
+	// Without a disk tier, eviction ends the charge
+	c := NewCache(100)
+	c.PutOwned("p", filled(100, 1), "peer")
+	c.Put("q", filled(100, 2))
+	if used, _ := c.OwnerUsage("peer"); used != 0 {
+		t.Errorf("evicted entry still charged %d", used)
+	}
+
+	// An entry falling off the disk tier ends the charge too
+	tiered, err := NewTieredCache(100, t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered.PutOwned("p", filled(100, 1), "peer")
+	tiered.Put("q", filled(100, 2)) // p spills
+	tiered.Put("r", filled(100, 3)) // q spills, p leaves the disk
+	if tiered.Has("p") {
+		t.Fatal("entry outlived both tiers")
+	}
+	if used, _ := tiered.OwnerUsage("peer"); used != 0 {
+		t.Errorf("dropped entry still charged %d", used)
+	}
+}
+
+func TestCacheDiskTierSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewTieredCache(100, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("a", filled(60, 1))
+	c.Put("b", filled(60, 2))
+	c.Flush()
+
+	reopened, err := NewTieredCache(100, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if data := reopened.Get(key); len(data) != 60 {
+			t.Errorf("%s: %d bytes after reopen", key, len(data))
+		}
+	}
+	if s := reopened.Stats(); s.DiskHits != 2 {
+		t.Errorf("%d disk hits, want 2", s.DiskHits)
+	}
+}
+
+func TestCacheDiskTierRebuiltAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	// What a crash leaves behind: complete entries written at different
+	// times, a write that never got renamed, and more than fits
+	base := time.Now().Add(-time.Hour)
+	for i, key := range []string{"old", "mid", "new"} {
+		path := filepath.Join(dir, url.PathEscape(key))
+		if err := os.WriteFile(path, filled(40, byte(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime := base.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, modTime, modTime)
+	}
+	torn := filepath.Join(dir, ".torn.tmp123")
+	if err := os.WriteFile(torn, filled(10, 9), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewTieredCache(100, dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(torn); !os.IsNotExist(err) {
+		t.Error("interrupted write not cleaned up")
+	}
+	if s := c.Stats(); s.DiskUsed != 80 {
+		t.Errorf("disk tier holds %d bytes, want 80", s.DiskUsed)
+	}
+	if c.Get("old") != nil {
+		t.Error("oldest entry kept beyond capacity")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Error("trimmed entry's file left on disk")
+	}
+	for i, key := range []string{"mid", "new"} {
+		if data := c.Get(key); len(data) != 40 || data[0] != byte(i+1) {
+			t.Errorf("%s not rebuilt from disk", key)
+		}
+	}
+}
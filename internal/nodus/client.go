@@ -0,0 +1,272 @@
+// Package nodus - Client for the daemon's control API
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrDaemonNotRunning is returned when nothing listens on the control socket
+var ErrDaemonNotRunning = errors.New("nodus daemon not running")
+
+// ControlClient talks to a running daemon over its control socket
+type ControlClient struct {
+	socket string
+	http   *http.Client
+}
+
+// NewControlClient creates a client for the daemon listening on socket
+func NewControlClient(socket string) *ControlClient {
+	return &ControlClient{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+			// Sync can take as long as replication does
+			Timeout: 3 * time.Minute,
+		},
+	}
+}
+
+// call performs one request; body is sent as JSON when non-nil
+func (c *ControlClient) call(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://nodus"+path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return ErrDaemonNotRunning
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return replyError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid reply from daemon: %w", err)
+	}
+	return nil
+}
+
+// Status returns the daemon's overall state
+func (c *ControlClient) Status() (*StatusInfo, error) {
+	var s StatusInfo
+	return &s, c.call(http.MethodGet, "/v1/status", nil, &s)
+}
+
+// Peers returns the connected peers
+func (c *ControlClient) Peers() ([]PeerInfo, error) {
+	var peers []PeerInfo
+	return peers, c.call(http.MethodGet, "/v1/peers", nil, &peers)
+}
+
+// Discovered returns the peers found by discovery or connected manually
+func (c *ControlClient) Discovered() ([]PeerInfo, error) {
+	var peers []PeerInfo
+	return peers, c.call(http.MethodGet, "/v1/discovered", nil, &peers)
+}
+
+// Connect dials a peer by multiaddr
+func (c *ControlClient) Connect(addr string) (*PeerInfo, error) {
+	var info PeerInfo
+	return &info, c.call(http.MethodPost, "/v1/connect", controlRequest{Addr: addr}, &info)
+}
+
+// ReloadTrust makes the daemon re-read the allowlist after the CLI edited it
+func (c *ControlClient) ReloadTrust() error {
+	return c.call(http.MethodPost, "/v1/trust/reload", controlRequest{}, nil)
+}
+
+// Files lists the files the node knows about
+func (c *ControlClient) Files() ([]FileInfo, error) {
+	var files []FileInfo
+	return files, c.call(http.MethodGet, "/v1/files", nil, &files)
+}
+
+// Sync replays changes journalled offline and pushes local files to their
+// replica holders
+func (c *ControlClient) Sync() (*SyncResult, error) {
+	var result SyncResult
+	return &result, c.call(http.MethodPost, "/v1/sync", controlRequest{}, &result)
+}
+
+// Cache returns block cache usage
+func (c *ControlClient) Cache() (*CacheInfo, error) {
+	var info CacheInfo
+	return &info, c.call(http.MethodGet, "/v1/cache", nil, &info)
+}
+
+// Mount mounts a volume ("" for the default) at path and returns where it
+// was mounted. The default volume may leave path empty for the configured
+// mount point.
+func (c *ControlClient) Mount(volume, path string) (string, error) {
+	var reply controlRequest
+	err := c.call(http.MethodPost, "/v1/mount", controlRequest{Path: path, Volume: volume}, &reply)
+	return reply.Path, err
+}
+
+// Unmount unmounts whatever volume is mounted at path
+func (c *ControlClient) Unmount(path string) error {
+	return c.call(http.MethodPost, "/v1/unmount", controlRequest{Path: path}, nil)
+}
+
+// Replicas describes where each block of a file lives
+func (c *ControlClient) Replicas(name string) ([]BlockReplicas, error) {
+	var report []BlockReplicas
+	return report, c.call(http.MethodGet, "/v1/replicas?file="+url.QueryEscape(name), nil, &report)
+}
+
+// Pins lists pinned files
+func (c *ControlClient) Pins() ([]PinInfo, error) {
+	var pins []PinInfo
+	return pins, c.call(http.MethodGet, "/v1/pins", nil, &pins)
+}
+
+// Pin fetches a file and keeps it cached across restarts
+func (c *ControlClient) Pin(name string) error {
+	return c.call(http.MethodPost, "/v1/pin", controlRequest{Name: name}, nil)
+}
+
+// Unpin releases a pinned file
+func (c *ControlClient) Unpin(name string) error {
+	return c.call(http.MethodPost, "/v1/unpin", controlRequest{Name: name}, nil)
+}
+
+// History lists the remembered versions of a file, newest first
+func (c *ControlClient) History(name string) ([]VersionInfo, error) {
+	var history []VersionInfo
+	return history, c.call(http.MethodGet, "/v1/history?file="+url.QueryEscape(name), nil, &history)
+}
+
+// Restore makes an earlier version of a file current again
+func (c *ControlClient) Restore(name, version string) (*VersionInfo, error) {
+	var info VersionInfo
+	return &info, c.call(http.MethodPost, "/v1/restore", controlRequest{Name: name, Version: version}, &info)
+}
+
+// Devices lists the device images exported over NBD
+func (c *ControlClient) Devices() ([]DeviceInfo, error) {
+	var devices []DeviceInfo
+	return devices, c.call(http.MethodGet, "/v1/devices", nil, &devices)
+}
+
+// CreateDevice creates a zeroed device image of at least size bytes
+func (c *ControlClient) CreateDevice(name string, size uint64) (*DeviceInfo, error) {
+	var info DeviceInfo
+	return &info, c.call(http.MethodPost, "/v1/device", controlRequest{Name: name, Size: size}, &info)
+}
+
+// Trash lists deleted files that can still be restored
+func (c *ControlClient) Trash() ([]TrashEntry, error) {
+	var trash []TrashEntry
+	return trash, c.call(http.MethodGet, "/v1/trash", nil, &trash)
+}
+
+// RestoreTrash brings a deleted file back from the trash
+func (c *ControlClient) RestoreTrash(name string) (*VersionInfo, error) {
+	var info VersionInfo
+	return &info, c.call(http.MethodPost, "/v1/untrash", controlRequest{Name: name}, &info)
+}
+
+// Volumes lists the named volumes
+func (c *ControlClient) Volumes() ([]VolumeInfo, error) {
+	var volumes []VolumeInfo
+	return volumes, c.call(http.MethodGet, "/v1/volumes", nil, &volumes)
+}
+
+// CreateVolume creates a named volume
+func (c *ControlClient) CreateVolume(name string, spec VolumeSpec) (*VolumeInfo, error) {
+	var info VolumeInfo
+	return &info, c.call(http.MethodPost, "/v1/volume", controlRequest{Name: name, Spec: &spec}, &info)
+}
+
+// DeleteVolume unmounts and deletes a named volume and everything in it
+func (c *ControlClient) DeleteVolume(name string) error {
+	return c.call(http.MethodPost, "/v1/volume/delete", controlRequest{Name: name}, nil)
+}
+
+// BootBundles lists the newest boot bundle of each channel
+func (c *ControlClient) BootBundles() ([]BootBundle, error) {
+	var bundles []BootBundle
+	return bundles, c.call(http.MethodGet, "/v1/boot", nil, &bundles)
+}
+
+// PublishBoot signs and publishes a boot bundle on a channel
+func (c *ControlClient) PublishBoot(channel string, src BootSources) (*BootBundle, error) {
+	var b BootBundle
+	return &b, c.call(http.MethodPost, "/v1/boot/publish", controlRequest{Name: channel, Boot: &src}, &b)
+}
+
+// FetchBoot writes a channel's verified boot images to dir. The daemon
+// streams them; they are written here, with the caller's permissions.
+func (c *ControlClient) FetchBoot(channel, dir string) (*BootBundle, error) {
+	var b BootBundle
+	if err := c.call(http.MethodPost, "/v1/boot/fetch", controlRequest{Name: channel}, &b); err != nil {
+		return nil, err
+	}
+	err := WriteBoot(dir, &b, func(file string, w io.Writer) error {
+		q := url.Values{"channel": {b.Channel}, "serial": {strconv.FormatUint(b.Serial, 10)}, "file": {file}}
+		return c.download("/v1/boot/image?"+q.Encode(), w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// download copies the body of a GET request to w
+func (c *ControlClient) download(path string, w io.Writer) error {
+	resp, err := c.http.Get("http://nodus" + path)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return ErrDaemonNotRunning
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return replyError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// replyError returns the error a failed request reported
+func replyError(resp *http.Response) error {
+	var e controlError
+	if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+		e.Error = resp.Status
+	}
+	return errors.New(e.Error)
+}
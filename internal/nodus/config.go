@@ -0,0 +1,56 @@
+// Package nodus - Node configuration
+package nodus
+
+import "time"
+
+// Config holds the settings used to start a Node
+type Config struct {
+	StateDir    string   // Persistent node state (identity key, records)
+	ListenAddrs []string // libp2p listen multiaddrs
+	CacheSize   int64    // RAM cache capacity in bytes
+	CachePolicy string   // RAM eviction policy: lru, lfu or 2q
+	PeerQuota   int64    // RAM cache bytes each peer's replicas may take (0 for unlimited)
+	OpenNetwork bool     // Accept unknown peers at TrustNetwork instead of probation
+
+	DiskCacheDir  string // Persistent cache tier ("" for StateDir/cache)
+	DiskCacheSize int64  // Disk tier capacity in bytes (0 for RAM only)
+
+	ControlSocket string // Unix socket the daemon serves its control API on
+	MountPoint    string // Where the daemon mounts the volume ("" to skip)
+	MetricsAddr   string // Local address for Prometheus metrics ("" to disable)
+	NBDListen     string // Unix socket path or host:port serving device images over NBD ("" to disable)
+	GatewayAddr   string // host:port of the read-only HTTP gateway ("" to disable)
+
+	ReplicationFactor int  // Copies of each block to keep, including our own
+	DHTServer         bool // Serve DHT records even without public reachability (LAN clusters)
+
+	WriteBackDelay time.Duration // How long FUSE writes stay buffered before they're stored (0 until close)
+	SyncTimeout    time.Duration // How long fsync waits for the replication factor to be met
+	TrashRetention time.Duration // How long deleted files can be restored from the trash
+
+	BootKeys []string // Peer IDs whose boot bundles are accepted besides trusted peers
+}
+
+// DefaultConfig returns a sensible default configuration
+func DefaultConfig() Config {
+	return Config{
+		StateDir: "/var/lib/nodus",
+		ListenAddrs: []string{
+			"/ip4/0.0.0.0/tcp/4001",
+			"/ip4/0.0.0.0/udp/4001/quic-v1",
+		},
+		CacheSize:         256 * 1024 * 1024, // 256MB
+		CachePolicy:       "lru",
+		PeerQuota:         64 * 1024 * 1024, // 64MB
+		DiskCacheSize:     4 << 30,          // 4GB
+		ControlSocket:     "/run/nodus.sock",
+		MountPoint:        "/mnt/nodus",
+		MetricsAddr:       "127.0.0.1:9465",
+		NBDListen:         "/run/nodus-nbd.sock",
+		ReplicationFactor: 3,
+		DHTServer:         true,
+		WriteBackDelay:    5 * time.Second,
+		SyncTimeout:       time.Minute,
+		TrashRetention:    7 * 24 * time.Hour,
+	}
+}
@@ -0,0 +1,569 @@
+// Package nodus - Control API served by the daemon over its unix socket
+package nodus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// StatusInfo is the daemon's overall state
+type StatusInfo struct {
+	ID                string      `json:"id"`
+	Addrs             []string    `json:"addrs"`
+	Peers             int         `json:"peers"`
+	Files             int         `json:"files"`
+	MountPoint        string      `json:"mount_point,omitempty"` // empty when the default volume isn't mounted
+	Mounts            []MountInfo `json:"mounts,omitempty"`
+	Encrypted         bool        `json:"encrypted"`
+	ReplicationFactor int         `json:"replication_factor"`
+	Uptime            string      `json:"uptime"`
+	Cache             CacheInfo   `json:"cache"`
+	Traffic           TrafficInfo `json:"traffic"`
+	Scores            []PeerScore `json:"scores"`
+	MetricsAddr       string      `json:"metrics_addr,omitempty"` // empty when metrics are disabled
+	NBDListen         string      `json:"nbd_listen,omitempty"`   // empty when NBD is disabled
+	GatewayAddr       string      `json:"gateway_addr,omitempty"` // empty when the gateway is disabled
+}
+
+// CacheInfo describes the block cache
+type CacheInfo struct {
+	CacheStats
+	Policy string `json:"policy"`
+}
+
+// PeerInfo describes a connected or discovered peer
+type PeerInfo struct {
+	ID        peer.ID    `json:"id"`
+	Level     TrustLevel `json:"level"`
+	Addrs     []string   `json:"addrs"`
+	Connected bool       `json:"connected"`
+}
+
+// FileInfo describes a file known to the node
+type FileInfo struct {
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	Blocks    int    `json:"blocks"`
+	Missing   int    `json:"missing"` // blocks not held locally
+	Encrypted bool   `json:"encrypted"`
+	Kind      string `json:"kind,omitempty"` // "" for files, dir or symlink
+	Mode      string `json:"mode"`
+	Mtime     int64  `json:"mtime,omitempty"` // Unix nanoseconds
+}
+
+// SyncResult summarises a sync pass
+type SyncResult struct {
+	Files   int          `json:"files"`
+	Peers   int          `json:"peers"` // peers asked to hold new replicas
+	Errors  []string     `json:"errors,omitempty"`
+	Journal JournalStats `json:"journal"`
+	Ops     []OpInfo     `json:"ops,omitempty"` // journalled operations still pending or failed
+}
+
+// controlRequest is the body of POST requests
+type controlRequest struct {
+	Addr string `json:"addr,omitempty"`
+	Path string `json:"path,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	Version string `json:"version,omitempty"`
+	Size    uint64 `json:"size,omitempty"`
+
+	Volume string       `json:"volume,omitempty"`
+	Spec   *VolumeSpec  `json:"spec,omitempty"`
+	Boot   *BootSources `json:"boot,omitempty"`
+}
+
+// controlError is the body of failed requests
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// controlHandler routes the control API
+func (d *Daemon) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", d.handleStatus)
+	mux.HandleFunc("/v1/peers", d.handlePeers)
+	mux.HandleFunc("/v1/discovered", d.handleDiscovered)
+	mux.HandleFunc("/v1/connect", d.handleConnect)
+	mux.HandleFunc("/v1/trust/reload", d.handleReloadTrust)
+	mux.HandleFunc("/v1/files", d.handleFiles)
+	mux.HandleFunc("/v1/sync", d.handleSync)
+	mux.HandleFunc("/v1/cache", d.handleCache)
+	mux.HandleFunc("/v1/mount", d.handleMount)
+	mux.HandleFunc("/v1/unmount", d.handleUnmount)
+	mux.HandleFunc("/v1/replicas", d.handleReplicas)
+	mux.HandleFunc("/v1/pins", d.handlePins)
+	mux.HandleFunc("/v1/pin", d.handlePin)
+	mux.HandleFunc("/v1/unpin", d.handleUnpin)
+	mux.HandleFunc("/v1/history", d.handleHistory)
+	mux.HandleFunc("/v1/restore", d.handleRestore)
+	mux.HandleFunc("/v1/devices", d.handleDevices)
+	mux.HandleFunc("/v1/device", d.handleCreateDevice)
+	mux.HandleFunc("/v1/trash", d.handleTrash)
+	mux.HandleFunc("/v1/untrash", d.handleUntrash)
+	mux.HandleFunc("/v1/volumes", d.handleVolumes)
+	mux.HandleFunc("/v1/volume", d.handleCreateVolume)
+	mux.HandleFunc("/v1/volume/delete", d.handleDeleteVolume)
+	mux.HandleFunc("/v1/boot", d.handleBoot)
+	mux.HandleFunc("/v1/boot/publish", d.handlePublishBoot)
+	mux.HandleFunc("/v1/boot/fetch", d.handleFetchBoot)
+	mux.HandleFunc("/v1/boot/image", d.handleBootImage)
+	return mux
+}
+
+// writeJSON sends v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, controlError{Error: err.Error()})
+}
+
+// readRequest decodes a POST body, rejecting other methods
+func readRequest(w http.ResponseWriter, r *http.Request) (controlRequest, bool) {
+	var req controlRequest
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s requires POST", r.URL.Path))
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return req, false
+	}
+	return req, true
+}
+
+func (d *Daemon) cacheInfo() CacheInfo {
+	return CacheInfo{CacheStats: d.node.GetCache().Stats(), Policy: d.cfg.CachePolicy}
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var addrs []string
+	for _, addr := range d.node.Addrs() {
+		addrs = append(addrs, fmt.Sprintf("%s/p2p/%s", addr, d.node.ID()))
+	}
+	writeJSON(w, http.StatusOK, StatusInfo{
+		ID:                d.node.ID(),
+		Addrs:             addrs,
+		Peers:             len(d.node.ConnectedPeers()),
+		Files:             len(d.node.Store().Files()),
+		MountPoint:        d.mountPoint(),
+		Mounts:            d.Mounts(),
+		Encrypted:         d.node.Store().masterKey() != nil,
+		ReplicationFactor: d.cfg.ReplicationFactor,
+		Uptime:            time.Since(d.started).Round(time.Second).String(),
+		Cache:             d.cacheInfo(),
+		Traffic:           d.node.Traffic(),
+		Scores:            d.node.PeerScores(),
+		MetricsAddr:       d.cfg.MetricsAddr,
+		NBDListen:         d.nbdListen(),
+		GatewayAddr:       d.gatewayAddr(),
+	})
+}
+
+// peerInfo describes one peer as the node sees it
+func (d *Daemon) peerInfo(id peer.ID) PeerInfo {
+	info := PeerInfo{
+		ID:        id,
+		Level:     d.node.TrustLevel(id),
+		Connected: len(d.node.host.Network().ConnsToPeer(id)) > 0,
+	}
+	for _, addr := range d.node.host.Peerstore().Addrs(id) {
+		info.Addrs = append(info.Addrs, addr.String())
+	}
+	return info
+}
+
+func (d *Daemon) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := []PeerInfo{}
+	for _, id := range d.node.ConnectedPeers() {
+		peers = append(peers, d.peerInfo(id))
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (d *Daemon) handleDiscovered(w http.ResponseWriter, r *http.Request) {
+	peers := []PeerInfo{}
+	for _, info := range d.node.KnownPeers() {
+		peers = append(peers, d.peerInfo(info.ID))
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (d *Daemon) handleConnect(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	if err := d.node.ConnectToPeer(ctx, req.Addr); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	info, _ := peer.AddrInfoFromString(req.Addr)
+	writeJSON(w, http.StatusOK, d.peerInfo(info.ID))
+}
+
+func (d *Daemon) handleReloadTrust(w http.ResponseWriter, r *http.Request) {
+	if _, ok := readRequest(w, r); !ok {
+		return
+	}
+	if err := d.node.Trust().Reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, controlRequest{})
+}
+
+func (d *Daemon) handleFiles(w http.ResponseWriter, r *http.Request) {
+	files := []FileInfo{}
+	store := d.node.Store()
+	for _, name := range store.Files() {
+		m := store.Manifest(name)
+		if m == nil {
+			continue
+		}
+		files = append(files, FileInfo{
+			Name:      name,
+			Size:      m.Size,
+			Blocks:    len(m.Blocks),
+			Missing:   len(store.MissingBlocks(m)),
+			Encrypted: m.Encrypted(),
+			Kind:      m.Kind,
+			Mode:      m.FileMode().String(),
+			Mtime:     m.Mtime,
+		})
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handleSync pushes every complete local file to its replica holders
+func (d *Daemon) handleSync(w http.ResponseWriter, r *http.Request) {
+	if _, ok := readRequest(w, r); !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	// Offline changes first, so the files replicated below are current on peers
+	d.node.ReplayJournal(ctx)
+
+	var result SyncResult
+	store := d.node.Store()
+	for _, name := range store.Files() {
+		m := store.Manifest(name)
+		if m == nil || m.Kind != "" || len(store.MissingBlocks(m)) > 0 {
+			continue
+		}
+		result.Files++
+		asked, err := d.node.replicate(ctx, m)
+		result.Peers += asked
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	result.Journal, result.Ops = d.node.JournalStats()
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (d *Daemon) handleCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.cacheInfo())
+}
+
+func (d *Daemon) handleMount(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Path == "" {
+		if req.Volume != "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("volume '%s' needs a mount point", req.Volume))
+			return
+		}
+		req.Path = d.cfg.MountPoint
+	}
+	err := d.Mount(req.Volume, req.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, controlRequest{Path: req.Path, Volume: req.Volume})
+	}
+}
+
+func (d *Daemon) handleUnmount(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := d.Unmount(req.Path); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, controlRequest{Path: req.Path})
+}
+
+func (d *Daemon) handleReplicas(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("file")
+	report, ok := d.node.ReplicaReport(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("'%s' is not replicated by this node", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (d *Daemon) handlePins(w http.ResponseWriter, r *http.Request) {
+	pins := d.node.Pins()
+	if pins == nil {
+		pins = []PinInfo{}
+	}
+	writeJSON(w, http.StatusOK, pins)
+}
+
+func (d *Daemon) handlePin(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	if err := d.node.Pin(ctx, req.Name); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, controlRequest{Name: req.Name})
+}
+
+func (d *Daemon) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	removed, err := d.node.Unpin(req.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, fmt.Errorf("'%s' is not pinned", req.Name))
+		return
+	}
+	writeJSON(w, http.StatusOK, controlRequest{Name: req.Name})
+}
+
+func (d *Daemon) handleHistory(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("file")
+	history := d.node.History(name)
+	if len(history) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no versions of '%s' known", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (d *Daemon) handleRestore(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	m, err := d.node.Restore(ctx, req.Name, req.Version)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, os.ErrInvalid):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, versionInfo(m, true))
+	}
+}
+
+func (d *Daemon) handleDevices(w http.ResponseWriter, r *http.Request) {
+	devices := d.node.Devices()
+	if devices == nil {
+		devices = []DeviceInfo{}
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (d *Daemon) handleCreateDevice(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	m, err := d.node.CreateDevice(req.Name, req.Size)
+	switch {
+	case errors.Is(err, os.ErrInvalid), errors.Is(err, os.ErrExist):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, DeviceInfo{Name: req.Name, Size: m.Size})
+	}
+}
+
+func (d *Daemon) handleTrash(w http.ResponseWriter, r *http.Request) {
+	trash := d.node.Trash()
+	if trash == nil {
+		trash = []TrashEntry{}
+	}
+	writeJSON(w, http.StatusOK, trash)
+}
+
+func (d *Daemon) handleUntrash(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	m, err := d.node.RestoreTrash(ctx, req.Name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, os.ErrExist):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, versionInfo(m, true))
+	}
+}
+
+func (d *Daemon) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes := d.node.Volumes()
+	if volumes == nil {
+		volumes = []VolumeInfo{}
+	}
+	writeJSON(w, http.StatusOK, volumes)
+}
+
+func (d *Daemon) handleCreateVolume(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	var spec VolumeSpec
+	if req.Spec != nil {
+		spec = *req.Spec
+	}
+	info, err := d.node.CreateVolume(req.Name, spec)
+	switch {
+	case errors.Is(err, os.ErrInvalid), errors.Is(err, os.ErrExist), errors.Is(err, ErrNoMasterKey):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func (d *Daemon) handleDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	err := d.DeleteVolume(req.Name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, os.ErrInvalid):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, controlRequest{Name: req.Name})
+	}
+}
+
+func (d *Daemon) handleBoot(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.node.BootBundles())
+}
+
+func (d *Daemon) handlePublishBoot(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Boot == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no boot images given"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	b, err := d.node.PublishBoot(ctx, req.Name, *req.Boot)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, os.ErrInvalid), errors.Is(err, ErrIsDir):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+func (d *Daemon) handleFetchBoot(w http.ResponseWriter, r *http.Request) {
+	req, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	b, err := d.node.LatestBoot(ctx, req.Name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+// handleBootImage streams one image of a channel's bundle. The client
+// checks it against the bundle's digest and writes it itself; the daemon
+// never writes outside its state directory on a client's behalf.
+func (d *Daemon) handleBootImage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	serial, err := strconv.ParseUint(q.Get("serial"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid serial %q", q.Get("serial")))
+		return
+	}
+	channel, file := q.Get("channel"), q.Get("file")
+	image, err := d.node.channelImage(channel, serial, file)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	// A short body fails the client's read rather than its digest check
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(image.Manifest.Size, 10))
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	if _, err := d.node.copyImage(ctx, image.Manifest, w); err != nil {
+		fmt.Printf("⚠️  Boot image %s of '%s': %v\n", file, channel, err)
+	}
+}
@@ -0,0 +1,103 @@
+package nodus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlStatusAndFiles(t *testing.T) {
+	n := newTestNode(t)
+	_, client := testControl(t, n)
+
+	if _, err := n.WriteFile("docs/a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.ID != n.ID() || status.Files != 1 || status.Peers != 0 {
+		t.Errorf("status %+v", status)
+	}
+	if len(status.Addrs) == 0 || !strings.HasSuffix(status.Addrs[0], "/p2p/"+n.ID()) {
+		t.Errorf("addrs %v, want the listen addresses with /p2p/%s", status.Addrs, n.ID())
+	}
+
+	files, err := client.Files()
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "docs/a.txt" || files[0].Size != 5 || files[0].Missing != 0 {
+		t.Errorf("files %+v", files)
+	}
+
+	info, err := client.Cache()
+	if err != nil {
+		t.Fatalf("Cache: %v", err)
+	}
+	if info.Entries == 0 || info.Capacity == 0 {
+		t.Errorf("cache %+v", info)
+	}
+}
+
+func TestControlConnectAndPeers(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	if err := a.Trust().Add(b.host.ID(), TrustNetwork, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Trust().Add(a.host.ID(), TrustNetwork, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, client := testControl(t, a)
+
+	info, err := client.Connect(fmt.Sprintf("%s/p2p/%s", b.Addrs()[0], b.ID()))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if info.ID != b.host.ID() || !info.Connected || info.Level != TrustNetwork {
+		t.Errorf("connected peer %+v", info)
+	}
+
+	peers, err := client.Peers()
+	if err != nil {
+		t.Fatalf("Peers: %v", err)
+	}
+	if len(peers) != 1 || peers[0].ID != b.host.ID() {
+		t.Errorf("peers %+v", peers)
+	}
+
+	if _, err := client.Connect("not-a-multiaddr"); err == nil {
+		t.Error("Connect to a bad address succeeded")
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	n := newTestNode(t)
+	d, client := testControl(t, n)
+
+	if _, err := client.History("missing.txt"); err == nil || !strings.Contains(err.Error(), "missing.txt") {
+		t.Errorf("History of a missing file: %v", err)
+	}
+	if _, err := client.Replicas("missing.txt"); err == nil {
+		t.Error("Replicas of a missing file succeeded")
+	}
+
+	h := d.controlHandler()
+	for _, path := range []string{"/v1/sync", "/v1/connect", "/v1/pin"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: %d, want %d", path, rec.Code, http.StatusMethodNotAllowed)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/connect", strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid request") {
+		t.Errorf("malformed body: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,301 @@
+// Package nodus - End-to-end block encryption and master key wrapping
+package nodus
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	keyringFile   = "keyring.json"
+	deviceKeyFile = "device.key"
+
+	// MasterKeySize is the length of a volume master key
+	MasterKeySize = 32
+
+	// BlockOverhead is the extra bytes an encrypted block carries (nonce + tag)
+	BlockOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+	// fileSaltSize is the length of the per-file key salt stored in manifests
+	fileSaltSize = 16
+)
+
+// ErrNoMasterKey is returned when encrypted content is read without a key
+var ErrNoMasterKey = errors.New("no master key for encrypted file")
+
+// MasterKey is the user secret all per-file keys are derived from
+type MasterKey [MasterKeySize]byte
+
+// NewMasterKey generates a random master key
+func NewMasterKey() (*MasterKey, error) {
+	var k MasterKey
+	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// fileKey derives the key for one file from its salt
+func (k *MasterKey) fileKey(salt []byte) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	r := hkdf.New(sha256.New, k[:], salt, []byte("spirit-nodus/file-key/1"))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// volumeKey derives the key a named volume's file keys are derived from
+func (k *MasterKey) volumeKey(volume string) (*MasterKey, error) {
+	var key MasterKey
+	r := hkdf.New(sha256.New, k[:], nil, []byte("spirit-nodus/volume-key/1:"+volume))
+	if _, err := io.ReadFull(r, key[:]); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// newFileSalt returns a fresh per-file salt
+func newFileSalt() ([]byte, error) {
+	salt := make([]byte, fileSaltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	return salt, err
+}
+
+// sealBlock encrypts a block as nonce | ciphertext | tag. The nonce is derived
+// from the plaintext, so an unchanged block seals to the same bytes and keeps
+// its content address.
+func sealBlock(fileKey, plain []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, fileKey)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := make([]byte, 0, len(nonce)+len(plain)+aead.Overhead())
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plain, nil), nil
+}
+
+// openBlock decrypts and authenticates a sealed block
+func openBlock(fileKey, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("sealed block too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("block authentication failed: %w", err)
+	}
+	return plain, nil
+}
+
+// KeyWrap is the master key sealed to one device's X25519 key
+type KeyWrap struct {
+	Device    string `json:"device"`    // hex X25519 public key of the device
+	Ephemeral string `json:"ephemeral"` // hex X25519 public key used for this wrap
+	Sealed    []byte `json:"sealed"`
+	Name      string `json:"name,omitempty"`
+}
+
+// Keyring holds one wrap of the master key per device sharing the volume.
+// It contains no secrets and can be copied between devices freely.
+type Keyring struct {
+	Wraps []KeyWrap `json:"wraps"`
+}
+
+// wrapKey derives the key-encryption key from an X25519 shared secret
+func wrapKey(shared []byte, device, ephemeral string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	r := hkdf.New(sha256.New, shared, []byte(device+ephemeral), []byte("spirit-nodus/key-wrap/1"))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Grant wraps the master key for another device's public key
+func (kr *Keyring) Grant(master *MasterKey, devicePub *ecdh.PublicKey, name string) error {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(devicePub)
+	if err != nil {
+		return err
+	}
+
+	device := hex.EncodeToString(devicePub.Bytes())
+	eph := hex.EncodeToString(ephemeral.PublicKey().Bytes())
+	kek, err := wrapKey(shared, device, eph)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealBlock(kek, master[:])
+	if err != nil {
+		return err
+	}
+
+	// Replace any previous wrap for the same device
+	wraps := kr.Wraps[:0]
+	for _, w := range kr.Wraps {
+		if w.Device != device {
+			wraps = append(wraps, w)
+		}
+	}
+	kr.Wraps = append(wraps, KeyWrap{Device: device, Ephemeral: eph, Sealed: sealed, Name: name})
+	return nil
+}
+
+// Unwrap recovers the master key with this device's private key
+func (kr *Keyring) Unwrap(device *ecdh.PrivateKey) (*MasterKey, error) {
+	self := hex.EncodeToString(device.PublicKey().Bytes())
+	for _, w := range kr.Wraps {
+		if w.Device != self {
+			continue
+		}
+		ephBytes, err := hex.DecodeString(w.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(ephBytes)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := device.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := wrapKey(shared, w.Device, w.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := openBlock(kek, w.Sealed)
+		if err != nil {
+			return nil, err
+		}
+		if len(plain) != MasterKeySize {
+			return nil, fmt.Errorf("wrapped master key has wrong size")
+		}
+		var k MasterKey
+		copy(k[:], plain)
+		return &k, nil
+	}
+	return nil, fmt.Errorf("keyring has no wrap for this device")
+}
+
+// LoadDeviceKey loads this device's X25519 wrapping key, creating it on
+// first use. Like the identity key, it is refused if group/world-readable.
+func LoadDeviceKey(stateDir string) (*ecdh.PrivateKey, error) {
+	path := filepath.Join(stateDir, deviceKeyFile)
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("device key %s has insecure permissions %v (want 0600)", path, info.Mode().Perm())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ecdh.X25519().NewPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device key %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, key.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadKeyring reads the keyring from stateDir (nil if encryption is not set up)
+func LoadKeyring(stateDir string) (*Keyring, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, keyringFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kr Keyring
+	if err := json.Unmarshal(data, &kr); err != nil {
+		return nil, fmt.Errorf("invalid keyring: %w", err)
+	}
+	return &kr, nil
+}
+
+// SaveKeyring writes the keyring to stateDir
+func SaveKeyring(stateDir string, kr *Keyring) error {
+	data, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(stateDir, keyringFile), data, 0644)
+}
+
+// LoadMasterKey unwraps the master key from the keyring in stateDir.
+// It returns nil without error when no keyring exists.
+func LoadMasterKey(stateDir string) (*MasterKey, error) {
+	kr, err := LoadKeyring(stateDir)
+	if err != nil || kr == nil {
+		return nil, err
+	}
+	device, err := LoadDeviceKey(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	return kr.Unwrap(device)
+}
+
+// InitKeyring creates a new master key wrapped for this device
+func InitKeyring(stateDir string) error {
+	if kr, err := LoadKeyring(stateDir); err != nil || kr != nil {
+		if err == nil {
+			err = fmt.Errorf("keyring already exists in %s", stateDir)
+		}
+		return err
+	}
+
+	device, err := LoadDeviceKey(stateDir)
+	if err != nil {
+		return err
+	}
+	master, err := NewMasterKey()
+	if err != nil {
+		return err
+	}
+
+	kr := &Keyring{}
+	hostname, _ := os.Hostname()
+	if err := kr.Grant(master, device.PublicKey(), hostname); err != nil {
+		return err
+	}
+	return SaveKeyring(stateDir, kr)
+}
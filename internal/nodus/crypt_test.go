@@ -0,0 +1,74 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageOnlyPeerCantRead(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) { cfg.ReplicationFactor = 2 })
+	key, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.store.SetMasterKey(key)
+	// b holds a's replicas but has no key, and a only trusts it for storage
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustCloud, TrustTrusted)
+
+	plain := testData(2*BlockSize+100, 1)
+	m, err := a.WriteFile("secret.bin", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Encrypted() {
+		t.Fatal("file written with a master key isn't encrypted")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.SyncFile(ctx, m.Name); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	for i, ref := range m.Blocks {
+		sealed, err := b.store.GetBlock(ref.Hash)
+		if err != nil {
+			t.Fatalf("holder lacks block %d: %v", i, err)
+		}
+		start := i * BlockSize
+		chunk := plain[start:min(start+BlockSize, len(plain))]
+		if bytes.Contains(sealed, chunk[:64]) {
+			t.Fatalf("holder's copy of block %d is plaintext", i)
+		}
+	}
+
+	if _, err := b.RequestFile(ctx, m.Name); err == nil {
+		t.Fatal("storage-only peer read the file")
+	}
+}
+
+func TestLoadDeviceKeyPermissions(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadDeviceKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadDeviceKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(again) {
+		t.Fatal("device key changed across loads")
+	}
+
+	if err := os.Chmod(filepath.Join(dir, deviceKeyFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDeviceKey(dir); err == nil {
+		t.Fatal("world-readable device key accepted")
+	}
+}
@@ -0,0 +1,309 @@
+// Package nodus - Long-running daemon: node, background loops, FUSE, NBD and control socket
+package nodus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Daemon runs a Node with its background loops, the FUSE mounts, the NBD
+// server, the HTTP gateway and the control API
+type Daemon struct {
+	cfg     Config
+	node    *Node
+	started time.Time
+	nbd     *NBDServer   // nil when NBD is disabled
+	gateway *http.Server // nil when the gateway is disabled
+
+	mu     sync.Mutex
+	mounts map[string]*NodusFS // by mount point
+}
+
+// NewDaemon creates the daemon's node
+func NewDaemon(ctx context.Context, cfg Config) (*Daemon, error) {
+	node, err := NewNode(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Daemon{cfg: cfg, node: node, started: time.Now(), mounts: make(map[string]*NodusFS)}, nil
+}
+
+// Node returns the daemon's node
+func (d *Daemon) Node() *Node {
+	return d.node
+}
+
+// Run starts discovery, providing and repair, mounts the volume, exports
+// device images, serves the gateway and the control socket until ctx is
+// cancelled, then unmounts and closes the node
+func (d *Daemon) Run(ctx context.Context) error {
+	ln, err := listenControl(d.cfg.ControlSocket)
+	if err != nil {
+		d.node.Close()
+		return err
+	}
+	srv := &http.Server{Handler: d.controlHandler()}
+
+	go d.node.StartDiscovery(ctx)
+	go d.node.StartProviding(ctx)
+	go d.node.StartRepair(ctx)
+	go d.node.StartPinning(ctx)
+	go d.node.StartLeases(ctx)
+	go d.node.StartJournal(ctx)
+	go d.node.StartTombstones(ctx)
+	go d.node.StartBoot(ctx)
+	go d.node.StartTrustReload(ctx)
+
+	if d.cfg.MountPoint != "" {
+		if err := d.Mount("", d.cfg.MountPoint); err != nil {
+			// The daemon stays useful for peers and the CLI without a mount
+			fmt.Printf("⚠️  %v\n", err)
+		}
+	}
+
+	d.nbd = d.serveNBD()
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	fmt.Printf("🛰️  Control API listening on %s\n", d.cfg.ControlSocket)
+
+	metricsSrv := d.serveMetrics()
+	d.gateway = d.serveGateway()
+
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	if metricsSrv != nil {
+		metricsSrv.Shutdown(shutdownCtx)
+	}
+	if d.gateway != nil {
+		d.gateway.Shutdown(shutdownCtx)
+	}
+	os.Remove(d.cfg.ControlSocket)
+	if d.nbd != nil {
+		d.nbd.Close()
+	}
+
+	d.unmountAll()
+	d.node.Close()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("control API failed: %w", err)
+	}
+	return nil
+}
+
+// serveMetrics serves Prometheus metrics on cfg.MetricsAddr. A failure only
+// disables metrics, so it returns nil rather than an error.
+func (d *Daemon) serveMetrics() *http.Server {
+	if d.cfg.MetricsAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", d.cfg.MetricsAddr)
+	if err != nil {
+		fmt.Printf("⚠️  Metrics disabled: %v\n", err)
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(d.node.MetricsRegistry(), promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	fmt.Printf("📊 Metrics on http://%s/metrics\n", d.cfg.MetricsAddr)
+	return srv
+}
+
+// serveNBD exports device images on cfg.NBDListen. Like metrics, a failure
+// only disables it.
+func (d *Daemon) serveNBD() *NBDServer {
+	if d.cfg.NBDListen == "" {
+		return nil
+	}
+	srv, err := ListenNBD(d.cfg.NBDListen, d.node)
+	if err != nil {
+		fmt.Printf("⚠️  NBD disabled: %v\n", err)
+		return nil
+	}
+	go srv.Serve()
+	fmt.Printf("💽 NBD exports on %s\n", d.cfg.NBDListen)
+	return srv
+}
+
+// serveGateway serves the read-only HTTP gateway on cfg.GatewayAddr. Like
+// metrics, a failure only disables it.
+func (d *Daemon) serveGateway() *http.Server {
+	if d.cfg.GatewayAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", d.cfg.GatewayAddr)
+	if err != nil {
+		fmt.Printf("⚠️  Gateway disabled: %v\n", err)
+		return nil
+	}
+	srv := &http.Server{Handler: d.node.GatewayHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	fmt.Printf("🌐 HTTP gateway on http://%s/v/%s/\n", d.cfg.GatewayAddr, DefaultVolume)
+	return srv
+}
+
+// gatewayAddr returns where the gateway listens ("" if it doesn't)
+func (d *Daemon) gatewayAddr() string {
+	if d.gateway == nil {
+		return ""
+	}
+	return d.cfg.GatewayAddr
+}
+
+// nbdListen returns where device images are exported ("" if they aren't)
+func (d *Daemon) nbdListen() string {
+	if d.nbd == nil {
+		return ""
+	}
+	return d.cfg.NBDListen
+}
+
+// MountInfo describes a mounted volume
+type MountInfo struct {
+	Path   string `json:"path"`
+	Volume string `json:"volume,omitempty"` // "" for the default volume
+}
+
+// Mount mounts a volume ("" for the default) at path, replacing any
+// other volume mounted there
+func (d *Daemon) Mount(volume, path string) error {
+	if volume != "" && d.node.store.volumeSpec(volume) == nil {
+		return fmt.Errorf("volume '%s': %w", volume, os.ErrNotExist)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if nfs, ok := d.mounts[path]; ok {
+		if nfs.volume == volume {
+			return nil
+		}
+		if err := nfs.Unmount(); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", path, err)
+		}
+		delete(d.mounts, path)
+	}
+
+	nfs, err := MountFUSE(path, d.node, volume)
+	if err != nil {
+		return err
+	}
+	d.mounts[path] = nfs
+	if volume == "" {
+		fmt.Printf("📂 Volume mounted at %s\n", path)
+	} else {
+		fmt.Printf("📂 Volume '%s' mounted at %s\n", volume, path)
+	}
+	return nil
+}
+
+// Unmount unmounts the volume mounted at path, if any
+func (d *Daemon) Unmount(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nfs, ok := d.mounts[path]
+	if !ok {
+		return nil
+	}
+	delete(d.mounts, path)
+	return nfs.Unmount()
+}
+
+// unmountVolume unmounts every mount of a volume
+func (d *Daemon) unmountVolume(volume string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for path, nfs := range d.mounts {
+		if nfs.volume != volume {
+			continue
+		}
+		if err := nfs.Unmount(); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", path, err)
+		}
+		delete(d.mounts, path)
+	}
+	return nil
+}
+
+// unmountAll unmounts every volume
+func (d *Daemon) unmountAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for path, nfs := range d.mounts {
+		if err := nfs.Unmount(); err != nil {
+			fmt.Printf("⚠️  Failed to unmount %s: %v\n", path, err)
+		}
+		delete(d.mounts, path)
+	}
+}
+
+// Mounts lists the mounted volumes, by mount point
+func (d *Daemon) Mounts() []MountInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mounts := make([]MountInfo, 0, len(d.mounts))
+	for path, nfs := range d.mounts {
+		mounts = append(mounts, MountInfo{Path: path, Volume: nfs.volume})
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+	return mounts
+}
+
+// mountPoint returns where the default volume is mounted ("" if it isn't)
+func (d *Daemon) mountPoint() string {
+	for _, m := range d.Mounts() {
+		if m.Volume == "" {
+			return m.Path
+		}
+	}
+	return ""
+}
+
+// DeleteVolume unmounts a named volume and deletes it
+func (d *Daemon) DeleteVolume(name string) error {
+	if err := d.unmountVolume(name); err != nil {
+		return err
+	}
+	return d.node.DeleteVolume(name)
+}
+
+// listenControl opens the control socket, replacing a stale one left by a crash
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("daemon already running on %s", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	// Root and the socket's group may control the daemon
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
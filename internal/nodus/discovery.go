@@ -21,7 +21,15 @@ type discoveryNotifee struct {
 }
 
 func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
-	fmt.Printf("📡 Discovered peer: %s\n", pi.ID.ShortString())
+	if pi.ID == n.node.host.ID() {
+		return
+	}
+	level := n.node.TrustLevel(pi.ID)
+	if level == TrustUnknown {
+		fmt.Printf("📡 Ignoring untrusted peer: %s\n", pi.ID.ShortString())
+		return
+	}
+	fmt.Printf("📡 Discovered %s peer: %s\n", level, pi.ID.ShortString())
 
 	// Try to connect
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -79,3 +87,15 @@ func (n *Node) ConnectToPeer(ctx context.Context, addr string) error {
 
 	return nil
 }
+
+// KnownPeers returns the peers found by discovery or connected manually
+func (n *Node) KnownPeers() []peer.AddrInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	peers := make([]peer.AddrInfo, 0, len(n.peers))
+	for _, info := range n.peers {
+		peers = append(peers, info)
+	}
+	return peers
+}
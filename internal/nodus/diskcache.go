@@ -0,0 +1,337 @@
+// Package nodus - Persistent on-disk tier of the cache
+package nodus
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskCache is an LRU of files in one directory. Entries are written
+// atomically, so after a crash every file is either complete or absent,
+// and the index is rebuilt from the directory on startup. Pinned entries,
+// those the RAM tier pinned and had to let go, are never evicted.
+type diskCache struct {
+	mu         sync.Mutex
+	dir        string
+	capacity   int64
+	used       int64
+	pinnedUsed int64 // bytes of pinned entries, including reserved ones
+	items      map[string]*list.Element
+	order      *list.List // front is most recently used
+
+	evictions atomic.Uint64 // entries dropped to make room
+}
+
+type diskEntry struct {
+	key      string
+	size     int64
+	ready    bool // false while the file is being written
+	pinned   bool // never evicted
+	reserved bool // room kept for a pinned entry not written yet
+}
+
+// openDiskCache opens or creates the disk tier in dir, ordering existing
+// entries by modification time and trimming them to capacity
+func openDiskCache(dir string, capacity int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []found
+	for _, e := range entries {
+		// Temporary files are writes interrupted by a crash
+		if strings.HasPrefix(e.Name(), ".") {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		key, err := url.PathUnescape(e.Name())
+		if err != nil {
+			continue
+		}
+		files = append(files, found{key: key, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	d := &diskCache{
+		dir:      dir,
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+	for _, f := range files {
+		d.items[f.key] = d.order.PushBack(&diskEntry{key: f.key, size: f.size, ready: true})
+		d.used += f.size
+	}
+	d.makeRoom(0)
+	return d, nil
+}
+
+// path returns the file holding key
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, url.PathEscape(key))
+}
+
+// get reads an entry, marking it recently used (nil if absent or unreadable)
+func (d *diskCache) get(key string) []byte {
+	d.mu.Lock()
+	elem, ok := d.items[key]
+	ok = ok && elem.Value.(*diskEntry).ready
+	if ok {
+		d.order.MoveToFront(elem)
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		d.delete(key)
+		return nil
+	}
+	// Keep the LRU order across restarts
+	now := time.Now()
+	os.Chtimes(d.path(key), now, now)
+	return data
+}
+
+// has reports whether key is on disk
+func (d *diskCache) has(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.items[key]
+	return ok && elem.Value.(*diskEntry).ready
+}
+
+// put writes an entry, evicting old ones to make room, and returns the keys
+// that are no longer on disk: the evicted ones, and key itself if it wasn't
+// kept. Entries larger than the whole tier are not kept.
+func (d *diskCache) put(key string, data []byte) ([]string, error) {
+	size := int64(len(data))
+	if size > d.capacity {
+		return []string{key}, nil
+	}
+
+	d.mu.Lock()
+	elem, ok := d.items[key]
+	if ok && !elem.Value.(*diskEntry).reserved {
+		d.order.MoveToFront(elem)
+		d.mu.Unlock()
+		now := time.Now()
+		os.Chtimes(d.path(key), now, now)
+		return nil, nil
+	}
+	var gone []string
+	var entry *diskEntry
+	if ok {
+		// A pinned entry whose room pin reserved
+		entry = elem.Value.(*diskEntry)
+		entry.reserved = false
+		d.order.MoveToFront(elem)
+	} else {
+		gone = d.makeRoom(size)
+		if d.used+size > d.capacity {
+			d.mu.Unlock()
+			return append(gone, key), nil // the rest is pinned
+		}
+		// Reserve the space before writing so concurrent puts stay within capacity
+		entry = &diskEntry{key: key, size: size}
+		elem = d.order.PushFront(entry)
+		d.items[key] = elem
+		d.used += size
+	}
+	d.mu.Unlock()
+
+	err := writeFileAtomic(d.path(key), data, 0600)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.items[key] != elem {
+		// Evicted or deleted while writing
+		if err == nil {
+			os.Remove(d.path(key))
+		}
+		return append(gone, key), nil
+	}
+	if err != nil {
+		d.remove(elem)
+		return append(gone, key), fmt.Errorf("disk cache write failed: %w", err)
+	}
+	entry.ready = true
+	return gone, nil
+}
+
+// pin keeps key from being evicted. An entry not on disk yet gets size bytes
+// reserved, so the RAM tier can let go of it knowing it will fit. It reports
+// false when there isn't room beside the other pinned entries, and returns
+// the keys evicted to make room.
+func (d *diskCache) pin(key string, size int64) ([]string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if elem, ok := d.items[key]; ok {
+		entry := elem.Value.(*diskEntry)
+		if !entry.pinned {
+			entry.pinned = true
+			d.pinnedUsed += entry.size
+		}
+		return nil, true
+	}
+	if d.pinnedUsed+size > d.capacity {
+		return nil, false
+	}
+	gone := d.makeRoom(size)
+	entry := &diskEntry{key: key, size: size, pinned: true, reserved: true}
+	d.items[key] = d.order.PushFront(entry)
+	d.used += size
+	d.pinnedUsed += size
+	return gone, true
+}
+
+// pinCached pins key only if it is on disk
+func (d *diskCache) pinCached(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, ok := d.items[key]
+	if !ok || !elem.Value.(*diskEntry).ready {
+		return false
+	}
+	if entry := elem.Value.(*diskEntry); !entry.pinned {
+		entry.pinned = true
+		d.pinnedUsed += entry.size
+	}
+	return true
+}
+
+// unpin makes key evictable again, dropping a reservation never written
+func (d *diskCache) unpin(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, ok := d.items[key]
+	if !ok || !elem.Value.(*diskEntry).pinned {
+		return
+	}
+	entry := elem.Value.(*diskEntry)
+	if entry.reserved {
+		d.remove(elem)
+		return
+	}
+	entry.pinned = false
+	d.pinnedUsed -= entry.size
+}
+
+// pinnedSize returns the bytes of pinned entries
+func (d *diskCache) pinnedSize() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pinnedUsed
+}
+
+// makeRoom evicts unpinned entries until size more bytes fit, or none are
+// left, and returns their keys; caller must hold mu
+func (d *diskCache) makeRoom(size int64) []string {
+	var gone []string
+	for d.used+size > d.capacity {
+		key, ok := d.evictOldest()
+		if !ok {
+			break
+		}
+		gone = append(gone, key)
+		d.evictions.Add(1)
+	}
+	return gone
+}
+
+// delete removes an entry
+func (d *diskCache) delete(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, ok := d.items[key]
+	if !ok {
+		return false
+	}
+	d.remove(elem)
+	return true
+}
+
+// evictOldest removes the least recently used unpinned entry and returns its
+// key, or false when every entry is pinned; caller must hold mu
+func (d *diskCache) evictOldest() (string, bool) {
+	for elem := d.order.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*diskEntry)
+		if !entry.pinned {
+			d.remove(elem)
+			return entry.key, true
+		}
+	}
+	return "", false
+}
+
+// remove drops an entry and its file; caller must hold mu
+func (d *diskCache) remove(elem *list.Element) {
+	entry := elem.Value.(*diskEntry)
+	d.order.Remove(elem)
+	delete(d.items, entry.key)
+	d.used -= entry.size
+	if entry.pinned {
+		d.pinnedUsed -= entry.size
+	}
+	if err := os.Remove(d.path(entry.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("⚠️  Failed to remove cached %s: %v\n", entry.key, err)
+	}
+}
+
+// keys returns every key on disk
+func (d *diskCache) keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := make([]string, 0, len(d.items))
+	for k, elem := range d.items {
+		if elem.Value.(*diskEntry).ready {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// usage returns bytes used and entry count
+func (d *diskCache) usage() (int64, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.used, len(d.items)
+}
+
+// clear removes every entry, pinned or not
+func (d *diskCache) clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.order.Len() > 0 {
+		d.remove(d.order.Back())
+	}
+}
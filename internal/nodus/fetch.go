@@ -0,0 +1,342 @@
+// Package nodus - Parallel fetching from several providers and peer scoring
+package nodus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// fetchWorkers bounds the requests one fetch keeps in flight
+	fetchWorkers = 8
+
+	// raceWidth is how many providers may be asked for the same item at once
+	raceWidth = 3
+
+	// hedgeDelay is how long we wait on a provider before also asking the next one
+	hedgeDelay = 500 * time.Millisecond
+
+	// stripeBlocks is how many blocks one striped range request carries
+	stripeBlocks = 8 // 2MB
+
+	// scoreWeight is the weight of the newest sample in the moving averages
+	scoreWeight = 0.3
+)
+
+// PeerScore tracks how well a peer has served our requests
+type PeerScore struct {
+	Peer        peer.ID       `json:"peer"`
+	Requests    int           `json:"requests"`
+	Failures    int           `json:"failures"`
+	FailureRate float64       `json:"failure_rate"` // moving average
+	Latency     time.Duration `json:"latency"`      // moving average of successful requests
+	Bandwidth   float64       `json:"bandwidth"`    // moving average, bytes per second
+	LastSeen    time.Time     `json:"last_seen"`
+}
+
+// Score is the expected number of blocks per second from this peer.
+// Peers we have not asked yet score as fast so they get a chance.
+func (s PeerScore) Score() float64 {
+	if s.Requests == 0 {
+		return 10
+	}
+	seconds := s.Latency.Seconds()
+	if s.Bandwidth > 0 {
+		seconds += BlockSize / s.Bandwidth
+	}
+	return (1 - s.FailureRate) / (seconds + 0.01)
+}
+
+// peerScores holds the scores of every peer we fetched from
+type peerScores struct {
+	mu     sync.Mutex
+	scores map[peer.ID]*PeerScore
+}
+
+func newPeerScores() *peerScores {
+	return &peerScores{scores: make(map[peer.ID]*PeerScore)}
+}
+
+// record adds the outcome of one request
+func (p *peerScores) record(id peer.ID, elapsed time.Duration, bytes int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.scores[id]
+	if s == nil {
+		s = &PeerScore{Peer: id}
+		p.scores[id] = s
+	}
+	first := s.Requests == 0
+	s.Requests++
+
+	failed := 0.0
+	if err != nil {
+		s.Failures++
+		failed = 1
+	}
+	s.FailureRate = average(s.FailureRate, failed, first)
+	if err != nil {
+		return
+	}
+
+	s.LastSeen = time.Now()
+	if s.Latency == 0 {
+		s.Latency = elapsed
+	} else {
+		s.Latency = time.Duration(average(float64(s.Latency), float64(elapsed), false))
+	}
+	if bytes > 0 && elapsed > 0 {
+		bw := float64(bytes) / elapsed.Seconds()
+		s.Bandwidth = average(s.Bandwidth, bw, s.Bandwidth == 0)
+	}
+}
+
+// average folds a sample into a moving average
+func average(avg, sample float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return avg*(1-scoreWeight) + sample*scoreWeight
+}
+
+// rank returns peers ordered best first
+func (p *peerScores) rank(peers []peer.ID) []peer.ID {
+	p.mu.Lock()
+	score := make(map[peer.ID]float64, len(peers))
+	for _, id := range peers {
+		s := PeerScore{}
+		if known := p.scores[id]; known != nil {
+			s = *known
+		}
+		score[id] = s.Score()
+	}
+	p.mu.Unlock()
+
+	ranked := append([]peer.ID(nil), peers...)
+	sort.SliceStable(ranked, func(i, j int) bool { return score[ranked[i]] > score[ranked[j]] })
+	return ranked
+}
+
+// snapshot returns a copy of every score, best first
+func (p *peerScores) snapshot() []PeerScore {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	scores := make([]PeerScore, 0, len(p.scores))
+	for _, s := range p.scores {
+		scores = append(scores, *s)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score() > scores[j].Score() })
+	return scores
+}
+
+// PeerScores returns the fetch scores of every peer we have asked, best first
+func (n *Node) PeerScores() []PeerScore {
+	return n.scores.snapshot()
+}
+
+// fetchFunc requests one item from a peer and returns the bytes received
+type fetchFunc func(ctx context.Context, peerID peer.ID) (int, error)
+
+// measure runs fetch and records its outcome in the peer's score.
+// Requests cancelled because another peer won are not held against the peer.
+func (n *Node) measure(ctx context.Context, peerID peer.ID, fetch fetchFunc) error {
+	start := time.Now()
+	bytes, err := fetch(ctx, peerID)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+	n.scores.record(peerID, time.Since(start), bytes, err)
+	return err
+}
+
+// race asks peers in order until one succeeds. Another peer is asked whenever
+// one fails or the running requests take longer than hedgeDelay, with at most
+// raceWidth in flight; the first success cancels the rest.
+func (n *Node) race(ctx context.Context, peers []peer.ID, fetch fetchFunc) error {
+	if len(peers) == 0 {
+		return ErrOffline
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan error, len(peers))
+	next, inflight := 0, 0
+	launch := func() {
+		id := peers[next]
+		next++
+		inflight++
+		go func() { results <- n.measure(ctx, id, fetch) }()
+	}
+
+	hedge := time.NewTimer(hedgeDelay)
+	defer hedge.Stop()
+
+	var firstErr error
+	launch()
+	for inflight > 0 {
+		select {
+		case err := <-results:
+			inflight--
+			if err == nil {
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if next < len(peers) {
+				launch()
+			}
+		case <-hedge.C:
+			if next < len(peers) && inflight < raceWidth {
+				launch()
+			}
+			hedge.Reset(hedgeDelay)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+// fetchManifest asks the best raceWidth providers for a file's manifest and
+// keeps the newest reply by version vector, so one stale peer can't serve an
+// old version. The next providers are only asked if none of these replies.
+func (n *Node) fetchManifest(ctx context.Context, peers []peer.ID, filename string) (*FileManifest, error) {
+	ranked := n.scores.rank(peers)
+	if len(ranked) == 0 {
+		return nil, ErrOffline
+	}
+
+	var (
+		mu       sync.Mutex
+		found    *FileManifest
+		firstErr error
+	)
+	fetch := func(ctx context.Context, peerID peer.ID) (int, error) {
+		m, err := n.requestManifest(ctx, peerID, filename)
+		if err != nil {
+			return 0, err
+		}
+		if err := n.checkSigner(m); err != nil {
+			return 0, err
+		}
+		// Only peers that may delete our files get to deliver their tombstones
+		if m.Kind == KindTombstone && n.TrustLevel(peerID) < TrustTrusted {
+			return 0, fmt.Errorf("tombstone of '%s' from %s below %s", filename, peerID.ShortString(), TrustTrusted)
+		}
+		mu.Lock()
+		if found == nil || newerManifest(m, found) {
+			found = m
+		}
+		mu.Unlock()
+		// Manifests are too small to say anything about bandwidth
+		return 0, nil
+	}
+
+	for start := 0; start < len(ranked) && found == nil; start += raceWidth {
+		batch := ranked[start:min(start+raceWidth, len(ranked))]
+		var wg sync.WaitGroup
+		for _, id := range batch {
+			wg.Add(1)
+			go func(id peer.ID) {
+				defer wg.Done()
+				if err := n.measure(ctx, id, fetch); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}(id)
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil && found == nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, firstErr
+	}
+
+	if found.Kind == KindTombstone {
+		n.acceptManifest(found)
+		return nil, fmt.Errorf("'%s' was deleted: %w", filename, os.ErrNotExist)
+	}
+	return found, nil
+}
+
+// fetchBlocks fetches refs concurrently, striping them over the best peers:
+// block i is first asked of one of the top raceWidth peers in turn, and the
+// remaining peers serve as hedges and fallbacks. Returns the first error.
+func (n *Node) fetchBlocks(ctx context.Context, peers []peer.ID, refs []BlockRef) error {
+	return n.fetchBlocksFor(ctx, "", peers, refs)
+}
+
+// fetchBlocksFor is fetchBlocks storing the blocks on behalf of owner, so they
+// count against that peer's cache quota
+func (n *Node) fetchBlocksFor(ctx context.Context, owner string, peers []peer.ID, refs []BlockRef) error {
+	ranked := n.scores.rank(peers)
+	if len(ranked) == 0 {
+		return ErrOffline
+	}
+	stripe := len(ranked)
+	if stripe > raceWidth {
+		stripe = raceWidth
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, fetchWorkers)
+	seen := make(map[BlockHash]bool)
+	for i, ref := range refs {
+		if seen[ref.Hash] || n.store.HasBlock(ref.Hash) {
+			continue
+		}
+		seen[ref.Hash] = true
+
+		order := make([]peer.ID, 0, len(ranked))
+		for j := 0; j < stripe; j++ {
+			order = append(order, ranked[(i+j)%stripe])
+		}
+		order = append(order, ranked[stripe:]...)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ref BlockRef, order []peer.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := n.race(ctx, order, func(ctx context.Context, peerID peer.ID) (int, error) {
+				data, err := n.requestBlock(ctx, peerID, ref.Hash)
+				if err == nil {
+					err = n.store.putVerifiedBlock(ref.Hash, data, owner)
+				}
+				if err != nil {
+					return 0, fmt.Errorf("block %s from %s: %w", ref.Hash.String()[:12], peerID.ShortString(), err)
+				}
+				return len(data), nil
+			})
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(ref, order)
+	}
+	wg.Wait()
+	return firstErr
+}
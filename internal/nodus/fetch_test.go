@@ -0,0 +1,66 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestFetchRaceSkipsBadData(t *testing.T) {
+	good := newTestNode(t)
+	evil := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, b, good, TrustTrusted, TrustTrusted)
+	linkNodes(t, b, evil, TrustTrusted, TrustTrusted)
+
+	data := testData(1000, 1)
+	h := HashBlock(data)
+	if err := good.store.blocks.Put(h.String(), data); err != nil {
+		t.Fatal(err)
+	}
+	// Other bytes under the same address
+	if err := evil.store.blocks.Put(h.String(), testData(1000, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both are unscored, so the bad peer is asked first
+	peers := []peer.ID{evil.host.ID(), good.host.ID()}
+	if ranked := b.scores.rank(peers); ranked[0] != evil.host.ID() {
+		t.Fatal("bad peer not asked first")
+	}
+	if err := b.fetchBlocks(context.Background(), peers, []BlockRef{{Hash: h, Size: 1000}}); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if got, err := b.store.GetBlock(h); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("stored block differs: %v", err)
+	}
+
+	scores := make(map[peer.ID]PeerScore)
+	for _, s := range b.PeerScores() {
+		scores[s.Peer] = s
+	}
+	if s := scores[evil.host.ID()]; s.Requests != 1 || s.Failures != 1 || s.FailureRate != 1 {
+		t.Errorf("bad peer scored %+v", s)
+	}
+	if s := scores[good.host.ID()]; s.Requests != 1 || s.Failures != 0 || s.Latency == 0 {
+		t.Errorf("good peer scored %+v", s)
+	}
+	if ranked := b.scores.rank(peers); ranked[0] != good.host.ID() {
+		t.Error("bad peer still ranked first")
+	}
+
+	// With only the bad peer the fetch fails and nothing is stored
+	other := testData(500, 3)
+	oh := HashBlock(other)
+	evil.store.blocks.Put(oh.String(), testData(500, 4))
+	err := b.fetchBlocks(context.Background(), peers[:1], []BlockRef{{Hash: oh, Size: 500}})
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("fetch from only the bad peer: %v, want ErrHashMismatch", err)
+	}
+	if b.store.HasBlock(oh) {
+		t.Fatal("bad block stored")
+	}
+}
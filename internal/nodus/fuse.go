@@ -3,10 +3,11 @@ package nodus
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,38 +15,68 @@ import (
 	"bazil.org/fuse/fs"
 )
 
-// NodusFS represents the FUSE filesystem
+// NodusFS represents the FUSE filesystem of one volume. Nodes carry only an
+// inode; the inode table maps it to the node's current path, so renames move
+// whole subtrees without touching the nodes the kernel holds.
 type NodusFS struct {
 	mountPoint string
+	volume     string // "" for the default volume
 	conn       *fuse.Conn
 	node       *Node
+
+	mu     sync.Mutex
+	inodes map[string]uint64 // path -> inode, allocated on first use
+	paths  map[uint64]string // inode -> current path
+	next   uint64
+	files  map[uint64]*File // file nodes, so every handle shares one buffer
 }
 
-// MountFUSE mounts the Nodus filesystem at the given path
-func MountFUSE(mountPoint string, node *Node) (*NodusFS, error) {
+// rootInode is the inode of the root directory, whose path is the volume's root
+const rootInode = 1
+
+// newNodusFS creates the filesystem of a volume of node without mounting it
+func newNodusFS(node *Node, volume string) *NodusFS {
+	root := volumeRoot(volume)
+	return &NodusFS{
+		node:   node,
+		volume: volume,
+		inodes: map[string]uint64{root: rootInode},
+		paths:  map[uint64]string{rootInode: root},
+		next:   rootInode + 1,
+		files:  make(map[uint64]*File),
+	}
+}
+
+// MountFUSE mounts a volume of the Nodus filesystem ("" for the default)
+// at the given path
+func MountFUSE(mountPoint string, node *Node, volume string) (*NodusFS, error) {
 	// Create mount point if it doesn't exist
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create mount point: %w", err)
 	}
 
+	fsName := "nodus"
+	if volume != "" {
+		fsName += ":" + volume
+	}
+
 	// Mount FUSE
 	c, err := fuse.Mount(
 		mountPoint,
-		fuse.FSName("nodus"),
+		fuse.FSName(fsName),
 		fuse.Subtype("spiritfs"),
-		fuse.LocalVolume(),
-		fuse.VolumeName("Nodus P2P"),
 		fuse.AllowOther(),
+		fuse.DefaultPermissions(), // the kernel checks modes and ownership
+		fuse.LockingFlock(),
+		fuse.LockingPOSIX(),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("fuse mount failed: %w", err)
 	}
 
-	nfs := &NodusFS{
-		mountPoint: mountPoint,
-		conn:       c,
-		node:       node,
-	}
+	nfs := newNodusFS(node, volume)
+	nfs.mountPoint = mountPoint
+	nfs.conn = c
 
 	// Serve filesystem in background
 	go func() {
@@ -54,12 +85,6 @@ func MountFUSE(mountPoint string, node *Node) (*NodusFS, error) {
 		}
 	}()
 
-	// Wait for mount to be ready
-	<-c.Ready
-	if c.MountError != nil {
-		return nil, c.MountError
-	}
-
 	return nfs, nil
 }
 
@@ -70,53 +95,335 @@ func (nfs *NodusFS) Unmount() error {
 
 // Root returns the root directory node
 func (nfs *NodusFS) Root() (fs.Node, error) {
-	return &Dir{fs: nfs, path: "/", inode: 1}, nil
+	return &Dir{entry{fs: nfs, inode: rootInode}}, nil
 }
 
-// Dir represents a directory in the filesystem
-type Dir struct {
+// inode returns the inode of path, allocating one on first use
+func (nfs *NodusFS) inode(path string) uint64 {
+	nfs.mu.Lock()
+	defer nfs.mu.Unlock()
+
+	ino, ok := nfs.inodes[path]
+	if !ok {
+		ino = nfs.next
+		nfs.next++
+		nfs.inodes[path] = ino
+		nfs.paths[ino] = path
+	}
+	return ino
+}
+
+// path returns the current path of an inode; ENOENT once it was removed
+func (nfs *NodusFS) path(ino uint64) (string, error) {
+	nfs.mu.Lock()
+	defer nfs.mu.Unlock()
+
+	path, ok := nfs.paths[ino]
+	if !ok {
+		return "", syscall.ENOENT
+	}
+	return path, nil
+}
+
+// moved points the inodes of oldPath and everything below it at newPath
+func (nfs *NodusFS) moved(oldPath, newPath string) {
+	nfs.mu.Lock()
+	defer nfs.mu.Unlock()
+
+	for ino, path := range nfs.paths {
+		var to string
+		switch {
+		case path == oldPath:
+			to = newPath
+		case strings.HasPrefix(path, oldPath+"/"):
+			to = newPath + path[len(oldPath):]
+		default:
+			continue
+		}
+		delete(nfs.inodes, path)
+		nfs.inodes[to] = ino
+		nfs.paths[ino] = to
+	}
+}
+
+// forget releases the inode of a path that no longer exists
+func (nfs *NodusFS) forget(path string) {
+	nfs.mu.Lock()
+	defer nfs.mu.Unlock()
+
+	if ino, ok := nfs.inodes[path]; ok {
+		delete(nfs.inodes, path)
+		delete(nfs.paths, ino)
+		delete(nfs.files, ino)
+	}
+}
+
+// nodeFor returns the FUSE node for a manifest
+func (nfs *NodusFS) nodeFor(m *FileManifest) fs.Node {
+	e := entry{fs: nfs, inode: nfs.inode(m.Name)}
+	switch m.Kind {
+	case KindDir:
+		return &Dir{e}
+	case KindSymlink:
+		return &Symlink{e}
+	}
+
+	nfs.mu.Lock()
+	defer nfs.mu.Unlock()
+	f, ok := nfs.files[e.inode]
+	if !ok {
+		f = &File{entry: e}
+		nfs.files[e.inode] = f
+	}
+	return f
+}
+
+// errno maps tree errors to the codes FUSE reports
+func errno(err error) error {
+	var code syscall.Errno
+	switch {
+	case errors.As(err, &code):
+		return code
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrInvalid):
+		return syscall.EINVAL
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EPERM
+	case errors.Is(err, ErrNoXattr):
+		return fuse.ErrNoXattr
+	case errors.Is(err, ErrXattrTooLarge):
+		return syscall.E2BIG
+	case errors.Is(err, ErrNotDir):
+		return syscall.ENOTDIR
+	case errors.Is(err, ErrIsDir):
+		return syscall.EISDIR
+	case errors.Is(err, ErrDirNotEmpty):
+		return syscall.ENOTEMPTY
+	case errors.Is(err, ErrOffline):
+		return syscall.EHOSTUNREACH
+	case errors.Is(err, ErrVolumeFull):
+		return syscall.EDQUOT
+	case errors.Is(err, ErrCrossVolume):
+		return syscall.EXDEV
+	}
+	return syscall.EIO
+}
+
+// entry is what every node has: an inode and the metadata stored in its manifest
+type entry struct {
 	fs    *NodusFS
-	path  string
 	inode uint64
 }
 
-// Attr sets the directory attributes
-func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = d.inode
-	a.Mode = os.ModeDir | 0755
-	a.Atime = time.Now()
-	a.Mtime = time.Now()
+// path returns the entry's current path
+func (e *entry) path() (string, error) {
+	return e.fs.path(e.inode)
+}
+
+// manifest returns the entry's manifest; the root and implicit directories
+// get an unsigned one without metadata
+func (e *entry) manifest() (*FileManifest, error) {
+	p, err := e.path()
+	if err != nil {
+		return nil, err
+	}
+	m := e.fs.node.statLocal(p)
+	if m == nil {
+		return nil, syscall.ENOENT
+	}
+	return m, nil
+}
+
+// fill sets attributes from a manifest
+func (e *entry) fill(m *FileManifest, a *fuse.Attr) {
+	a.Inode = e.inode
+	a.Mode = m.FileMode()
+	a.Size = m.Size
+	if m.Kind == KindSymlink {
+		a.Size = uint64(len(m.Target))
+	}
+	a.Uid = m.Uid
+	a.Gid = m.Gid
+	a.Atime = m.AccessTime()
+	a.Mtime = m.ModTime()
+	a.Ctime = m.ChangeTime()
+}
+
+// Attr sets the entry's attributes
+func (e *entry) Attr(ctx context.Context, a *fuse.Attr) error {
+	m, err := e.manifest()
+	if err != nil {
+		return err
+	}
+	e.fill(m, a)
 	return nil
 }
 
-// Lookup looks up a child node
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	// Check cache first
-	cache := d.fs.node.GetCache()
-	if data := cache.Get(name); data != nil {
-		return &File{fs: d.fs, name: name, data: data, inode: hashString(name)}, nil
+// Setattr changes mode, ownership and times
+func (e *entry) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := e.setattr(req); err != nil {
+		return err
 	}
+	return e.Attr(ctx, &resp.Attr)
+}
 
-	// Request from P2P network
-	data, err := d.fs.node.RequestFile(ctx, name)
-	if err == nil && data != nil {
-		// Cache the fetched data
-		cache.Put(name, data)
-		return &File{fs: d.fs, name: name, data: data, inode: hashString(name)}, nil
+// setattr stores the metadata changes of a Setattr request, if any
+func (e *entry) setattr(req *fuse.SetattrRequest) error {
+	v := req.Valid
+	if !v.Mode() && !v.Uid() && !v.Gid() && !v.Atime() && !v.Mtime() && !v.AtimeNow() && !v.MtimeNow() {
+		return nil
 	}
+	p, err := e.path()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	_, err = e.fs.node.UpdateMeta(p, func(meta *Meta) error {
+		if v.Mode() {
+			meta.Mode = posixMode(req.Mode)
+		}
+		if v.Uid() {
+			meta.Uid = req.Uid
+		}
+		if v.Gid() {
+			meta.Gid = req.Gid
+		}
+		if v.AtimeNow() {
+			meta.Atime = now
+		} else if v.Atime() {
+			meta.Atime = req.Atime.UnixNano()
+		}
+		if v.MtimeNow() {
+			meta.Mtime = now
+		} else if v.Mtime() {
+			meta.Mtime = req.Mtime.UnixNano()
+		}
+		return nil
+	})
+	if err != nil {
+		return errno(err)
+	}
+	return nil
+}
+
+// Getxattr returns an extended attribute
+func (e *entry) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	p, err := e.path()
+	if err != nil {
+		return err
+	}
+	value, err := e.fs.node.GetXattr(p, req.Name)
+	if err != nil {
+		return errno(err)
+	}
+	resp.Xattr = value
+	return nil
+}
 
-	return nil, syscall.ENOENT
+// Listxattr lists extended attribute names
+func (e *entry) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	p, err := e.path()
+	if err != nil {
+		return err
+	}
+	names, err := e.fs.node.ListXattr(p)
+	if err != nil {
+		return errno(err)
+	}
+	resp.Append(names...)
+	return nil
+}
+
+// Setxattr sets an extended attribute
+func (e *entry) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	p, err := e.path()
+	if err != nil {
+		return err
+	}
+	if _, err := e.fs.node.SetXattr(p, req.Name, req.Xattr, req.Flags); err != nil {
+		return errno(err)
+	}
+	return nil
+}
+
+// Removexattr deletes an extended attribute
+func (e *entry) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	p, err := e.path()
+	if err != nil {
+		return err
+	}
+	if _, err := e.fs.node.RemoveXattr(p, req.Name); err != nil {
+		return errno(err)
+	}
+	return nil
+}
+
+// requestMeta returns the metadata of an entry created by a request
+func requestMeta(h fuse.Header, mode, umask os.FileMode) *Meta {
+	return &Meta{Mode: posixMode(mode &^ umask), Uid: h.Uid, Gid: h.Gid}
+}
+
+// Dir represents a directory in the filesystem
+type Dir struct {
+	entry
+}
+
+// child returns the path of name inside the directory. The default volume's
+// root doesn't reach into the named volumes.
+func (d *Dir) child(name string) (string, error) {
+	dir, err := d.path()
+	if err != nil {
+		return "", err
+	}
+	if dir == "" && name == VolumeDir {
+		return "", syscall.EPERM
+	}
+	return joinPath(dir, name), nil
+}
+
+// Lookup looks up a child node; for files only the manifest is fetched here
+// and blocks are streamed on Read
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	path, err := d.child(name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	m, err := d.fs.node.Stat(ctx, path)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	return d.fs.nodeFor(m), nil
 }
 
 // ReadDirAll returns directory contents
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	var entries []fuse.Dirent
-	cache := d.fs.node.GetCache()
-	for _, key := range cache.Keys() {
+	dir, err := d.path()
+	if err != nil {
+		return nil, err
+	}
+	children, err := d.fs.node.ReadDir(dir)
+	if err != nil {
+		return nil, errno(err)
+	}
+	entries := make([]fuse.Dirent, 0, len(children))
+	for _, child := range children {
+		if dir == "" && child.Name == VolumeDir {
+			continue
+		}
+		typ := fuse.DT_File
+		switch child.Kind {
+		case KindDir:
+			typ = fuse.DT_Dir
+		case KindSymlink:
+			typ = fuse.DT_Link
+		}
 		entries = append(entries, fuse.Dirent{
-			Inode: hashString(key),
-			Name:  key,
-			Type:  fuse.DT_File,
+			Inode: d.fs.inode(joinPath(dir, child.Name)),
+			Name:  child.Name,
+			Type:  typ,
 		})
 	}
 	return entries, nil
@@ -124,99 +431,363 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 // Create creates a new file
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	file := &File{
-		fs:    d.fs,
-		name:  req.Name,
-		data:  []byte{},
-		inode: hashString(req.Name),
+	path, err := d.child(req.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := d.fs.node.Create(path, requestMeta(req.Header, req.Mode, req.Umask))
+	if err != nil {
+		return nil, nil, errno(err)
 	}
 
-	d.fs.node.GetCache().Put(req.Name, file.data)
+	file := d.fs.nodeFor(m).(*File)
+	file.mu.Lock()
+	file.buf = d.fs.node.newWriteBuffer(m)
+	file.opens++
+	file.mu.Unlock()
 	resp.Flags = fuse.OpenDirectIO
 	return file, file, nil
 }
 
-// Remove deletes a file
+// Mkdir creates a subdirectory
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	path, err := d.child(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.fs.node.Mkdir(path, requestMeta(req.Header, req.Mode, req.Umask))
+	if err != nil {
+		return nil, errno(err)
+	}
+	return d.fs.nodeFor(m), nil
+}
+
+// Symlink creates a symbolic link
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	path, err := d.child(req.NewName)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.fs.node.Symlink(path, req.Target, requestMeta(req.Header, 0777, 0))
+	if err != nil {
+		return nil, errno(err)
+	}
+	return d.fs.nodeFor(m), nil
+}
+
+// Remove deletes a file, symlink or empty directory
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	cache := d.fs.node.GetCache()
-	if cache.Get(req.Name) == nil {
-		return syscall.ENOENT
+	path, err := d.child(req.Name)
+	if err != nil {
+		return err
+	}
+	if req.Dir {
+		err = d.fs.node.RemoveDir(path)
+	} else {
+		err = d.fs.node.Remove(path)
 	}
-	cache.Delete(req.Name)
+	if err != nil {
+		return errno(err)
+	}
+	d.fs.forget(path)
 	return nil
 }
 
-// File represents a file in the filesystem
+// Rename moves an entry, possibly into another directory
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	target, ok := newDir.(*Dir)
+	if !ok {
+		return syscall.EXDEV
+	}
+	oldPath, err := d.child(req.OldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := target.child(req.NewName)
+	if err != nil {
+		return err
+	}
+	if err := d.fs.node.Rename(oldPath, newPath); err != nil {
+		return errno(err)
+	}
+	d.fs.forget(newPath)
+	d.fs.moved(oldPath, newPath)
+	return nil
+}
+
+// Symlink represents a symbolic link in the filesystem
+type Symlink struct {
+	entry
+}
+
+// Readlink returns the link target
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	m, err := l.manifest()
+	if err != nil {
+		return "", err
+	}
+	if m.Kind != KindSymlink {
+		return "", syscall.EINVAL
+	}
+	return m.Target, nil
+}
+
+// File represents a file in the filesystem. Writes go to a buffer of
+// modified blocks shared by every handle; it is stored and announced on
+// close, fsync, or once it has been dirty for the write-back delay. Unchanged
+// blocks keep their address, so replication only sends the blocks that changed.
+// Locks taken through its handles are backed by a lease on the file from
+// every peer (see locks.go).
 type File struct {
-	fs    *NodusFS
-	name  string
-	data  []byte
-	inode uint64
+	entry
+
+	mu    sync.Mutex
+	buf   *writeBuffer // modified blocks, set up only once the file is written
+	dirty bool         // buf has writes not stored yet
+	opens int          // open handles; the buffer is dropped after the last one
+	timer *time.Timer  // pending write-back
+
+	lockMu    sync.Mutex
+	locks     lockTable
+	lease     LeaseMode // held for the locks
+	leaseName string    // path the lease was taken on
 }
 
-// Attr sets file attributes
+// Attr sets file attributes; the size of buffered content wins over the manifest
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = f.inode
-	a.Mode = 0644
-	a.Size = uint64(len(f.data))
-	a.Atime = time.Now()
-	a.Mtime = time.Now()
+	if err := f.entry.Attr(ctx, a); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buf != nil {
+		a.Size = uint64(f.buf.Size())
+	}
 	return nil
 }
 
-// ReadAll reads the entire file
-func (f *File) ReadAll(ctx context.Context) ([]byte, error) {
-	if data := f.fs.node.GetCache().Get(f.name); data != nil {
-		f.data = data
+// Open returns the file as its own handle
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opens++
+	return f, nil
+}
+
+// Read serves a byte range, fetching only the blocks that cover it
+func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	f.mu.Lock()
+	if f.buf != nil {
+		data, err := f.buf.ReadAt(ctx, req.Offset, req.Size)
+		f.mu.Unlock()
+		if err != nil {
+			return errno(err)
+		}
+		resp.Data = data
+		return nil
 	}
-	return f.data, nil
+	f.mu.Unlock()
+
+	name, err := f.path()
+	if err != nil {
+		return err
+	}
+	m, err := f.fs.node.OpenFile(ctx, name)
+	if err != nil {
+		return syscall.ENOENT
+	}
+	data, err := f.fs.node.ReadAt(ctx, m, req.Offset, req.Size)
+	if err != nil {
+		return errno(err)
+	}
+	resp.Data = data
+	return nil
 }
 
-// Write writes data to the file
-func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	newLen := int(req.Offset) + len(req.Data)
-	if newLen > len(f.data) {
-		newData := make([]byte, newLen)
-		copy(newData, f.data)
-		f.data = newData
+// load sets up the write buffer before the file is modified; only the
+// manifest is fetched, blocks are read as writes reach them. The caller holds f.mu.
+func (f *File) load(ctx context.Context) error {
+	if f.buf != nil {
+		return nil
 	}
+	name, err := f.path()
+	if err != nil {
+		return err
+	}
+	m, err := f.fs.node.OpenFile(ctx, name)
+	if err != nil {
+		return errno(err)
+	}
+	f.buf = f.fs.node.newWriteBuffer(m)
+	return nil
+}
 
-	copy(f.data[req.Offset:], req.Data)
-	resp.Size = len(req.Data)
+// markDirty records unstored writes and schedules a write-back; the caller holds f.mu
+func (f *File) markDirty() {
+	f.dirty = true
+	if delay := f.fs.node.cfg.WriteBackDelay; delay > 0 && f.timer == nil {
+		f.timer = time.AfterFunc(delay, f.writeBack)
+	}
+}
+
+// store writes the buffer to the block store and announces it, returning
+// nil when there was nothing to store; the caller holds f.mu
+func (f *File) store() (*FileManifest, error) {
+	m, err := f.save()
+	if m != nil {
+		f.fs.node.announce(m)
+	}
+	return m, err
+}
+
+// save is store without the announcement; the caller holds f.mu
+func (f *File) save() (*FileManifest, error) {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	if !f.dirty {
+		return nil, nil
+	}
+	name, err := f.path()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bufferFetchTimeout)
+	defer cancel()
+	m, err := f.buf.save(ctx, name)
+	if err != nil {
+		return nil, errno(err)
+	}
+	f.dirty = false
+	return m, nil
+}
+
+// commit stores the buffer and replicates it in the background
+func (f *File) commit() error {
+	f.mu.Lock()
+	m, err := f.store()
+	f.mu.Unlock()
+	if m != nil {
+		f.fs.node.replicateLater(m)
+	}
+	return err
+}
 
-	// Update cache and broadcast to peers
-	f.fs.node.GetCache().Put(f.name, f.data)
-	go f.fs.node.BroadcastFile(f.name, f.data)
+// writeBack commits writes that stayed buffered for the write-back delay
+func (f *File) writeBack() {
+	if err := f.commit(); err != nil && !errors.Is(err, syscall.ENOENT) {
+		fmt.Printf("⚠️  Write-back failed: %v\n", err)
+	}
+}
+
+// Write copies data into the blocks it covers
+func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(ctx); err != nil {
+		return err
+	}
 
+	if err := f.buf.WriteAt(ctx, req.Data, req.Offset); err != nil {
+		return errno(err)
+	}
+	resp.Size = len(req.Data)
+	f.markDirty()
 	return nil
 }
 
-// Flush is called when file handle is closed
+// Flush is called on every close of a handle and drops the POSIX locks of
+// the closing process. Content already stored isn't written again, which
+// would overwrite an mtime set since (cp -p, rsync -t).
 func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	f.fs.node.GetCache().Put(f.name, f.data)
+	f.unlockOwner(req.LockOwner, false)
+	return f.commit()
+}
+
+// Fsync stores the buffer and, when enough peers are connected, waits until
+// the replication factor is met
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	f.mu.Lock()
+	_, err := f.store()
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	name, err := f.path()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.fs.node.cfg.SyncTimeout)
+	defer cancel()
+	if err := f.fs.node.syncWrite(ctx, name); err != nil {
+		fmt.Printf("⚠️  fsync: %v\n", err)
+		return syscall.EIO
+	}
 	return nil
 }
 
-// Setattr handles attribute changes
+// Release drops the handle's flock locks, and the buffer and every lock
+// once the last handle is closed
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		f.unlockOwner(req.LockOwner, true)
+	}
+	f.mu.Lock()
+	f.opens--
+	if f.opens > 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	f.mu.Unlock()
+	f.unlockAll()
+
+	f.mu.Lock()
+	m, err := f.store()
+	if errors.Is(err, syscall.ENOENT) {
+		err = nil // removed while open; the writes go with it
+	}
+	if err == nil {
+		f.buf = nil
+		f.dirty = false
+	}
+	f.mu.Unlock()
+
+	if m != nil {
+		f.fs.node.replicateLater(m)
+	}
+	return err
+}
+
+// Setattr handles attribute changes. Buffered writes are stored before
+// metadata changes so a later store doesn't bump an mtime set explicitly,
+// and truncates without an open handle are stored right away.
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.mu.Lock()
 	if req.Valid.Size() {
-		if req.Size < uint64(len(f.data)) {
-			f.data = f.data[:req.Size]
-		} else if req.Size > uint64(len(f.data)) {
-			newData := make([]byte, req.Size)
-			copy(newData, f.data)
-			f.data = newData
+		if err := f.load(ctx); err != nil {
+			f.mu.Unlock()
+			return err
 		}
-		f.fs.node.GetCache().Put(f.name, f.data)
+		f.buf.Truncate(int64(req.Size))
+		f.markDirty()
+	}
+	var m *FileManifest
+	var err error
+	if f.opens == 0 || req.Valid&^(fuse.SetattrSize|fuse.SetattrHandle|fuse.SetattrLockOwner) != 0 {
+		m, err = f.store()
+	}
+	f.mu.Unlock()
+	if m != nil {
+		f.fs.node.replicateLater(m)
+	}
+	if err != nil {
+		return err
 	}
-	return f.Attr(ctx, &resp.Attr)
-}
 
-// hashString creates a deterministic inode from filename
-func hashString(s string) uint64 {
-	h := sha256.Sum256([]byte(s))
-	hex := hex.EncodeToString(h[:8])
-	var result uint64
-	fmt.Sscanf(hex, "%x", &result)
-	return result
+	if err := f.setattr(req); err != nil {
+		return err
+	}
+	return f.Attr(ctx, &resp.Attr)
 }
@@ -0,0 +1,236 @@
+package nodus
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// testRoot returns the root directory of n's default volume, driven the way
+// the kernel would but without mounting, so no /dev/fuse is needed
+func testRoot(t *testing.T, n *Node) *Dir {
+	t.Helper()
+	root, err := newNodusFS(n, "").Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root.(*Dir)
+}
+
+// lookupPath walks the names below d
+func lookupPath(t *testing.T, d *Dir, names ...string) fs.Node {
+	t.Helper()
+	var node fs.Node = d
+	for _, name := range names {
+		dir, ok := node.(*Dir)
+		if !ok {
+			t.Fatalf("%s: parent is not a directory", name)
+		}
+		var err error
+		if node, err = dir.Lookup(context.Background(), name); err != nil {
+			t.Fatalf("lookup %s: %v", name, err)
+		}
+	}
+	return node
+}
+
+func mkdir(t *testing.T, d *Dir, name string) *Dir {
+	t.Helper()
+	node, err := d.Mkdir(context.Background(), &fuse.MkdirRequest{Name: name, Mode: os.ModeDir | 0755})
+	if err != nil {
+		t.Fatalf("mkdir %s: %v", name, err)
+	}
+	return node.(*Dir)
+}
+
+// writeTestFile creates name in d, writes data and closes it
+func writeTestFile(t *testing.T, d *Dir, name string, data []byte) *File {
+	t.Helper()
+	ctx := context.Background()
+	node, _, err := d.Create(ctx, &fuse.CreateRequest{Name: name, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+	f := node.(*File)
+	if err := f.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	if err := f.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("release %s: %v", name, err)
+	}
+	return f
+}
+
+func readTestFile(t *testing.T, f *File) string {
+	t.Helper()
+	var resp fuse.ReadResponse
+	if err := f.Read(context.Background(), &fuse.ReadRequest{Size: 1 << 20}, &resp); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(resp.Data)
+}
+
+func dirNames(t *testing.T, d *Dir) []string {
+	t.Helper()
+	entries, err := d.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFSNestedDirectories(t *testing.T) {
+	n := newTestNode(t)
+	root := testRoot(t, n)
+
+	src := mkdir(t, mkdir(t, root, "projects"), "src")
+	writeTestFile(t, src, "main.go", []byte("package main\n"))
+	if _, err := root.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "projects", Mode: os.ModeDir | 0755}); !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("mkdir over a directory: %v, want EEXIST", err)
+	}
+
+	f := lookupPath(t, root, "projects", "src", "main.go").(*File)
+	if got := readTestFile(t, f); got != "package main\n" {
+		t.Fatalf("read %q", got)
+	}
+	if got := dirNames(t, root); len(got) != 1 || got[0] != "projects" {
+		t.Fatalf("root lists %v", got)
+	}
+	if m := n.store.Manifest("projects/src"); m == nil || m.Kind != KindDir || m.Signer != n.host.ID() {
+		t.Fatalf("directory isn't a signed object: %+v", m)
+	}
+	if _, err := root.Lookup(context.Background(), VolumeDir); err == nil {
+		t.Fatal("named volumes reachable from the default root")
+	}
+}
+
+func TestFSRenameMovesSubtree(t *testing.T) {
+	n := newTestNode(t)
+	root := testRoot(t, n)
+	ctx := context.Background()
+
+	projects := mkdir(t, root, "projects")
+	src := mkdir(t, projects, "src")
+	f := writeTestFile(t, src, "main.go", []byte("v1"))
+
+	if err := root.Rename(ctx, &fuse.RenameRequest{OldName: "projects", NewName: "archive"}, root); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	// Nodes the kernel still holds follow the move
+	if p, err := src.path(); err != nil || p != "archive/src" {
+		t.Fatalf("moved directory at %q, %v", p, err)
+	}
+	if got := readTestFile(t, f); got != "v1" {
+		t.Fatalf("moved file reads %q", got)
+	}
+	if _, err := root.Lookup(ctx, "projects"); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("old path still resolves: %v", err)
+	}
+	if n.store.Manifest("archive/src/main.go") == nil {
+		t.Fatal("file not moved with its directory")
+	}
+
+	// Into another directory
+	other := mkdir(t, root, "other")
+	if err := src.Rename(ctx, &fuse.RenameRequest{OldName: "main.go", NewName: "app.go"}, other); err != nil {
+		t.Fatalf("rename across directories: %v", err)
+	}
+	if got := dirNames(t, other); len(got) != 1 || got[0] != "app.go" {
+		t.Fatalf("other lists %v", got)
+	}
+}
+
+func TestFSRemoveAndSymlinks(t *testing.T) {
+	n := newTestNode(t)
+	root := testRoot(t, n)
+	ctx := context.Background()
+
+	docs := mkdir(t, root, "docs")
+	writeTestFile(t, docs, "readme", []byte("hello"))
+	if _, err := docs.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: "readme"}); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	link := lookupPath(t, root, "docs", "link").(*Symlink)
+	if target, err := link.Readlink(ctx, &fuse.ReadlinkRequest{}); err != nil || target != "readme" {
+		t.Fatalf("readlink %q, %v", target, err)
+	}
+
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "docs", Dir: true}); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("rmdir of a non-empty directory: %v, want ENOTEMPTY", err)
+	}
+	for _, name := range []string{"readme", "link"} {
+		if err := docs.Remove(ctx, &fuse.RemoveRequest{Name: name}); err != nil {
+			t.Fatalf("remove %s: %v", name, err)
+		}
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "docs", Dir: true}); err != nil {
+		t.Fatalf("rmdir: %v", err)
+	}
+	if _, err := docs.ReadDirAll(ctx); err == nil {
+		t.Fatal("removed directory still lists")
+	}
+}
+
+func TestFSDirectoriesReachPeers(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+
+	mkdir(t, mkdir(t, testRoot(t, a), "shared"), "inbox")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		m := b.store.Manifest("shared/inbox")
+		if m != nil && m.Kind == KindDir && m.Signer == a.host.ID() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("directory not announced to the peer")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	lookupPath(t, testRoot(t, b), "shared", "inbox")
+}
+
+func TestFSFsyncWithoutPeers(t *testing.T) {
+	// Alone, with the default factor: fsync can't wait for copies nobody can hold
+	n := newTestNode(t, func(cfg *Config) {
+		cfg.ReplicationFactor = 3
+		cfg.SyncTimeout = 5 * time.Second
+	})
+	ctx := context.Background()
+	node, _, err := testRoot(t, n).Create(ctx, &fuse.CreateRequest{Name: "db", Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := node.(*File)
+	if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("committed")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := f.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Fatalf("fsync offline: %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("fsync waited %v for replicas", waited)
+	}
+	if data, err := n.store.ReadFile("db"); err != nil || string(data) != "committed" {
+		t.Fatalf("fsync didn't store the write: %q, %v", data, err)
+	}
+	if stats, _ := n.JournalStats(); stats.Pending != 1 {
+		t.Fatalf("%d operations journalled, want 1", stats.Pending)
+	}
+}
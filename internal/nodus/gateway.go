@@ -0,0 +1,307 @@
+// Package nodus - Read-only HTTP gateway for iPXE/UEFI HTTP boot and browsers
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultVolume names the default volume in gateway URLs
+const DefaultVolume = "default"
+
+// gatewayTimeout bounds how long one gateway request may wait on peers
+const gatewayTimeout = 2 * time.Minute
+
+// GatewayHandler serves the node's content read-only over HTTP:
+//
+//	GET /v/<volume>/<path>  files, with Range support, and directory listings
+//	GET /blob/<sha256>      a block held locally by its address, or a boot
+//	                        image by its digest
+//
+// The default volume is "default". Encrypted files are never served, and
+// blocks are not fetched from the network on behalf of a client. There is
+// no authentication otherwise; anyone who can reach the gateway can read
+// every plaintext file the node can, so it should only listen on a trusted
+// network.
+func (n *Node) GatewayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v/", n.serveGatewayPath)
+	mux.HandleFunc("/blob/", n.serveGatewayBlob)
+	return mux
+}
+
+// gatewayStatus maps an error to an HTTP status
+func gatewayStatus(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, os.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, ErrOffline), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// gatewayError sends err as a plain-text error response
+func gatewayError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), gatewayStatus(err))
+}
+
+// readOnly rejects methods other than GET and HEAD
+func readOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "the gateway is read-only", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// gatewayPath maps the part of a URL after /v/ to a store path
+func gatewayPath(rest string) (string, error) {
+	volume, p, _ := strings.Cut(rest, "/")
+	p = strings.TrimSuffix(p, "/")
+	if p != "" {
+		if err := checkPath(p); err != nil {
+			return "", fmt.Errorf("%w: %v", os.ErrInvalid, err)
+		}
+	}
+	if volume == DefaultVolume {
+		// Named volumes are only reachable by their own name
+		if p == VolumeDir || strings.HasPrefix(p, VolumeDir+"/") {
+			return "", fmt.Errorf("'%s': %w", p, os.ErrNotExist)
+		}
+		return p, nil
+	}
+	if err := checkVolumeName(volume); err != nil {
+		return "", err
+	}
+	if p == "" {
+		return volumeRoot(volume), nil
+	}
+	return volumeRoot(volume) + "/" + p, nil
+}
+
+// serveGatewayPath serves a file or lists a directory of a volume
+func (n *Node) serveGatewayPath(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/v/")
+	p, err := gatewayPath(rest)
+	if err != nil {
+		gatewayError(w, err)
+		return
+	}
+	if volume := volumeOf(p); volume != "" && n.store.volumeSpec(volume) == nil {
+		gatewayError(w, fmt.Errorf("volume '%s': %w", volume, os.ErrNotExist))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayTimeout)
+	defer cancel()
+	m, err := n.Stat(ctx, p)
+	if err != nil {
+		gatewayError(w, err)
+		return
+	}
+
+	switch m.Kind {
+	case KindDir:
+		// Relative links in the listing need the trailing slash
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		n.serveListing(w, r, p)
+	case KindSymlink:
+		// Only relative targets stay inside the volume
+		if strings.HasPrefix(m.Target, "/") {
+			gatewayError(w, fmt.Errorf("'%s' points outside the volume: %w", p, os.ErrNotExist))
+			return
+		}
+		http.Redirect(w, r, m.Target, http.StatusFound)
+	case "":
+		if strings.HasSuffix(r.URL.Path, "/") {
+			gatewayError(w, fmt.Errorf("'%s': %w", p, ErrNotDir))
+			return
+		}
+		// The gateway has no authentication to hand out what the key protects
+		if m.Encrypted() {
+			gatewayError(w, fmt.Errorf("'%s' is encrypted: %w", p, os.ErrPermission))
+			return
+		}
+		n.serveManifest(w, r, m, contentTag(m))
+	default:
+		gatewayError(w, fmt.Errorf("'%s': %w", p, os.ErrNotExist))
+	}
+}
+
+// serveListing lists a directory as HTML, or as JSON for clients that ask for it
+func (n *Node) serveListing(w http.ResponseWriter, r *http.Request, dir string) {
+	entries, err := n.ReadDir(dir)
+	if err != nil {
+		gatewayError(w, err)
+		return
+	}
+	if dir == "" {
+		visible := entries[:0]
+		for _, e := range entries {
+			if e.Name != VolumeDir {
+				visible = append(visible, e)
+			}
+		}
+		entries = visible
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	var b strings.Builder
+	title := html.EscapeString(r.URL.Path)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	for _, e := range entries {
+		name := e.Name
+		if e.Kind == KindDir {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</ul>\n</body></html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// contentTag derives a file's ETag from its size and block hashes, so it
+// changes with the content and nothing else
+func contentTag(m *FileManifest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", m.Size)
+	for _, ref := range m.Blocks {
+		h.Write(ref.Hash[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serveManifest serves a file's content; http.ServeContent handles Range,
+// HEAD and conditional requests against the ETag
+func (n *Node) serveManifest(w http.ResponseWriter, r *http.Request, m *FileManifest, etag string) {
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayTimeout)
+	defer cancel()
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	name := m.Name[strings.LastIndexByte(m.Name, '/')+1:]
+	http.ServeContent(w, r, name, time.Unix(0, m.Mtime), &manifestReader{ctx: ctx, node: n, m: m, block: -1})
+}
+
+// serveGatewayBlob serves content by hash: a block by its address, or a boot
+// image by the digest in its bundle. Only blocks already held locally are
+// served, so clients can't make the node fetch arbitrary content.
+func (n *Node) serveGatewayBlob(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	h, err := ParseBlockHash(strings.TrimPrefix(r.URL.Path, "/blob/"))
+	if err != nil {
+		gatewayError(w, fmt.Errorf("%w: %v", os.ErrInvalid, err))
+		return
+	}
+
+	if m := n.bootImage(h.String()); m != nil {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		n.serveManifest(w, r, m, h.String())
+		return
+	}
+
+	data, err := n.store.GetBlock(h)
+	if err != nil {
+		gatewayError(w, fmt.Errorf("blob %s: %w", h.String()[:12], os.ErrNotExist))
+		return
+	}
+
+	w.Header().Set("ETag", `"`+h.String()+`"`)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// bootImage returns the boot image whose content has the given digest (nil if none)
+func (n *Node) bootImage(digest string) *FileManifest {
+	for _, b := range n.boot.list() {
+		for _, fi := range b.images() {
+			if fi.image.SHA256 == digest {
+				return fi.image.Manifest
+			}
+		}
+	}
+	return nil
+}
+
+// manifestReader reads a file through the node a block at a time, fetching
+// blocks from peers as the reader reaches them
+type manifestReader struct {
+	ctx  context.Context
+	node *Node
+	m    *FileManifest
+	off  int64
+
+	block int // index of the block in data, -1 for none
+	data  []byte
+}
+
+// Read implements io.Reader
+func (r *manifestReader) Read(p []byte) (int, error) {
+	if r.off >= int64(r.m.Size) {
+		return 0, io.EOF
+	}
+	i := int(r.off / BlockSize)
+	if i != r.block {
+		data, err := r.node.ReadAt(r.ctx, r.m, int64(i)*BlockSize, BlockSize)
+		if err != nil {
+			return 0, err
+		}
+		r.block, r.data = i, data
+	}
+	copied := copy(p, r.data[r.off-int64(i)*BlockSize:])
+	r.off += int64(copied)
+	return copied, nil
+}
+
+// Seek implements io.Seeker
+func (r *manifestReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += int64(r.m.Size)
+	default:
+		return 0, fmt.Errorf("seek: bad whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative offset %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
@@ -0,0 +1,138 @@
+package nodus
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// gatewayGet requests path from the gateway with the given header pairs
+func gatewayGet(t *testing.T, srv *httptest.Server, path string, header ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestGatewayServesFiles(t *testing.T) {
+	n := newTestNode(t)
+	data := testData(3*BlockSize/2, 1)
+	m, err := n.WriteFile("docs/big.bin", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(n.GatewayHandler())
+	defer srv.Close()
+
+	resp, body := gatewayGet(t, srv, "/v/default/docs/big.bin")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("GET file: %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	// A range across the block boundary
+	resp, body = gatewayGet(t, srv, "/v/default/docs/big.bin", "Range", "bytes=262140-262150")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[262140:262151]) {
+		t.Fatalf("GET range: %d %q", resp.StatusCode, body)
+	}
+
+	resp, _ = gatewayGet(t, srv, "/v/default/docs/big.bin", "If-None-Match", `"`+contentTag(m)+`"`)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("conditional GET: %d, want 304", resp.StatusCode)
+	}
+
+	resp, body = gatewayGet(t, srv, "/v/default/docs/", "Accept", "application/json")
+	var entries []DirEntry
+	if err := json.Unmarshal(body, &entries); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("listing: %d %v", resp.StatusCode, err)
+	}
+	if len(entries) != 1 || entries[0].Name != "big.bin" {
+		t.Fatalf("listing: %+v", entries)
+	}
+
+	if resp, _ = gatewayGet(t, srv, "/v/default/.volumes/x"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("volume through the default volume: %d, want 404", resp.StatusCode)
+	}
+	if resp, _ = gatewayGet(t, srv, "/v/default/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing file: %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGatewayRefusesEncryptedFiles(t *testing.T) {
+	n := newTestNode(t)
+	key, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.store.SetMasterKey(key)
+	m, err := n.WriteFile("secret.txt", []byte("not for the gateway\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Encrypted() {
+		t.Fatal("file written with a master key isn't encrypted")
+	}
+	srv := httptest.NewServer(n.GatewayHandler())
+	defer srv.Close()
+
+	resp, body := gatewayGet(t, srv, "/v/default/secret.txt")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("encrypted file: %d, want 403", resp.StatusCode)
+	}
+	if bytes.Contains(body, []byte("not for the gateway")) {
+		t.Fatal("gateway served encrypted content")
+	}
+}
+
+func TestGatewayBlobServesLocalBlocksOnly(t *testing.T) {
+	writer := newTestNode(t)
+	reader := newTestNode(t)
+	linkNodes(t, writer, reader, TrustTrusted, TrustTrusted)
+
+	local, err := reader.WriteFile("mine.bin", testData(1000, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := writer.WriteFile("theirs.bin", testData(1000, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(reader.GatewayHandler())
+	defer srv.Close()
+
+	h := local.Blocks[0].Hash
+	resp, body := gatewayGet(t, srv, "/blob/"+h.String())
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testData(1000, 2)) {
+		t.Fatalf("local block: %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	// A peer holds it, but the gateway doesn't fetch for clients
+	h = remote.Blocks[0].Hash
+	if resp, _ = gatewayGet(t, srv, "/blob/"+h.String()); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("remote block: %d, want 404", resp.StatusCode)
+	}
+	if reader.store.HasBlock(h) {
+		t.Fatal("gateway fetched a remote block")
+	}
+
+	if resp, _ = gatewayGet(t, srv, "/blob/nothex"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad address: %d, want 400", resp.StatusCode)
+	}
+}
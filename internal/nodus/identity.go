@@ -0,0 +1,358 @@
+// Package nodus - Persistent Ed25519 node identity and key rotation
+package nodus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	identityFile     = "identity.key"
+	prevIdentityFile = "identity.key.prev"
+	nextIdentityFile = "identity.key.next" // a rotation not finished yet
+	handoverFile     = "handover.json"
+)
+
+// handoverContext domain-separates handover signatures from other Ed25519 uses
+const handoverContext = "spirit-nodus-handover/1\n"
+
+// LoadIdentity loads the node key from stateDir, creating it on first run.
+// A rotation interrupted by a crash is finished first, or rolled back if
+// its hand-over record was never written.
+func LoadIdentity(stateDir string) (crypto.PrivKey, error) {
+	path := filepath.Join(stateDir, identityFile)
+	if err := finishRotation(stateDir); err != nil {
+		return nil, err
+	}
+
+	key, err := readKeyFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// First run: generate and persist a new key
+	key, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	if err := writeKeyFile(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readKeyFile reads a marshaled private key, refusing group/world-readable files
+func readKeyFile(path string) (crypto.PrivKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("identity key %s has insecure permissions %v (want 0600)", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// writeKeyFile atomically writes a private key with 0600 permissions
+func writeKeyFile(path string, key crypto.PrivKey) error {
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and renames it over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Fingerprint returns a short, SSH-style fingerprint of a public key
+func Fingerprint(pub crypto.PubKey) (string, error) {
+	raw, err := pub.Raw()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// HandoverRecord lets a node move to a new key without re-pairing:
+// the old key vouches for the new one and the new key accepts the hand-over.
+type HandoverRecord struct {
+	OldKey []byte    `json:"old_key"` // marshaled public keys
+	NewKey []byte    `json:"new_key"`
+	Issued time.Time `json:"issued"`
+	OldSig []byte    `json:"old_sig"`
+	NewSig []byte    `json:"new_sig"`
+}
+
+// payload is the byte string both keys sign
+func (r *HandoverRecord) payload() []byte {
+	msg := []byte(handoverContext)
+	msg = append(msg, r.OldKey...)
+	msg = append(msg, r.NewKey...)
+	return append(msg, r.Issued.UTC().Format(time.RFC3339Nano)...)
+}
+
+// NewHandoverRecord signs a hand-over from oldKey to newKey
+func NewHandoverRecord(oldKey, newKey crypto.PrivKey) (*HandoverRecord, error) {
+	oldPub, err := crypto.MarshalPublicKey(oldKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	newPub, err := crypto.MarshalPublicKey(newKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &HandoverRecord{OldKey: oldPub, NewKey: newPub, Issued: time.Now().UTC()}
+	if r.OldSig, err = oldKey.Sign(r.payload()); err != nil {
+		return nil, err
+	}
+	if r.NewSig, err = newKey.Sign(r.payload()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verify checks both signatures on the record
+func (r *HandoverRecord) Verify() error {
+	oldPub, err := crypto.UnmarshalPublicKey(r.OldKey)
+	if err != nil {
+		return fmt.Errorf("invalid old key: %w", err)
+	}
+	newPub, err := crypto.UnmarshalPublicKey(r.NewKey)
+	if err != nil {
+		return fmt.Errorf("invalid new key: %w", err)
+	}
+
+	if ok, err := oldPub.Verify(r.payload(), r.OldSig); err != nil || !ok {
+		return fmt.Errorf("hand-over not signed by old key")
+	}
+	if ok, err := newPub.Verify(r.payload(), r.NewSig); err != nil || !ok {
+		return fmt.Errorf("hand-over not signed by new key")
+	}
+	return nil
+}
+
+// Peers returns the old and new peer IDs named by the record
+func (r *HandoverRecord) Peers() (oldID, newID peer.ID, err error) {
+	oldPub, err := crypto.UnmarshalPublicKey(r.OldKey)
+	if err != nil {
+		return "", "", err
+	}
+	newPub, err := crypto.UnmarshalPublicKey(r.NewKey)
+	if err != nil {
+		return "", "", err
+	}
+	if oldID, err = peer.IDFromPublicKey(oldPub); err != nil {
+		return "", "", err
+	}
+	if newID, err = peer.IDFromPublicKey(newPub); err != nil {
+		return "", "", err
+	}
+	return oldID, newID, nil
+}
+
+// RotateIdentity replaces the node key, keeping the previous key and a
+// signed hand-over record in stateDir. The new key is written aside first
+// and the hand-over record commits the rotation, so a crash at any point
+// leaves either the old key or the new one with its record, never a key
+// peers can't follow; see finishRotation.
+func RotateIdentity(stateDir string) (*HandoverRecord, error) {
+	oldKey, err := LoadIdentity(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	newKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+
+	record, err := NewHandoverRecord(oldKey, newKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKeyFile(filepath.Join(stateDir, nextIdentityFile), newKey); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(stateDir, handoverFile), data, 0644); err != nil {
+		os.Remove(filepath.Join(stateDir, nextIdentityFile))
+		return nil, err
+	}
+	if err := finishRotation(stateDir); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// finishRotation completes a rotation whose new key is waiting in
+// identity.key.next: with a hand-over record from the current key to it,
+// the current key becomes identity.key.prev and the new one takes its
+// place; without one the new key is dropped.
+func finishRotation(stateDir string) error {
+	nextPath := filepath.Join(stateDir, nextIdentityFile)
+	next, err := readKeyFile(nextPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cur, err := readKeyFile(filepath.Join(stateDir, identityFile))
+	if err != nil {
+		return err
+	}
+
+	record, err := LoadHandover(stateDir)
+	if err != nil || record == nil || !record.hands(cur.GetPublic(), next.GetPublic()) {
+		fmt.Println("🔑 Rolling back an interrupted key rotation")
+		return os.Remove(nextPath)
+	}
+	if err := writeKeyFile(filepath.Join(stateDir, prevIdentityFile), cur); err != nil {
+		return err
+	}
+	return os.Rename(nextPath, filepath.Join(stateDir, identityFile))
+}
+
+// hands reports whether the record hands over from oldPub to newPub
+func (r *HandoverRecord) hands(oldPub, newPub crypto.PubKey) bool {
+	o, err := crypto.MarshalPublicKey(oldPub)
+	if err != nil {
+		return false
+	}
+	n, err := crypto.MarshalPublicKey(newPub)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(o, r.OldKey) && bytes.Equal(n, r.NewKey)
+}
+
+// LoadHandover returns the latest hand-over record in stateDir (nil if the key was never rotated)
+func LoadHandover(stateDir string) (*HandoverRecord, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, handoverFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var record HandoverRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid hand-over record: %w", err)
+	}
+	if err := record.Verify(); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// RequestHandover asks a peer for the hand-over record that introduced its current key
+func (n *Node) RequestHandover(ctx context.Context, peerID peer.ID) (*HandoverRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolIdentity)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	reply, err := roundTrip(stream, frame{Type: msgHandoverRequest})
+	if err != nil {
+		return nil, err
+	}
+
+	var record HandoverRecord
+	if err := json.Unmarshal(reply.Payload, &record); err != nil {
+		return nil, fmt.Errorf("invalid hand-over record: %w", err)
+	}
+	if err := record.Verify(); err != nil {
+		return nil, err
+	}
+	if _, newID, err := record.Peers(); err != nil || newID != peerID {
+		return nil, fmt.Errorf("hand-over record does not name %s", peerID.ShortString())
+	}
+	return &record, nil
+}
+
+// handleIdentityRequest serves this node's hand-over record
+func (n *Node) handleIdentityRequest(stream network.Stream) {
+	defer stream.Close()
+
+	if _, err := readFrame(bufio.NewReader(stream), MaxFrameSize); err != nil {
+		return
+	}
+
+	record, err := LoadHandover(n.cfg.StateDir)
+	if err != nil || record == nil {
+		writeFrame(stream, errorFrame(msgHandover, StatusNotFound, "no hand-over record"))
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		writeFrame(stream, errorFrame(msgHandover, StatusError, err.Error()))
+		return
+	}
+	writeFrame(stream, frame{Type: msgHandover, Payload: data})
+}
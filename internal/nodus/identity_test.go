@@ -0,0 +1,137 @@
+package nodus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestRotateIdentity(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := RotateIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Verify(); err != nil {
+		t.Fatalf("hand-over record doesn't verify: %v", err)
+	}
+	prev, err := readKeyFile(filepath.Join(dir, prevIdentityFile))
+	if err != nil || !prev.Equals(oldKey) {
+		t.Fatalf("previous key not kept: %v", err)
+	}
+	newKey, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.hands(oldKey.GetPublic(), newKey.GetPublic()) {
+		t.Error("hand-over record doesn't name the old and new keys")
+	}
+	if _, err := os.Stat(filepath.Join(dir, nextIdentityFile)); !os.IsNotExist(err) {
+		t.Error("pending key left behind after rotation")
+	}
+}
+
+func TestInterruptedRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RotateIdentity(dir); err != nil {
+		t.Fatal(err)
+	}
+	newKey, _ := LoadIdentity(dir)
+
+	// Crash after the hand-over record: startup finishes the switch
+	os.Remove(filepath.Join(dir, prevIdentityFile))
+	if err := writeKeyFile(filepath.Join(dir, identityFile), oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(filepath.Join(dir, nextIdentityFile), newKey); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equals(newKey) {
+		t.Fatal("interrupted rotation with a hand-over record wasn't finished")
+	}
+	if prev, err := readKeyFile(filepath.Join(dir, prevIdentityFile)); err != nil || !prev.Equals(oldKey) {
+		t.Fatalf("previous key not kept when finishing: %v", err)
+	}
+
+	// Crash before the hand-over record: the record on disk is for the
+	// earlier rotation, so the pending key is dropped
+	next, err := LoadIdentity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(filepath.Join(dir, nextIdentityFile), next); err != nil {
+		t.Fatal(err)
+	}
+	key, err = LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equals(newKey) {
+		t.Fatal("rotation without a hand-over record wasn't rolled back")
+	}
+	if _, err := os.Stat(filepath.Join(dir, nextIdentityFile)); !os.IsNotExist(err) {
+		t.Error("rolled back key left behind")
+	}
+	if current, _ := LoadHandover(dir); current == nil || !current.hands(oldKey.GetPublic(), newKey.GetPublic()) {
+		t.Error("hand-over record changed by the rollback")
+	}
+}
+
+func TestHandoverCarriesTrust(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, _ := peer.IDFromPrivateKey(oldKey)
+	if _, err := RotateIdentity(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestNode(t, func(cfg *Config) { cfg.StateDir = dir })
+	b := newTestNode(t)
+	if err := b.Trust().Add(oldID, TrustTrusted, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Trust().Add(b.host.ID(), TrustTrusted, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.ConnectToPeer(ctx, fmt.Sprintf("%s/p2p/%s", b.Addrs()[0], b.ID())); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	waitFor(t, "trust to move to the new key", func() bool {
+		return b.Trust().Level(a.host.ID()) == TrustTrusted
+	})
+	if b.Trust().Level(oldID) != TrustUnknown {
+		t.Error("old key still trusted after the hand-over")
+	}
+
+	record, err := b.RequestHandover(ctx, a.host.ID())
+	if err != nil {
+		t.Fatalf("RequestHandover: %v", err)
+	}
+	if _, newID, _ := record.Peers(); newID != a.host.ID() {
+		t.Errorf("hand-over names %s, want %s", newID, a.ID())
+	}
+}
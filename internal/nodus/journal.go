@@ -0,0 +1,529 @@
+// Package nodus - Journal of changes made offline, replayed when peers return
+package nodus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	journalFile = "journal.json"
+
+	// appliedFile holds the IDs of operations peers replayed here
+	appliedFile = "journal-applied.json"
+
+	// journalKeep is how many settled operations are kept for reporting
+	journalKeep = 256
+
+	// journalRetryInterval is how often pending operations are retried while
+	// peers are connected
+	journalRetryInterval = time.Minute
+
+	// journalReplayTimeout bounds sending one operation to one peer
+	journalReplayTimeout = 30 * time.Second
+
+	// journalConnectDelay gives a new connection time to settle its trust
+	// level before pending operations are replayed over it
+	journalConnectDelay = 2 * time.Second
+
+	// appliedTTL is how long a peer remembers the IDs of replayed operations
+	appliedTTL = 24 * time.Hour
+)
+
+// ErrOffline is returned when a file isn't local and no peer can provide it
+var ErrOffline = errors.New("offline: no peers connected")
+
+// Journal operation kinds
+const (
+	OpCreate = "create"
+	OpWrite  = "write"
+	OpRename = "rename"
+	OpDelete = "delete"
+)
+
+// Journal operation states
+const (
+	OpPending = "pending"
+	OpAcked   = "acked"  // every reachable peer applied it
+	OpFailed  = "failed" // a peer rejected it; it won't be retried
+)
+
+// OpInfo describes one journalled operation
+type OpInfo struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Path     string    `json:"path"`
+	From     string    `json:"from,omitempty"` // old path of a rename
+	Time     time.Time `json:"time"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Attempts int       `json:"attempts,omitempty"`
+}
+
+// journalOp is an operation as journalled and replayed: the manifest written
+// by a create, write or rename, or the tombstone of a delete
+type journalOp struct {
+	OpInfo
+	Manifest json.RawMessage `json:"manifest"`
+}
+
+// manifest decodes and checks the operation's manifest
+func (op *journalOp) manifest() (*FileManifest, error) {
+	m, err := UnmarshalManifest(op.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if m.Name != op.Path {
+		return nil, fmt.Errorf("manifest of '%s' in %s of '%s'", m.Name, op.Kind, op.Path)
+	}
+	return m, nil
+}
+
+// JournalStats counts journalled operations by state
+type JournalStats struct {
+	Pending int `json:"pending"`
+	Acked   int `json:"acked"`
+	Failed  int `json:"failed"`
+}
+
+// journal records changes made while no peer was connected, persisted in
+// order so they survive restarts. It also remembers which operations peers
+// replayed here, so a replay that is retried is applied once.
+type journal struct {
+	mu          sync.Mutex
+	path        string
+	ops         []*journalOp
+	appliedPath string
+	applied     map[string]time.Time // IDs of operations replayed by peers
+	kick        chan struct{}
+
+	replaying sync.Mutex // held by the one replay running
+}
+
+// loadJournal loads the journal from stateDir (empty if missing)
+func loadJournal(stateDir string) (*journal, error) {
+	j := &journal{
+		path:        filepath.Join(stateDir, journalFile),
+		appliedPath: filepath.Join(stateDir, appliedFile),
+		applied:     make(map[string]time.Time),
+		kick:        make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &j.ops); err != nil {
+			return nil, fmt.Errorf("invalid journal: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// A replay retried after a restart must still be applied once
+	data, err = os.ReadFile(j.appliedPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &j.applied); err != nil {
+			return nil, fmt.Errorf("invalid journal: %w", err)
+		}
+		j.expireApplied(time.Now())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return j, nil
+}
+
+// save persists the journal; caller must hold mu
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j.ops, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path, data, 0644)
+}
+
+// record appends op as pending. A write replaces a pending create or write of
+// the same path that nothing has renamed or deleted since; the later
+// manifest supersedes it.
+func (j *journal) record(op *journalOp) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if op.Kind == OpWrite {
+		for i := len(j.ops) - 1; i >= 0; i-- {
+			prev := j.ops[i]
+			if prev.Path != op.Path && prev.From != op.Path {
+				continue
+			}
+			if prev.State == OpPending && (prev.Kind == OpCreate || prev.Kind == OpWrite) {
+				op.Kind = prev.Kind
+				j.ops = append(j.ops[:i], j.ops[i+1:]...)
+			}
+			break
+		}
+	}
+	j.ops = append(j.ops, op)
+	j.prune()
+	if err := j.save(); err != nil {
+		fmt.Printf("⚠️  Failed to save journal: %v\n", err)
+	}
+}
+
+// prune drops the oldest settled operations beyond journalKeep; caller must hold mu
+func (j *journal) prune() {
+	settled := 0
+	for _, op := range j.ops {
+		if op.State != OpPending {
+			settled++
+		}
+	}
+	if settled <= journalKeep {
+		return
+	}
+	kept := j.ops[:0]
+	for _, op := range j.ops {
+		if op.State != OpPending && settled > journalKeep {
+			settled--
+			continue
+		}
+		kept = append(kept, op)
+	}
+	j.ops = kept
+}
+
+// pending returns the pending operations, oldest first
+func (j *journal) pending() []*journalOp {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var ops []*journalOp
+	for _, op := range j.ops {
+		if op.State == OpPending {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// settle records the outcome of replaying op, or of attempting to
+func (j *journal) settle(op *journalOp, state string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	op.State = state
+	op.Error = ""
+	if err != nil {
+		op.Error = err.Error()
+	}
+	j.prune()
+	if err := j.save(); err != nil {
+		fmt.Printf("⚠️  Failed to save journal: %v\n", err)
+	}
+}
+
+// stats counts the operations by state and lists those not acked
+func (j *journal) stats() (JournalStats, []OpInfo) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var stats JournalStats
+	var open []OpInfo
+	for _, op := range j.ops {
+		switch op.State {
+		case OpPending:
+			stats.Pending++
+		case OpAcked:
+			stats.Acked++
+			continue
+		case OpFailed:
+			stats.Failed++
+		}
+		open = append(open, op.OpInfo)
+	}
+	return stats, open
+}
+
+// seen reports whether a peer already replayed the operation with id here
+func (j *journal) seen(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.applied[id]
+	return ok
+}
+
+// markApplied remembers a replayed operation, forgetting old ones
+func (j *journal) markApplied(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.expireApplied(now)
+	j.applied[id] = now
+	data, err := json.Marshal(j.applied)
+	if err == nil {
+		err = writeFileAtomic(j.appliedPath, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("⚠️  Failed to save journal: %v\n", err)
+	}
+}
+
+// expireApplied forgets replayed operations older than appliedTTL; caller
+// must hold mu
+func (j *journal) expireApplied(now time.Time) {
+	for id, at := range j.applied {
+		if now.Sub(at) > appliedTTL {
+			delete(j.applied, id)
+		}
+	}
+}
+
+// wake asks the replay loop to run
+func (j *journal) wake() {
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+}
+
+// newOp starts a pending operation with a fresh ID
+func newOp(kind, path string) *journalOp {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &journalOp{OpInfo: OpInfo{
+		ID:    hex.EncodeToString(id),
+		Kind:  kind,
+		Path:  path,
+		Time:  time.Now(),
+		State: OpPending,
+	}}
+}
+
+// offline reports whether no peer would hear of a change now
+func (n *Node) offline() bool {
+	return len(n.peersAtLeast(TrustCloud)) == 0
+}
+
+// journalWrite records a local create, write or delete of m. It's a create
+// when m is the only version of its path this node knows.
+func (n *Node) journalWrite(m *FileManifest) {
+	kind := OpWrite
+	switch {
+	case m.Kind == KindTombstone:
+		kind = OpDelete
+	case len(n.store.versions(m.Name)) <= 1:
+		kind = OpCreate
+	}
+	n.journalManifest(newOp(kind, m.Name), m)
+}
+
+// journalRename records that m was moved from its old path from
+func (n *Node) journalRename(from string, m *FileManifest) {
+	op := newOp(OpRename, m.Name)
+	op.From = from
+	n.journalManifest(op, m)
+}
+
+// journalManifest records op carrying m
+func (n *Node) journalManifest(op *journalOp, m *FileManifest) {
+	encoded, err := m.Marshal()
+	if err != nil {
+		fmt.Printf("⚠️  Failed to journal %s of '%s': %v\n", op.Kind, m.Name, err)
+		return
+	}
+	op.Manifest = encoded
+	n.journal.record(op)
+	fmt.Printf("📝 Offline: journalled %s of '%s'\n", op.Kind, m.Name)
+}
+
+// applyOp applies a journalled operation to the local store. Its manifest
+// is accepted like an announcement, so newer versions win. The old path of a
+// rename is removed by the tombstone journalled after it.
+func (n *Node) applyOp(op *journalOp) error {
+	if err := checkPath(op.Path); err != nil {
+		return err
+	}
+	switch op.Kind {
+	case OpCreate, OpWrite, OpDelete:
+	case OpRename:
+		if err := checkPath(op.From); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown operation '%s'", op.Kind)
+	}
+	m, err := op.manifest()
+	if err != nil {
+		return err
+	}
+	if (m.Kind == KindTombstone) != (op.Kind == OpDelete) {
+		return fmt.Errorf("%s of '%s' carries a %q manifest", op.Kind, op.Path, m.Kind)
+	}
+	n.acceptManifest(m)
+	return nil
+}
+
+// restoreJournal applies the pending operations again after a restart, since
+// manifests live in memory. Writes whose blocks were lost can't be replayed.
+func (n *Node) restoreJournal() {
+	for _, op := range n.journal.pending() {
+		m, err := op.manifest()
+		if err != nil {
+			n.journal.settle(op, OpFailed, err)
+			continue
+		}
+		if m.Kind == "" && len(n.store.MissingBlocks(m)) > 0 {
+			n.journal.settle(op, OpFailed, fmt.Errorf("content of '%s' lost in restart", m.Name))
+			continue
+		}
+		if err := n.applyOp(op); err != nil {
+			n.journal.settle(op, OpFailed, err)
+			continue
+		}
+		if m.Kind != "" {
+			continue
+		}
+		if cur := n.store.Manifest(m.Name); cur != nil && cur.ID() == m.ID() {
+			n.holdUnreplicated(cur)
+		}
+	}
+}
+
+// ReplayJournal sends the pending operations, oldest first, to every
+// connected cloud peer. An operation is acked once each peer that accepts
+// journal replays applied it, and fails if one rejects it; otherwise it
+// stays pending for the next replay. Peers apply each operation ID once.
+func (n *Node) ReplayJournal(ctx context.Context) {
+	peers := n.peersAtLeast(TrustCloud)
+	if len(peers) == 0 {
+		return
+	}
+	n.journal.replaying.Lock()
+	defer n.journal.replaying.Unlock()
+
+	for _, op := range n.journal.pending() {
+		if ctx.Err() != nil {
+			return
+		}
+		payload, err := json.Marshal(op)
+		if err != nil {
+			n.journal.settle(op, OpFailed, err)
+			continue
+		}
+
+		applied := 0
+		var rejected, lastErr error
+		for _, id := range peers {
+			err := n.sendOp(ctx, id, payload)
+			var re *RemoteError
+			switch {
+			case err == nil:
+				applied++
+			case errors.As(err, &re) && re.Status == StatusForbidden:
+				// The peer doesn't take writes from us; it never will
+			case errors.As(err, &re) && re.Status == StatusBadRequest:
+				rejected = fmt.Errorf("%s: %w", id.ShortString(), err)
+			default:
+				lastErr = fmt.Errorf("%s: %w", id.ShortString(), err)
+			}
+		}
+
+		n.journal.mu.Lock()
+		op.Attempts++
+		n.journal.mu.Unlock()
+		switch {
+		case rejected != nil:
+			n.journal.settle(op, OpFailed, rejected)
+			fmt.Printf("⚠️  Replay of %s of '%s' rejected: %v\n", op.Kind, op.Path, rejected)
+		case lastErr == nil && applied > 0:
+			n.journal.settle(op, OpAcked, nil)
+			if m, err := op.manifest(); err == nil && m.Kind == "" {
+				n.replicateLater(m)
+			}
+		default:
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no peer accepts journal replays")
+			}
+			n.journal.settle(op, OpPending, lastErr)
+		}
+	}
+}
+
+// sendOp replays one encoded operation to a peer and waits for its ack
+func (n *Node) sendOp(ctx context.Context, peerID peer.ID, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, journalReplayTimeout)
+	defer cancel()
+
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileBroadcast)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	_, err = roundTrip(stream, frame{Type: msgJournalOp, Payload: payload})
+	return err
+}
+
+// serveJournalOp applies an operation a peer journalled while offline
+func (n *Node) serveJournalOp(remote peer.ID, req frame) frame {
+	var op journalOp
+	if err := json.Unmarshal(req.Payload, &op); err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+	if op.ID == "" {
+		return errorFrame(msgAck, StatusBadRequest, "operation without ID")
+	}
+	if n.journal.seen(op.ID) {
+		return frame{Type: msgAck}
+	}
+	if err := n.applyOp(&op); err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+	n.journal.markApplied(op.ID)
+	fmt.Printf("📥 Replayed %s of '%s' from %s\n", op.Kind, op.Path, remote.ShortString())
+	return frame{Type: msgAck}
+}
+
+// JournalStats counts the journalled operations by state and lists those
+// still pending or failed
+func (n *Node) JournalStats() (JournalStats, []OpInfo) {
+	return n.journal.stats()
+}
+
+// StartJournal replays pending operations whenever a peer connects, and
+// retries them periodically, until ctx is cancelled
+func (n *Node) StartJournal(ctx context.Context) {
+	ticker := time.NewTicker(journalRetryInterval)
+	defer ticker.Stop()
+
+	n.ReplayJournal(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.journal.kick:
+		case <-ticker.C:
+		}
+		n.ReplayJournal(ctx)
+	}
+}
+
+// journalNotifee wakes the replay loop as peers connect
+type journalNotifee struct {
+	network.NoopNotifiee
+	node *Node
+}
+
+func (j *journalNotifee) Connected(net network.Network, conn network.Conn) {
+	time.AfterFunc(journalConnectDelay, j.node.journal.wake)
+}
@@ -0,0 +1,29 @@
+package nodus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppliedSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	j, err := loadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Lock()
+	j.applied["old"] = time.Now().Add(-appliedTTL - time.Minute)
+	j.mu.Unlock()
+	j.markApplied("recent")
+
+	j, err = loadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.seen("recent") {
+		t.Fatal("replayed operation forgotten across a restart")
+	}
+	if j.seen("old") {
+		t.Fatal("expired operation remembered")
+	}
+}
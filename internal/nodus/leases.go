@@ -0,0 +1,350 @@
+// Package nodus - Distributed leases backing FUSE locks across peers
+package nodus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// leaseTTL is how long a lease granted to a peer lasts without renewal
+	leaseTTL = 30 * time.Second
+
+	// leaseRenewInterval is how often held leases are renewed with every peer
+	leaseRenewInterval = leaseTTL / 3
+
+	// leaseRequestTimeout bounds one round of lease requests
+	leaseRequestTimeout = 5 * time.Second
+
+	// maxLeaseRequest bounds a lease request frame
+	maxLeaseRequest = 16 * 1024
+)
+
+// ErrLeaseHeld is returned when another peer holds a conflicting lease
+var ErrLeaseHeld = errors.New("lease held by another peer")
+
+// LeaseMode is what a lease on a file allows its holder
+type LeaseMode uint8
+
+const (
+	LeaseNone      LeaseMode = iota
+	LeaseShared              // read locks; any number of peers may hold one
+	LeaseExclusive           // write locks; no other peer holds any lease
+)
+
+// String returns the mode name
+func (m LeaseMode) String() string {
+	switch m {
+	case LeaseNone:
+		return "none"
+	case LeaseShared:
+		return "shared"
+	case LeaseExclusive:
+		return "exclusive"
+	}
+	return fmt.Sprintf("LeaseMode(%d)", uint8(m))
+}
+
+// leaseRequest is the payload of msgLease and msgLeaseRelease
+type leaseRequest struct {
+	Path string    `json:"path"`
+	Mode LeaseMode `json:"mode,omitempty"`
+}
+
+// lease is one peer's hold on a path
+type lease struct {
+	mode    LeaseMode
+	expires time.Time // zero for our own leases, which last until released
+}
+
+// leaseTable records the leases this node holds and those it granted to
+// peers. Every peer keeps its own table; a lease is only held once each
+// connected peer has granted it.
+type leaseTable struct {
+	mu     sync.Mutex
+	leases map[string]map[peer.ID]lease // path -> holder -> lease
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{leases: make(map[string]map[peer.ID]lease)}
+}
+
+// conflict returns a live lease on path held by someone other than holder
+// that mode can't coexist with, dropping expired ones; caller must hold mu
+func (t *leaseTable) conflict(path string, holder peer.ID, mode LeaseMode) (peer.ID, LeaseMode, bool) {
+	now := time.Now()
+	for id, l := range t.leases[path] {
+		if id == holder {
+			continue
+		}
+		if !l.expires.IsZero() && now.After(l.expires) {
+			delete(t.leases[path], id)
+			continue
+		}
+		if mode == LeaseExclusive || l.mode == LeaseExclusive {
+			return id, l.mode, true
+		}
+	}
+	return "", LeaseNone, false
+}
+
+// grant gives holder a lease on path for ttl (0 for no expiry) unless it
+// conflicts with another holder's, which is returned. It replaces the
+// holder's earlier lease, so the same call renews, upgrades and downgrades.
+func (t *leaseTable) grant(path string, holder peer.ID, mode LeaseMode, ttl time.Duration) (peer.ID, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if other, _, found := t.conflict(path, holder, mode); found {
+		return other, false
+	}
+	holders := t.leases[path]
+	if holders == nil {
+		holders = make(map[peer.ID]lease)
+		t.leases[path] = holders
+	}
+	l := lease{mode: mode}
+	if ttl > 0 {
+		l.expires = time.Now().Add(ttl)
+	}
+	holders[holder] = l
+	return "", true
+}
+
+// release drops holder's lease on path
+func (t *leaseTable) release(path string, holder peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.leases[path], holder)
+	if len(t.leases[path]) == 0 {
+		delete(t.leases, path)
+	}
+}
+
+// drop releases every lease of holder and returns how many it had
+func (t *leaseTable) drop(holder peer.ID) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dropped := 0
+	for path, holders := range t.leases {
+		if _, ok := holders[holder]; ok {
+			delete(holders, holder)
+			dropped++
+		}
+		if len(holders) == 0 {
+			delete(t.leases, path)
+		}
+	}
+	return dropped
+}
+
+// mode returns holder's lease on path
+func (t *leaseTable) mode(path string, holder peer.ID) LeaseMode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.leases[path][holder].mode
+}
+
+// held returns the leases of holder by path
+func (t *leaseTable) held(holder peer.ID) map[string]LeaseMode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	held := make(map[string]LeaseMode)
+	for path, holders := range t.leases {
+		if l, ok := holders[holder]; ok {
+			held[path] = l.mode
+		}
+	}
+	return held
+}
+
+// AcquireLease takes a lease on name, or changes the mode of the one held.
+// This node and every connected trusted peer must grant it; if one refuses,
+// the grants of this round are undone and ErrLeaseHeld is returned. Peers
+// that can't be reached don't block it; the next renewal tells them.
+func (n *Node) AcquireLease(ctx context.Context, name string, mode LeaseMode) error {
+	self := n.host.ID()
+	prev := n.leases.mode(name, self)
+	if holder, ok := n.leases.grant(name, self, mode, 0); !ok {
+		return fmt.Errorf("'%s': %w (%s)", name, ErrLeaseHeld, holder.ShortString())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, leaseRequestTimeout)
+	defer cancel()
+	granted, refused := n.requestLeases(ctx, n.peersAtLeast(TrustTrusted), name, mode)
+	if refused == "" {
+		return nil
+	}
+
+	if prev == LeaseNone {
+		n.leases.release(name, self)
+		go n.sendLeases(granted, msgLeaseRelease, name, LeaseNone)
+	} else {
+		n.leases.grant(name, self, prev, 0)
+		go n.sendLeases(granted, msgLease, name, prev)
+	}
+	return fmt.Errorf("'%s': %w (%s)", name, ErrLeaseHeld, refused.ShortString())
+}
+
+// ReleaseLease gives up the lease on name
+func (n *Node) ReleaseLease(name string) {
+	n.leases.release(name, n.host.ID())
+	go n.sendLeases(n.peersAtLeast(TrustTrusted), msgLeaseRelease, name, LeaseNone)
+}
+
+// leaseConflict returns a peer whose lease on name keeps this node from
+// taking one in mode
+func (n *Node) leaseConflict(name string, mode LeaseMode) (peer.ID, LeaseMode, bool) {
+	n.leases.mu.Lock()
+	defer n.leases.mu.Unlock()
+	return n.leases.conflict(name, n.host.ID(), mode)
+}
+
+// requestLeases asks peers concurrently for a lease on name, returning the
+// peers that granted it and one that refused ("" if none did)
+func (n *Node) requestLeases(ctx context.Context, peers []peer.ID, name string, mode LeaseMode) ([]peer.ID, peer.ID) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		granted []peer.ID
+		refused peer.ID
+	)
+	for _, id := range peers {
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			err := n.sendLease(ctx, id, msgLease, name, mode)
+			var re *RemoteError
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				granted = append(granted, id)
+			case errors.As(err, &re) && re.Status == StatusLocked:
+				refused = id
+			}
+		}(id)
+	}
+	wg.Wait()
+	return granted, refused
+}
+
+// sendLeases sends the same lease message to each peer
+func (n *Node) sendLeases(peers []peer.ID, typ uint8, name string, mode LeaseMode) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	for _, id := range peers {
+		n.sendLease(ctx, id, typ, name, mode)
+	}
+}
+
+// sendLease sends one lease request or release to a peer and waits for its reply
+func (n *Node) sendLease(ctx context.Context, peerID peer.ID, typ uint8, name string, mode LeaseMode) error {
+	payload, err := json.Marshal(leaseRequest{Path: name, Mode: mode})
+	if err != nil {
+		return err
+	}
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolLease)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	_, err = roundTrip(stream, frame{Type: typ, Payload: payload})
+	return err
+}
+
+// handleLeaseRequest grants, renews and releases leases for peers
+func (n *Node) handleLeaseRequest(stream network.Stream) {
+	defer stream.Close()
+
+	req, err := readFrame(bufio.NewReader(stream), maxLeaseRequest)
+	if err != nil {
+		writeFrame(stream, badRequest(msgAck, err))
+		return
+	}
+	writeFrame(stream, n.serveLease(stream.Conn().RemotePeer(), req))
+}
+
+// serveLease answers one lease frame from remote
+func (n *Node) serveLease(remote peer.ID, req frame) frame {
+	var lr leaseRequest
+	if err := json.Unmarshal(req.Payload, &lr); err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+	if err := checkPath(lr.Path); err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+
+	switch req.Type {
+	case msgLease:
+		if lr.Mode != LeaseShared && lr.Mode != LeaseExclusive {
+			return errorFrame(msgAck, StatusBadRequest, fmt.Sprintf("bad lease mode %d", lr.Mode))
+		}
+		if holder, ok := n.leases.grant(lr.Path, remote, lr.Mode, leaseTTL); !ok {
+			return errorFrame(msgAck, StatusLocked, fmt.Sprintf("'%s' is leased by %s", lr.Path, holder))
+		}
+	case msgLeaseRelease:
+		n.leases.release(lr.Path, remote)
+	default:
+		return errorFrame(msgAck, StatusBadRequest, fmt.Sprintf("unexpected message type %d", req.Type))
+	}
+	return frame{Type: msgAck}
+}
+
+// StartLeases renews the leases this node holds until ctx is cancelled.
+// Renewals also reach peers that connected after a lease was taken.
+func (n *Node) StartLeases(ctx context.Context) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.renewLeases(ctx)
+		}
+	}
+}
+
+// renewLeases sends every held lease to every trusted peer again
+func (n *Node) renewLeases(ctx context.Context) {
+	for name, mode := range n.leases.held(n.host.ID()) {
+		rctx, cancel := context.WithTimeout(ctx, leaseRequestTimeout)
+		_, refused := n.requestLeases(rctx, n.peersAtLeast(TrustTrusted), name, mode)
+		cancel()
+		if refused != "" {
+			// Taken while the peers couldn't reach each other; both keep their locks
+			fmt.Printf("⚠️  Lease on '%s' conflicts with one held by %s\n", name, refused.ShortString())
+		}
+	}
+}
+
+// leaseNotifee drops the leases of peers as they disconnect
+type leaseNotifee struct {
+	network.NoopNotifiee
+	node *Node
+}
+
+func (l *leaseNotifee) Disconnected(net network.Network, conn network.Conn) {
+	remote := conn.RemotePeer()
+	if net.Connectedness(remote) == network.Connected {
+		return // another connection to the peer is still open
+	}
+	if dropped := l.node.leases.drop(remote); dropped > 0 {
+		fmt.Printf("🔓 %s disconnected, released its %d lease(s)\n", remote.ShortString(), dropped)
+	}
+}
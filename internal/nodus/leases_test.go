@@ -0,0 +1,91 @@
+package nodus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseTableExpiry(t *testing.T) {
+	table := newLeaseTable()
+	holder, other := testPeerID(t), testPeerID(t)
+
+	if _, ok := table.grant("f", holder, LeaseExclusive, 50*time.Millisecond); !ok {
+		t.Fatal("first grant refused")
+	}
+	if id, ok := table.grant("f", other, LeaseShared, leaseTTL); ok || id != holder {
+		t.Fatalf("conflicting grant: %v, held by %s", ok, id)
+	}
+	// Renewing replaces the holder's own lease rather than conflicting with it
+	if _, ok := table.grant("f", holder, LeaseShared, 50*time.Millisecond); !ok {
+		t.Fatal("downgrade refused")
+	}
+	if _, ok := table.grant("f", other, LeaseShared, leaseTTL); !ok {
+		t.Fatal("shared lease refused beside a shared one")
+	}
+	if _, ok := table.grant("g", other, LeaseExclusive, leaseTTL); !ok {
+		t.Fatal("lease on another path refused")
+	}
+
+	// Unrenewed, the holder's lease lapses and stops blocking others
+	time.Sleep(100 * time.Millisecond)
+	table.release("f", other)
+	if _, ok := table.grant("f", other, LeaseExclusive, leaseTTL); !ok {
+		t.Fatal("expired lease still blocks")
+	}
+	if mode := table.mode("f", holder); mode != LeaseNone {
+		t.Errorf("expired lease still held as %s", mode)
+	}
+}
+
+func TestLeasesAcrossPeers(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+	ctx := context.Background()
+
+	if err := a.AcquireLease(ctx, "repo/.git/index", LeaseExclusive); err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	if err := b.AcquireLease(ctx, "repo/.git/index", LeaseShared); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("lease on b while a holds it: %v, want ErrLeaseHeld", err)
+	}
+	// The refused round is undone, so a can still downgrade and b share
+	if err := a.AcquireLease(ctx, "repo/.git/index", LeaseShared); err != nil {
+		t.Fatalf("downgrade: %v", err)
+	}
+	if err := b.AcquireLease(ctx, "repo/.git/index", LeaseShared); err != nil {
+		t.Fatalf("shared lease beside a's: %v", err)
+	}
+	if err := a.AcquireLease(ctx, "repo/.git/index", LeaseExclusive); !errors.Is(err, ErrLeaseHeld) {
+		t.Fatalf("upgrade while b shares: %v, want ErrLeaseHeld", err)
+	}
+	if mode := a.leases.mode("repo/.git/index", a.host.ID()); mode != LeaseShared {
+		t.Errorf("refused upgrade left a holding %s", mode)
+	}
+}
+
+func TestLeasesDroppedOnDisconnect(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+	ctx := context.Background()
+
+	if err := a.AcquireLease(ctx, "vm.img", LeaseExclusive); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found := b.leaseConflict("vm.img", LeaseShared); !found {
+		t.Fatal("b doesn't know a's lease")
+	}
+
+	// The holder goes away without releasing
+	a.Close()
+	waitFor(t, "a's lease to be dropped", func() bool {
+		_, _, found := b.leaseConflict("vm.img", LeaseShared)
+		return !found
+	})
+	if err := b.AcquireLease(ctx, "vm.img", LeaseExclusive); err != nil {
+		t.Errorf("lease after the holder left: %v", err)
+	}
+}
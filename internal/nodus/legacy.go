@@ -0,0 +1,187 @@
+// Package nodus - Compatibility with 1.0.0 peers (whole files, text headers)
+package nodus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Protocol IDs spoken by 1.0.0 nodes
+	ProtocolFileRequestV1   = protocol.ID("/spirit/nodus/file/1.0.0")
+	ProtocolFileBroadcastV1 = protocol.ID("/spirit/nodus/broadcast/1.0.0")
+
+	// maxLegacyLine bounds the text header lines of the 1.0.0 protocol
+	maxLegacyLine = 4096
+)
+
+// readLegacyLine reads one newline-terminated header line of at most maxLegacyLine bytes
+func readLegacyLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLegacyLine {
+			return "", fmt.Errorf("header line exceeds %d bytes", maxLegacyLine)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// checkLegacyName rejects names a 1.0.0 peer may not store under: anything
+// but a clean path, and the named volumes, which 1.0.0 knows nothing about
+func checkLegacyName(name string) error {
+	if err := checkPath(name); err != nil {
+		return err
+	}
+	if name == VolumeDir || strings.HasPrefix(name, VolumeDir+"/") {
+		return fmt.Errorf("'%s' is inside %s", name, VolumeDir)
+	}
+	return nil
+}
+
+// checkLegacyPush rejects a 1.0.0 push to a path that was deleted or ever
+// had a versioned manifest, which the unversioned push would otherwise undo
+func (n *Node) checkLegacyPush(name string) error {
+	if n.tombstones.get(name) != nil {
+		return fmt.Errorf("'%s' was deleted", name)
+	}
+	for _, m := range n.store.versions(name) {
+		if len(m.Version) > 0 {
+			return fmt.Errorf("'%s' has a newer version", name)
+		}
+	}
+	return nil
+}
+
+// requestLegacyFile fetches a whole file from a 1.0.0 peer and stores it as blocks
+func (n *Node) requestLegacyFile(stream network.Stream, filename string) (*FileManifest, error) {
+	if err := checkLegacyName(filename); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write([]byte(filename + "\n")); err != nil {
+		return nil, err
+	}
+	stream.CloseWrite()
+
+	data, err := io.ReadAll(io.LimitReader(stream, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxFrameSize {
+		return nil, fmt.Errorf("legacy file: %w", ErrFrameTooLarge)
+	}
+	if len(data) == 0 {
+		// 1.0.0 peers signal "not found" with an empty stream
+		return nil, &RemoteError{Status: StatusNotFound, Message: filename}
+	}
+
+	return n.store.PutFile(filename, data)
+}
+
+// sendLegacyFile pushes a whole file to a 1.0.0 peer.
+// 1.0.0 only carries plaintext, so encrypted files are never sent.
+func (n *Node) sendLegacyFile(stream network.Stream, m *FileManifest) error {
+	if m.Kind != "" {
+		return fmt.Errorf("'%s' is a %s, not sending to 1.0.0 peer", m.Name, m.Kind)
+	}
+	if m.Encrypted() {
+		return fmt.Errorf("'%s' is encrypted, not sending to 1.0.0 peer", m.Name)
+	}
+	data, err := n.store.Assemble(m)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("%s\n%d\n", m.Name, len(data))
+	if _, err := stream.Write([]byte(header)); err != nil {
+		return err
+	}
+	_, err = stream.Write(data)
+	return err
+}
+
+// handleLegacyFileRequest serves whole files to 1.0.0 peers
+func (n *Node) handleLegacyFileRequest(stream network.Stream) {
+	defer stream.Close()
+
+	filename, err := readLegacyLine(bufio.NewReader(stream))
+	if err != nil {
+		return
+	}
+
+	// 1.0.0 has no negative reply; an empty stream means not found.
+	// Encrypted files are never decrypted for the wire.
+	m := n.store.Manifest(filename)
+	if m == nil || m.Encrypted() {
+		return
+	}
+	data, err := n.store.Assemble(m)
+	if err != nil {
+		return
+	}
+
+	stream.Write(data)
+	fmt.Printf("📤 File '%s' sent to 1.0.0 peer %s\n", filename, stream.Conn().RemotePeer().ShortString())
+}
+
+// handleLegacyBroadcast accepts whole-file pushes from 1.0.0 peers
+func (n *Node) handleLegacyBroadcast(stream network.Stream) {
+	defer stream.Close()
+
+	r := bufio.NewReader(stream)
+	filename, err := readLegacyLine(r)
+	if err != nil {
+		return
+	}
+	if err := checkLegacyName(filename); err != nil {
+		fmt.Printf("⚠️  Rejected 1.0.0 broadcast: %v\n", err)
+		return
+	}
+	sizeLine, err := readLegacyLine(r)
+	if err != nil {
+		return
+	}
+	size, err := strconv.Atoi(sizeLine)
+	if err != nil || size < 0 || size > MaxBroadcastSize {
+		fmt.Printf("⚠️  Rejected 1.0.0 broadcast '%s' with size %q\n", filename, sizeLine)
+		return
+	}
+	// 1.0.0 knows nothing of versions, so its push can't supersede one
+	if err := n.checkLegacyPush(filename); err != nil {
+		fmt.Printf("⚠️  Rejected 1.0.0 broadcast: %v\n", err)
+		return
+	}
+	remote := stream.Conn().RemotePeer()
+	if err := n.checkQuota(remote, []BlockRef{{Size: uint32(size)}}); err != nil {
+		fmt.Printf("⚠️  Rejected 1.0.0 broadcast '%s': %v\n", filename, err)
+		return
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return
+	}
+
+	m, err := n.store.storeUnversioned(filename, data, remote.String(), nil)
+	if err != nil {
+		fmt.Printf("⚠️  Rejected 1.0.0 broadcast '%s': %v\n", filename, err)
+		return
+	}
+	if !n.acceptManifest(m) {
+		fmt.Printf("⚠️  Rejected 1.0.0 broadcast '%s': a newer version is held\n", filename)
+		return
+	}
+	fmt.Printf("📥 Received broadcast: '%s' (%d bytes) from 1.0.0 peer %s\n", filename, size, remote.ShortString())
+}
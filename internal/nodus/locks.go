@@ -0,0 +1,292 @@
+// Package nodus - flock and POSIX record locks for FUSE files
+package nodus
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// lockRetryInterval is how often a waiting lock retries a lease another
+// peer holds; a random share of it is added so two peers don't retry in step
+const lockRetryInterval = time.Second
+
+// fileLock is a lock one owner holds on an inclusive byte range. flock and
+// POSIX locks are independent, as on Linux; FUSE sends flock as the whole range.
+type fileLock struct {
+	owner      fuse.LockOwner
+	flock      bool
+	start, end uint64
+	exclusive  bool
+	pid        int32
+}
+
+// requestLock converts the lock of a FUSE request
+func requestLock(owner fuse.LockOwner, lk fuse.FileLock, flags fuse.LockFlags) fileLock {
+	return fileLock{
+		owner:     owner,
+		flock:     flags&fuse.LockFlock != 0,
+		start:     lk.Start,
+		end:       lk.End,
+		exclusive: lk.Type == fuse.LockWrite,
+		pid:       lk.PID,
+	}
+}
+
+// fuseLock converts l back for a lock query
+func (l fileLock) fuseLock() fuse.FileLock {
+	lk := fuse.FileLock{Start: l.start, End: l.end, Type: fuse.LockRead, PID: l.pid}
+	if l.exclusive {
+		lk.Type = fuse.LockWrite
+	}
+	return lk
+}
+
+// conflicts reports whether l and o can't both be held
+func (l fileLock) conflicts(o fileLock) bool {
+	return l.flock == o.flock && l.owner != o.owner &&
+		l.start <= o.end && o.start <= l.end &&
+		(l.exclusive || o.exclusive)
+}
+
+// lockTable holds the locks taken through one file's handles
+type lockTable struct {
+	locks   []fileLock
+	changed chan struct{} // closed whenever a lock is released
+}
+
+// conflict returns a held lock that keeps l from being taken
+func (t *lockTable) conflict(l fileLock) (fileLock, bool) {
+	for _, held := range t.locks {
+		if held.conflicts(l) {
+			return held, true
+		}
+	}
+	return fileLock{}, false
+}
+
+// set takes l, replacing its owner's locks of the same kind on its range
+func (t *lockTable) set(l fileLock) {
+	t.unlock(l.owner, l.flock, l.start, l.end)
+	t.locks = append(t.locks, l)
+}
+
+// unlock releases owner's locks on start..end, keeping the parts of longer
+// locks outside it
+func (t *lockTable) unlock(owner fuse.LockOwner, flock bool, start, end uint64) {
+	var kept []fileLock
+	for _, l := range t.locks {
+		if l.owner != owner || l.flock != flock || l.start > end || l.end < start {
+			kept = append(kept, l)
+			continue
+		}
+		if l.start < start {
+			left := l
+			left.end = start - 1
+			kept = append(kept, left)
+		}
+		if l.end > end {
+			right := l
+			right.start = end + 1
+			kept = append(kept, right)
+		}
+	}
+	t.locks = kept
+	t.wake()
+}
+
+// unlockOwner releases every lock of owner of one kind
+func (t *lockTable) unlockOwner(owner fuse.LockOwner, flock bool) {
+	t.unlock(owner, flock, 0, math.MaxUint64)
+}
+
+// clear releases every lock
+func (t *lockTable) clear() {
+	t.locks = nil
+	t.wake()
+}
+
+// leaseMode returns the lease the held locks need from other peers
+func (t *lockTable) leaseMode() LeaseMode {
+	mode := LeaseNone
+	for _, l := range t.locks {
+		if l.exclusive {
+			return LeaseExclusive
+		}
+		mode = LeaseShared
+	}
+	return mode
+}
+
+// wait returns a channel closed the next time a lock is released
+func (t *lockTable) wait() <-chan struct{} {
+	if t.changed == nil {
+		t.changed = make(chan struct{})
+	}
+	return t.changed
+}
+
+// wake signals waiters that a lock was released
+func (t *lockTable) wake() {
+	if t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+}
+
+// Lock takes a lock without waiting: EAGAIN if another owner here holds a
+// conflicting one, or another peer holds a conflicting lease on the file
+func (f *File) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	_, err := f.lock(ctx, requestLock(req.LockOwner, req.Lock, req.LockFlags))
+	return err
+}
+
+// LockWait takes a lock, waiting for local owners to release theirs and
+// retrying while another peer holds the lease
+func (f *File) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	l := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	for {
+		released, err := f.lock(ctx, l)
+		if err != syscall.EAGAIN {
+			return err
+		}
+		retry := lockRetryInterval + time.Duration(rand.Int63n(int64(lockRetryInterval)))
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-released:
+		case <-time.After(retry):
+		}
+	}
+}
+
+// lock takes l if nothing conflicts, first taking or upgrading the file's
+// lease. A local conflict returns a channel closed when a lock is released.
+func (f *File) lock(ctx context.Context, l fileLock) (<-chan struct{}, error) {
+	name, err := f.path()
+	if err != nil {
+		return nil, err
+	}
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+
+	if _, held := f.locks.conflict(l); held {
+		return f.locks.wait(), syscall.EAGAIN
+	}
+
+	next := lockTable{locks: append([]fileLock(nil), f.locks.locks...)}
+	next.set(l)
+	if mode := next.leaseMode(); mode > f.lease {
+		if err := f.fs.node.AcquireLease(ctx, name, mode); err != nil {
+			if errors.Is(err, ErrLeaseHeld) {
+				return nil, syscall.EAGAIN
+			}
+			return nil, syscall.EIO
+		}
+		if f.lease == LeaseNone {
+			f.leaseName = name
+		}
+		f.lease = mode
+		f.reload()
+	}
+	f.locks.set(l)
+	f.settleLease()
+	return nil, nil
+}
+
+// reload drops an unmodified buffer once a lease is taken, so reads and
+// writes under the lock start from what the previous holder stored
+func (f *File) reload() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		f.buf = nil
+	}
+}
+
+// settleLease weakens or gives up the lease once the held locks no longer
+// need it. Writes made under an exclusive lease are stored and announced
+// before it goes, so the next holder sees them; the caller holds lockMu.
+func (f *File) settleLease() {
+	mode := f.locks.leaseMode()
+	if mode >= f.lease {
+		return
+	}
+	node := f.fs.node
+	if f.lease == LeaseExclusive {
+		f.mu.Lock()
+		m, err := f.save()
+		f.mu.Unlock()
+		if err == nil && m != nil {
+			node.announceWait(m)
+			node.replicateLater(m)
+		}
+	}
+
+	if mode == LeaseNone {
+		node.ReleaseLease(f.leaseName)
+	} else {
+		// Every peer accepts a downgrade, so the result doesn't matter
+		node.AcquireLease(context.Background(), f.leaseName, mode)
+	}
+	f.lease = mode
+}
+
+// Unlock releases a lock or part of one
+func (f *File) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	l := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+	f.locks.unlock(l.owner, l.flock, l.start, l.end)
+	f.settleLease()
+	return nil
+}
+
+// unlockOwner releases the locks an owner loses when it closes the file
+func (f *File) unlockOwner(owner fuse.LockOwner, flock bool) {
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+	f.locks.unlockOwner(owner, flock)
+	f.settleLease()
+}
+
+// unlockAll releases every lock once the last handle is closed
+func (f *File) unlockAll() {
+	f.lockMu.Lock()
+	defer f.lockMu.Unlock()
+	f.locks.clear()
+	f.settleLease()
+}
+
+// QueryLock reports a lock that would keep the requested one from being
+// taken. A conflicting lease of another peer is reported as a lock on the
+// whole file without a PID.
+func (f *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	l := requestLock(req.LockOwner, req.Lock, req.LockFlags)
+	f.lockMu.Lock()
+	held, found := f.locks.conflict(l)
+	f.lockMu.Unlock()
+	if found {
+		resp.Lock = held.fuseLock()
+		return nil
+	}
+
+	name, err := f.path()
+	if err != nil {
+		return err
+	}
+	mode := LeaseShared
+	if l.exclusive {
+		mode = LeaseExclusive
+	}
+	if _, other, found := f.fs.node.leaseConflict(name, mode); found {
+		remote := fileLock{start: 0, end: math.MaxInt64, exclusive: other == LeaseExclusive}
+		resp.Lock = remote.fuseLock()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package nodus
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// lockReq builds a lock request on start..end for owner
+func lockReq(owner fuse.LockOwner, start, end uint64, typ fuse.LockType, flags fuse.LockFlags) *fuse.LockRequest {
+	return &fuse.LockRequest{
+		LockOwner: owner,
+		Lock:      fuse.FileLock{Start: start, End: end, Type: typ, PID: int32(owner)},
+		LockFlags: flags,
+	}
+}
+
+func TestFSLocksConflictLocally(t *testing.T) {
+	n := newTestNode(t)
+	ctx := context.Background()
+	f := writeTestFile(t, testRoot(t, n), "db.sqlite", []byte("pages"))
+
+	if err := f.Lock(ctx, lockReq(1, 0, 99, fuse.LockWrite, 0)); err != nil {
+		t.Fatalf("first lock: %v", err)
+	}
+	if err := f.Lock(ctx, lockReq(2, 50, 60, fuse.LockRead, 0)); err != syscall.EAGAIN {
+		t.Fatalf("overlapping lock: %v, want EAGAIN", err)
+	}
+	if err := f.Lock(ctx, lockReq(2, 100, 199, fuse.LockWrite, 0)); err != nil {
+		t.Fatalf("lock beside the held range: %v", err)
+	}
+	// flock and POSIX locks don't see each other
+	if err := f.Lock(ctx, lockReq(2, 0, 1<<63-1, fuse.LockWrite, fuse.LockFlock)); err != nil {
+		t.Fatalf("flock beside POSIX locks: %v", err)
+	}
+
+	var query fuse.QueryLockResponse
+	if err := f.QueryLock(ctx, &fuse.QueryLockRequest{LockOwner: 2, Lock: fuse.FileLock{Start: 10, End: 20, Type: fuse.LockRead}}, &query); err != nil {
+		t.Fatal(err)
+	}
+	if query.Lock.Type != fuse.LockWrite || query.Lock.PID != 1 || query.Lock.Start != 0 || query.Lock.End != 99 {
+		t.Errorf("query reported %+v, want owner 1's write lock", query.Lock)
+	}
+
+	// A waiter is woken once the range it wants is unlocked
+	done := make(chan error, 1)
+	go func() {
+		req := fuse.LockWaitRequest(*lockReq(2, 0, 9, fuse.LockWrite, 0))
+		done <- f.LockWait(ctx, &req)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("LockWait returned %v while the range was held", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock := fuse.UnlockRequest(*lockReq(1, 0, 49, fuse.LockUnlock, 0))
+	if err := f.Unlock(ctx, &unlock); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("LockWait: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("LockWait not woken by the unlock")
+	}
+	// Owner 1 still holds the rest of its range
+	if err := f.Lock(ctx, lockReq(2, 50, 60, fuse.LockRead, 0)); err != syscall.EAGAIN {
+		t.Errorf("lock on the range still held: %v, want EAGAIN", err)
+	}
+}
+
+func TestFSLocksConflictAcrossPeers(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+	ctx := context.Background()
+
+	fa := writeTestFile(t, testRoot(t, a), "shared.db", []byte("v1"))
+	waitFor(t, "the file on the peer", func() bool { return b.store.Manifest("shared.db") != nil })
+	fb := lookupPath(t, testRoot(t, b), "shared.db").(*File)
+
+	if err := fa.Lock(ctx, lockReq(1, 0, 1<<63-1, fuse.LockWrite, fuse.LockFlock)); err != nil {
+		t.Fatalf("lock on a: %v", err)
+	}
+	if err := fb.Lock(ctx, lockReq(1, 0, 1<<63-1, fuse.LockRead, fuse.LockFlock)); err != syscall.EAGAIN {
+		t.Fatalf("lock on b while a holds the file: %v, want EAGAIN", err)
+	}
+
+	unlock := fuse.UnlockRequest(*lockReq(1, 0, 1<<63-1, fuse.LockUnlock, fuse.LockFlock))
+	if err := fa.Unlock(ctx, &unlock); err != nil {
+		t.Fatal(err)
+	}
+	// The release reaches b in the background
+	waitFor(t, "the lease to be released", func() bool {
+		return fb.Lock(ctx, lockReq(1, 0, 1<<63-1, fuse.LockRead, fuse.LockFlock)) == nil
+	})
+	// Shared leases coexist
+	if err := fa.Lock(ctx, lockReq(2, 0, 1<<63-1, fuse.LockRead, fuse.LockFlock)); err != nil {
+		t.Errorf("shared lock beside the peer's: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+// Package nodus - POSIX metadata: modes, ownership, timestamps and xattrs
+package nodus
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Extended attribute limits, matching what Linux accepts
+const (
+	MaxXattrName  = 255
+	MaxXattrValue = 64 * 1024
+	maxXattrTotal = 256 * 1024 // all attributes of one entry
+)
+
+// SetXattr flags, with the values of setxattr(2)
+const (
+	XattrCreate  = 1 // fail if the attribute exists
+	XattrReplace = 2 // fail if it doesn't
+)
+
+var (
+	// ErrNoXattr is returned for an attribute the entry doesn't have
+	ErrNoXattr = errors.New("no such attribute")
+	// ErrXattrTooLarge is returned when an attribute exceeds the size limits
+	ErrXattrTooLarge = errors.New("attribute too large")
+)
+
+// Meta is the POSIX metadata carried in a manifest and replicated with it.
+// Times are Unix nanoseconds. Atime is only stored when set explicitly, so
+// reads never turn into announcements; until then it reads as Mtime.
+type Meta struct {
+	Mode   uint32            `json:"mode,omitempty"` // st_mode: type and permission bits
+	Uid    uint32            `json:"uid,omitempty"`
+	Gid    uint32            `json:"gid,omitempty"`
+	Atime  int64             `json:"atime,omitempty"`
+	Mtime  int64             `json:"mtime,omitempty"`
+	Ctime  int64             `json:"ctime,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// File type bits of st_mode. They make a stored mode nonzero even with no
+// permissions, so zero only means a manifest that predates metadata.
+const (
+	modeTypeMask = 0170000
+	modeRegular  = 0100000
+	modeDir      = 0040000
+	modeSymlink  = 0120000
+)
+
+// typeBits returns the st_mode type bits of a manifest kind
+func typeBits(kind string) uint32 {
+	switch kind {
+	case KindDir:
+		return modeDir
+	case KindSymlink:
+		return modeSymlink
+	}
+	return modeRegular
+}
+
+// defaultMode is the mode of an entry created without one, and of
+// manifests from peers that predate metadata
+func defaultMode(kind string) uint32 {
+	switch kind {
+	case KindDir:
+		return modeDir | 0755
+	case KindSymlink:
+		return modeSymlink | 0777
+	}
+	return modeRegular | 0644
+}
+
+// newMeta returns the metadata of a new entry: meta with its times filled
+// in, or when meta is nil the default mode and this process's ownership
+func newMeta(kind string, meta *Meta) Meta {
+	now := time.Now().UnixNano()
+	var m Meta
+	if meta != nil {
+		m = meta.clone()
+		m.Mode = m.Mode&07777 | typeBits(kind)
+	} else {
+		m.Mode = defaultMode(kind)
+		m.Uid, m.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	}
+	if m.Mtime == 0 {
+		m.Mtime = now
+	}
+	if m.Atime == 0 {
+		m.Atime = m.Mtime
+	}
+	m.Ctime = now
+	return m
+}
+
+// clone copies the metadata so the copy's xattrs can be changed
+func (m Meta) clone() Meta {
+	if m.Xattrs != nil {
+		xattrs := make(map[string][]byte, len(m.Xattrs))
+		for name, value := range m.Xattrs {
+			xattrs[name] = value
+		}
+		m.Xattrs = xattrs
+	}
+	return m
+}
+
+// checkMeta validates metadata received from a peer or set locally
+func (m *FileManifest) checkMeta() error {
+	if m.Mode != 0 && m.Mode&modeTypeMask != typeBits(m.Kind) {
+		return fmt.Errorf("mode %o doesn't match kind %q", m.Mode, m.Kind)
+	}
+	total := 0
+	for name, value := range m.Xattrs {
+		if err := checkXattrName(name); err != nil {
+			return err
+		}
+		total += len(name) + len(value)
+		if len(value) > MaxXattrValue || total > maxXattrTotal {
+			return fmt.Errorf("xattr '%s': %w", name, ErrXattrTooLarge)
+		}
+	}
+	return nil
+}
+
+// checkXattrName accepts the user, trusted and security namespaces. system.*
+// holds ACLs, which the filesystem doesn't enforce.
+func checkXattrName(name string) error {
+	if len(name) > MaxXattrName {
+		return fmt.Errorf("xattr name: %w", ErrXattrTooLarge)
+	}
+	for _, ns := range []string{"user.", "trusted.", "security."} {
+		if strings.HasPrefix(name, ns) && len(name) > len(ns) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: xattr name %q", os.ErrInvalid, name)
+}
+
+// FileMode returns the entry's type and permission bits
+func (m *FileManifest) FileMode() os.FileMode {
+	bits := m.Mode
+	if bits == 0 {
+		bits = defaultMode(m.Kind)
+	}
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	switch m.Kind {
+	case KindDir:
+		mode |= os.ModeDir
+	case KindSymlink:
+		mode |= os.ModeSymlink
+	}
+	return mode
+}
+
+// posixMode converts the permission bits of an os.FileMode to st_mode bits
+func posixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// unixTime converts stored nanoseconds, leaving unset times zero
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// ModTime returns the last content change
+func (m *FileManifest) ModTime() time.Time {
+	return unixTime(m.Mtime)
+}
+
+// AccessTime returns the last explicitly set access time, or ModTime
+func (m *FileManifest) AccessTime() time.Time {
+	if m.Atime == 0 {
+		return m.ModTime()
+	}
+	return unixTime(m.Atime)
+}
+
+// ChangeTime returns the last content or metadata change
+func (m *FileManifest) ChangeTime() time.Time {
+	return unixTime(m.Ctime)
+}
+
+// UpdateMeta changes the metadata of p and announces the new manifest. A
+// changed Mode only needs permission bits; the type bits are kept.
+// Directories implied by deeper paths become real directories; the root
+// has no manifest and can't be changed.
+func (n *Node) UpdateMeta(p string, update func(*Meta) error) (*FileManifest, error) {
+	if p == "" {
+		return nil, fmt.Errorf("%w: the root has no metadata", os.ErrPermission)
+	}
+	m := n.statLocal(p)
+	if m == nil {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+
+	changed := *m
+	changed.Meta = m.Meta.clone()
+	if err := update(&changed.Meta); err != nil {
+		return nil, err
+	}
+	if changed.Mode != m.Mode {
+		changed.Mode = changed.Mode&07777 | typeBits(changed.Kind)
+	}
+	if err := changed.checkMeta(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	changed.Ctime = time.Now().UnixNano()
+
+	if changed.Kind != "" {
+		if err := n.publishObject(&changed); err != nil {
+			return nil, err
+		}
+		return &changed, nil
+	}
+	n.store.stamp(&changed)
+	n.store.PutManifest(&changed)
+	n.announce(&changed)
+	return &changed, nil
+}
+
+// GetXattr returns one extended attribute of p
+func (n *Node) GetXattr(p, name string) ([]byte, error) {
+	m := n.statLocal(p)
+	if m == nil {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	value, ok := m.Xattrs[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s: %w", p, name, ErrNoXattr)
+	}
+	return value, nil
+}
+
+// ListXattr returns the sorted names of p's extended attributes
+func (n *Node) ListXattr(p string) ([]string, error) {
+	m := n.statLocal(p)
+	if m == nil {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	names := make([]string, 0, len(m.Xattrs))
+	for name := range m.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SetXattr sets an extended attribute of p; flags are XattrCreate or XattrReplace
+func (n *Node) SetXattr(p, name string, value []byte, flags uint32) (*FileManifest, error) {
+	if err := checkXattrName(name); err != nil {
+		return nil, err
+	}
+	return n.UpdateMeta(p, func(meta *Meta) error {
+		_, exists := meta.Xattrs[name]
+		switch {
+		case flags&XattrCreate != 0 && exists:
+			return fmt.Errorf("%s: %w", name, os.ErrExist)
+		case flags&XattrReplace != 0 && !exists:
+			return fmt.Errorf("%s: %w", name, ErrNoXattr)
+		}
+		if meta.Xattrs == nil {
+			meta.Xattrs = make(map[string][]byte)
+		}
+		meta.Xattrs[name] = append([]byte(nil), value...)
+		return nil
+	})
+}
+
+// RemoveXattr deletes an extended attribute of p
+func (n *Node) RemoveXattr(p, name string) (*FileManifest, error) {
+	return n.UpdateMeta(p, func(meta *Meta) error {
+		if _, ok := meta.Xattrs[name]; !ok {
+			return fmt.Errorf("%s: %w", name, ErrNoXattr)
+		}
+		delete(meta.Xattrs, name)
+		if len(meta.Xattrs) == 0 {
+			meta.Xattrs = nil
+		}
+		return nil
+	})
+}
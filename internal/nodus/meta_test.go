@@ -0,0 +1,150 @@
+package nodus
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestFSSetattrKeepsModeAndTimes(t *testing.T) {
+	n := newTestNode(t)
+	ctx := context.Background()
+	root := testRoot(t, n)
+	f := writeTestFile(t, root, "build.sh", []byte("#!/bin/sh\n"))
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	req := &fuse.SetattrRequest{
+		Valid: fuse.SetattrMode | fuse.SetattrMtime | fuse.SetattrAtime | fuse.SetattrUid | fuse.SetattrGid,
+		Mode:  0755,
+		Mtime: mtime,
+		Atime: mtime.Add(time.Hour),
+		Uid:   1234,
+		Gid:   5678,
+	}
+	var resp fuse.SetattrResponse
+	if err := f.Setattr(ctx, req, &resp); err != nil {
+		t.Fatalf("setattr: %v", err)
+	}
+	if resp.Attr.Mode != 0755 || !resp.Attr.Mtime.Equal(mtime) {
+		t.Errorf("setattr replied mode %v mtime %v", resp.Attr.Mode, resp.Attr.Mtime)
+	}
+
+	// Stat again through a fresh lookup, as after the kernel drops its cache
+	var a fuse.Attr
+	if err := lookupPath(t, testRoot(t, n), "build.sh").Attr(ctx, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Mode != 0755 || a.Uid != 1234 || a.Gid != 5678 {
+		t.Errorf("attr mode %v owner %d:%d", a.Mode, a.Uid, a.Gid)
+	}
+	if !a.Mtime.Equal(mtime) || !a.Atime.Equal(mtime.Add(time.Hour)) {
+		t.Errorf("mtime %v atime %v, want %v and an hour later", a.Mtime, a.Atime, mtime)
+	}
+	if !a.Ctime.After(mtime) {
+		t.Errorf("ctime %v not bumped by the change", a.Ctime)
+	}
+	if readTestFile(t, f) != "#!/bin/sh\n" {
+		t.Error("content changed by setattr")
+	}
+
+	dir := mkdir(t, root, "bin")
+	if err := dir.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: os.ModeDir | 0700}, &resp); err != nil {
+		t.Fatalf("chmod directory: %v", err)
+	}
+	if resp.Attr.Mode != os.ModeDir|0700 {
+		t.Errorf("directory mode %v", resp.Attr.Mode)
+	}
+}
+
+func TestFSXattrs(t *testing.T) {
+	n := newTestNode(t)
+	ctx := context.Background()
+	f := writeTestFile(t, testRoot(t, n), "tagged", []byte("x"))
+
+	set := func(name, value string, flags uint32) error {
+		return f.Setxattr(ctx, &fuse.SetxattrRequest{Name: name, Xattr: []byte(value), Flags: flags})
+	}
+	get := func(name string) (string, error) {
+		var resp fuse.GetxattrResponse
+		err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, &resp)
+		return string(resp.Xattr), err
+	}
+
+	if err := set("user.colour", "blue", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("user.owner", "ops", XattrCreate); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := get("user.colour"); err != nil || v != "blue" {
+		t.Errorf("get: %q, %v", v, err)
+	}
+
+	var list fuse.ListxattrResponse
+	if err := f.Listxattr(ctx, &fuse.ListxattrRequest{}, &list); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(list.Xattr); got != "user.colour\x00user.owner\x00" {
+		t.Errorf("list %q", got)
+	}
+
+	if err := set("user.colour", "red", XattrCreate); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("create over an existing attribute: %v", err)
+	}
+	if err := set("user.size", "9", XattrReplace); err != fuse.ErrNoXattr {
+		t.Errorf("replace of a missing attribute: %v", err)
+	}
+	if err := set("system.posix_acl_access", "", 0); err == nil {
+		t.Error("system namespace accepted")
+	}
+	if err := set("user.big", strings.Repeat("x", MaxXattrValue+1), 0); !errors.Is(err, syscall.E2BIG) {
+		t.Errorf("oversized value: %v", err)
+	}
+
+	if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.colour"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get("user.colour"); err != fuse.ErrNoXattr {
+		t.Errorf("get after remove: %v", err)
+	}
+	if v, _ := get("user.owner"); v != "ops" {
+		t.Errorf("other attribute lost: %q", v)
+	}
+}
+
+func TestMetaReachesPeers(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+
+	if _, err := a.WriteFile("script", []byte("run")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UpdateMeta("script", func(m *Meta) error {
+		m.Mode = 0750
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SetXattr("script", "user.origin", []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "metadata on the peer", func() bool {
+		m := b.store.Manifest("script")
+		return m != nil && string(m.Xattrs["user.origin"]) == "a"
+	})
+	m := b.store.Manifest("script")
+	if m.FileMode() != 0750 {
+		t.Errorf("peer sees mode %v, want -rwxr-x---", m.FileMode())
+	}
+	if data, err := b.store.ReadFile("script"); err == nil && string(data) != "run" {
+		t.Errorf("content on the peer: %q", data)
+	}
+}
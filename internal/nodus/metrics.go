@@ -0,0 +1,166 @@
+// Package nodus - Cache, traffic and request metrics in Prometheus format
+package nodus
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Request kinds observed by the latency histogram
+const (
+	requestManifest  = "manifest"
+	requestBlock     = "block"
+	requestRange     = "range"
+	requestReplicate = "replicate"
+)
+
+// nodeMetrics holds everything the metrics endpoint exports
+type nodeMetrics struct {
+	registry  *prometheus.Registry
+	bandwidth *metrics.BandwidthCounter // fed by libp2p for every stream
+	requests  *prometheus.HistogramVec
+}
+
+// newNodeMetrics creates the registry with traffic and request metrics;
+// the cache is registered once it exists
+func newNodeMetrics() *nodeMetrics {
+	m := &nodeMetrics{
+		registry:  prometheus.NewRegistry(),
+		bandwidth: metrics.NewBandwidthCounter(),
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "nodus",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests to peers by type and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15), // 1ms to 16s
+		}, []string{"type", "result"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		&trafficCollector{bw: m.bandwidth},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observe records one request to a peer; deferred with a pointer to the
+// request's named error result
+func (m *nodeMetrics) observe(kind string, start time.Time, errp *error) {
+	result := "ok"
+	if *errp != nil {
+		result = "error"
+	}
+	m.requests.WithLabelValues(kind, result).Observe(time.Since(start).Seconds())
+}
+
+var (
+	trafficProtocolDesc = prometheus.NewDesc("nodus_protocol_bytes_total",
+		"Bytes transferred per libp2p protocol.", []string{"protocol", "direction"}, nil)
+	trafficPeerDesc = prometheus.NewDesc("nodus_peer_bytes_total",
+		"Bytes transferred per peer.", []string{"peer", "direction"}, nil)
+)
+
+// trafficCollector exports libp2p's bandwidth counters
+type trafficCollector struct {
+	bw *metrics.BandwidthCounter
+}
+
+func (c *trafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- trafficProtocolDesc
+	ch <- trafficPeerDesc
+}
+
+func (c *trafficCollector) Collect(ch chan<- prometheus.Metric) {
+	for proto, s := range c.bw.GetBandwidthByProtocol() {
+		ch <- prometheus.MustNewConstMetric(trafficProtocolDesc, prometheus.CounterValue, float64(s.TotalIn), string(proto), "in")
+		ch <- prometheus.MustNewConstMetric(trafficProtocolDesc, prometheus.CounterValue, float64(s.TotalOut), string(proto), "out")
+	}
+	for id, s := range c.bw.GetBandwidthByPeer() {
+		ch <- prometheus.MustNewConstMetric(trafficPeerDesc, prometheus.CounterValue, float64(s.TotalIn), id.String(), "in")
+		ch <- prometheus.MustNewConstMetric(trafficPeerDesc, prometheus.CounterValue, float64(s.TotalOut), id.String(), "out")
+	}
+}
+
+// cacheCollector exports Cache.Stats
+type cacheCollector struct {
+	cache *Cache
+}
+
+var (
+	cacheHitsDesc      = prometheus.NewDesc("nodus_cache_hits_total", "Cache lookups served, by tier.", []string{"tier"}, nil)
+	cacheMissesDesc    = prometheus.NewDesc("nodus_cache_misses_total", "Cache lookups not found in any tier.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("nodus_cache_evictions_total", "Entries evicted, by tier.", []string{"tier"}, nil)
+	cacheBytesDesc     = prometheus.NewDesc("nodus_cache_bytes", "Bytes held, by tier.", []string{"tier"}, nil)
+	cacheCapacityDesc  = prometheus.NewDesc("nodus_cache_capacity_bytes", "Capacity, by tier.", []string{"tier"}, nil)
+	cacheEntriesDesc   = prometheus.NewDesc("nodus_cache_entries", "Entries held, by tier.", []string{"tier"}, nil)
+	cachePinnedDesc    = prometheus.NewDesc("nodus_cache_pinned_bytes", "Bytes held by pinned entries.", nil, nil)
+)
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{cacheHitsDesc, cacheMissesDesc, cacheEvictionsDesc,
+		cacheBytesDesc, cacheCapacityDesc, cacheEntriesDesc, cachePinnedDesc} {
+		ch <- d
+	}
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.cache.Stats()
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(d *prometheus.Desc, v int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+
+	counter(cacheHitsDesc, s.Hits, "ram")
+	counter(cacheHitsDesc, s.DiskHits, "disk")
+	counter(cacheMissesDesc, s.Misses)
+	counter(cacheEvictionsDesc, s.Evictions, "ram")
+	counter(cacheEvictionsDesc, s.DiskEvictions, "disk")
+	gauge(cacheBytesDesc, s.Used, "ram")
+	gauge(cacheBytesDesc, s.DiskUsed, "disk")
+	gauge(cacheCapacityDesc, s.Capacity, "ram")
+	gauge(cacheCapacityDesc, s.DiskCapacity, "disk")
+	gauge(cacheEntriesDesc, int64(s.Entries), "ram")
+	gauge(cacheEntriesDesc, int64(s.DiskEntries), "disk")
+	gauge(cachePinnedDesc, s.Pinned)
+}
+
+// TrafficStats is bytes transferred in one direction pair
+type TrafficStats struct {
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+}
+
+// TrafficInfo summarises libp2p traffic
+type TrafficInfo struct {
+	Total     TrafficStats            `json:"total"`
+	Protocols map[string]TrafficStats `json:"protocols"`
+	Peers     map[string]TrafficStats `json:"peers"`
+}
+
+// Traffic returns bytes transferred in total, per protocol and per peer
+func (n *Node) Traffic() TrafficInfo {
+	bw := n.metrics.bandwidth
+	total := bw.GetBandwidthTotals()
+	info := TrafficInfo{
+		Total:     TrafficStats{In: total.TotalIn, Out: total.TotalOut},
+		Protocols: make(map[string]TrafficStats),
+		Peers:     make(map[string]TrafficStats),
+	}
+	for proto, s := range bw.GetBandwidthByProtocol() {
+		info.Protocols[string(proto)] = TrafficStats{In: s.TotalIn, Out: s.TotalOut}
+	}
+	for id, s := range bw.GetBandwidthByPeer() {
+		info.Peers[id.String()] = TrafficStats{In: s.TotalIn, Out: s.TotalOut}
+	}
+	return info
+}
+
+// MetricsRegistry returns the registry served by the metrics endpoint
+func (n *Node) MetricsRegistry() *prometheus.Registry {
+	return n.metrics.registry
+}
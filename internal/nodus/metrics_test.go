@@ -0,0 +1,87 @@
+package nodus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns the value of the first sample matching series, a metric
+// name with its labels as they appear in the text format
+func scrape(t *testing.T, n *Node, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(n.MetricsRegistry(), promhttp.HandlerOpts{}).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	match := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(series) + ` (\S+)$`).FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		return 0
+	}
+	v, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		t.Fatalf("%s: %v", series, err)
+	}
+	return v
+}
+
+func TestMetricsCountCacheAndRequests(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustNetwork, TrustNetwork)
+
+	if _, err := a.WriteFile("data.bin", testData(2*BlockSize, 3)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := b.RequestFile(ctx, "data.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.store.ReadFile("data.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := scrape(t, b, `nodus_request_duration_seconds_count{result="ok",type="manifest"}`); v != 1 {
+		t.Errorf("%v manifest requests observed, want 1", v)
+	}
+	if v := scrape(t, b, `nodus_request_duration_seconds_count{result="ok",type="block"}`); v < 1 {
+		t.Error("block requests not observed")
+	}
+	if v := scrape(t, b, `nodus_cache_hits_total{tier="ram"}`); v < 2 {
+		t.Errorf("%v RAM hits, want the two blocks read back", v)
+	}
+	if v := scrape(t, b, `nodus_cache_entries{tier="ram"}`); v != float64(b.GetCache().Stats().Entries) {
+		t.Errorf("cache entries %v, want %d", v, b.GetCache().Stats().Entries)
+	}
+
+	// libp2p's bandwidth meters update on a ticker
+	in := `nodus_peer_bytes_total{direction="in",peer="` + a.ID() + `"}`
+	waitFor(t, "traffic from the peer", func() bool { return scrape(t, b, in) >= 2*BlockSize })
+	if got := b.Traffic().Peers[a.ID()].In; got < 2*BlockSize {
+		t.Errorf("Traffic reports %d bytes in from the peer", got)
+	}
+}
+
+func TestMetricsRecordFailedRequests(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustNetwork, TrustNetwork)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := b.RequestFile(ctx, "missing.bin"); err == nil {
+		t.Fatal("RequestFile of a missing file succeeded")
+	}
+	if v := scrape(t, b, `nodus_request_duration_seconds_count{result="error",type="manifest"}`); v < 1 {
+		t.Error("failed manifest request not observed")
+	}
+	if v := scrape(t, b, `nodus_cache_misses_total`); v != float64(b.GetCache().Stats().Misses) {
+		t.Errorf("misses %v, want %d", v, b.GetCache().Stats().Misses)
+	}
+}
@@ -0,0 +1,793 @@
+// Package nodus - NBD server exporting device images stored in Nodus
+package nodus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DeviceDir is the directory holding the images exported over NBD
+const DeviceDir = "devices"
+
+// MaxDeviceSize bounds an image so its manifest, one reference per block,
+// stays within MaxBroadcastSize
+const MaxDeviceSize = 8 << 30 // 8GB
+
+const (
+	// nbdMaxRequest bounds the payload of one read or write
+	nbdMaxRequest = 32 << 20
+
+	// nbdMaxDirty is how many changed blocks a device buffers before storing them
+	nbdMaxDirty = 256 // 64MB
+
+	// nbdMaxOption bounds the payload of one negotiation option
+	nbdMaxOption = 64 * 1024
+
+	// nbdRequestTimeout bounds fetching the blocks one request needs
+	nbdRequestTimeout = time.Minute
+)
+
+// NBD protocol constants: fixed newstyle negotiation and simple replies
+const (
+	nbdMagic        = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic     = 0x49484156454f5054 // "IHAVEOPT"
+	nbdRepMagic     = 0x0003e889045565a9
+	nbdRequestMagic = 0x25609513
+	nbdReplyMagic   = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0 // handshake flags
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdOptExportName = 1
+	nbdOptAbort      = 2
+	nbdOptList       = 3
+	nbdOptInfo       = 6
+	nbdOptGo         = 7
+
+	nbdRepAck        = 1
+	nbdRepServer     = 2
+	nbdRepInfo       = 3
+	nbdRepErrUnsup   = 1<<31 | 1
+	nbdRepErrPolicy  = 1<<31 | 2
+	nbdRepErrInvalid = 1<<31 | 3
+	nbdRepErrUnknown = 1<<31 | 6
+
+	nbdInfoExport    = 0
+	nbdInfoBlockSize = 3
+
+	nbdFlagHasFlags  = 1 << 0 // transmission flags
+	nbdFlagSendFlush = 1 << 2
+	nbdFlagSendFUA   = 1 << 3
+	nbdFlagSendTrim  = 1 << 5
+
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+	nbdCmdTrim  = 4
+
+	nbdCmdFlagFUA = 1 << 0
+)
+
+// nbdTransmissionFlags are the commands every export supports
+const nbdTransmissionFlags = nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA | nbdFlagSendTrim
+
+// DeviceInfo describes an image exported over NBD
+type DeviceInfo struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+// Devices lists the images in DeviceDir
+func (n *Node) Devices() []DeviceInfo {
+	entries, err := n.ReadDir(DeviceDir)
+	if err != nil {
+		return nil
+	}
+	var devices []DeviceInfo
+	for _, e := range entries {
+		if m := n.store.Manifest(joinPath(DeviceDir, e.Name)); m != nil && m.Kind == "" {
+			devices = append(devices, DeviceInfo{Name: e.Name, Size: m.Size})
+		}
+	}
+	return devices
+}
+
+// CreateDevice creates an image of size bytes, rounded up to whole blocks,
+// that reads as zeros. Every block shares the address of one zero block,
+// so the image takes no space until it is written.
+func (n *Node) CreateDevice(name string, size uint64) (*FileManifest, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("%w: bad device name %q", os.ErrInvalid, name)
+	}
+	if size == 0 || size > MaxDeviceSize {
+		return nil, fmt.Errorf("%w: device size must be 1 to %d bytes", os.ErrInvalid, uint64(MaxDeviceSize))
+	}
+	if n.statLocal(DeviceDir) == nil {
+		if _, err := n.Mkdir(DeviceDir, nil); err != nil {
+			return nil, err
+		}
+	}
+	p := joinPath(DeviceDir, name)
+	if err := n.checkCreate(p); err != nil {
+		return nil, err
+	}
+
+	size = (size + BlockSize - 1) / BlockSize * BlockSize
+	m := &FileManifest{Name: p, Size: size, Meta: newMeta("", nil)}
+	if n.store.masterKey() != nil {
+		salt, err := newFileSalt()
+		if err != nil {
+			return nil, err
+		}
+		m.Salt = salt
+	}
+	zero, err := n.store.putBlocks(m, [][]byte{make([]byte, BlockSize)}, "")
+	if err != nil {
+		return nil, err
+	}
+	m.Blocks = make([]BlockRef, size/BlockSize)
+	for i := range m.Blocks {
+		m.Blocks[i] = zero[0]
+	}
+
+	n.store.stamp(m)
+	if err := n.holdUnreplicated(m); err != nil {
+		return nil, err
+	}
+	n.store.PutManifest(m)
+	n.announce(m)
+	n.replicateLater(m)
+	return m, nil
+}
+
+// NBDServer exports the images in DeviceDir to NBD clients such as
+// nbd-client or qemu's nbd: driver
+type NBDServer struct {
+	node *Node
+	ln   net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+// ListenNBD listens for NBD clients on addr: a unix socket path, or
+// host:port for TCP
+func ListenNBD(addr string, node *Node) (*NBDServer, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+		os.Remove(addr)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return &NBDServer{node: node, ln: ln, conns: make(map[net.Conn]bool)}, nil
+}
+
+// Addr returns the address the server listens on
+func (s *NBDServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve accepts clients until the server is closed
+func (s *NBDServer) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting clients and disconnects the attached ones, storing
+// their writes
+func (s *NBDServer) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if s.ln.Addr().Network() == "unix" {
+		os.Remove(s.ln.Addr().String())
+	}
+	return err
+}
+
+// serveConn negotiates an export with one client and serves its requests
+func (s *NBDServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	dev, err := s.negotiate(r, w)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			fmt.Printf("⚠️  NBD negotiation failed: %v\n", err)
+		}
+		return
+	}
+	if dev == nil {
+		return // the client only listed exports or aborted
+	}
+	defer dev.close()
+
+	fmt.Printf("💽 NBD client attached '%s' (%d bytes)\n", dev.name, dev.size())
+	if err := dev.serve(r, w); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		fmt.Printf("⚠️  NBD client of '%s' failed: %v\n", dev.name, err)
+	}
+	fmt.Printf("💽 NBD client detached '%s'\n", dev.name)
+}
+
+// negotiate runs the newstyle handshake and returns the device the client
+// chose, or nil when it ended negotiation without one
+func (s *NBDServer) negotiate(r *bufio.Reader, w *bufio.Writer) (*nbdDevice, error) {
+	var hello [18]byte
+	binary.BigEndian.PutUint64(hello[0:], nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:], nbdOptMagic)
+	binary.BigEndian.PutUint16(hello[16:], nbdFlagFixedNewstyle|nbdFlagNoZeroes)
+	w.Write(hello[:])
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(r, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+	noZeroes := clientFlags&nbdFlagNoZeroes != 0
+
+	for {
+		var header [16]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint64(header[0:]) != nbdOptMagic {
+			return nil, fmt.Errorf("bad option magic")
+		}
+		opt := binary.BigEndian.Uint32(header[8:])
+		length := binary.BigEndian.Uint32(header[12:])
+		if length > nbdMaxOption {
+			return nil, fmt.Errorf("option %d of %d bytes too large", opt, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		switch opt {
+		case nbdOptExportName:
+			// No way to report an error but hanging up
+			dev, err := s.attach(string(data))
+			if err != nil {
+				return nil, err
+			}
+			var reply [10 + 124]byte
+			binary.BigEndian.PutUint64(reply[0:], dev.size())
+			binary.BigEndian.PutUint16(reply[8:], nbdTransmissionFlags)
+			if noZeroes {
+				w.Write(reply[:10])
+			} else {
+				w.Write(reply[:])
+			}
+			if err := w.Flush(); err != nil {
+				dev.close()
+				return nil, err
+			}
+			return dev, nil
+
+		case nbdOptAbort:
+			optionReply(w, opt, nbdRepAck, nil)
+			return nil, w.Flush()
+
+		case nbdOptList:
+			for _, d := range s.node.Devices() {
+				name := make([]byte, 4, 4+len(d.Name))
+				binary.BigEndian.PutUint32(name, uint32(len(d.Name)))
+				optionReply(w, opt, nbdRepServer, append(name, d.Name...))
+			}
+			optionReply(w, opt, nbdRepAck, nil)
+
+		case nbdOptInfo, nbdOptGo:
+			dev, err := s.infoOrGo(w, opt, data)
+			if err != nil {
+				return nil, err
+			}
+			if dev != nil {
+				return dev, nil
+			}
+
+		default:
+			optionReply(w, opt, nbdRepErrUnsup, []byte("unsupported option"))
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// infoOrGo answers NBD_OPT_INFO and NBD_OPT_GO, returning the device a
+// successful GO attached
+func (s *NBDServer) infoOrGo(w *bufio.Writer, opt uint32, data []byte) (*nbdDevice, error) {
+	if len(data) < 6 {
+		optionReply(w, opt, nbdRepErrInvalid, []byte("short request"))
+		return nil, nil
+	}
+	nameLen := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 6+uint64(nameLen) {
+		optionReply(w, opt, nbdRepErrInvalid, []byte("short request"))
+		return nil, nil
+	}
+	name := string(data[4 : 4+nameLen])
+	requests := data[4+nameLen:]
+	count := int(binary.BigEndian.Uint16(requests))
+	if len(requests) != 2+2*count {
+		optionReply(w, opt, nbdRepErrInvalid, []byte("bad information requests"))
+		return nil, nil
+	}
+	wantBlockSize := false
+	for i := 0; i < count; i++ {
+		if binary.BigEndian.Uint16(requests[2+2*i:]) == nbdInfoBlockSize {
+			wantBlockSize = true
+		}
+	}
+
+	var dev *nbdDevice
+	var size uint64
+	if opt == nbdOptGo {
+		var err error
+		if dev, err = s.attach(name); err != nil {
+			optionError(w, opt, err)
+			return nil, nil
+		}
+		size = dev.size()
+	} else {
+		m, err := s.image(name)
+		if err != nil {
+			optionError(w, opt, err)
+			return nil, nil
+		}
+		size = m.Size
+	}
+
+	var export [12]byte
+	binary.BigEndian.PutUint16(export[0:], nbdInfoExport)
+	binary.BigEndian.PutUint64(export[2:], size)
+	binary.BigEndian.PutUint16(export[10:], nbdTransmissionFlags)
+	optionReply(w, opt, nbdRepInfo, export[:])
+	if wantBlockSize {
+		var sizes [14]byte
+		binary.BigEndian.PutUint16(sizes[0:], nbdInfoBlockSize)
+		binary.BigEndian.PutUint32(sizes[2:], 1)    // minimum
+		binary.BigEndian.PutUint32(sizes[6:], 4096) // preferred
+		binary.BigEndian.PutUint32(sizes[10:], nbdMaxRequest)
+		optionReply(w, opt, nbdRepInfo, sizes[:])
+	}
+	optionReply(w, opt, nbdRepAck, nil)
+	if err := w.Flush(); err != nil {
+		if dev != nil {
+			dev.close()
+		}
+		return nil, err
+	}
+	return dev, nil
+}
+
+// optionReply writes one negotiation reply
+func optionReply(w *bufio.Writer, opt, typ uint32, data []byte) {
+	var header [20]byte
+	binary.BigEndian.PutUint64(header[0:], nbdRepMagic)
+	binary.BigEndian.PutUint32(header[8:], opt)
+	binary.BigEndian.PutUint32(header[12:], typ)
+	binary.BigEndian.PutUint32(header[16:], uint32(len(data)))
+	w.Write(header[:])
+	w.Write(data)
+}
+
+// optionError reports why an export can't be used
+func optionError(w *bufio.Writer, opt uint32, err error) {
+	typ := uint32(nbdRepErrInvalid)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		typ = nbdRepErrUnknown
+	case errors.Is(err, ErrLeaseHeld):
+		typ = nbdRepErrPolicy
+	}
+	optionReply(w, opt, typ, []byte(err.Error()))
+}
+
+// image returns the manifest of an export, fetching it from peers if needed
+func (s *NBDServer) image(name string) (*FileManifest, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("device '%s': %w", name, os.ErrNotExist)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nbdRequestTimeout)
+	defer cancel()
+	m, err := s.node.OpenFile(ctx, joinPath(DeviceDir, name))
+	if err != nil || m.Kind != "" {
+		return nil, fmt.Errorf("device '%s': %w", name, os.ErrNotExist)
+	}
+	return m, nil
+}
+
+// attach takes the exclusive lease on an export, so no other peer attaches
+// it at the same time, and opens it
+func (s *NBDServer) attach(name string) (*nbdDevice, error) {
+	if _, err := s.image(name); err != nil {
+		return nil, err
+	}
+	p := joinPath(DeviceDir, name)
+	if err := s.node.AcquireLease(context.Background(), p, LeaseExclusive); err != nil {
+		return nil, err
+	}
+	// The previous holder announced its last writes before releasing the lease
+	m := s.node.store.Manifest(p)
+	if m == nil {
+		s.node.ReleaseLease(p)
+		return nil, fmt.Errorf("device '%s': %w", name, os.ErrNotExist)
+	}
+	return &nbdDevice{
+		node:   s.node,
+		name:   p,
+		m:      m,
+		dirty:  make(map[int][]byte),
+		zeroed: make(map[int]bool),
+	}, nil
+}
+
+// nbdDevice is an attached image with the blocks changed since it was last
+// stored. Changes are stored as a new version of the image on flush, on
+// FUA writes, after the write-back delay and when the client detaches.
+type nbdDevice struct {
+	node *Node
+	name string
+
+	mu     sync.Mutex
+	m      *FileManifest  // stored version the changes apply to
+	dirty  map[int][]byte // plaintext of written blocks
+	zeroed map[int]bool   // trimmed blocks, stored as zeros
+	timer  *time.Timer    // pending write-back
+}
+
+// size returns the image size in bytes
+func (d *nbdDevice) size() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m.Size
+}
+
+// serve answers requests until the client disconnects. Requests are
+// handled in order, so every reply follows the writes before it.
+func (d *nbdDevice) serve(r *bufio.Reader, w *bufio.Writer) error {
+	for {
+		var header [28]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(header[0:]) != nbdRequestMagic {
+			return fmt.Errorf("bad request magic")
+		}
+		flags := binary.BigEndian.Uint16(header[4:])
+		typ := binary.BigEndian.Uint16(header[6:])
+		handle := binary.BigEndian.Uint64(header[8:])
+		off := binary.BigEndian.Uint64(header[16:])
+		length := binary.BigEndian.Uint32(header[24:])
+
+		var data []byte
+		var err error
+		switch typ {
+		case nbdCmdRead:
+			data, err = d.read(off, length)
+		case nbdCmdWrite:
+			if length > nbdMaxRequest {
+				return fmt.Errorf("write of %d bytes too large", length)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			err = d.write(off, payload)
+		case nbdCmdTrim:
+			err = d.trim(off, length)
+		case nbdCmdFlush:
+			err = d.flush()
+		case nbdCmdDisc:
+			return nil
+		default:
+			err = syscall.EINVAL
+		}
+		if err == nil && flags&nbdCmdFlagFUA != 0 && (typ == nbdCmdWrite || typ == nbdCmdTrim) {
+			err = d.flush()
+		}
+
+		if err := writeNBDReply(w, handle, err, data); err != nil {
+			return err
+		}
+	}
+}
+
+// writeNBDReply sends a simple reply, with data only when the request succeeded
+func writeNBDReply(w *bufio.Writer, handle uint64, err error, data []byte) error {
+	var errno syscall.Errno
+	if err != nil && !errors.As(err, &errno) {
+		errno = syscall.EIO
+	}
+	var header [16]byte
+	binary.BigEndian.PutUint32(header[0:], nbdReplyMagic)
+	binary.BigEndian.PutUint32(header[4:], uint32(errno))
+	binary.BigEndian.PutUint64(header[8:], handle)
+	w.Write(header[:])
+	if errno == 0 {
+		w.Write(data)
+	}
+	return w.Flush()
+}
+
+// check validates a request range against the image size; the caller holds mu
+func (d *nbdDevice) check(off uint64, length uint32, beyond syscall.Errno) error {
+	if length > nbdMaxRequest {
+		return syscall.EINVAL
+	}
+	if off > d.m.Size || uint64(length) > d.m.Size-off {
+		return beyond
+	}
+	return nil
+}
+
+// block returns the current plaintext of block i, which the caller may
+// keep and change; the caller holds mu
+func (d *nbdDevice) block(ctx context.Context, i int) ([]byte, error) {
+	if b, ok := d.dirty[i]; ok {
+		return b, nil
+	}
+	if d.zeroed[i] {
+		return make([]byte, d.blockLen(i)), nil
+	}
+	b, err := d.node.ReadAt(ctx, d.m, int64(i)*BlockSize, BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != d.blockLen(i) {
+		return nil, fmt.Errorf("block %d of '%s' is %d bytes", i, d.name, len(b))
+	}
+	return b, nil
+}
+
+// blockLen returns the size of block i; only the last may be short
+func (d *nbdDevice) blockLen(i int) int {
+	if rest := d.m.Size - uint64(i)*BlockSize; rest < BlockSize {
+		return int(rest)
+	}
+	return BlockSize
+}
+
+// read returns length bytes at off, fetching the blocks not held locally
+func (d *nbdDevice) read(off uint64, length uint32) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.check(off, length, syscall.EINVAL); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nbdRequestTimeout)
+	defer cancel()
+
+	data := make([]byte, 0, length)
+	for end := off + uint64(length); off < end; {
+		i := int(off / BlockSize)
+		b, err := d.block(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		start := off - uint64(i)*BlockSize
+		n := min(uint64(len(b))-start, end-off)
+		data = append(data, b[start:start+n]...)
+		off += n
+	}
+	return data, nil
+}
+
+// write buffers data at off, storing the changes once too many blocks are buffered
+func (d *nbdDevice) write(off uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.check(off, uint32(len(data)), syscall.ENOSPC); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nbdRequestTimeout)
+	defer cancel()
+
+	for len(data) > 0 {
+		i := int(off / BlockSize)
+		b, err := d.block(ctx, i)
+		if err != nil {
+			return err
+		}
+		n := copy(b[off-uint64(i)*BlockSize:], data)
+		d.dirty[i] = b
+		delete(d.zeroed, i)
+		data = data[n:]
+		off += uint64(n)
+	}
+
+	if len(d.dirty) >= nbdMaxDirty {
+		m, err := d.store()
+		if err != nil {
+			return err
+		}
+		d.node.announce(m)
+		d.node.replicateLater(m)
+		return nil
+	}
+	d.markDirty()
+	return nil
+}
+
+// trim zeroes the whole blocks inside a range; the rest is left as it is,
+// which TRIM allows
+func (d *nbdDevice) trim(off uint64, length uint32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.check(off, length, syscall.ENOSPC); err != nil {
+		return err
+	}
+	end := off + uint64(length)
+	for i := int((off + BlockSize - 1) / BlockSize); uint64(i)*BlockSize < end; i++ {
+		if blockEnd := uint64(i)*BlockSize + uint64(d.blockLen(i)); blockEnd > end {
+			break
+		}
+		delete(d.dirty, i)
+		d.zeroed[i] = true
+	}
+	d.markDirty()
+	return nil
+}
+
+// markDirty schedules a write-back; the caller holds mu
+func (d *nbdDevice) markDirty() {
+	if delay := d.node.cfg.WriteBackDelay; delay > 0 && d.timer == nil {
+		d.timer = time.AfterFunc(delay, d.writeBack)
+	}
+}
+
+// store records the buffered changes as a new version of the image,
+// returning nil when there were none; the caller holds mu
+func (d *nbdDevice) store() (*FileManifest, error) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if len(d.dirty) == 0 && len(d.zeroed) == 0 {
+		return nil, nil
+	}
+
+	m := *d.m
+	m.Meta = d.m.Meta.clone()
+	m.Blocks = append([]BlockRef(nil), d.m.Blocks...)
+
+	indexes := make([]int, 0, len(d.dirty))
+	for i := range d.dirty {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	blocks := make([][]byte, len(indexes))
+	for j, i := range indexes {
+		blocks[j] = d.dirty[i]
+	}
+	refs, err := d.node.store.putBlocks(&m, blocks, "")
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	for j, i := range indexes {
+		m.Blocks[i] = refs[j]
+	}
+
+	// A trimmed device is mostly zero blocks; seal each size of them once
+	zeros := make(map[int]BlockRef)
+	for i := range d.zeroed {
+		size := d.blockLen(i)
+		if _, ok := zeros[size]; !ok {
+			refs, err := d.node.store.putBlocks(&m, [][]byte{make([]byte, size)}, "")
+			if err != nil {
+				return nil, syscall.EIO
+			}
+			zeros[size] = refs[0]
+		}
+		m.Blocks[i] = zeros[size]
+	}
+
+	m.Mtime = time.Now().UnixNano()
+	m.Ctime = m.Mtime
+	d.node.store.stamp(&m)
+	// The written blocks stay pinned until a peer holds them, as FUSE writes do
+	if err := d.node.holdChanged(&m, d.m); err != nil {
+		fmt.Printf("⚠️  Storing '%s' failed: %v\n", d.name, err)
+		return nil, syscall.ENOSPC
+	}
+	d.node.store.PutManifest(&m)
+	d.m = &m
+	d.dirty = make(map[int][]byte)
+	d.zeroed = make(map[int]bool)
+	return &m, nil
+}
+
+// writeBack stores changes that stayed buffered for the write-back delay
+func (d *nbdDevice) writeBack() {
+	d.mu.Lock()
+	m, err := d.store()
+	d.mu.Unlock()
+	if err != nil {
+		fmt.Printf("⚠️  Write-back of '%s' failed: %v\n", d.name, err)
+		return
+	}
+	if m != nil {
+		d.node.announce(m)
+		d.node.replicateLater(m)
+	}
+}
+
+// flush stores the buffered changes and waits for replicas as fsync does on
+// the FUSE mount
+func (d *nbdDevice) flush() error {
+	d.mu.Lock()
+	m, err := d.store()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		d.node.announce(m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.node.cfg.SyncTimeout)
+	defer cancel()
+	if err := d.node.syncWrite(ctx, d.name); err != nil {
+		fmt.Printf("⚠️  NBD flush: %v\n", err)
+		return syscall.EIO
+	}
+	return nil
+}
+
+// close stores the buffered changes, announces them before giving up the
+// lease so the next peer to attach sees them, and releases the lease
+func (d *nbdDevice) close() {
+	d.mu.Lock()
+	m, err := d.store()
+	d.mu.Unlock()
+	if err != nil {
+		fmt.Printf("⚠️  Storing '%s' failed: %v\n", d.name, err)
+	}
+	if m != nil {
+		d.node.announceWait(m)
+		d.node.replicateLater(m)
+	}
+	d.node.ReleaseLease(d.name)
+}
@@ -0,0 +1,218 @@
+package nodus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// nbdClient is a minimal fixed newstyle NBD client
+type nbdClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	size   uint64
+	handle uint64
+}
+
+// dialNBD serves node over NBD on loopback and attaches export with NBD_OPT_GO
+func dialNBD(t *testing.T, node *Node, export string) (*nbdClient, *NBDServer) {
+	t.Helper()
+	s, err := ListenNBD("127.0.0.1:0", node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c := &nbdClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	var hello [18]byte
+	if _, err := io.ReadFull(c.r, hello[:]); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if binary.BigEndian.Uint64(hello[0:]) != nbdMagic || binary.BigEndian.Uint64(hello[8:]) != nbdOptMagic {
+		t.Fatalf("bad hello %x", hello)
+	}
+	binary.Write(conn, binary.BigEndian, uint32(nbdFlagFixedNewstyle|nbdFlagNoZeroes))
+
+	data := make([]byte, 4, 4+len(export)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(export)))
+	data = append(append(data, export...), 0, 0)
+	var opt [16]byte
+	binary.BigEndian.PutUint64(opt[0:], nbdOptMagic)
+	binary.BigEndian.PutUint32(opt[8:], nbdOptGo)
+	binary.BigEndian.PutUint32(opt[12:], uint32(len(data)))
+	conn.Write(append(opt[:], data...))
+
+	for {
+		var header [20]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			t.Fatalf("option reply: %v", err)
+		}
+		typ := binary.BigEndian.Uint32(header[12:])
+		reply := make([]byte, binary.BigEndian.Uint32(header[16:]))
+		if _, err := io.ReadFull(c.r, reply); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case typ == nbdRepAck:
+			return c, s
+		case typ == nbdRepInfo && binary.BigEndian.Uint16(reply) == nbdInfoExport:
+			c.size = binary.BigEndian.Uint64(reply[2:])
+		case typ&(1<<31) != 0:
+			t.Fatalf("NBD_OPT_GO failed: %s", reply)
+		}
+	}
+}
+
+// do sends one request and returns the reply's error and, for reads, data
+func (c *nbdClient) do(typ uint16, flags uint16, off uint64, length uint32, payload []byte) ([]byte, syscall.Errno) {
+	c.t.Helper()
+	c.handle++
+	var req [28]byte
+	binary.BigEndian.PutUint32(req[0:], nbdRequestMagic)
+	binary.BigEndian.PutUint16(req[4:], flags)
+	binary.BigEndian.PutUint16(req[6:], typ)
+	binary.BigEndian.PutUint64(req[8:], c.handle)
+	binary.BigEndian.PutUint64(req[16:], off)
+	binary.BigEndian.PutUint32(req[24:], length)
+	if _, err := c.conn.Write(append(req[:], payload...)); err != nil {
+		c.t.Fatal(err)
+	}
+	if typ == nbdCmdDisc {
+		return nil, 0
+	}
+
+	var reply [16]byte
+	if _, err := io.ReadFull(c.r, reply[:]); err != nil {
+		c.t.Fatalf("reply: %v", err)
+	}
+	if binary.BigEndian.Uint32(reply[0:]) != nbdReplyMagic || binary.BigEndian.Uint64(reply[8:]) != c.handle {
+		c.t.Fatalf("bad reply %x", reply)
+	}
+	errno := syscall.Errno(binary.BigEndian.Uint32(reply[4:]))
+	if typ != nbdCmdRead || errno != 0 {
+		return nil, errno
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatal(err)
+	}
+	return data, 0
+}
+
+func (c *nbdClient) write(off uint64, data []byte, flags uint16) {
+	c.t.Helper()
+	if _, errno := c.do(nbdCmdWrite, flags, off, uint32(len(data)), data); errno != 0 {
+		c.t.Fatalf("write at %d: %v", off, errno)
+	}
+}
+
+func (c *nbdClient) read(off uint64, length uint32) []byte {
+	c.t.Helper()
+	data, errno := c.do(nbdCmdRead, 0, off, length, nil)
+	if errno != 0 {
+		c.t.Fatalf("read at %d: %v", off, errno)
+	}
+	return data
+}
+
+func TestNBDReadWriteTrimFlush(t *testing.T) {
+	n := newTestNode(t)
+	if _, err := n.CreateDevice("disk", 8*BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := dialNBD(t, n, "disk")
+	if c.size != 8*BlockSize {
+		t.Fatalf("export size %d, want %d", c.size, 8*BlockSize)
+	}
+
+	if got := c.read(0, 4096); !bytes.Equal(got, make([]byte, 4096)) {
+		t.Fatal("new device doesn't read as zeros")
+	}
+	data := testData(3*BlockSize, 1)
+	c.write(BlockSize/2, data, 0)
+	if got := c.read(BlockSize/2, uint32(len(data))); !bytes.Equal(got, data) {
+		t.Fatal("read doesn't return the buffered write")
+	}
+
+	// Trim only zeroes the whole blocks in the range
+	if _, errno := c.do(nbdCmdTrim, 0, BlockSize/2, 2*BlockSize, nil); errno != 0 {
+		t.Fatalf("trim: %v", errno)
+	}
+	want := append([]byte(nil), data...)
+	clear(want[BlockSize/2 : BlockSize/2+BlockSize])
+	if got := c.read(BlockSize/2, uint32(len(data))); !bytes.Equal(got, want) {
+		t.Fatal("trim changed more or less than the whole blocks in range")
+	}
+
+	if _, errno := c.do(nbdCmdWrite, 0, 8*BlockSize-10, 20, make([]byte, 20)); errno != syscall.ENOSPC {
+		t.Fatalf("write past the end: got %v, want ENOSPC", errno)
+	}
+	if _, errno := c.do(nbdCmdFlush, 0, 0, 0, nil); errno != 0 {
+		t.Fatalf("flush: %v", errno)
+	}
+
+	m := n.store.Manifest(joinPath(DeviceDir, "disk"))
+	stored, err := n.ReadAt(context.Background(), m, BlockSize/2, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, want) {
+		t.Fatal("flush didn't store the writes")
+	}
+}
+
+func TestNBDWritesPinnedUntilReplicated(t *testing.T) {
+	// No peer to replicate to, so the writes stay unreplicated
+	n := newTestNode(t, func(cfg *Config) {
+		cfg.ReplicationFactor = 2
+		cfg.WriteBackDelay = 0
+		cfg.SyncTimeout = 5 * time.Second
+	})
+	if _, err := n.CreateDevice("disk", 64*BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	c, s := dialNBD(t, n, "disk")
+	c.write(3*BlockSize, testData(2*BlockSize, 2), 0)
+	// Offline, FLUSH succeeds once the writes are stored locally
+	if _, errno := c.do(nbdCmdFlush, 0, 0, 0, nil); errno != 0 {
+		t.Fatalf("flush without peers: %v", errno)
+	}
+	c.do(nbdCmdDisc, 0, 0, 0, nil)
+	s.Close() // waits for the device to store its changes
+
+	name := joinPath(DeviceDir, "disk")
+	m := n.store.Manifest(name)
+	if m == nil || m.Blocks[3].Hash == m.Blocks[0].Hash {
+		t.Fatal("writes weren't stored on detach")
+	}
+	n.pins.mu.Lock()
+	held := n.pins.dirty[name]
+	n.pins.mu.Unlock()
+	if held == nil {
+		t.Fatal("unreplicated device write isn't pinned")
+	}
+
+	// The written blocks and the shared zero block, not one pin per block
+	if len(held.Blocks) != 3 {
+		t.Fatalf("%d blocks pinned, want 3", len(held.Blocks))
+	}
+	for _, i := range []int{0, 3, 4} {
+		if !n.store.blocks.Pinned(m.Blocks[i].Hash.String()) {
+			t.Fatalf("block %d isn't pinned", i)
+		}
+	}
+}
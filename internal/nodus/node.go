@@ -2,12 +2,14 @@
 package nodus
 
 import (
+	"bufio"
 	"context"
 	"fmt"
-	"io"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -18,29 +20,62 @@ import (
 )
 
 const (
-	// Protocol IDs for Nodus P2P
-	ProtocolFileRequest   = protocol.ID("/spirit/nodus/file/1.0.0")
-	ProtocolFileBroadcast = protocol.ID("/spirit/nodus/broadcast/1.0.0")
+	// Protocol IDs for Nodus P2P (framed, see wire.go)
+	ProtocolFileRequest   = protocol.ID("/spirit/nodus/file/2.0.0")
+	ProtocolFileBroadcast = protocol.ID("/spirit/nodus/broadcast/2.0.0")
+	ProtocolIdentity      = protocol.ID("/spirit/nodus/identity/1.0.0")
+	ProtocolLease         = protocol.ID("/spirit/nodus/lease/1.0.0")
 )
 
 // Node represents a Nodus P2P node
 type Node struct {
-	host  host.Host
-	dht   *dht.IpfsDHT
-	cache *Cache
-	mu    sync.RWMutex
+	cfg        Config
+	host       host.Host
+	gater      *trustGater
+	dht        *dht.IpfsDHT
+	cache      *Cache
+	store      *BlockStore
+	replicas   *ReplicaTracker
+	pins       *pinSet
+	scores     *peerScores
+	metrics    *nodeMetrics
+	leases     *leaseTable
+	journal    *journal
+	tombstones *tombstoneSet
+	boot       *bootSet
+	fetches    blockFetches
+	mu         sync.RWMutex
+
+	provideQueue chan cid.Cid
 
 	peers map[peer.ID]peer.AddrInfo
 }
 
-// NewNode creates a new libp2p node
-func NewNode(ctx context.Context) (*Node, error) {
-	// Create libp2p host with default options
+// NewNode creates a new libp2p node with the persistent identity from cfg.StateDir
+func NewNode(ctx context.Context, cfg Config) (*Node, error) {
+	key, err := LoadIdentity(cfg.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+	self, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	trust, err := LoadTrustStore(cfg.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load allowlist: %w", err)
+	}
+	gater := newTrustGater(trust, cfg.OpenNetwork)
+	gater.self = self
+
+	// Create libp2p host, counting traffic per protocol and peer
+	metrics := newNodeMetrics()
 	h, err := libp2p.New(
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/4001",
-			"/ip4/0.0.0.0/udp/4001/quic-v1",
-		),
+		libp2p.Identity(key),
+		libp2p.BandwidthReporter(metrics.bandwidth),
+		libp2p.ListenAddrStrings(cfg.ListenAddrs...),
+		libp2p.ConnectionGater(gater),
 		libp2p.EnableNATService(),
 		libp2p.EnableRelay(),
 		libp2p.EnableHolePunching(),
@@ -49,8 +84,12 @@ func NewNode(ctx context.Context) (*Node, error) {
 		return nil, fmt.Errorf("failed to create host: %w", err)
 	}
 
-	// Create DHT for peer discovery
-	kadDHT, err := dht.New(ctx, h, dht.Mode(dht.ModeAutoServer))
+	// Create DHT for peer discovery and provider records
+	mode := dht.ModeAutoServer
+	if cfg.DHTServer {
+		mode = dht.ModeServer
+	}
+	kadDHT, err := dht.New(ctx, h, dht.Mode(mode), dht.ProtocolPrefix(DHTProtocolPrefix))
 	if err != nil {
 		h.Close()
 		return nil, fmt.Errorf("failed to create DHT: %w", err)
@@ -62,20 +101,119 @@ func NewNode(ctx context.Context) (*Node, error) {
 		return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
 	}
 
+	master, err := LoadMasterKey(cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load master key: %w", err)
+	}
+	replicas, err := LoadReplicaTracker(cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load replica records: %w", err)
+	}
+	pins, err := loadPinSet(cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load pins: %w", err)
+	}
+	journal, err := loadJournal(cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load journal: %w", err)
+	}
+	tombstones, err := loadTombstones(cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load tombstones: %w", err)
+	}
+	boot, err := loadBootSet(cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load boot bundles: %w", err)
+	}
+
+	cache, err := newNodeCache(cfg)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	store, err := LoadBlockStore(cache, cfg.StateDir)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to load manifests: %w", err)
+	}
 	node := &Node{
-		host:  h,
-		dht:   kadDHT,
-		cache: NewCache(256 * 1024 * 1024), // 256MB RAM cache
-		peers: make(map[peer.ID]peer.AddrInfo),
+		cfg:        cfg,
+		host:       h,
+		gater:      gater,
+		dht:        kadDHT,
+		cache:      cache,
+		store:      store,
+		replicas:   replicas,
+		pins:       pins,
+		scores:     newPeerScores(),
+		metrics:    metrics,
+		leases:     newLeaseTable(),
+		journal:    journal,
+		tombstones: tombstones,
+		boot:       boot,
+		peers:      make(map[peer.ID]peer.AddrInfo),
+
+		provideQueue: make(chan cid.Cid, provideQueueSize),
 	}
 
-	// Set up protocol handlers
-	h.SetStreamHandler(ProtocolFileRequest, node.handleFileRequest)
-	h.SetStreamHandler(ProtocolFileBroadcast, node.handleFileBroadcast)
+	metrics.registry.MustRegister(&cacheCollector{cache: cache})
+	node.store.SetMasterKey(master)
+	node.store.setObserver(node)
+	node.store.setSelf(h.ID())
+	node.restoreTombstones()
+	node.restoreJournal()
+
+	// Set up protocol handlers, each gated by its minimum trust level
+	handlers := map[protocol.ID]network.StreamHandler{
+		ProtocolFileRequest:     node.handleFileRequest,
+		ProtocolFileBroadcast:   node.handleFileBroadcast,
+		ProtocolFileRequestV1:   node.handleLegacyFileRequest,
+		ProtocolFileBroadcastV1: node.handleLegacyBroadcast,
+		ProtocolIdentity:        node.handleIdentityRequest,
+		ProtocolLease:           node.handleLeaseRequest,
+	}
+	for id, handler := range handlers {
+		h.SetStreamHandler(id, node.authorize(id, handler))
+	}
+	h.Network().Notify(&trustNotifee{node: node})
+	h.Network().Notify(&leaseNotifee{node: node})
+	h.Network().Notify(&journalNotifee{node: node})
 
 	return node, nil
 }
 
+// newNodeCache creates the block cache, with a disk tier unless cfg disables it
+func newNodeCache(cfg Config) (*Cache, error) {
+	policy, err := NewEvictionPolicy(cfg.CachePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *Cache
+	if cfg.DiskCacheSize <= 0 {
+		cache = NewCache(cfg.CacheSize)
+	} else {
+		dir := cfg.DiskCacheDir
+		if dir == "" {
+			dir = filepath.Join(cfg.StateDir, "cache")
+		}
+		if cache, err = NewTieredCache(cfg.CacheSize, dir, cfg.DiskCacheSize); err != nil {
+			return nil, fmt.Errorf("failed to open disk cache: %w", err)
+		}
+	}
+	cache.SetPolicy(policy)
+	// Nothing but blocks is cached, and no block is larger than a full sealed one
+	cache.SetMaxItemSize(BlockSize + BlockOverhead)
+	cache.SetQuota(cfg.PeerQuota)
+	return cache, nil
+}
+
 // ID returns the node's peer ID
 func (n *Node) ID() string {
 	return n.host.ID().String()
@@ -88,6 +226,10 @@ func (n *Node) Addrs() []multiaddr.Multiaddr {
 
 // Close shuts down the node
 func (n *Node) Close() error {
+	n.cache.Flush()
+	if err := n.replicas.Flush(); err != nil {
+		fmt.Printf("⚠️  Failed to save replica records: %v\n", err)
+	}
 	n.dht.Close()
 	return n.host.Close()
 }
@@ -102,122 +244,290 @@ func (n *Node) GetCache() *Cache {
 	return n.cache
 }
 
-// RequestFile requests a file from connected peers
+// Store returns the node's block store
+func (n *Node) Store() *BlockStore {
+	return n.store
+}
+
+// RequestFile requests a file from connected peers, fetching only missing blocks
 func (n *Node) RequestFile(ctx context.Context, filename string) ([]byte, error) {
-	peers := n.ConnectedPeers()
+	// Serve locally if manifest and all blocks are present
+	if m := n.store.Manifest(filename); m != nil && len(n.store.MissingBlocks(m)) == 0 {
+		return n.store.Assemble(m)
+	}
+	if err := n.deleted(filename); err != nil {
+		return nil, err
+	}
+
+	peers := n.findProviders(ctx, manifestCID(filename))
 	if len(peers) == 0 {
-		return nil, fmt.Errorf("no peers connected")
+		return nil, fmt.Errorf("'%s' isn't cached here: %w", filename, ErrOffline)
 	}
 
-	// Try each peer until we get the file
-	for _, peerID := range peers {
-		data, err := n.requestFileFromPeer(ctx, peerID, filename)
-		if err == nil && len(data) > 0 {
-			fmt.Printf("📥 File '%s' received from peer %s\n", filename, peerID.ShortString())
-			return data, nil
+	// Ask several providers at once; the first manifest wins
+	m := n.store.Manifest(filename)
+	if m == nil {
+		var err error
+		if m, err = n.fetchManifest(ctx, peers, filename); err != nil {
+			return nil, fmt.Errorf("file not found on any peer: %w", err)
 		}
 	}
 
-	return nil, fmt.Errorf("file not found on any peer")
+	// Manifest providers usually hold most blocks; look up the rest individually
+	n.fetchBlocks(ctx, peers, n.store.fetchList(m))
+	n.fetchFromProviders(ctx, n.store.MissingBlocks(m))
+
+	data, err := n.store.Assemble(m)
+	if err != nil {
+		return nil, fmt.Errorf("file '%s' incomplete: %w", filename, err)
+	}
+	n.store.PutManifest(m)
+	fmt.Printf("📥 File '%s' assembled from peers\n", filename)
+	return data, nil
+}
+
+// openFileStream opens a file-protocol stream, falling back to 1.0.0 if the peer is old
+func (n *Node) openFileStream(ctx context.Context, peerID peer.ID) (network.Stream, error) {
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileRequest, ProtocolFileRequestV1)
+	if err != nil {
+		return nil, err
+	}
+	setStreamDeadline(ctx, stream)
+	return stream, nil
 }
 
-// requestFileFromPeer requests a specific file from a peer
-func (n *Node) requestFileFromPeer(ctx context.Context, peerID peer.ID, filename string) ([]byte, error) {
+// requestManifest requests a file's manifest from a peer
+func (n *Node) requestManifest(ctx context.Context, peerID peer.ID, filename string) (_ *FileManifest, err error) {
+	defer n.metrics.observe(requestManifest, time.Now(), &err)
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileRequest)
+	stream, err := n.openFileStream(ctx, peerID)
 	if err != nil {
 		return nil, err
 	}
 	defer stream.Close()
 
-	// Send filename request
-	_, err = stream.Write([]byte(filename + "\n"))
+	if stream.Protocol() == ProtocolFileRequestV1 {
+		return n.requestLegacyFile(stream, filename)
+	}
+
+	reply, err := roundTrip(stream, frame{Type: msgManifestRequest, Payload: []byte(filename)})
 	if err != nil {
 		return nil, err
 	}
+	return UnmarshalManifest(reply.Payload)
+}
 
-	// Read response
-	data, err := io.ReadAll(stream)
+// requestBlock requests a single block from a peer
+func (n *Node) requestBlock(ctx context.Context, peerID peer.ID, h BlockHash) (_ []byte, err error) {
+	defer n.metrics.observe(requestBlock, time.Now(), &err)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := n.openFileStream(ctx, peerID)
 	if err != nil {
 		return nil, err
 	}
+	defer stream.Close()
 
-	return data, nil
+	if stream.Protocol() == ProtocolFileRequestV1 {
+		return nil, fmt.Errorf("peer %s only speaks %s", peerID.ShortString(), ProtocolFileRequestV1)
+	}
+
+	reply, err := roundTrip(stream, frame{Type: msgBlockRequest, Payload: h[:]})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Payload, nil
 }
 
-// handleFileRequest handles incoming file requests from peers
+// handleFileRequest handles incoming manifest and block requests from peers
 func (n *Node) handleFileRequest(stream network.Stream) {
 	defer stream.Close()
 
-	// Read filename
-	buf := make([]byte, 1024)
-	nBytes, err := stream.Read(buf)
+	req, err := readFrame(bufio.NewReader(stream), MaxFrameSize)
 	if err != nil {
+		writeFrame(stream, badRequest(0, err))
 		return
 	}
 
-	filename := string(buf[:nBytes-1]) // Remove newline
+	writeFrame(stream, n.serveFileRequest(req))
+}
 
-	// Check cache
-	data := n.cache.Get(filename)
-	if data == nil {
-		// File not found
-		return
+// serveFileRequest answers one request frame
+func (n *Node) serveFileRequest(req frame) frame {
+	switch req.Type {
+	case msgManifestRequest:
+		m := n.store.Manifest(string(req.Payload))
+		if m == nil {
+			// The tombstone tells the asking peer its copy is stale
+			m = n.tombstones.get(string(req.Payload))
+		}
+		if m == nil {
+			return errorFrame(msgManifest, StatusNotFound, string(req.Payload))
+		}
+		data, err := m.Marshal()
+		if err != nil {
+			return errorFrame(msgManifest, StatusError, err.Error())
+		}
+		return frame{Type: msgManifest, Payload: data}
+
+	case msgBlockRequest:
+		var h BlockHash
+		if len(req.Payload) != len(h) {
+			return errorFrame(msgBlock, StatusBadRequest, "bad block hash")
+		}
+		copy(h[:], req.Payload)
+		data, err := n.store.GetBlock(h)
+		if err != nil {
+			return errorFrame(msgBlock, StatusNotFound, h.String())
+		}
+		return frame{Type: msgBlock, Payload: data}
+
+	case msgRangeRequest:
+		return n.serveRangeRequest(req)
+
+	case msgBootRequest:
+		return n.serveBootRequest(req)
+	}
+
+	return errorFrame(0, StatusBadRequest, fmt.Sprintf("unknown message type %d", req.Type))
+}
+
+// BroadcastFile stores a file as blocks, announces its manifest to all connected
+// peers and places its blocks on replica holders in the background
+func (n *Node) BroadcastFile(filename string, data []byte) error {
+	m, err := n.WriteFile(filename, data)
+	if err != nil {
+		return err
 	}
 
-	// Send file data
-	stream.Write(data)
-	fmt.Printf("📤 File '%s' sent to peer %s\n", filename, stream.Conn().RemotePeer().ShortString())
+	n.announce(m)
+	n.replicateLater(m)
+	return nil
+}
+
+// replicateLater replicates m in the background
+func (n *Node) replicateLater(m *FileManifest) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		if _, err := n.replicate(ctx, m); err != nil {
+			fmt.Printf("⚠️  Replication of '%s' incomplete: %v\n", m.Name, err)
+		}
+	}()
 }
 
-// BroadcastFile broadcasts a file to all connected peers
-func (n *Node) BroadcastFile(filename string, data []byte) {
-	peers := n.ConnectedPeers()
+// announce sends a manifest to every cloud peer in the background, or
+// journals it for later when none is connected
+func (n *Node) announce(m *FileManifest) {
+	peers := n.peersAtLeast(TrustCloud)
+	if len(peers) == 0 {
+		n.journalWrite(m)
+		return
+	}
+	for _, peerID := range peers {
+		go n.sendManifestToPeer(peerID, m)
+	}
+}
+
+// announceWait announces a manifest to every cloud peer and waits for their
+// acks, or journals it for later when none is connected
+func (n *Node) announceWait(m *FileManifest) {
+	peers := n.peersAtLeast(TrustCloud)
+	if len(peers) == 0 {
+		n.journalWrite(m)
+		return
+	}
+	var wg sync.WaitGroup
 	for _, peerID := range peers {
-		go n.sendFileToPeer(peerID, filename, data)
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+			n.sendManifestToPeer(id, m)
+		}(peerID)
 	}
+	wg.Wait()
 }
 
-// sendFileToPeer sends a file to a specific peer
-func (n *Node) sendFileToPeer(peerID peer.ID, filename string, data []byte) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// sendManifestToPeer announces a manifest to a specific peer and waits for its
+// ack, recording which peers hold a tombstone
+func (n *Node) sendManifestToPeer(peerID peer.ID, m *FileManifest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileBroadcast)
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileBroadcast, ProtocolFileBroadcastV1)
 	if err != nil {
-		return
+		return err
 	}
 	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+
+	if stream.Protocol() == ProtocolFileBroadcastV1 {
+		return n.sendLegacyFile(stream, m)
+	}
+
+	encoded, err := m.Marshal()
+	if err != nil {
+		return err
+	}
 
-	// Send filename + data
-	header := fmt.Sprintf("%s\n%d\n", filename, len(data))
-	stream.Write([]byte(header))
-	stream.Write(data)
+	// The peer records the manifest; blocks travel separately to replica holders
+	if _, err := roundTrip(stream, frame{Type: msgAnnounce, Payload: encoded}); err != nil {
+		fmt.Printf("⚠️  Broadcast '%s' to %s failed: %v\n", m.Name, peerID.ShortString(), err)
+		return err
+	}
+	if m.Kind == KindTombstone {
+		n.tombstones.ack(m, peerID)
+	}
+	return nil
 }
 
-// handleFileBroadcast handles incoming file broadcasts from peers
+// handleFileBroadcast handles manifest announcements, replica requests and
+// journal replays from peers
 func (n *Node) handleFileBroadcast(stream network.Stream) {
 	defer stream.Close()
 
-	// Read header (filename + size)
-	buf := make([]byte, 1024)
-	nBytes, err := stream.Read(buf)
+	req, err := readFrame(bufio.NewReader(stream), MaxBroadcastSize)
 	if err != nil {
+		writeFrame(stream, badRequest(msgAck, err))
 		return
 	}
 
-	// Parse header
-	var filename string
-	var size int
-	fmt.Sscanf(string(buf[:nBytes]), "%s\n%d\n", &filename, &size)
+	remote := stream.Conn().RemotePeer()
+	switch req.Type {
+	case msgAnnounce:
+		writeFrame(stream, n.serveAnnounce(remote, req))
+	case msgReplicate:
+		writeFrame(stream, n.serveReplicate(remote, req))
+	case msgReplicaBlocks:
+		writeFrame(stream, n.serveReplicaBlocks(remote, req))
+	case msgJournalOp:
+		writeFrame(stream, n.serveJournalOp(remote, req))
+	case msgBoot:
+		writeFrame(stream, n.serveBoot(remote, req))
+	default:
+		writeFrame(stream, errorFrame(msgAck, StatusBadRequest, fmt.Sprintf("unexpected message type %d", req.Type)))
+	}
+}
 
-	// Read file data
-	data := make([]byte, size)
-	io.ReadFull(stream, data)
+// serveAnnounce records a manifest announced by a peer; blocks are fetched on demand
+func (n *Node) serveAnnounce(remote peer.ID, req frame) frame {
+	m, err := UnmarshalManifest(req.Payload)
+	if err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
 
-	// Store in cache
-	n.cache.Put(filename, data)
-	fmt.Printf("📥 Received broadcast: '%s' (%d bytes) from %s\n", filename, size, stream.Conn().RemotePeer().ShortString())
+	if m.Kind == KindTombstone {
+		if n.acceptManifest(m) {
+			fmt.Printf("🗑️  '%s' deleted by %s\n", m.Name, m.Writer.ShortString())
+		}
+		n.tombstones.ack(m, remote)
+		return frame{Type: msgAck}
+	}
+	if n.acceptManifest(m) {
+		fmt.Printf("📥 Received broadcast: '%s' (%d bytes, %d blocks) from %s\n", m.Name, m.Size, len(m.Blocks), remote.ShortString())
+	}
+	return frame{Type: msgAck}
 }
@@ -0,0 +1,132 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRequestFileFromPeer(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustNetwork, TrustNetwork)
+
+	want := testData(2*BlockSize+77, 1)
+	if _, err := a.WriteFile("docs/report.bin", want); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	got, err := b.RequestFile(ctx, "docs/report.bin")
+	if err != nil {
+		t.Fatalf("RequestFile: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("content differs from what was written")
+	}
+	if b.store.Manifest("docs/report.bin") == nil {
+		t.Error("fetched manifest wasn't kept")
+	}
+
+	if _, err := b.RequestFile(ctx, "docs/missing.bin"); err == nil {
+		t.Error("RequestFile of a missing file succeeded")
+	}
+}
+
+func TestManifestsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.StateDir = dir
+	cfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	cfg.DiskCacheSize = 1 << 30
+
+	n, err := NewNode(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testData(BlockSize+10, 2)
+	written, err := n.WriteFile("kept.bin", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.WriteFile("gone.bin", []byte("short-lived")); err != nil {
+		t.Fatal(err)
+	}
+	n.store.DeleteFile("gone.bin")
+	n.Close()
+
+	n, err = NewNode(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	defer n.Close()
+
+	m := n.store.Manifest("kept.bin")
+	if m == nil {
+		t.Fatal("manifest lost across restart")
+	}
+	if m.ID() != written.ID() {
+		t.Error("reloaded manifest differs from the written one")
+	}
+	if n.store.Manifest("gone.bin") != nil {
+		t.Error("deleted manifest came back")
+	}
+	got, err := n.store.ReadFile("kept.bin")
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("ReadFile after restart: %v", err)
+	}
+}
+
+// pushLegacy sends name as a 1.0.0 broadcast from a to b and waits for b to close the stream
+func pushLegacy(t *testing.T, a, b *Node, name string, data []byte) {
+	t.Helper()
+	stream, err := a.host.NewStream(context.Background(), b.host.ID(), ProtocolFileBroadcastV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	fmt.Fprintf(stream, "%s\n%d\n", name, len(data))
+	stream.Write(data)
+	stream.CloseWrite()
+	io.ReadAll(stream)
+}
+
+func TestLegacyBroadcastCantUndoVersions(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+
+	pushLegacy(t, a, b, "old.txt", []byte("from 1.0.0"))
+	m := b.store.Manifest("old.txt")
+	if m == nil || len(m.Version) != 0 || m.Writer != "" {
+		t.Fatalf("legacy push stored as %+v, want an unversioned manifest", m)
+	}
+	// Between unversioned copies the last push wins
+	pushLegacy(t, a, b, "old.txt", []byte("again"))
+	if data, _ := b.store.ReadFile("old.txt"); string(data) != "again" {
+		t.Fatalf("second push: %q", data)
+	}
+
+	if _, err := b.WriteFile("doc.txt", []byte("versioned")); err != nil {
+		t.Fatal(err)
+	}
+	pushLegacy(t, a, b, "doc.txt", []byte("stale"))
+	if data, _ := b.store.ReadFile("doc.txt"); string(data) != "versioned" {
+		t.Fatalf("legacy push replaced a versioned file: %q", data)
+	}
+
+	if _, err := b.WriteFile("gone.txt", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove("gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	pushLegacy(t, a, b, "gone.txt", []byte("resurrected"))
+	if b.store.Manifest("gone.txt") != nil {
+		t.Fatal("legacy push resurrected a deleted file")
+	}
+}
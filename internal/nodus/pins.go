@@ -0,0 +1,357 @@
+// Package nodus - Pinned files: user pins and local writes not yet replicated
+package nodus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const pinsFile = "pins.json"
+
+// Pin reasons reported by Pins
+const (
+	PinUser         = "user"
+	PinUnreplicated = "unreplicated"
+)
+
+// PinInfo describes a pinned file
+type PinInfo struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	Size   uint64 `json:"size"`
+	Blocks int    `json:"blocks"`
+	Held   bool   `json:"held"` // false while a user pin waits for the file to be fetched
+}
+
+// pinSet tracks which manifests hold pins on their blocks.
+// User pins are persisted by name; unreplicated writes are pinned until a peer holds them.
+type pinSet struct {
+	mu    sync.Mutex
+	path  string
+	user  map[string]*FileManifest // nil until the file is local and pinned
+	dirty map[string]*FileManifest
+}
+
+// pinsSnapshot is the on-disk form of the user pins
+type pinsSnapshot struct {
+	Files []string `json:"files"`
+}
+
+// loadPinSet loads the user pins from stateDir (empty if missing)
+func loadPinSet(stateDir string) (*pinSet, error) {
+	p := &pinSet{
+		path:  filepath.Join(stateDir, pinsFile),
+		user:  make(map[string]*FileManifest),
+		dirty: make(map[string]*FileManifest),
+	}
+
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap pinsSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid pins: %w", err)
+	}
+	for _, name := range snap.Files {
+		p.user[name] = nil
+	}
+	return p, nil
+}
+
+// save persists the user pins; caller must hold mu
+func (p *pinSet) save() error {
+	snap := pinsSnapshot{Files: make([]string, 0, len(p.user))}
+	for name := range p.user {
+		snap.Files = append(snap.Files, name)
+	}
+	sort.Strings(snap.Files)
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.path, data, 0644)
+}
+
+// repin moves a pin from old to m (either may be nil); caller must hold mu
+func (n *Node) repin(old, m *FileManifest) error {
+	if m != nil {
+		if err := n.store.pinBlocks(m); err != nil {
+			return err
+		}
+	}
+	if old != nil {
+		n.store.unpinBlocks(old)
+	}
+	return nil
+}
+
+// Pin fetches a file and keeps all of its blocks in the cache, across restarts
+func (n *Node) Pin(ctx context.Context, name string) error {
+	if _, err := n.RequestFile(ctx, name); err != nil {
+		return err
+	}
+	m := n.store.Manifest(name)
+	if m == nil {
+		return fmt.Errorf("file '%s' not found", name)
+	}
+
+	n.pins.mu.Lock()
+	defer n.pins.mu.Unlock()
+
+	old, known := n.pins.user[name]
+	if old == m {
+		return nil
+	}
+	if err := n.repin(old, m); err != nil {
+		return err
+	}
+	n.pins.user[name] = m
+	if !known {
+		return n.pins.save()
+	}
+	return nil
+}
+
+// Unpin releases a user pin; it reports whether the file was pinned
+func (n *Node) Unpin(name string) (bool, error) {
+	n.pins.mu.Lock()
+	defer n.pins.mu.Unlock()
+
+	old, ok := n.pins.user[name]
+	if !ok {
+		return false, nil
+	}
+	n.repin(old, nil)
+	delete(n.pins.user, name)
+	return true, n.pins.save()
+}
+
+// Pins lists user pins, unreplicated files and boot images, by name
+func (n *Node) Pins() []PinInfo {
+	n.pins.mu.Lock()
+	defer n.pins.mu.Unlock()
+
+	var pins []PinInfo
+	add := func(name, reason string, m *FileManifest) {
+		info := PinInfo{Name: name, Reason: reason, Held: m != nil}
+		if m != nil {
+			info.Size = m.Size
+			info.Blocks = len(m.Blocks)
+		}
+		pins = append(pins, info)
+	}
+	for name, m := range n.pins.user {
+		add(name, PinUser, m)
+	}
+	for name, m := range n.pins.dirty {
+		add(name, PinUnreplicated, m)
+	}
+	pins = append(pins, n.bootPins()...)
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Name != pins[j].Name {
+			return pins[i].Name < pins[j].Name
+		}
+		return pins[i].Reason < pins[j].Reason
+	})
+	return pins
+}
+
+// WriteFile stores a locally written file. Its blocks stay pinned until
+// another peer holds them, and the repair loop replicates it.
+func (n *Node) WriteFile(name string, data []byte) (*FileManifest, error) {
+	return n.writeFile(name, data, nil)
+}
+
+// writeFile is WriteFile giving a new file meta instead of default metadata
+func (n *Node) writeFile(name string, data []byte, meta *Meta) (*FileManifest, error) {
+	if err := n.checkWrite(name, int64(len(data))); err != nil {
+		return nil, err
+	}
+	m, err := n.store.storeFile(name, data, "", meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.commitWrite(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkWrite reports whether a local write of size bytes to name may go
+// ahead, before any of its blocks are stored
+func (n *Node) checkWrite(name string, size int64) error {
+	if err := n.checkVolumeQuota(name, uint64(size)); err != nil {
+		return err
+	}
+	return n.checkDirtyRoom(name, size)
+}
+
+// commitWrite records a locally written version whose blocks are stored.
+// Pin before recording the manifest: a write that can't be kept until it is
+// replicated must not replace the version we have.
+func (n *Node) commitWrite(m *FileManifest) error {
+	if err := n.holdUnreplicated(m); err != nil {
+		return err
+	}
+	n.store.PutManifest(m)
+	return nil
+}
+
+// checkDirtyRoom reports whether a write of size bytes to name could stay
+// pinned until replicated, counting the pin it replaces as released. Writing
+// the blocks first would only evict them again.
+func (n *Node) checkDirtyRoom(name string, size int64) error {
+	n.pins.mu.Lock()
+	if old := n.pins.dirty[name]; old != nil {
+		size -= int64(old.Size)
+	}
+	n.pins.mu.Unlock()
+	if err := n.cache.checkPinRoom(size); err != nil {
+		return fmt.Errorf("'%s' can't stay cached until replicated: %w", name, err)
+	}
+	return nil
+}
+
+// holdUnreplicated pins the blocks of a local write until a peer holds them
+func (n *Node) holdUnreplicated(m *FileManifest) error {
+	return n.holdBlocks(m, m.Blocks)
+}
+
+// holdChanged is holdUnreplicated for a write that replaced only some blocks
+// of base: the new blocks are pinned, and those of base still waiting for a
+// holder, while the rest stays wherever base's blocks are
+func (n *Node) holdChanged(m, base *FileManifest) error {
+	n.pins.mu.Lock()
+	kept := make(map[BlockHash]bool)
+	for _, ref := range base.Blocks {
+		kept[ref.Hash] = true
+	}
+	if old := n.pins.dirty[m.Name]; old != nil {
+		for _, ref := range old.Blocks {
+			delete(kept, ref.Hash)
+		}
+	}
+	n.pins.mu.Unlock()
+
+	var changed []BlockRef
+	for _, ref := range uniqueBlocks(m) {
+		if !kept[ref.Hash] {
+			changed = append(changed, ref)
+		}
+	}
+	return n.holdBlocks(m, changed)
+}
+
+// holdBlocks pins refs, blocks of m, as its unreplicated write
+func (n *Node) holdBlocks(m *FileManifest, refs []BlockRef) error {
+	n.pins.mu.Lock()
+	defer n.pins.mu.Unlock()
+
+	held := *m
+	held.Blocks = refs
+	if err := n.repin(n.pins.dirty[m.Name], &held); err != nil {
+		return err
+	}
+	n.pins.dirty[m.Name] = &held
+	if old, ok := n.pins.user[m.Name]; ok {
+		// A user pin follows the file to its new content
+		if err := n.repin(old, m); err == nil {
+			n.pins.user[m.Name] = m
+		}
+	}
+
+	n.replicas.Track(m)
+	return nil
+}
+
+// DeleteFile forgets a file and releases its pins
+func (n *Node) DeleteFile(name string) bool {
+	n.pins.mu.Lock()
+	if m, ok := n.pins.dirty[name]; ok {
+		n.repin(m, nil)
+		delete(n.pins.dirty, name)
+	}
+	if m, ok := n.pins.user[name]; ok {
+		n.repin(m, nil)
+		delete(n.pins.user, name)
+		n.pins.save()
+	}
+	n.pins.mu.Unlock()
+
+	return n.store.DeleteFile(name)
+}
+
+// releaseReplicated unpins an unreplicated write once every pinned block has
+// a copy on another peer, or right away when replication is off
+func (n *Node) releaseReplicated(name string) {
+	n.pins.mu.Lock()
+	defer n.pins.mu.Unlock()
+
+	m, ok := n.pins.dirty[name]
+	if !ok {
+		return
+	}
+	if n.replicationFactor(name) > 1 {
+		for _, ref := range m.Blocks {
+			if len(n.replicas.Holders(ref.Hash)) == 0 {
+				return
+			}
+		}
+	}
+	n.repin(m, nil)
+	delete(n.pins.dirty, name)
+}
+
+// StartPinning applies saved user pins, fetching their files, and keeps pins
+// following file updates from peers
+func (n *Node) StartPinning(ctx context.Context) {
+	ticker := time.NewTicker(repairInterval)
+	defer ticker.Stop()
+
+	for {
+		n.refreshPins(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshPins re-pins user pins whose file is missing or changed and
+// releases unreplicated writes that now have copies elsewhere
+func (n *Node) refreshPins(ctx context.Context) {
+	n.pins.mu.Lock()
+	var stale, dirty []string
+	for name, m := range n.pins.user {
+		if m == nil || n.store.Manifest(name) != m {
+			stale = append(stale, name)
+		}
+	}
+	for name := range n.pins.dirty {
+		dirty = append(dirty, name)
+	}
+	n.pins.mu.Unlock()
+
+	for _, name := range stale {
+		if err := n.Pin(ctx, name); err != nil {
+			fmt.Printf("⚠️  Pinned file '%s' unavailable: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("📌 Pinned '%s'\n", name)
+	}
+	for _, name := range dirty {
+		n.releaseReplicated(name)
+	}
+}
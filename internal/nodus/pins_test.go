@@ -0,0 +1,34 @@
+package nodus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWriteTooLargeToPinKeepsOldVersion(t *testing.T) {
+	n := newTestNode(t, func(cfg *Config) { cfg.CacheSize = 4 * BlockSize })
+
+	old := testData(BlockSize, 1)
+	if _, err := n.WriteFile("disk.img", old); err != nil {
+		t.Fatal(err)
+	}
+	_, err := n.WriteFile("disk.img", testData(6*BlockSize, 2))
+	if !errors.Is(err, ErrCacheFull) {
+		t.Fatalf("oversized write: %v, want ErrCacheFull", err)
+	}
+
+	got, err := n.store.ReadFile("disk.img")
+	if err != nil {
+		t.Fatalf("old version lost: %v", err)
+	}
+	if !bytes.Equal(got, old) {
+		t.Error("old version replaced by a write that failed")
+	}
+	if _, err := n.WriteFile("fresh.img", testData(6*BlockSize, 3)); err == nil {
+		t.Error("oversized new file written")
+	}
+	if n.store.Manifest("fresh.img") != nil {
+		t.Error("failed write left a manifest behind")
+	}
+}
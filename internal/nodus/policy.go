@@ -0,0 +1,230 @@
+// Package nodus - Eviction policies for the RAM cache
+package nodus
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// EvictionPolicy decides which RAM cache entry is evicted next.
+// The cache serialises all calls, so policies need no locking.
+type EvictionPolicy interface {
+	Add(key string)    // a new entry was stored
+	Touch(key string)  // an entry was read or rewritten
+	Evict(key string)  // an entry was evicted to make room
+	Remove(key string) // an entry was deleted
+	// Victim returns the entry to evict next, passing over keys skip reports
+	// true for (pinned entries); false if every entry is skipped
+	Victim(skip func(key string) bool) (string, bool)
+}
+
+// NewEvictionPolicy returns the policy with the given name: lru, lfu or 2q
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(), nil
+	case "lfu":
+		return newLFUPolicy(), nil
+	case "2q":
+		return new2QPolicy(), nil
+	}
+	return nil, fmt.Errorf("unknown cache policy %q (want lru, lfu or 2q)", name)
+}
+
+// lruPolicy evicts the least recently used entry
+type lruPolicy struct {
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key string) {
+	if elem, ok := p.items[key]; ok {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.items[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Touch(key string) {
+	if elem, ok := p.items[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Evict(key string) {
+	p.Remove(key)
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.items[key]; ok {
+		p.order.Remove(elem)
+		delete(p.items, key)
+	}
+}
+
+func (p *lruPolicy) Victim(skip func(string) bool) (string, bool) {
+	return oldestIn(p.order, skip)
+}
+
+// oldestIn returns the entry nearest the back of order that skip allows
+func oldestIn(order *list.List, skip func(string) bool) (string, bool) {
+	for elem := order.Back(); elem != nil; elem = elem.Prev() {
+		if key := elem.Value.(string); !skip(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lfuPolicy evicts the least frequently used entry, oldest first on ties.
+// Victim scans every entry, which is fine for the few thousand blocks a RAM cache holds.
+type lfuPolicy struct {
+	items map[string]*lfuItem
+	clock uint64
+}
+
+type lfuItem struct {
+	hits uint64
+	last uint64 // clock of the last access
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) Add(key string) {
+	p.clock++
+	if item, ok := p.items[key]; ok {
+		item.hits++
+		item.last = p.clock
+		return
+	}
+	p.items[key] = &lfuItem{hits: 1, last: p.clock}
+}
+
+func (p *lfuPolicy) Touch(key string) {
+	if item, ok := p.items[key]; ok {
+		p.clock++
+		item.hits++
+		item.last = p.clock
+	}
+}
+
+func (p *lfuPolicy) Evict(key string) {
+	p.Remove(key)
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	delete(p.items, key)
+}
+
+func (p *lfuPolicy) Victim(skip func(string) bool) (string, bool) {
+	var victim string
+	var best *lfuItem
+	for key, item := range p.items {
+		if skip(key) {
+			continue
+		}
+		if best == nil || item.hits < best.hits || (item.hits == best.hits && item.last < best.last) {
+			victim, best = key, item
+		}
+	}
+	return victim, best != nil
+}
+
+// twoQPolicy is 2Q: new entries wait in a FIFO and only entries seen again
+// after leaving it reach the main LRU, so one-off scans (a large file read
+// once) don't flush the hot set
+type twoQPolicy struct {
+	in    *list.List // FIFO of entries seen once
+	main  *list.List // LRU of entries seen again
+	ghost *list.List // keys recently evicted from in
+	items map[string]*list.Element
+	queue map[string]*list.List // which list each key is in
+}
+
+const (
+	// twoQInShare is the share of entries kept in the FIFO before it is evicted from first
+	twoQInShare = 4 // 1/4
+	// twoQGhosts is how many evicted keys 2Q remembers
+	twoQGhosts = 4096
+)
+
+func new2QPolicy() *twoQPolicy {
+	return &twoQPolicy{
+		in:    list.New(),
+		main:  list.New(),
+		ghost: list.New(),
+		items: make(map[string]*list.Element),
+		queue: make(map[string]*list.List),
+	}
+}
+
+func (p *twoQPolicy) Add(key string) {
+	switch p.queue[key] {
+	case p.in, p.main:
+		p.Touch(key)
+		return
+	case p.ghost:
+		// Seen before: straight into the main LRU
+		p.drop(key)
+		p.push(p.main, key)
+		return
+	}
+	p.push(p.in, key)
+}
+
+func (p *twoQPolicy) Touch(key string) {
+	// Hits in the FIFO don't count; they are usually the same scan
+	if p.queue[key] == p.main {
+		p.main.MoveToFront(p.items[key])
+	}
+}
+
+// Evict remembers keys evicted from the FIFO, so they reach the main LRU
+// if they come back soon
+func (p *twoQPolicy) Evict(key string) {
+	if p.queue[key] != p.in {
+		p.Remove(key)
+		return
+	}
+	p.drop(key)
+	p.push(p.ghost, key)
+	if p.ghost.Len() > twoQGhosts {
+		p.drop(p.ghost.Back().Value.(string))
+	}
+}
+
+// Remove forgets a deleted key entirely; coming back isn't a sign of reuse
+func (p *twoQPolicy) Remove(key string) {
+	p.drop(key)
+}
+
+func (p *twoQPolicy) Victim(skip func(string) bool) (string, bool) {
+	if p.in.Len()*twoQInShare > p.in.Len()+p.main.Len() {
+		if key, ok := oldestIn(p.in, skip); ok {
+			return key, true
+		}
+	}
+	if key, ok := oldestIn(p.main, skip); ok {
+		return key, true
+	}
+	return oldestIn(p.in, skip)
+}
+
+func (p *twoQPolicy) push(l *list.List, key string) {
+	p.items[key] = l.PushFront(key)
+	p.queue[key] = l
+}
+
+func (p *twoQPolicy) drop(key string) {
+	if l := p.queue[key]; l != nil {
+		l.Remove(p.items[key])
+		delete(p.items, key)
+		delete(p.queue, key)
+	}
+}
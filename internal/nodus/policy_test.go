@@ -0,0 +1,98 @@
+package nodus
+
+import "testing"
+
+// evictAll drains p, returning keys in the order it evicts them
+func evictAll(p EvictionPolicy, skip func(string) bool) []string {
+	var order []string
+	for {
+		key, ok := p.Victim(skip)
+		if !ok {
+			return order
+		}
+		order = append(order, key)
+		p.Evict(key)
+	}
+}
+
+func none(string) bool { return false }
+
+func TestLFUPolicyEvictsLeastUsed(t *testing.T) {
+	p := newLFUPolicy()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Add(key)
+	}
+	p.Touch("a")
+	p.Touch("a")
+	p.Touch("c")
+	p.Touch("d")
+
+	// b has one hit; c and d two each, c older; a three
+	want := []string{"b", "c", "d", "a"}
+	got := evictAll(p, none)
+	if len(got) != len(want) {
+		t.Fatalf("evicted %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("evicted %v, want %v", got, want)
+		}
+	}
+
+	p.Add("x")
+	p.Add("y")
+	if key, _ := p.Victim(func(k string) bool { return k == "x" }); key != "y" {
+		t.Errorf("victim %q, want the unskipped y", key)
+	}
+	p.Remove("y")
+	if _, ok := p.Victim(func(k string) bool { return k == "x" }); ok {
+		t.Error("removed key still a victim")
+	}
+}
+
+func TestTwoQPolicyResistsScans(t *testing.T) {
+	p := new2QPolicy()
+
+	// Evicted from the FIFO, then seen again: promoted to the main LRU
+	p.Add("hot")
+	p.Evict("hot")
+	p.Add("hot")
+	if p.queue["hot"] != p.main {
+		t.Fatal("key seen again after eviction didn't reach the main LRU")
+	}
+
+	// A one-off scan fills the FIFO and is evicted before the hot entry
+	for _, key := range []string{"s1", "s2", "s3", "s4"} {
+		p.Add(key)
+		p.Touch(key)
+	}
+	if key, _ := p.Victim(none); key != "s1" {
+		t.Fatalf("victim %q, want the oldest scanned key", key)
+	}
+	order := evictAll(p, none)
+	if order[len(order)-1] != "hot" {
+		t.Errorf("evicted %v, want hot last", order)
+	}
+}
+
+func TestTwoQPolicyForgetsDeletedKeys(t *testing.T) {
+	p := new2QPolicy()
+	p.Add("gone")
+	p.Remove("gone")
+	if _, ok := p.queue["gone"]; ok {
+		t.Fatal("deleted key remembered as a ghost")
+	}
+	p.Add("gone")
+	if p.queue["gone"] != p.in {
+		t.Error("deleted key came back straight into the main LRU")
+	}
+
+	p.Evict("gone")
+	if p.queue["gone"] != p.ghost {
+		t.Fatal("evicted key not remembered")
+	}
+	p.Remove("gone")
+	if _, ok := p.queue["gone"]; ok {
+		t.Error("ghost survived deleting the key")
+	}
+}
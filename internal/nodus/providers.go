@@ -0,0 +1,163 @@
+// Package nodus - DHT provider records for blocks and manifests
+package nodus
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// DHTProtocolPrefix keeps Nodus records out of the public IPFS DHT
+	DHTProtocolPrefix = "/spirit"
+
+	// maxProviders is how many providers a lookup collects
+	maxProviders = 8
+
+	// reprovideInterval refreshes records before the DHT expires them (48h)
+	reprovideInterval = 12 * time.Hour
+
+	// provideQueueSize bounds pending announcements; extras wait for the next reprovide
+	provideQueueSize = 4096
+)
+
+// blockCID is the DHT key for a block: a raw CIDv1 over its SHA-256
+func blockCID(h BlockHash) cid.Cid {
+	mh, _ := multihash.Encode(h[:], multihash.SHA2_256)
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+// manifestCID is the DHT key for the manifest of a named file
+func manifestCID(name string) cid.Cid {
+	sum := sha256.Sum256([]byte("spirit-nodus/manifest:" + name))
+	mh, _ := multihash.Encode(sum[:], multihash.SHA2_256)
+	return cid.NewCidV1(cid.DagJSON, mh)
+}
+
+// storeObserver is told about content newly held by a BlockStore
+type storeObserver interface {
+	blockStored(h BlockHash)
+	manifestStored(m *FileManifest)
+}
+
+func (n *Node) blockStored(h BlockHash) {
+	n.queueProvide(blockCID(h))
+}
+
+func (n *Node) manifestStored(m *FileManifest) {
+	// Only versions that follow the tombstone are stored in its place
+	n.tombstones.remove(m.Name)
+	n.queueProvide(manifestCID(m.Name))
+}
+
+// queueProvide schedules an announcement without blocking the caller
+func (n *Node) queueProvide(c cid.Cid) {
+	select {
+	case n.provideQueue <- c:
+	default:
+		// Queue full: the next reprovide pass catches up
+	}
+}
+
+// StartProviding announces stored content in the DHT and re-announces it periodically
+func (n *Node) StartProviding(ctx context.Context) {
+	ticker := time.NewTicker(reprovideInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-n.provideQueue:
+			n.provide(ctx, c)
+		case <-ticker.C:
+			n.reprovide(ctx)
+		}
+	}
+}
+
+// provide announces one record
+func (n *Node) provide(ctx context.Context, c cid.Cid) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	// Failures (e.g. no DHT peers yet on a lone node) are retried by the reprovide pass
+	n.dht.Provide(ctx, c, true)
+}
+
+// reprovide re-announces every manifest held locally, and the blocks of
+// those files, of tracked replicas, pins and replicas held for peers
+func (n *Node) reprovide(ctx context.Context) {
+	count := 0
+	seen := make(map[BlockHash]bool)
+	provideBlock := func(h BlockHash) {
+		if !seen[h] && n.store.HasBlock(h) {
+			seen[h] = true
+			n.provide(ctx, blockCID(h))
+			count++
+		}
+	}
+
+	for _, name := range n.store.Files() {
+		m := n.store.Manifest(name)
+		if m == nil {
+			continue
+		}
+		n.provide(ctx, manifestCID(name))
+		count++
+		for _, ref := range m.Blocks {
+			provideBlock(ref.Hash)
+		}
+	}
+	for _, h := range n.replicas.Blocks() {
+		provideBlock(h)
+	}
+	for _, key := range append(n.cache.PinnedKeys(), n.cache.OwnedKeys()...) {
+		if h, err := ParseBlockHash(key); err == nil {
+			provideBlock(h)
+		}
+	}
+	fmt.Printf("📣 Re-announced %d provider records\n", count)
+}
+
+// findProviders returns trusted peers announcing c, connecting to them as needed.
+// When the DHT knows no provider, connected peers are returned instead so LAN
+// peers and 1.0.0 nodes that never announce are still reachable.
+func (n *Node) findProviders(ctx context.Context, c cid.Cid) []peer.ID {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	self := n.host.ID()
+	var found []peer.ID
+	for info := range n.dht.FindProvidersAsync(ctx, c, maxProviders) {
+		if info.ID == self || n.TrustLevel(info.ID) < TrustCloud {
+			continue
+		}
+		if len(info.Addrs) > 0 {
+			n.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
+		}
+		if err := n.host.Connect(ctx, info); err != nil {
+			continue
+		}
+		found = append(found, info.ID)
+	}
+
+	if len(found) == 0 {
+		return n.peersAtLeast(TrustCloud)
+	}
+	return found
+}
+
+// fetchFromProviders looks up each block in the DHT and fetches it from its providers
+func (n *Node) fetchFromProviders(ctx context.Context, refs []BlockRef) {
+	for _, ref := range refs {
+		if !n.store.HasBlock(ref.Hash) {
+			n.fetchBlocks(ctx, n.findProviders(ctx, blockCID(ref.Hash)), []BlockRef{ref})
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package nodus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// dhtProviders looks c up in n's DHT, retrying while records propagate
+func dhtProviders(t *testing.T, n *Node, c cid.Cid) map[peer.ID]bool {
+	t.Helper()
+	found := make(map[peer.ID]bool)
+	for attempt := 0; attempt < 10 && len(found) == 0; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		for info := range n.dht.FindProvidersAsync(ctx, c, maxProviders) {
+			found[info.ID] = true
+		}
+		cancel()
+		if len(found) == 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	return found
+}
+
+func TestReprovideHeldReplicas(t *testing.T) {
+	server := func(cfg *Config) { cfg.DHTServer = true }
+	holder := newTestNode(t, server)
+	writer := newTestNode(t, server, func(cfg *Config) { cfg.ReplicationFactor = 2 })
+	reader := newTestNode(t, server)
+	linkNodes(t, holder, writer, TrustTrusted, TrustCloud)
+	linkNodes(t, reader, holder, TrustNetwork, TrustNetwork)
+
+	m, err := writer.WriteFile("replicated.bin", testData(BlockSize+5, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := writer.replicate(ctx, m); err != nil {
+		t.Fatalf("replicate: %v", err)
+	}
+	if holder.store.Manifest("replicated.bin") != nil {
+		t.Fatal("holder knows the file; its blocks would be provided anyway")
+	}
+
+	holder.reprovide(ctx)
+	for _, ref := range m.Blocks {
+		if providers := dhtProviders(t, reader, blockCID(ref.Hash)); !providers[holder.host.ID()] {
+			t.Errorf("holder isn't a provider of block %s: %v", ref.Hash.String()[:12], providers)
+		}
+	}
+}
+
+func TestReprovidePinnedBlocks(t *testing.T) {
+	server := func(cfg *Config) { cfg.DHTServer = true }
+	a := newTestNode(t, server)
+	b := newTestNode(t, server)
+	linkNodes(t, a, b, TrustNetwork, TrustNetwork)
+
+	h, err := a.store.PutBlock(testData(1000, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.cache.Pin(h.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	a.reprovide(ctx)
+	if providers := dhtProviders(t, b, blockCID(h)); !providers[a.host.ID()] {
+		t.Errorf("pinned block not provided: %v", providers)
+	}
+}
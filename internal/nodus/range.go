@@ -0,0 +1,333 @@
+// Package nodus - Range reads and read-ahead for large files
+package nodus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// maxRangeBlocks bounds how many blocks one range reply carries
+	maxRangeBlocks = MaxFrameSize/BlockSize - 1
+
+	// readAheadBlocks is how far past a read we prefetch in the background
+	readAheadBlocks = 4 // 1MB
+)
+
+// OpenFile returns a file's manifest, fetching it from peers if needed.
+// No blocks are transferred; use ReadAt to pull content on demand.
+func (n *Node) OpenFile(ctx context.Context, filename string) (*FileManifest, error) {
+	if m := n.store.Manifest(filename); m != nil {
+		return m, nil
+	}
+	if err := n.deleted(filename); err != nil {
+		return nil, err
+	}
+
+	peers := n.findProviders(ctx, manifestCID(filename))
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("'%s' isn't cached here: %w", filename, ErrOffline)
+	}
+
+	m, err := n.fetchManifest(ctx, peers, filename)
+	if err != nil {
+		return nil, fmt.Errorf("file not found on any peer: %w", err)
+	}
+	n.store.PutManifest(m)
+	return m, nil
+}
+
+// ReadAt reads up to size bytes at off, fetching only the blocks that cover
+// the range and prefetching the following blocks in the background
+func (n *Node) ReadAt(ctx context.Context, m *FileManifest, off int64, size int) ([]byte, error) {
+	first, last := m.blockSpan(off, int64(size))
+	if last < first {
+		return nil, nil
+	}
+
+	if err := n.fetchSpan(ctx, m, first, last); err != nil {
+		return nil, err
+	}
+	n.prefetch(m, last+1, last+readAheadBlocks)
+
+	data := make([]byte, 0, (last-first+1)*BlockSize)
+	for i := first; i <= last; i++ {
+		block, err := n.store.ReadBlock(m, i)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, block...)
+	}
+
+	start := off - int64(first)*BlockSize
+	end := start + int64(size)
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[start:end], nil
+}
+
+// blockFetches tracks the blocks being fetched, so overlapping reads and
+// prefetches fetch each block once
+type blockFetches struct {
+	mu      sync.Mutex
+	pending map[BlockHash]chan struct{} // closed when the fetch ends
+}
+
+// claim returns the indexes of the blocks in first..last of m that are
+// missing and that nobody fetches yet, now claimed by the caller, and the
+// fetches of the others still missing to wait for
+func (f *blockFetches) claim(m *FileManifest, first, last int, has func(BlockHash) bool) ([]int, []chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == nil {
+		f.pending = make(map[BlockHash]chan struct{})
+	}
+
+	var mine []int
+	var wait []chan struct{}
+	seen := make(map[BlockHash]bool)
+	for i := first; i <= last; i++ {
+		h := m.Blocks[i].Hash
+		if seen[h] || has(h) {
+			continue
+		}
+		seen[h] = true
+		if ch, ok := f.pending[h]; ok {
+			wait = append(wait, ch)
+			continue
+		}
+		f.pending[h] = make(chan struct{})
+		mine = append(mine, i)
+	}
+	return mine, wait
+}
+
+// release ends the caller's fetch of the claimed blocks
+func (f *blockFetches) release(m *FileManifest, claimed []int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range claimed {
+		h := m.Blocks[i].Hash
+		close(f.pending[h])
+		delete(f.pending, h)
+	}
+}
+
+// fetchSpan makes blocks first..last of m local, fetching the missing ones
+// no other read is fetching and waiting for the rest
+func (n *Node) fetchSpan(ctx context.Context, m *FileManifest, first, last int) error {
+	mine, wait := n.fetches.claim(m, first, last, n.store.HasBlock)
+	if len(mine) == 0 && len(wait) == 0 {
+		return nil
+	}
+	err := n.fetchClaimed(ctx, m, mine)
+	for _, done := range wait {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !n.spanMissing(m, first, last) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("blocks %d-%d of '%s' not found on any peer", first, last, m.Name)
+}
+
+// fetchClaimed fetches the claimed blocks of m and releases them. Runs of
+// adjacent blocks are cut into chunks of stripeBlocks fetched concurrently
+// from the best providers in turn, one range round trip each, falling back
+// to racing individual blocks.
+func (n *Node) fetchClaimed(ctx context.Context, m *FileManifest, claimed []int) error {
+	if len(claimed) == 0 {
+		return nil
+	}
+	defer n.fetches.release(m, claimed)
+	n.cache.countMisses(len(claimed))
+
+	peers := n.scores.rank(n.findProviders(ctx, manifestCID(m.Name)))
+	if len(peers) == 0 {
+		return ErrOffline
+	}
+	stripe := len(peers)
+	if stripe > raceWidth {
+		stripe = raceWidth
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fetchWorkers)
+	for c, run := range blockRuns(claimed, stripeBlocks) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(peerID peer.ID, start, end int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := n.measure(ctx, peerID, func(ctx context.Context, peerID peer.ID) (int, error) {
+				return n.requestRange(ctx, peerID, m, start, end)
+			})
+			if err != nil {
+				span := &FileManifest{Name: m.Name, Blocks: m.Blocks[start : end+1]}
+				n.fetchBlocks(ctx, peers, n.store.MissingBlocks(span))
+			}
+		}(peers[c%stripe], run[0], run[1])
+	}
+	wg.Wait()
+
+	// Blocks placed on replica holders that don't have the manifest
+	var missing []BlockRef
+	for _, i := range claimed {
+		if !n.store.HasBlock(m.Blocks[i].Hash) {
+			missing = append(missing, m.Blocks[i])
+		}
+	}
+	n.fetchFromProviders(ctx, missing)
+	return nil
+}
+
+// blockRuns groups ascending block indexes into runs of adjacent blocks,
+// each at most max long, as [first, last] pairs
+func blockRuns(indexes []int, max int) [][2]int {
+	var runs [][2]int
+	for _, i := range indexes {
+		if k := len(runs) - 1; k >= 0 && runs[k][1] == i-1 && i-runs[k][0] < max {
+			runs[k][1] = i
+			continue
+		}
+		runs = append(runs, [2]int{i, i})
+	}
+	return runs
+}
+
+// spanMissing reports whether any block in first..last is not held locally
+func (n *Node) spanMissing(m *FileManifest, first, last int) bool {
+	for _, ref := range m.Blocks[first : last+1] {
+		if !n.store.HasBlock(ref.Hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetch claims the missing blocks in first..last of m that nobody fetches
+// yet and pulls them into the cache in the background, without blocking readers
+func (n *Node) prefetch(m *FileManifest, first, last int) {
+	if last >= len(m.Blocks) {
+		last = len(m.Blocks) - 1
+	}
+	if last < first {
+		return
+	}
+	mine, _ := n.fetches.claim(m, first, last, n.store.HasBlock)
+	if len(mine) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		n.fetchClaimed(ctx, m, mine)
+	}()
+}
+
+// encodeRangeRequest builds the payload: uvarint offset | uvarint length | filename
+func encodeRangeRequest(filename string, off, length uint64) []byte {
+	payload := binary.AppendUvarint(nil, off)
+	payload = binary.AppendUvarint(payload, length)
+	return append(payload, filename...)
+}
+
+// decodeRangeRequest parses a range request payload
+func decodeRangeRequest(payload []byte) (filename string, off, length uint64, err error) {
+	off, n1 := binary.Uvarint(payload)
+	if n1 <= 0 {
+		return "", 0, 0, fmt.Errorf("bad range offset")
+	}
+	length, n2 := binary.Uvarint(payload[n1:])
+	if n2 <= 0 {
+		return "", 0, 0, fmt.Errorf("bad range length")
+	}
+	return string(payload[n1+n2:]), off, length, nil
+}
+
+// requestRange asks a peer for the blocks covering first..last of m in one
+// round trip and verifies each against the manifest. Returns the bytes received.
+func (n *Node) requestRange(ctx context.Context, peerID peer.ID, m *FileManifest, first, last int) (_ int, err error) {
+	defer n.metrics.observe(requestRange, time.Now(), &err)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := n.openFileStream(ctx, peerID)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	if stream.Protocol() == ProtocolFileRequestV1 {
+		return 0, fmt.Errorf("peer %s only speaks %s", peerID.ShortString(), ProtocolFileRequestV1)
+	}
+
+	off := uint64(first) * BlockSize
+	length := uint64(last-first+1) * BlockSize
+	reply, err := roundTrip(stream, frame{Type: msgRangeRequest, Payload: encodeRangeRequest(m.Name, off, length)})
+	if err != nil {
+		return 0, err
+	}
+
+	// Reply: uvarint first block index | blocks back to back
+	index, nIdx := binary.Uvarint(reply.Payload)
+	if nIdx <= 0 || index != uint64(first) {
+		return 0, fmt.Errorf("range reply from %s starts at wrong block", peerID.ShortString())
+	}
+	data := reply.Payload[nIdx:]
+	received := len(data)
+	for _, ref := range m.Blocks[first : last+1] {
+		if len(data) < int(ref.Size) {
+			return 0, fmt.Errorf("short range reply from %s", peerID.ShortString())
+		}
+		if err := n.store.PutVerifiedBlock(ref.Hash, data[:ref.Size]); err != nil {
+			return 0, fmt.Errorf("range block %s from %s: %w", ref.Hash.String()[:12], peerID.ShortString(), err)
+		}
+		data = data[ref.Size:]
+	}
+	return received, nil
+}
+
+// serveRangeRequest answers a range request with the block-aligned blocks covering it
+func (n *Node) serveRangeRequest(req frame) frame {
+	filename, off, length, err := decodeRangeRequest(req.Payload)
+	if err != nil {
+		return errorFrame(msgRange, StatusBadRequest, err.Error())
+	}
+
+	m := n.store.Manifest(filename)
+	if m == nil {
+		return errorFrame(msgRange, StatusNotFound, filename)
+	}
+	if off >= m.Size || length > MaxFrameSize {
+		return errorFrame(msgRange, StatusBadRequest, "range out of bounds")
+	}
+
+	first, last := m.blockSpan(int64(off), int64(length))
+	if last-first+1 > maxRangeBlocks {
+		return errorFrame(msgRange, StatusTooLarge, fmt.Sprintf("range spans more than %d blocks", maxRangeBlocks))
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(first))
+	for _, ref := range m.Blocks[first : last+1] {
+		block, err := n.store.GetBlock(ref.Hash)
+		if err != nil {
+			return errorFrame(msgRange, StatusNotFound, ref.Hash.String())
+		}
+		payload = append(payload, block...)
+	}
+	return frame{Type: msgRange, Payload: payload}
+}
@@ -0,0 +1,79 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestReadAtFetchesCoveringBlocks(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+
+	data := testData(20*BlockSize, 1)
+	if _, err := a.WriteFile("big.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	m, err := b.OpenFile(ctx, "big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off := int64(10*BlockSize + 100)
+	got, err := b.ReadAt(ctx, m, off, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[off:off+1000]) {
+		t.Fatal("read returned the wrong bytes")
+	}
+
+	// The covering block and the read-ahead after it, nothing else
+	readAhead := func(i int) bool { return i > 10 && i <= 10+readAheadBlocks }
+	waitFor(t, "the read-ahead", func() bool {
+		for i := 11; i <= 10+readAheadBlocks; i++ {
+			if !b.store.HasBlock(m.Blocks[i].Hash) {
+				return false
+			}
+		}
+		return true
+	})
+	for i, ref := range m.Blocks {
+		if held := b.store.HasBlock(ref.Hash); held != (i == 10 || readAhead(i)) {
+			t.Errorf("block %d held: %v", i, held)
+		}
+	}
+}
+
+func TestBlockFetchesClaimedOnce(t *testing.T) {
+	m := &FileManifest{Name: "f"}
+	for i := 0; i < 6; i++ {
+		m.Blocks = append(m.Blocks, BlockRef{Hash: HashBlock([]byte{byte(i % 5)}), Size: 1})
+	}
+	none := func(BlockHash) bool { return false }
+
+	var f blockFetches
+	mine, wait := f.claim(m, 0, 3, none)
+	if len(mine) != 4 || len(wait) != 0 {
+		t.Fatalf("first claim: %d mine, %d to wait for", len(mine), len(wait))
+	}
+	// Blocks 2 and 3 are already being fetched; block 5 repeats block 0
+	other, wait := f.claim(m, 2, 5, none)
+	if len(other) != 1 || other[0] != 4 || len(wait) != 3 {
+		t.Fatalf("overlapping claim: mine %v, %d to wait for", other, len(wait))
+	}
+
+	f.release(m, mine)
+	for _, done := range wait[:2] {
+		select {
+		case <-done:
+		default:
+			t.Fatal("released fetch still pending")
+		}
+	}
+	if again, _ := f.claim(m, 0, 1, none); len(again) != 2 {
+		t.Fatalf("released blocks claimed %v, want both", again)
+	}
+}
@@ -0,0 +1,642 @@
+// Package nodus - Replica placement, acknowledgement tracking and repair
+package nodus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	replicasFile = "replicas.json"
+
+	// replicaSaveDelay batches the tracker changes written in one save
+	replicaSaveDelay = time.Second
+
+	// repairInterval is how often the repair loop checks replica counts
+	repairInterval = 30 * time.Second
+
+	// replicaBatch is how many blocks one push carries; base64 in the JSON
+	// payload keeps it well under MaxBroadcastSize
+	replicaBatch = 8
+)
+
+// ReplicaTracker records which peers acknowledged storing which blocks.
+// Changes are saved in batches, at most replicaSaveDelay after they are made,
+// and holders are kept only for blocks a tracked file still references.
+// Only files this node replicated are tracked, so each writer repairs its own data.
+type ReplicaTracker struct {
+	mu      sync.Mutex
+	path    string
+	holders map[BlockHash]map[peer.ID]time.Time
+	files   map[string][]BlockHash
+	refs    map[BlockHash]int // tracked files referencing each block
+	timer   *time.Timer       // pending save, nil when saved
+
+	saveMu sync.Mutex // orders writes of the replicas file
+}
+
+// replicaSnapshot is the on-disk form of the tracker
+type replicaSnapshot struct {
+	Holders map[string]map[peer.ID]time.Time `json:"holders"`
+	Files   map[string][]BlockHash           `json:"files"`
+}
+
+// LoadReplicaTracker loads tracked replicas from stateDir (empty if missing)
+func LoadReplicaTracker(stateDir string) (*ReplicaTracker, error) {
+	t := &ReplicaTracker{
+		path:    filepath.Join(stateDir, replicasFile),
+		holders: make(map[BlockHash]map[peer.ID]time.Time),
+		files:   make(map[string][]BlockHash),
+		refs:    make(map[BlockHash]int),
+	}
+
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snap replicaSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid replica records: %w", err)
+	}
+	for hexHash, holders := range snap.Holders {
+		h, err := ParseBlockHash(hexHash)
+		if err != nil {
+			continue
+		}
+		t.holders[h] = holders
+	}
+	for name, hashes := range snap.Files {
+		t.files[name] = hashes
+		t.reference(hashes, 1)
+	}
+	// Records saved before holders were pruned
+	for h := range t.holders {
+		if t.refs[h] == 0 {
+			delete(t.holders, h)
+		}
+	}
+	return t, nil
+}
+
+// save writes the tracker now, taking the place of any pending save
+func (t *ReplicaTracker) save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	snap := replicaSnapshot{
+		Holders: make(map[string]map[peer.ID]time.Time, len(t.holders)),
+		Files:   t.files,
+	}
+	for h, holders := range t.holders {
+		snap.Holders[h.String()] = holders
+	}
+	data, err := json.Marshal(snap)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data, 0644)
+}
+
+// saveLater schedules a save unless one is pending; caller must hold mu
+func (t *ReplicaTracker) saveLater() {
+	if t.timer != nil {
+		return
+	}
+	t.timer = time.AfterFunc(replicaSaveDelay, func() {
+		if err := t.save(); err != nil {
+			fmt.Printf("⚠️  Failed to save replica records: %v\n", err)
+		}
+	})
+}
+
+// Flush writes pending changes, for shutdown
+func (t *ReplicaTracker) Flush() error {
+	t.mu.Lock()
+	pending := t.timer != nil
+	t.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return t.save()
+}
+
+// reference adds delta to the reference count of each distinct hash,
+// dropping the holders of blocks no tracked file references anymore;
+// caller must hold mu
+func (t *ReplicaTracker) reference(hashes []BlockHash, delta int) {
+	seen := make(map[BlockHash]bool, len(hashes))
+	for _, h := range hashes {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if t.refs[h] += delta; t.refs[h] <= 0 {
+			delete(t.refs, h)
+			delete(t.holders, h)
+		}
+	}
+}
+
+// Track starts tracking the blocks of a file, replacing those of its
+// previous version
+func (t *ReplicaTracker) Track(m *FileManifest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hashes := make([]BlockHash, len(m.Blocks))
+	for i, ref := range m.Blocks {
+		hashes[i] = ref.Hash
+	}
+	// Reference the new blocks first so those both versions share keep their holders
+	t.reference(hashes, 1)
+	if old, ok := t.files[m.Name]; ok {
+		t.reference(old, -1)
+	}
+	t.files[m.Name] = hashes
+	t.saveLater()
+}
+
+// Ack records that a peer stored a set of blocks. Blocks no tracked file
+// references anymore are not recorded.
+func (t *ReplicaTracker) Ack(id peer.ID, blocks []BlockRef) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, ref := range blocks {
+		if t.refs[ref.Hash] == 0 {
+			continue
+		}
+		holders := t.holders[ref.Hash]
+		if holders == nil {
+			holders = make(map[peer.ID]time.Time)
+			t.holders[ref.Hash] = holders
+		}
+		holders[id] = now
+	}
+	t.saveLater()
+}
+
+// Holders returns the peers that acknowledged a block
+func (t *ReplicaTracker) Holders(h BlockHash) []peer.ID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	holders := make([]peer.ID, 0, len(t.holders[h]))
+	for id := range t.holders[h] {
+		holders = append(holders, id)
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i] < holders[j] })
+	return holders
+}
+
+// Blocks returns every tracked block once
+func (t *ReplicaTracker) Blocks() []BlockHash {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var blocks []BlockHash
+	seen := make(map[BlockHash]bool)
+	for _, hashes := range t.files {
+		for _, h := range hashes {
+			if !seen[h] {
+				seen[h] = true
+				blocks = append(blocks, h)
+			}
+		}
+	}
+	return blocks
+}
+
+// Forget stops tracking a file
+func (t *ReplicaTracker) Forget(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hashes, ok := t.files[name]
+	if !ok {
+		return
+	}
+	delete(t.files, name)
+	t.reference(hashes, -1)
+	t.saveLater()
+}
+
+// Files returns the tracked file names
+func (t *ReplicaTracker) Files() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.files))
+	for name := range t.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BlockReplicas describes where one block of a file lives
+type BlockReplicas struct {
+	Index   int       `json:"index"`
+	Hash    BlockHash `json:"hash"`
+	Holders []peer.ID `json:"holders"`
+	Live    int       `json:"live"` // copies currently reachable, including our own
+	Met     bool      `json:"met"`
+}
+
+// Report describes the replicas of a tracked file. live reports whether a holder
+// is reachable and local whether this node holds a block itself.
+func (t *ReplicaTracker) Report(name string, factor int, live func(peer.ID) bool, local func(BlockHash) bool) ([]BlockReplicas, bool) {
+	t.mu.Lock()
+	hashes, ok := t.files[name]
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	report := make([]BlockReplicas, len(hashes))
+	for i, h := range hashes {
+		r := BlockReplicas{Index: i, Hash: h, Holders: t.Holders(h)}
+		if local(h) {
+			r.Live++
+		}
+		for _, id := range r.Holders {
+			if live(id) {
+				r.Live++
+			}
+		}
+		r.Met = r.Live >= factor
+		report[i] = r
+	}
+	return report, true
+}
+
+// rendezvousScore ranks a peer for a block; the highest scores hold the replicas
+func rendezvousScore(h BlockHash, id peer.ID) string {
+	sum := sha256.Sum256(append(h[:], id...))
+	return string(sum[:])
+}
+
+// placeBlock picks up to want peers from candidates to hold a block, skipping
+// peers that already hold it. Rendezvous hashing keeps placement stable as peers come and go.
+func placeBlock(h BlockHash, candidates []peer.ID, exclude map[peer.ID]bool, want int) []peer.ID {
+	var pool []peer.ID
+	for _, id := range candidates {
+		if !exclude[id] {
+			pool = append(pool, id)
+		}
+	}
+	sort.Slice(pool, func(i, j int) bool {
+		return rendezvousScore(h, pool[i]) > rendezvousScore(h, pool[j])
+	})
+	if len(pool) > want {
+		pool = pool[:want]
+	}
+	return pool
+}
+
+// Replicas returns the node's replica tracker
+func (n *Node) Replicas() *ReplicaTracker {
+	return n.replicas
+}
+
+// ReplicaReport describes where each block of a file lives right now
+func (n *Node) ReplicaReport(name string) ([]BlockReplicas, bool) {
+	connected := make(map[peer.ID]bool)
+	for _, id := range n.ConnectedPeers() {
+		connected[id] = true
+	}
+	return n.replicas.Report(name, n.replicationFactor(name),
+		func(id peer.ID) bool { return connected[id] },
+		n.store.HasBlock)
+}
+
+// replicate places every block of m on enough peers to meet the replication
+// factor and waits for their acknowledgements. It returns how many peers were asked.
+func (n *Node) replicate(ctx context.Context, m *FileManifest) (int, error) {
+	n.replicas.Track(m)
+
+	connected := make(map[peer.ID]bool)
+	candidates := n.peersAtLeast(TrustCloud)
+	for _, id := range candidates {
+		connected[id] = true
+	}
+
+	// Group the blocks each peer should receive
+	assign := make(map[peer.ID][]BlockRef)
+	for _, ref := range uniqueBlocks(m) {
+		exclude := make(map[peer.ID]bool)
+		have := 0
+		if n.store.HasBlock(ref.Hash) {
+			have++
+		}
+		for _, id := range n.replicas.Holders(ref.Hash) {
+			exclude[id] = true
+			if connected[id] {
+				have++
+			}
+		}
+
+		want := n.replicationFactor(m.Name) - have
+		if want <= 0 {
+			continue
+		}
+		for _, id := range placeBlock(ref.Hash, candidates, exclude, want) {
+			assign[id] = append(assign[id], ref)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(assign))
+	for id, blocks := range assign {
+		wg.Add(1)
+		go func(id peer.ID, blocks []BlockRef) {
+			defer wg.Done()
+			if err := n.sendReplicate(ctx, id, blocks); err != nil {
+				errs <- fmt.Errorf("%s: %w", id.ShortString(), err)
+				return
+			}
+			n.replicas.Ack(id, blocks)
+		}(id, blocks)
+	}
+	wg.Wait()
+	close(errs)
+	n.releaseReplicated(m.Name)
+
+	for err := range errs {
+		return len(assign), err
+	}
+	return len(assign), nil
+}
+
+// uniqueBlocks returns each distinct block of m once
+func uniqueBlocks(m *FileManifest) []BlockRef {
+	var refs []BlockRef
+	seen := make(map[BlockHash]bool)
+	for _, ref := range m.Blocks {
+		if !seen[ref.Hash] {
+			seen[ref.Hash] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// replicaBlock is one block pushed to a replica holder
+type replicaBlock struct {
+	Ref  BlockRef `json:"ref"`
+	Data []byte   `json:"data"`
+}
+
+// sendReplicate asks a peer to keep a set of blocks and pushes the ones it
+// lacks. Holders may be cloud peers, which can't read from us, so they never
+// pull.
+func (n *Node) sendReplicate(ctx context.Context, peerID peer.ID, blocks []BlockRef) (err error) {
+	defer n.metrics.observe(requestReplicate, time.Now(), &err)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	payload, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	reply, err := n.broadcastRoundTrip(ctx, peerID, frame{Type: msgReplicate, Payload: payload})
+	if err != nil {
+		return err
+	}
+	var missing []BlockRef
+	if len(reply.Payload) > 0 {
+		if err := json.Unmarshal(reply.Payload, &missing); err != nil {
+			return fmt.Errorf("invalid replicate reply: %w", err)
+		}
+	}
+
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > replicaBatch {
+			batch = batch[:replicaBatch]
+		}
+		missing = missing[len(batch):]
+
+		push := make([]replicaBlock, len(batch))
+		for i, ref := range batch {
+			data, err := n.store.GetBlock(ref.Hash)
+			if err != nil {
+				return fmt.Errorf("block %s: %w", ref.Hash.String()[:12], err)
+			}
+			push[i] = replicaBlock{Ref: ref, Data: data}
+		}
+		payload, err := json.Marshal(push)
+		if err != nil {
+			return err
+		}
+		if _, err := n.broadcastRoundTrip(ctx, peerID, frame{Type: msgReplicaBlocks, Payload: payload}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastRoundTrip sends one frame on a new broadcast stream and reads the reply
+func (n *Node) broadcastRoundTrip(ctx context.Context, peerID peer.ID, req frame) (frame, error) {
+	stream, err := n.host.NewStream(ctx, peerID, ProtocolFileBroadcast)
+	if err != nil {
+		return frame{}, err
+	}
+	defer stream.Close()
+	setStreamDeadline(ctx, stream)
+	return roundTrip(stream, req)
+}
+
+// serveReplicate answers a replicate request with the blocks this node lacks,
+// which the sender then pushes. The blocks count against the sender's cache
+// quota, and requests that can't fit in what is left of it are refused.
+func (n *Node) serveReplicate(remote peer.ID, req frame) frame {
+	var blocks []BlockRef
+	if err := json.Unmarshal(req.Payload, &blocks); err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+
+	missing := n.store.MissingBlocks(&FileManifest{Blocks: blocks})
+	if err := n.checkQuota(remote, missing); err != nil {
+		return errorFrame(msgAck, StatusTooLarge, err.Error())
+	}
+	if len(missing) == 0 {
+		fmt.Printf("📦 Holding %d replica blocks for %s\n", len(blocks), remote.ShortString())
+		return frame{Type: msgAck}
+	}
+	payload, err := json.Marshal(missing)
+	if err != nil {
+		return errorFrame(msgAck, StatusError, err.Error())
+	}
+	return frame{Type: msgAck, Payload: payload}
+}
+
+// serveReplicaBlocks stores blocks pushed by a replicating peer under its quota
+func (n *Node) serveReplicaBlocks(remote peer.ID, req frame) frame {
+	var push []replicaBlock
+	if err := json.Unmarshal(req.Payload, &push); err != nil {
+		return errorFrame(msgAck, StatusBadRequest, err.Error())
+	}
+
+	refs := make([]BlockRef, len(push))
+	for i, b := range push {
+		refs[i] = b.Ref
+	}
+	if err := n.checkQuota(remote, n.store.MissingBlocks(&FileManifest{Blocks: refs})); err != nil {
+		return errorFrame(msgAck, StatusTooLarge, err.Error())
+	}
+
+	for _, b := range push {
+		if err := n.store.putVerifiedBlock(b.Ref.Hash, b.Data, remote.String()); err != nil {
+			if errors.Is(err, ErrQuotaExceeded) {
+				return errorFrame(msgAck, StatusTooLarge, err.Error())
+			}
+			return errorFrame(msgAck, StatusError, fmt.Sprintf("block %s: %v", b.Ref.Hash.String()[:12], err))
+		}
+	}
+
+	fmt.Printf("📦 Holding %d replica blocks for %s\n", len(push), remote.ShortString())
+	return frame{Type: msgAck}
+}
+
+// checkQuota reports whether refs fit in what is left of remote's cache quota
+func (n *Node) checkQuota(remote peer.ID, refs []BlockRef) error {
+	used, quota := n.cache.OwnerUsage(remote.String())
+	if quota == 0 {
+		return nil
+	}
+	need := int64(0)
+	for _, ref := range refs {
+		need += int64(ref.Size)
+	}
+	if used+need > quota {
+		return fmt.Errorf("%d bytes for %s with %d of %d held: %w", need, remote.ShortString(), used, quota, ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// StartRepair periodically re-replicates tracked blocks whose holders have disappeared
+func (n *Node) StartRepair(ctx context.Context) {
+	ticker := time.NewTicker(repairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.repair(ctx)
+		}
+	}
+}
+
+// repair runs one pass over every tracked file
+func (n *Node) repair(ctx context.Context) {
+	for _, name := range n.replicas.Files() {
+		report, ok := n.ReplicaReport(name)
+		if !ok {
+			continue
+		}
+
+		degraded := 0
+		for _, r := range report {
+			if !r.Met {
+				degraded++
+			}
+		}
+		if degraded == 0 {
+			continue
+		}
+
+		m := n.store.Manifest(name)
+		if m == nil {
+			n.replicas.Forget(name)
+			continue
+		}
+		asked, err := n.replicate(ctx, m)
+		if err != nil {
+			fmt.Printf("⚠️  Repair of '%s' (%d blocks under-replicated) failed: %v\n", name, degraded, err)
+		} else if asked > 0 {
+			fmt.Printf("🔧 Repaired '%s' (%d blocks under-replicated, %d new holders)\n", name, degraded, asked)
+		}
+	}
+}
+
+// ErrUnderReplicated is returned by SyncFile when blocks lack copies at the deadline
+var ErrUnderReplicated = errors.New("not enough replicas")
+
+// syncRetryInterval is how often SyncFile retries while peers are missing
+const syncRetryInterval = time.Second
+
+// syncWrite makes a stored write durable for fsync and NBD FLUSH. The write
+// is already stored locally, and journalled when no peer is connected; it
+// waits for replicas only when enough peers are connected to hold them, so an
+// offline node or a network smaller than the factor doesn't stall.
+func (n *Node) syncWrite(ctx context.Context, name string) error {
+	if n.offline() {
+		return nil // the announcement journalled it for when peers return
+	}
+	if len(n.peersAtLeast(TrustCloud))+1 < n.replicationFactor(name) {
+		if m := n.store.Manifest(name); m != nil && m.Kind == "" {
+			n.replicateLater(m)
+		}
+		return nil
+	}
+	return n.SyncFile(ctx, name)
+}
+
+// SyncFile replicates a file and waits until every block has the configured
+// number of live copies, retrying as peers connect until ctx is done
+func (n *Node) SyncFile(ctx context.Context, name string) error {
+	for {
+		m := n.store.Manifest(name)
+		if m == nil {
+			return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		if m.Kind != "" {
+			return nil // directories and symlinks travel with their announcements
+		}
+
+		_, err := n.replicate(ctx, m)
+		report, _ := n.ReplicaReport(name)
+		short := 0
+		for _, r := range report {
+			if !r.Met {
+				short++
+			}
+		}
+		if short == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("%s: %w (%d of %d blocks below %d copies): %v",
+				name, ErrUnderReplicated, short, len(report), n.replicationFactor(name), err)
+		case <-time.After(syncRetryInterval):
+		}
+	}
+}
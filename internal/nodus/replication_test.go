@@ -0,0 +1,92 @@
+package nodus
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicateToCloudHolder(t *testing.T) {
+	a := newTestNode(t, func(cfg *Config) { cfg.ReplicationFactor = 2 })
+	b := newTestNode(t)
+	// b is only a cloud peer to a, so it can't read from a and must be pushed to,
+	// in more than one batch
+	linkNodes(t, a, b, TrustCloud, TrustTrusted)
+
+	m, err := a.WriteFile("big.bin", testData((replicaBatch+2)*BlockSize+1234, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	asked, err := a.replicate(ctx, m)
+	if err != nil {
+		t.Fatalf("replicate: %v", err)
+	}
+	if asked != 1 {
+		t.Fatalf("asked %d holders, want 1", asked)
+	}
+
+	for _, ref := range m.Blocks {
+		if !b.store.HasBlock(ref.Hash) {
+			t.Errorf("holder lacks block %s", ref.Hash.String()[:12])
+		}
+		if holders := a.replicas.Holders(ref.Hash); len(holders) != 1 || holders[0] != b.host.ID() {
+			t.Errorf("block %s holders %v, want [%s]", ref.Hash.String()[:12], holders, b.host.ID())
+		}
+	}
+	if used, _ := b.cache.OwnerUsage(a.host.ID().String()); used == 0 {
+		t.Error("pushed blocks aren't charged to the sender")
+	}
+
+	// A second pass finds every block placed and asks nobody
+	if asked, err := a.replicate(ctx, m); err != nil || asked != 0 {
+		t.Errorf("second replicate asked %d, err %v", asked, err)
+	}
+}
+
+func TestReplicaTrackerPrunesAndBatches(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := LoadReplicaTracker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := func(seed byte) BlockRef { return BlockRef{Hash: HashBlock([]byte{seed}), Size: 1} }
+	holder := testPeerID(t)
+
+	tr.Track(&FileManifest{Name: "f", Blocks: []BlockRef{ref(1), ref(2)}})
+	tr.Ack(holder, []BlockRef{ref(1), ref(2), ref(3)})
+	if len(tr.Holders(ref(3).Hash)) != 0 {
+		t.Fatal("holder recorded for an untracked block")
+	}
+	if _, err := os.Stat(filepath.Join(dir, replicasFile)); !os.IsNotExist(err) {
+		t.Fatalf("saved on every change: %v", err)
+	}
+
+	// The new version shares block 2; block 1 is no longer referenced
+	tr.Track(&FileManifest{Name: "f", Blocks: []BlockRef{ref(2), ref(4)}})
+	if len(tr.Holders(ref(1).Hash)) != 0 {
+		t.Error("holders of a replaced block kept")
+	}
+	if len(tr.Holders(ref(2).Hash)) != 1 {
+		t.Error("holders of a shared block dropped")
+	}
+
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadReplicaTracker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Holders(ref(2).Hash); len(got) != 1 || got[0] != holder {
+		t.Fatalf("holders after reload: %v", got)
+	}
+
+	reloaded.Forget("f")
+	if len(reloaded.Holders(ref(2).Hash)) != 0 || len(reloaded.Blocks()) != 0 {
+		t.Error("forgotten file left holders behind")
+	}
+}
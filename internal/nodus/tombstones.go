@@ -0,0 +1,352 @@
+// Package nodus - Tombstones: signed deletes that replicate like writes, and the trash
+package nodus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// KindTombstone marks a manifest recording that its path was deleted
+const KindTombstone = "tombstone"
+
+const (
+	tombstonesFile = "tombstones.json"
+
+	// tombstoneInterval is how often tombstones are offered to peers that
+	// haven't acknowledged them, and collected once all have
+	tombstoneInterval = 30 * time.Second
+)
+
+// tombstone is a deletion this node knows of
+type tombstone struct {
+	m       *FileManifest    // the signed tombstone
+	deleted *FileManifest    // what it removed here, kept for the trash
+	acked   map[peer.ID]bool // peers known to hold it
+}
+
+// tombstoneRecord is the on-disk form of a tombstone
+type tombstoneRecord struct {
+	Tombstone json.RawMessage `json:"tombstone"`
+	Deleted   json.RawMessage `json:"deleted,omitempty"`
+	Acked     []peer.ID       `json:"acked,omitempty"`
+}
+
+// tombstoneSet holds the tombstones by path, persisted so deleted files
+// stay deleted across restarts
+type tombstoneSet struct {
+	mu     sync.Mutex
+	path   string
+	graves map[string]*tombstone
+}
+
+// loadTombstones loads the tombstones from stateDir (empty if missing)
+func loadTombstones(stateDir string) (*tombstoneSet, error) {
+	t := &tombstoneSet{
+		path:   filepath.Join(stateDir, tombstonesFile),
+		graves: make(map[string]*tombstone),
+	}
+
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []tombstoneRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid tombstones: %w", err)
+	}
+	for _, r := range records {
+		m, err := UnmarshalManifest(r.Tombstone)
+		if err != nil || m.Kind != KindTombstone {
+			return nil, fmt.Errorf("invalid tombstone: %v", err)
+		}
+		grave := &tombstone{m: m, acked: make(map[peer.ID]bool)}
+		if len(r.Deleted) > 0 {
+			if grave.deleted, err = UnmarshalManifest(r.Deleted); err != nil {
+				return nil, fmt.Errorf("invalid tombstone: %w", err)
+			}
+		}
+		for _, id := range r.Acked {
+			grave.acked[id] = true
+		}
+		t.graves[m.Name] = grave
+	}
+	return t, nil
+}
+
+// save persists the tombstones; caller must hold mu
+func (t *tombstoneSet) save() error {
+	names := make([]string, 0, len(t.graves))
+	for name := range t.graves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := make([]tombstoneRecord, 0, len(names))
+	for _, name := range names {
+		grave := t.graves[name]
+		var r tombstoneRecord
+		var err error
+		if r.Tombstone, err = grave.m.Marshal(); err != nil {
+			return err
+		}
+		if grave.deleted != nil {
+			if r.Deleted, err = grave.deleted.Marshal(); err != nil {
+				return err
+			}
+		}
+		for id := range grave.acked {
+			r.Acked = append(r.Acked, id)
+		}
+		sort.Slice(r.Acked, func(i, j int) bool { return r.Acked[i] < r.Acked[j] })
+		records = append(records, r)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data, 0644)
+}
+
+// saveOrWarn persists the tombstones, warning on failure; caller must hold mu
+func (t *tombstoneSet) saveOrWarn() {
+	if err := t.save(); err != nil {
+		fmt.Printf("⚠️  Failed to save tombstones: %v\n", err)
+	}
+}
+
+// get returns the tombstone of name (nil if it isn't deleted)
+func (t *tombstoneSet) get(name string) *FileManifest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if grave, ok := t.graves[name]; ok {
+		return grave.m
+	}
+	return nil
+}
+
+// put records tombstone m, which deleted the local version deleted (may be nil)
+func (t *tombstoneSet) put(m, deleted *FileManifest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.graves[m.Name] = &tombstone{m: m, deleted: deleted, acked: make(map[peer.ID]bool)}
+	t.saveOrWarn()
+}
+
+// remove forgets the tombstone of name once a newer version took its place
+func (t *tombstoneSet) remove(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.graves[name]; ok {
+		delete(t.graves, name)
+		t.saveOrWarn()
+	}
+}
+
+// ack records that a peer holds tombstone m
+func (t *tombstoneSet) ack(m *FileManifest, id peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	grave, ok := t.graves[m.Name]
+	if !ok || grave.m.ID() != m.ID() || grave.acked[id] {
+		return
+	}
+	grave.acked[id] = true
+	t.saveOrWarn()
+}
+
+// unacked returns the tombstones some of peers haven't acknowledged, with
+// those peers
+func (t *tombstoneSet) unacked(peers []peer.ID) map[*FileManifest][]peer.ID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := make(map[*FileManifest][]peer.ID)
+	for _, grave := range t.graves {
+		for _, id := range peers {
+			if !grave.acked[id] {
+				pending[grave.m] = append(pending[grave.m], id)
+			}
+		}
+	}
+	return pending
+}
+
+// collect forgets the tombstones older than keep that every known peer
+// acknowledged, returning how many
+func (t *tombstoneSet) collect(known []peer.ID, keep time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	collected := 0
+	for name, grave := range t.graves {
+		if time.Since(time.Unix(0, grave.m.Ctime)) < keep {
+			continue
+		}
+		all := true
+		for _, id := range known {
+			if !grave.acked[id] {
+				all = false
+				break
+			}
+		}
+		if all {
+			delete(t.graves, name)
+			collected++
+		}
+	}
+	if collected > 0 {
+		t.saveOrWarn()
+	}
+	return collected
+}
+
+// restoreTombstones adds the loaded tombstones to the store's history, so
+// files created again supersede them
+func (n *Node) restoreTombstones() {
+	n.tombstones.mu.Lock()
+	defer n.tombstones.mu.Unlock()
+	for _, grave := range n.tombstones.graves {
+		n.store.recordTombstone(grave.m)
+	}
+}
+
+// bury deletes m and publishes a signed tombstone superseding every version
+// of its path seen so far. target is the new path when m was renamed.
+func (n *Node) bury(m *FileManifest, target string) error {
+	now := time.Now().UnixNano()
+	t := &FileManifest{Name: m.Name, Kind: KindTombstone, Target: target}
+	t.Mtime, t.Ctime = now, now
+	n.store.stamp(t)
+	if err := n.signObject(t); err != nil {
+		return err
+	}
+	n.DeleteFile(m.Name)
+	n.store.recordTombstone(t)
+	n.tombstones.put(t, m)
+	n.announce(t)
+	return nil
+}
+
+// acceptTombstone applies a tombstone announced by a peer. It deletes the
+// local version if the tombstone follows it; a write made concurrently
+// with the delete survives it.
+func (n *Node) acceptTombstone(t *FileManifest) bool {
+	if cur := n.tombstones.get(t.Name); cur != nil && t.Version.compare(cur.Version) != orderAfter {
+		return false
+	}
+	local := n.store.Manifest(t.Name)
+	if local != nil && t.Version.compare(local.Version) != orderAfter {
+		return false
+	}
+
+	n.DeleteFile(t.Name)
+	n.store.recordTombstone(t)
+	n.tombstones.put(t, local)
+	return true
+}
+
+// deleted reports whether name has a tombstone, so peers still holding the
+// file aren't asked for it
+func (n *Node) deleted(name string) error {
+	if n.tombstones.get(name) != nil {
+		return fmt.Errorf("'%s' was deleted: %w", name, os.ErrNotExist)
+	}
+	return nil
+}
+
+// knownPeers returns the allowlisted peers that receive announcements
+func (n *Node) knownPeers() []peer.ID {
+	var known []peer.ID
+	for _, e := range n.Trust().List() {
+		if e.Level >= TrustCloud && e.ID != n.host.ID() {
+			known = append(known, e.ID)
+		}
+	}
+	return known
+}
+
+// StartTombstones offers tombstones to connected peers that haven't
+// acknowledged them, and forgets those every known peer holds once they
+// leave the trash, until ctx is cancelled
+func (n *Node) StartTombstones(ctx context.Context) {
+	ticker := time.NewTicker(tombstoneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for t, peers := range n.tombstones.unacked(n.peersAtLeast(TrustCloud)) {
+				for _, id := range peers {
+					n.sendManifestToPeer(id, t)
+				}
+			}
+			if collected := n.tombstones.collect(n.knownPeers(), n.cfg.TrashRetention); collected > 0 {
+				fmt.Printf("🧹 Forgot %d tombstone(s) every peer holds\n", collected)
+			}
+		}
+	}
+}
+
+// TrashEntry describes a deleted file that can still be restored
+type TrashEntry struct {
+	Name    string    `json:"name"`
+	Kind    string    `json:"kind,omitempty"` // "" for files
+	Size    uint64    `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	By      string    `json:"by,omitempty"` // peer that deleted it
+}
+
+// Trash lists the files deleted within the trash retention, by name.
+// Renamed files aren't listed; their content lives on under the new name.
+func (n *Node) Trash() []TrashEntry {
+	n.tombstones.mu.Lock()
+	defer n.tombstones.mu.Unlock()
+
+	var trash []TrashEntry
+	for name, grave := range n.tombstones.graves {
+		deleted := time.Unix(0, grave.m.Ctime)
+		if grave.deleted == nil || grave.m.Target != "" || time.Since(deleted) > n.cfg.TrashRetention {
+			continue
+		}
+		entry := TrashEntry{Name: name, Kind: grave.deleted.Kind, Size: grave.deleted.Size, Deleted: deleted}
+		if grave.m.Writer != "" {
+			entry.By = grave.m.Writer.String()
+		}
+		trash = append(trash, entry)
+	}
+	sort.Slice(trash, func(i, j int) bool { return trash[i].Name < trash[j].Name })
+	return trash
+}
+
+// RestoreTrash brings a deleted file back, as a new write that supersedes
+// its tombstone on every peer
+func (n *Node) RestoreTrash(ctx context.Context, name string) (*FileManifest, error) {
+	var deleted *FileManifest
+	n.tombstones.mu.Lock()
+	if grave, ok := n.tombstones.graves[name]; ok && grave.m.Target == "" &&
+		time.Since(time.Unix(0, grave.m.Ctime)) <= n.cfg.TrashRetention {
+		deleted = grave.deleted
+	}
+	n.tombstones.mu.Unlock()
+	if deleted == nil {
+		return nil, fmt.Errorf("'%s' in trash: %w", name, os.ErrNotExist)
+	}
+	if n.statLocal(name) != nil {
+		return nil, fmt.Errorf("'%s': %w", name, os.ErrExist)
+	}
+	return n.rewrite(ctx, deleted)
+}
@@ -0,0 +1,168 @@
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestTombstoneSuppressesStaleAnnouncements(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	linkNodes(t, a, b, TrustTrusted, TrustTrusted)
+
+	old, err := a.WriteFile("notes.txt", []byte("draft"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.announceWait(old)
+	if b.store.Manifest("notes.txt") == nil {
+		t.Fatal("file not announced to the peer")
+	}
+
+	if err := a.Remove("notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delete on the peer", func() bool { return b.store.Manifest("notes.txt") == nil })
+	if pending := a.tombstones.unacked([]peer.ID{b.host.ID()}); len(pending) != 0 {
+		t.Error("tombstone not acknowledged by the peer that took it")
+	}
+
+	// A peer that missed the delete announces the old version again
+	if err := a.sendManifestToPeer(b.host.ID(), old); err != nil {
+		t.Fatal(err)
+	}
+	if b.store.Manifest("notes.txt") != nil {
+		t.Fatal("stale announcement resurrected a deleted file")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := b.RequestFile(ctx, "notes.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("RequestFile of a deleted file: %v", err)
+	}
+
+	// Writing the name again supersedes the tombstone everywhere
+	m, err := a.WriteFile("notes.txt", []byte("final"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.announceWait(m)
+	if b.store.Manifest("notes.txt") == nil {
+		t.Fatal("write after the delete didn't reach the peer")
+	}
+	if b.tombstones.get("notes.txt") != nil {
+		t.Error("tombstone kept after a newer write")
+	}
+}
+
+// graveAt returns a tombstone for name made at ctime, signed by n
+func graveAt(t *testing.T, n *Node, name string, ctime time.Time) *FileManifest {
+	t.Helper()
+	m := &FileManifest{Name: name, Kind: KindTombstone, Meta: Meta{Mtime: ctime.UnixNano(), Ctime: ctime.UnixNano()}}
+	if err := n.signObject(m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTombstonesCollectedOnceAllPeersAck(t *testing.T) {
+	n := newTestNode(t)
+	dir := t.TempDir()
+	set, err := loadTombstones(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := testPeerID(t), testPeerID(t)
+	known := []peer.ID{p1, p2}
+
+	old := graveAt(t, n, "old.txt", time.Now().Add(-time.Hour))
+	recent := graveAt(t, n, "recent.txt", time.Now())
+	set.put(old, nil)
+	set.put(recent, nil)
+
+	set.ack(old, p1)
+	set.ack(recent, p1)
+	set.ack(recent, p2)
+	if n := set.collect(known, time.Minute); n != 0 {
+		t.Fatalf("collected %d tombstones before every peer acked", n)
+	}
+	if pending := set.unacked(known); len(pending) != 1 || len(pending[old]) != 1 || pending[old][0] != p2 {
+		t.Errorf("unacked %v, want old.txt for p2", pending)
+	}
+
+	// Acks survive a restart
+	set, err = loadTombstones(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.ack(set.get("old.txt"), p2)
+	if n := set.collect(known, time.Minute); n != 1 {
+		t.Fatalf("collected %d tombstones, want old.txt", n)
+	}
+	if set.get("old.txt") != nil {
+		t.Error("acked tombstone kept")
+	}
+	// Still within the trash retention, so kept though every peer holds it
+	if set.get("recent.txt") == nil {
+		t.Error("tombstone collected inside the retention")
+	}
+
+	// An ack for an older tombstone of the same path doesn't count
+	newer := graveAt(t, n, "recent.txt", time.Now().Add(time.Second))
+	set.put(newer, nil)
+	set.ack(recent, p1)
+	if pending := set.unacked(known); len(pending[newer]) != 2 {
+		t.Errorf("stale ack counted for the newer tombstone: %v", pending)
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	n := newTestNode(t)
+	want := testData(BlockSize+5, 7)
+	if _, err := n.WriteFile("report.pdf", want); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Remove("report.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if n.store.Manifest("report.pdf") != nil {
+		t.Fatal("removed file still stored")
+	}
+
+	trash := n.Trash()
+	if len(trash) != 1 || trash[0].Name != "report.pdf" || trash[0].Size != uint64(len(want)) {
+		t.Fatalf("trash %+v", trash)
+	}
+
+	ctx := context.Background()
+	if _, err := n.RestoreTrash(ctx, "other.pdf"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restoring a file never deleted: %v", err)
+	}
+	if _, err := n.RestoreTrash(ctx, "report.pdf"); err != nil {
+		t.Fatalf("RestoreTrash: %v", err)
+	}
+	got, err := n.store.ReadFile("report.pdf")
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("restored content: %v", err)
+	}
+	if trash := n.Trash(); len(trash) != 0 {
+		t.Errorf("trash after restore %+v", trash)
+	}
+
+	// Outside the retention deleted files can't come back
+	n.cfg.TrashRetention = 0
+	if err := n.Remove("report.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if trash := n.Trash(); len(trash) != 0 {
+		t.Errorf("trash lists files past retention: %+v", trash)
+	}
+	if _, err := n.RestoreTrash(ctx, "report.pdf"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("restoring past retention: %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+// Package nodus - Directory tree: directories and symlinks as signed manifests
+package nodus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest kinds besides regular files
+const (
+	KindDir     = "dir"
+	KindSymlink = "symlink"
+)
+
+// objectContext prefixes the bytes signed for a directory or symlink
+const objectContext = "spirit-nodus/object:"
+
+var (
+	// ErrNotDir is returned when a path used as a directory is something else
+	ErrNotDir = errors.New("not a directory")
+	// ErrIsDir is returned when a file operation names a directory
+	ErrIsDir = errors.New("is a directory")
+	// ErrDirNotEmpty is returned when removing or replacing a directory with children
+	ErrDirNotEmpty = errors.New("directory not empty")
+)
+
+// DirEntry is one child of a directory
+type DirEntry struct {
+	Name string `json:"name"`
+	Kind string `json:"kind,omitempty"` // "" for files
+}
+
+// checkPath rejects names that aren't clean relative paths, so every path
+// has exactly one key in the store
+func checkPath(p string) error {
+	if p == "" {
+		return fmt.Errorf("empty path")
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("bad path %q", p)
+		}
+	}
+	return nil
+}
+
+// joinPath returns the path of name inside dir ("" is the root)
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// parentPath returns the directory holding p
+func parentPath(p string) string {
+	if dir := path.Dir(p); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// signingPayload is the byte string a directory or symlink's author signs
+func (m *FileManifest) signingPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	data, err := unsigned.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(objectContext), data...), nil
+}
+
+// checkObject validates a directory, symlink or tombstone manifest and its signature
+func (m *FileManifest) checkObject() error {
+	switch m.Kind {
+	case KindDir:
+		if m.Target != "" {
+			return fmt.Errorf("directory with a target")
+		}
+	case KindSymlink:
+		if m.Target == "" {
+			return fmt.Errorf("symlink without a target")
+		}
+	case KindTombstone:
+		// Target is the new path when the file was renamed
+	default:
+		return fmt.Errorf("unknown kind %q", m.Kind)
+	}
+	if len(m.Blocks) > 0 || m.Size != 0 || m.Encrypted() {
+		return fmt.Errorf("%s with content", m.Kind)
+	}
+
+	pub, err := m.Signer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("bad signer: %w", err)
+	}
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(payload, m.Signature); err != nil || !ok {
+		return fmt.Errorf("%s '%s' not signed by %s", m.Kind, m.Name, m.Signer.ShortString())
+	}
+	return nil
+}
+
+// checkSigner rejects a directory, symlink or tombstone unless this node or
+// a trusted peer signed it; any peer can mint a key and sign an object
+func (n *Node) checkSigner(m *FileManifest) error {
+	if m.Kind == "" || n.TrustLevel(m.Signer) >= TrustTrusted {
+		return nil
+	}
+	return fmt.Errorf("%s '%s' signed by untrusted %s", m.Kind, m.Name, m.Signer.ShortString())
+}
+
+// signObject signs a directory or symlink manifest with the node key
+func (n *Node) signObject(m *FileManifest) error {
+	key := n.host.Peerstore().PrivKey(n.host.ID())
+	if key == nil {
+		return fmt.Errorf("no private key for %s", n.host.ID())
+	}
+	m.Signer = n.host.ID()
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+	m.Signature, err = key.Sign(payload)
+	return err
+}
+
+// publishObject stores a directory or symlink manifest and announces it.
+// Peers keep it like any announced manifest and serve it to manifest requests.
+func (n *Node) publishObject(m *FileManifest) error {
+	if err := n.storeObject(m); err != nil {
+		return err
+	}
+	n.announce(m)
+	return nil
+}
+
+// storeObject stamps, signs and stores a directory or symlink manifest
+func (n *Node) storeObject(m *FileManifest) error {
+	n.store.stamp(m)
+	if err := n.signObject(m); err != nil {
+		return err
+	}
+	n.store.PutManifest(m)
+	return nil
+}
+
+// Stat returns the manifest at p, fetching it from peers if it isn't local.
+// Directories implied by deeper paths and the root ("") are reported as
+// unsigned directory manifests.
+func (n *Node) Stat(ctx context.Context, p string) (*FileManifest, error) {
+	if p == "" || n.hasChildren(p) {
+		if m := n.store.Manifest(p); m != nil {
+			return m, nil
+		}
+		return &FileManifest{Name: p, Kind: KindDir}, nil
+	}
+	m, err := n.OpenFile(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w (%v)", p, os.ErrNotExist, err)
+	}
+	return m, nil
+}
+
+// statLocal is Stat without asking peers
+func (n *Node) statLocal(p string) *FileManifest {
+	if m := n.store.Manifest(p); m != nil {
+		return m
+	}
+	if p == "" || n.hasChildren(p) {
+		return &FileManifest{Name: p, Kind: KindDir}
+	}
+	return nil
+}
+
+// hasChildren reports whether any known path lies inside dir
+func (n *Node) hasChildren(dir string) bool {
+	return len(n.descendants(dir)) > 0
+}
+
+// descendants returns every known path inside dir, parents before children
+func (n *Node) descendants(dir string) []string {
+	prefix := dir + "/"
+	var paths []string
+	for _, name := range n.store.Files() {
+		if dir == "" || strings.HasPrefix(name, prefix) {
+			paths = append(paths, name)
+		}
+	}
+	return paths
+}
+
+// ReadDir lists the children of dir known locally, including directories
+// only implied by deeper paths
+func (n *Node) ReadDir(dir string) ([]DirEntry, error) {
+	if m := n.statLocal(dir); m == nil {
+		return nil, fmt.Errorf("%s: %w", dir, os.ErrNotExist)
+	} else if m.Kind != KindDir {
+		return nil, fmt.Errorf("%s: %w", dir, ErrNotDir)
+	}
+
+	children := make(map[string]string)
+	for _, name := range n.descendants(dir) {
+		rest := name
+		if dir != "" {
+			rest = name[len(dir)+1:]
+		}
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			children[rest[:i]] = KindDir
+		} else if m := n.store.Manifest(name); m != nil {
+			if _, seen := children[rest]; !seen {
+				children[rest] = m.Kind
+			}
+		}
+	}
+
+	entries := make([]DirEntry, 0, len(children))
+	for name, kind := range children {
+		entries = append(entries, DirEntry{Name: name, Kind: kind})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// checkCreate verifies p can be created: its parent is a directory and p is free
+func (n *Node) checkCreate(p string) error {
+	if err := checkPath(p); err != nil {
+		return fmt.Errorf("%w: %v", os.ErrInvalid, err)
+	}
+	parent := n.statLocal(parentPath(p))
+	if parent == nil {
+		return fmt.Errorf("%s: %w", parentPath(p), os.ErrNotExist)
+	}
+	if parent.Kind != KindDir {
+		return fmt.Errorf("%s: %w", parentPath(p), ErrNotDir)
+	}
+	if n.statLocal(p) != nil {
+		return fmt.Errorf("%s: %w", p, os.ErrExist)
+	}
+	return nil
+}
+
+// Create creates an empty file with the given metadata (nil for defaults)
+func (n *Node) Create(p string, meta *Meta) (*FileManifest, error) {
+	if err := n.checkCreate(p); err != nil {
+		return nil, err
+	}
+	return n.writeFile(p, []byte{}, meta)
+}
+
+// Mkdir creates a directory and announces it to peers; meta may be nil
+func (n *Node) Mkdir(p string, meta *Meta) (*FileManifest, error) {
+	if err := n.checkCreate(p); err != nil {
+		return nil, err
+	}
+	m := &FileManifest{Name: p, Kind: KindDir, Meta: newMeta(KindDir, meta)}
+	if err := n.publishObject(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Symlink creates a symlink at p pointing to target; meta may be nil
+func (n *Node) Symlink(p, target string, meta *Meta) (*FileManifest, error) {
+	if target == "" {
+		return nil, fmt.Errorf("%w: empty symlink target", os.ErrInvalid)
+	}
+	if err := n.checkCreate(p); err != nil {
+		return nil, err
+	}
+	m := &FileManifest{Name: p, Kind: KindSymlink, Target: target, Meta: newMeta(KindSymlink, meta)}
+	if err := n.publishObject(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RemoveDir removes an empty directory
+func (n *Node) RemoveDir(p string) error {
+	m := n.statLocal(p)
+	switch {
+	case p == "":
+		return fmt.Errorf("%w: can't remove the root", os.ErrInvalid)
+	case m == nil:
+		return fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	case m.Kind != KindDir:
+		return fmt.Errorf("%s: %w", p, ErrNotDir)
+	case n.hasChildren(p):
+		return fmt.Errorf("%s: %w", p, ErrDirNotEmpty)
+	}
+	return n.bury(m, "")
+}
+
+// Remove deletes a file or symlink
+func (n *Node) Remove(p string) error {
+	m := n.statLocal(p)
+	if m == nil {
+		return fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	if m.Kind == KindDir {
+		return fmt.Errorf("%s: %w", p, ErrIsDir)
+	}
+	return n.bury(m, "")
+}
+
+// Rename moves a file, symlink or whole directory to newPath, replacing a
+// file or empty directory already there as rename(2) does. Files keep their
+// blocks and pins; directories and symlinks are signed again under the new path.
+func (n *Node) Rename(oldPath, newPath string) error {
+	if err := checkPath(newPath); err != nil {
+		return fmt.Errorf("%w: %v", os.ErrInvalid, err)
+	}
+	src := n.statLocal(oldPath)
+	if oldPath == "" || src == nil {
+		return fmt.Errorf("%s: %w", oldPath, os.ErrNotExist)
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if volumeOf(oldPath) != volumeOf(newPath) {
+		return fmt.Errorf("%s -> %s: %w", oldPath, newPath, ErrCrossVolume)
+	}
+	if oldPath == VolumeDir || oldPath == volumeRoot(volumeOf(oldPath)) {
+		return fmt.Errorf("%w: %s is a volume root", os.ErrPermission, oldPath)
+	}
+	if src.Kind == KindDir && strings.HasPrefix(newPath, oldPath+"/") {
+		return fmt.Errorf("%w: can't move %s inside itself", os.ErrInvalid, oldPath)
+	}
+	if parent := n.statLocal(parentPath(newPath)); parent == nil {
+		return fmt.Errorf("%s: %w", parentPath(newPath), os.ErrNotExist)
+	} else if parent.Kind != KindDir {
+		return fmt.Errorf("%s: %w", parentPath(newPath), ErrNotDir)
+	}
+
+	if dst := n.statLocal(newPath); dst != nil {
+		switch {
+		case src.Kind == KindDir && dst.Kind != KindDir:
+			return fmt.Errorf("%s: %w", newPath, ErrNotDir)
+		case src.Kind != KindDir && dst.Kind == KindDir:
+			return fmt.Errorf("%s: %w", newPath, ErrIsDir)
+		case dst.Kind == KindDir && n.hasChildren(newPath):
+			return fmt.Errorf("%s: %w", newPath, ErrDirNotEmpty)
+		}
+		if err := n.bury(dst, ""); err != nil {
+			return err
+		}
+	}
+
+	paths := []string{oldPath}
+	if src.Kind == KindDir {
+		paths = append(paths, n.descendants(oldPath)...)
+	}
+	for _, p := range paths {
+		m := n.store.Manifest(p)
+		if m == nil {
+			continue // a directory only implied by its children
+		}
+		moved := *m
+		moved.Name = newPath + p[len(oldPath):]
+		if p == oldPath {
+			moved.Ctime = time.Now().UnixNano()
+		}
+		if err := n.move(m, &moved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move replaces manifest m with its renamed copy, carrying over pins and
+// replica tracking, announces the new name and buries the old one
+func (n *Node) move(m, moved *FileManifest) error {
+	if moved.Kind != "" {
+		if err := n.storeObject(moved); err != nil {
+			return err
+		}
+		n.announceMove(m.Name, moved)
+		return n.bury(m, moved.Name)
+	}
+
+	n.store.stamp(moved)
+	n.store.PutManifest(moved)
+	n.pins.mu.Lock()
+	if dirty, ok := n.pins.dirty[m.Name]; ok {
+		delete(n.pins.dirty, m.Name)
+		n.pins.dirty[moved.Name] = dirty
+	}
+	if user, ok := n.pins.user[m.Name]; ok {
+		delete(n.pins.user, m.Name)
+		n.pins.user[moved.Name] = user
+		n.pins.save()
+	}
+	n.pins.mu.Unlock()
+	if _, tracked := n.ReplicaReport(m.Name); tracked {
+		n.replicas.Forget(m.Name)
+		n.replicas.Track(moved)
+	}
+	n.announceMove(m.Name, moved)
+	return n.bury(m, moved.Name)
+}
+
+// announceMove announces the new name of a moved file, or journals the
+// rename when no peer is connected
+func (n *Node) announceMove(from string, moved *FileManifest) {
+	if n.offline() {
+		n.journalRename(from, moved)
+		return
+	}
+	n.announce(moved)
+}
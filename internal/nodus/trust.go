@@ -0,0 +1,422 @@
+// Package nodus - Trusted-peer allowlist and connection gating
+package nodus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const trustFile = "trust.json"
+
+// trustReloadInterval is how often a running node checks the allowlist file
+// for edits made outside it
+const trustReloadInterval = 10 * time.Second
+
+// TrustLevel ranks what a peer is allowed to do (see docs: Trust Hierarchy)
+type TrustLevel int
+
+const (
+	TrustUnknown TrustLevel = iota // Not on the allowlist
+	TrustCloud                     // Storage only: we read from it, it never reads or writes us
+	TrustNetwork                   // May fetch hash-verified content
+	TrustTrusted                   // May also broadcast writes
+	TrustSelf                      // This node
+)
+
+// String returns the level name used in the allowlist and CLI
+func (l TrustLevel) String() string {
+	switch l {
+	case TrustCloud:
+		return "cloud"
+	case TrustNetwork:
+		return "network"
+	case TrustTrusted:
+		return "trusted"
+	case TrustSelf:
+		return "self"
+	}
+	return "unknown"
+}
+
+// ParseTrustLevel parses a level name
+func ParseTrustLevel(s string) (TrustLevel, error) {
+	for l := TrustUnknown; l <= TrustSelf; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return TrustUnknown, fmt.Errorf("unknown trust level %q (want cloud, network, trusted or self)", s)
+}
+
+// MarshalText encodes the level by name (used by JSON)
+func (l TrustLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText decodes a level name (used by JSON)
+func (l *TrustLevel) UnmarshalText(text []byte) error {
+	parsed, err := ParseTrustLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// protocolTrust is the minimum level required to open each protocol
+var protocolTrust = map[protocol.ID]TrustLevel{
+	ProtocolFileRequest:     TrustNetwork,
+	ProtocolFileRequestV1:   TrustNetwork,
+	ProtocolFileBroadcast:   TrustTrusted,
+	ProtocolFileBroadcastV1: TrustTrusted,
+	ProtocolIdentity:        TrustUnknown,
+	ProtocolLease:           TrustTrusted,
+}
+
+// TrustEntry is one allowlisted peer
+type TrustEntry struct {
+	ID    peer.ID    `json:"id"`
+	Level TrustLevel `json:"level"`
+	Name  string     `json:"name,omitempty"`
+	Added time.Time  `json:"added"`
+}
+
+// TrustStore is the persisted allowlist. Lookups are served from memory; the
+// file is re-read when the CLI asks the daemon to, and otherwise checked for
+// changes every trustReloadInterval, so CLI edits apply to a running daemon.
+type TrustStore struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	entries map[peer.ID]TrustEntry
+}
+
+// LoadTrustStore loads the allowlist from stateDir (empty if missing)
+func LoadTrustStore(stateDir string) (*TrustStore, error) {
+	t := &TrustStore{
+		path:    filepath.Join(stateDir, trustFile),
+		entries: make(map[peer.ID]TrustEntry),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the allowlist file; caller must not hold mu
+func (t *TrustStore) load() error {
+	info, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var list []TrustEntry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid allowlist %s: %w", t.path, err)
+	}
+
+	entries := make(map[peer.ID]TrustEntry, len(list))
+	for _, e := range list {
+		entries[e.ID] = e
+	}
+
+	t.mu.Lock()
+	t.entries = entries
+	t.modTime = info.ModTime()
+	t.mu.Unlock()
+	return nil
+}
+
+// Reload re-reads the allowlist after it was edited outside this store
+func (t *TrustStore) Reload() error {
+	return t.load()
+}
+
+// refresh reloads the allowlist if the file changed on disk
+func (t *TrustStore) refresh() {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return
+	}
+	t.mu.RLock()
+	changed := !info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+	if changed {
+		if err := t.load(); err != nil {
+			fmt.Printf("⚠️  Allowlist reload failed: %v\n", err)
+		}
+	}
+}
+
+// save writes the allowlist; caller must hold mu
+func (t *TrustStore) save() error {
+	list := make([]TrustEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(t.path, data, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(t.path); err == nil {
+		t.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Level returns the allowlisted level of a peer (TrustUnknown if absent)
+func (t *TrustStore) Level(id peer.ID) TrustLevel {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.entries[id].Level
+}
+
+// Add allowlists a peer at the given level
+func (t *TrustStore) Add(id peer.ID, level TrustLevel, name string) error {
+	if level <= TrustUnknown || level >= TrustSelf {
+		return fmt.Errorf("cannot add a peer at level %s", level)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[id] = TrustEntry{ID: id, Level: level, Name: name, Added: time.Now().UTC()}
+	return t.save()
+}
+
+// Remove drops a peer from the allowlist
+func (t *TrustStore) Remove(id peer.ID) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.entries[id]; !ok {
+		return false, nil
+	}
+	delete(t.entries, id)
+	return true, t.save()
+}
+
+// List returns all allowlisted peers
+func (t *TrustStore) List() []TrustEntry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	list := make([]TrustEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ApplyHandover moves a trusted peer's entry to its new key.
+// It reports false if the old key was not allowlisted.
+func (t *TrustStore) ApplyHandover(r *HandoverRecord) (bool, error) {
+	if err := r.Verify(); err != nil {
+		return false, err
+	}
+	oldID, newID, err := r.Peers()
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[oldID]
+	if !ok {
+		return false, nil
+	}
+	delete(t.entries, oldID)
+	entry.ID = newID
+	t.entries[newID] = entry
+	return true, t.save()
+}
+
+// trustGater is the libp2p ConnectionGater for Nodus.
+// Unknown peers may connect inbound on probation (identity protocol only),
+// but we never dial them unless the network is open.
+type trustGater struct {
+	self  peer.ID
+	trust *TrustStore
+	open  bool // treat unknown peers as TrustNetwork
+
+	mu       sync.Mutex
+	rejected map[peer.ID]time.Time
+}
+
+// probationBan is how long a peer that failed probation is refused
+const probationBan = 10 * time.Minute
+
+func newTrustGater(trust *TrustStore, open bool) *trustGater {
+	return &trustGater{trust: trust, open: open, rejected: make(map[peer.ID]time.Time)}
+}
+
+// level returns the effective trust level of a peer
+func (g *trustGater) level(id peer.ID) TrustLevel {
+	if id == g.self {
+		return TrustSelf
+	}
+	if l := g.trust.Level(id); l != TrustUnknown {
+		return l
+	}
+	if g.open {
+		return TrustNetwork
+	}
+	return TrustUnknown
+}
+
+// reject refuses a peer for probationBan
+func (g *trustGater) reject(id peer.ID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rejected[id] = time.Now().Add(probationBan)
+}
+
+// isRejected reports whether a peer is currently banned
+func (g *trustGater) isRejected(id peer.ID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.rejected[id]
+	if ok && time.Now().After(until) {
+		delete(g.rejected, id)
+		return false
+	}
+	return ok
+}
+
+func (g *trustGater) InterceptPeerDial(id peer.ID) bool {
+	return g.level(id) > TrustUnknown
+}
+
+func (g *trustGater) InterceptAddrDial(id peer.ID, _ multiaddr.Multiaddr) bool {
+	return g.level(id) > TrustUnknown
+}
+
+func (g *trustGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *trustGater) InterceptSecured(dir network.Direction, id peer.ID, _ network.ConnMultiaddrs) bool {
+	if g.level(id) > TrustUnknown {
+		return true
+	}
+	// Inbound strangers get probation unless they already failed it
+	return dir == network.DirInbound && !g.isRejected(id)
+}
+
+func (g *trustGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// Trust returns the node's allowlist
+func (n *Node) Trust() *TrustStore {
+	return n.gater.trust
+}
+
+// StartTrustReload picks up allowlist edits made outside the node, such as
+// by the CLI while the daemon runs, until ctx is cancelled
+func (n *Node) StartTrustReload(ctx context.Context) {
+	ticker := time.NewTicker(trustReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.gater.trust.refresh()
+		}
+	}
+}
+
+// TrustLevel returns the effective trust level of a peer
+func (n *Node) TrustLevel(id peer.ID) TrustLevel {
+	return n.gater.level(id)
+}
+
+// peersAtLeast returns connected peers whose trust level is at least min.
+// Peers still on probation are never used for storage.
+func (n *Node) peersAtLeast(min TrustLevel) []peer.ID {
+	var peers []peer.ID
+	for _, id := range n.ConnectedPeers() {
+		if n.gater.level(id) >= min {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// authorize wraps a stream handler with the protocol's minimum trust level
+func (n *Node) authorize(id protocol.ID, handler network.StreamHandler) network.StreamHandler {
+	required := protocolTrust[id]
+	return func(stream network.Stream) {
+		remote := stream.Conn().RemotePeer()
+		if level := n.gater.level(remote); level < required {
+			fmt.Printf("🚫 %s (%s) denied %s\n", remote.ShortString(), level, id)
+			if id == ProtocolFileRequestV1 || id == ProtocolFileBroadcastV1 {
+				stream.Reset()
+				return
+			}
+			writeFrame(stream, errorFrame(0, StatusForbidden, fmt.Sprintf("%s requires %s", id, required)))
+			stream.Close()
+			return
+		}
+		handler(stream)
+	}
+}
+
+// probation asks an unknown inbound peer for a hand-over record from a trusted
+// key; without one it is disconnected and refused for a while
+func (n *Node) probation(id peer.ID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	record, err := n.RequestHandover(ctx, id)
+	if err == nil {
+		if ok, err := n.gater.trust.ApplyHandover(record); ok && err == nil {
+			oldID, _, _ := record.Peers()
+			fmt.Printf("🔑 %s rotated key to %s, trust carried over\n", oldID.ShortString(), id.ShortString())
+			return
+		}
+	}
+
+	n.gater.reject(id)
+	n.host.Network().ClosePeer(id)
+	fmt.Printf("🚫 Untrusted peer %s disconnected\n", id.ShortString())
+}
+
+// trustNotifee starts probation for unknown peers as they connect
+type trustNotifee struct {
+	network.NoopNotifiee
+	node *Node
+}
+
+func (t *trustNotifee) Connected(_ network.Network, conn network.Conn) {
+	if remote := conn.RemotePeer(); t.node.gater.level(remote) == TrustUnknown {
+		go t.node.probation(remote)
+	}
+}
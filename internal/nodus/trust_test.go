@@ -0,0 +1,60 @@
+package nodus
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestTrustReloadsOnlyWhenAsked(t *testing.T) {
+	dir := t.TempDir()
+	daemon, err := LoadTrustStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Add(id, TrustNetwork, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := daemon.Level(id); got != TrustNetwork {
+		t.Fatalf("level %s, want network", got)
+	}
+
+	// The CLI edits the file while the daemon runs; make sure its mtime moves
+	cli, err := LoadTrustStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := cli.Add(id, TrustTrusted, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := daemon.Level(id); got != TrustNetwork {
+		t.Fatalf("lookup re-read the file: level %s", got)
+	}
+
+	daemon.refresh()
+	if got := daemon.Level(id); got != TrustTrusted {
+		t.Fatalf("after refresh: level %s, want trusted", got)
+	}
+
+	if _, err := cli.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := daemon.Level(id); got != TrustUnknown {
+		t.Fatalf("after reload: level %s, want unknown", got)
+	}
+}
@@ -0,0 +1,354 @@
+// Package nodus - Version vectors, conflict detection and file history
+package nodus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// historyDepth is how many versions of each path the store remembers
+const historyDepth = 16
+
+// VersionVector counts the writes each peer made to a file. A version that
+// counts at least as many writes from every peer supersedes the other;
+// when each has writes the other lacks, they were made concurrently.
+type VersionVector map[string]uint64
+
+// order is how two versions relate
+type order int
+
+const (
+	orderEqual order = iota
+	orderBefore
+	orderAfter
+	orderConcurrent
+)
+
+// compare orders v against o
+func (v VersionVector) compare(o VersionVector) order {
+	less, greater := false, false
+	for id, n := range v {
+		if n > o[id] {
+			greater = true
+		} else if n < o[id] {
+			less = true
+		}
+	}
+	for id, n := range o {
+		if _, ok := v[id]; !ok && n > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return orderConcurrent
+	case less:
+		return orderBefore
+	case greater:
+		return orderAfter
+	}
+	return orderEqual
+}
+
+// merge returns a new vector with the highest count of each peer in v and o
+func (v VersionVector) merge(o VersionVector) VersionVector {
+	merged := make(VersionVector, len(v)+len(o))
+	for id, n := range v {
+		merged[id] = n
+	}
+	for id, n := range o {
+		if n > merged[id] {
+			merged[id] = n
+		}
+	}
+	return merged
+}
+
+// String formats the vector with short peer IDs, e.g. {k4Ff2a:3 xfCBui:1}
+func (v VersionVector) String() string {
+	ids := make([]string, 0, len(v))
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("%s:%d", shortID(id), v[id])
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// shortID returns the last characters of a peer ID, as libp2p's ShortString does
+func shortID(id string) string {
+	if len(id) <= 6 {
+		return id
+	}
+	return id[len(id)-6:]
+}
+
+// conflictName names the sibling that keeps a losing concurrent version
+func conflictName(name string, writer peer.ID) string {
+	who := "unknown"
+	if writer != "" {
+		who = shortID(writer.String())
+	}
+	return name + ".conflict-" + who
+}
+
+// supersedes picks the winner of two concurrent versions the same way on every
+// peer: the later mtime, then the higher writer ID, then the higher manifest ID
+func supersedes(a, b *FileManifest) bool {
+	if a.Mtime != b.Mtime {
+		return a.Mtime > b.Mtime
+	}
+	if a.Writer != b.Writer {
+		return a.Writer > b.Writer
+	}
+	ida, idb := a.ID(), b.ID()
+	return bytes.Compare(ida[:], idb[:]) > 0
+}
+
+// newerManifest reports whether a should replace b as the current version:
+// it follows b, or it wins as a concurrent version
+func newerManifest(a, b *FileManifest) bool {
+	switch a.Version.compare(b.Version) {
+	case orderAfter:
+		return true
+	case orderConcurrent:
+		return supersedes(a, b)
+	}
+	return false
+}
+
+// setSelf sets the peer ID local writes are stamped with
+func (s *BlockStore) setSelf(id peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.self = id
+}
+
+// stamp marks m as a local write following every version of its path seen
+// so far, including deleted and conflicting ones
+func (s *BlockStore) stamp(m *FileManifest) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	version := m.Version.merge(nil)
+	for _, old := range s.history[m.Name] {
+		version = version.merge(old.Version)
+	}
+	version[s.self.String()]++
+	m.Version = version
+	m.Writer = s.self
+}
+
+// recordVersion adds m to the history of its path and reports whether it
+// was new; caller must hold mu
+func (s *BlockStore) recordVersion(m *FileManifest) bool {
+	versions := s.history[m.Name]
+	id := m.ID()
+	for _, old := range versions {
+		if old.ID() == id {
+			return false
+		}
+	}
+	versions = append(versions, m)
+	if len(versions) > historyDepth {
+		versions = versions[len(versions)-historyDepth:]
+	}
+	s.history[m.Name] = versions
+	return true
+}
+
+// recordTombstone adds a tombstone to the history of its path, so the next
+// local write of the path supersedes it
+func (s *BlockStore) recordTombstone(t *FileManifest) {
+	s.mu.Lock()
+	added := s.recordVersion(t)
+	s.mu.Unlock()
+	if added {
+		s.saveOrWarn(t.Name)
+	}
+}
+
+// versions returns the remembered versions of a path, oldest first
+func (s *BlockStore) versions(name string) []*FileManifest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*FileManifest(nil), s.history[name]...)
+}
+
+// acceptManifest stores a manifest announced by a peer unless ours supersedes
+// it. Of two concurrent versions the winner takes the name and the other file
+// is kept beside it as name.conflict-<writer>. Every peer holding both makes
+// the same choice, and the next local write supersedes both. A version the
+// path's tombstone follows stays deleted.
+func (n *Node) acceptManifest(m *FileManifest) bool {
+	if err := n.checkSigner(m); err != nil {
+		fmt.Printf("⚠️  Ignoring '%s': %v\n", m.Name, err)
+		return false
+	}
+	if m.Kind == KindTombstone {
+		return n.acceptTombstone(m)
+	}
+	local := n.store.Manifest(m.Name)
+	if local == nil {
+		if t := n.tombstones.get(m.Name); t != nil {
+			if o := m.Version.compare(t.Version); o == orderBefore || o == orderEqual {
+				return false
+			}
+		}
+		n.store.PutManifest(m)
+		return true
+	}
+
+	switch m.Version.compare(local.Version) {
+	case orderBefore:
+		return false
+	case orderEqual:
+		if m.ID() == local.ID() {
+			return false
+		}
+		// Unversioned manifests from older peers: the last one wins
+		n.store.PutManifest(m)
+		return true
+	case orderAfter:
+		n.store.PutManifest(m)
+		return true
+	}
+
+	winner, loser := m, local
+	if !supersedes(m, local) {
+		winner, loser = local, m
+		n.store.mu.Lock()
+		added := n.store.recordVersion(m)
+		n.store.mu.Unlock()
+		if added {
+			n.store.saveOrWarn(m.Name)
+		}
+	}
+	if loser.Kind == "" {
+		sibling := *loser
+		sibling.Name = conflictName(m.Name, loser.Writer)
+		n.store.PutManifest(&sibling)
+		fmt.Printf("⚠️  Concurrent edits of '%s': keeping %s's version, the other is '%s'\n",
+			m.Name, winner.Writer.ShortString(), sibling.Name)
+	}
+	if winner == m {
+		n.store.PutManifest(m)
+	}
+	return winner == m
+}
+
+// VersionInfo describes one remembered version of a file
+type VersionInfo struct {
+	ID      string        `json:"id"` // manifest hash; restore accepts a unique prefix
+	Version VersionVector `json:"version"`
+	Writer  string        `json:"writer,omitempty"`
+	Kind    string        `json:"kind,omitempty"`
+	Size    uint64        `json:"size"`
+	Mtime   int64         `json:"mtime,omitempty"`
+	Current bool          `json:"current"`
+}
+
+// versionInfo describes version m of a file
+func versionInfo(m *FileManifest, current bool) VersionInfo {
+	info := VersionInfo{
+		ID:      m.ID().String(),
+		Version: m.Version,
+		Kind:    m.Kind,
+		Size:    m.Size,
+		Mtime:   m.Mtime,
+		Current: current,
+	}
+	if m.Writer != "" {
+		info.Writer = m.Writer.String()
+	}
+	return info
+}
+
+// History lists the remembered versions of a file, newest first
+func (n *Node) History(name string) []VersionInfo {
+	current := n.store.Manifest(name)
+	versions := n.store.versions(name)
+	history := make([]VersionInfo, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		m := versions[i]
+		history = append(history, versionInfo(m, current != nil && current.ID() == m.ID()))
+	}
+	return history
+}
+
+// findVersion returns the remembered version of name whose ID starts with prefix
+func (n *Node) findVersion(name, prefix string) (*FileManifest, error) {
+	if len(prefix) < 4 {
+		return nil, fmt.Errorf("%w: version ID '%s' too short", os.ErrInvalid, prefix)
+	}
+	var found *FileManifest
+	for _, m := range n.store.versions(name) {
+		if !strings.HasPrefix(m.ID().String(), prefix) {
+			continue
+		}
+		if found != nil && found.ID() != m.ID() {
+			return nil, fmt.Errorf("%w: version '%s' of '%s' is ambiguous", os.ErrInvalid, prefix, name)
+		}
+		found = m
+	}
+	if found == nil {
+		return nil, fmt.Errorf("version '%s' of '%s': %w", prefix, name, os.ErrNotExist)
+	}
+	return found, nil
+}
+
+// Restore makes an earlier version of a file current again, as a new write
+// that supersedes every version seen so far
+func (n *Node) Restore(ctx context.Context, name, id string) (*FileManifest, error) {
+	old, err := n.findVersion(name, id)
+	if err != nil {
+		return nil, err
+	}
+	if old.Kind == KindTombstone {
+		return nil, fmt.Errorf("%w: version '%s' of '%s' is its deletion", os.ErrInvalid, id, name)
+	}
+	return n.rewrite(ctx, old)
+}
+
+// rewrite stores an old version of a file again as a new write
+func (n *Node) rewrite(ctx context.Context, old *FileManifest) (*FileManifest, error) {
+	name := old.Name
+	if old.Kind != "" {
+		restored := *old
+		restored.Meta = old.Meta.clone()
+		restored.Ctime = time.Now().UnixNano()
+		if err := n.publishObject(&restored); err != nil {
+			return nil, err
+		}
+		return &restored, nil
+	}
+
+	if missing := n.store.MissingBlocks(old); len(missing) > 0 {
+		n.fetchBlocks(ctx, n.peersAtLeast(TrustCloud), missing)
+		n.fetchFromProviders(ctx, n.store.MissingBlocks(old))
+	}
+	data, err := n.store.Assemble(old)
+	if err != nil {
+		return nil, fmt.Errorf("version %s of '%s' incomplete: %w", old.ID().String()[:12], name, err)
+	}
+
+	meta := old.Meta.clone()
+	meta.Mtime, meta.Atime = 0, 0
+	m, err := n.writeFile(name, data, &meta)
+	if err != nil {
+		return nil, err
+	}
+	n.announce(m)
+	n.replicateLater(m)
+	return m, nil
+}
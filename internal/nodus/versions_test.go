@@ -0,0 +1,162 @@
+package nodus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestFetchManifestKeepsNewest(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	c := newTestNode(t)
+	linkNodes(t, a, b, TrustNetwork, TrustNetwork)
+	linkNodes(t, c, a, TrustNetwork, TrustNetwork)
+	linkNodes(t, c, b, TrustNetwork, TrustNetwork)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := a.WriteFile("notes.txt", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.RequestFile(ctx, "notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := a.WriteFile("notes.txt", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b still serves the first version; whichever answers first, c keeps the second
+	for i := 0; i < 3; i++ {
+		m, err := c.fetchManifest(ctx, []peer.ID{b.host.ID(), a.host.ID()}, "notes.txt")
+		if err != nil {
+			t.Fatalf("fetchManifest: %v", err)
+		}
+		if m.ID() != latest.ID() {
+			t.Fatalf("got version %s, want %s", m.Version, latest.Version)
+		}
+	}
+}
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	cfg.DiskCacheSize = 0
+
+	n, err := NewNode(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		if _, err := n.WriteFile("log.txt", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := n.store.versions("log.txt")
+	n.Close()
+
+	n, err = NewNode(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	defer n.Close()
+	after := n.store.versions("log.txt")
+	if len(after) != len(before) {
+		t.Fatalf("%d versions after restart, want %d", len(after), len(before))
+	}
+	for i := range after {
+		if after[i].ID() != before[i].ID() {
+			t.Errorf("version %d differs after restart", i)
+		}
+	}
+
+	// The next write still follows every version written before the restart
+	m, err := n.WriteFile("log.txt", []byte("four"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version.compare(before[len(before)-1].Version) != orderAfter {
+		t.Errorf("version %s doesn't follow %s", m.Version, before[len(before)-1].Version)
+	}
+}
+
+func TestManifestsStoredPerPath(t *testing.T) {
+	dir := t.TempDir()
+	s, err := LoadBlockStore(NewCache(1<<20), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutFile("a.txt", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(s.recordPath("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < historyDepth+3; i++ {
+		if _, err := s.PutFile("b.txt", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writing one path leaves the others' records alone
+	after, err := os.Stat(s.recordPath("a.txt"))
+	if err != nil || !os.SameFile(before, after) {
+		t.Fatalf("record of an untouched path rewritten: %v", err)
+	}
+	// Each remembered version is stored once; trimmed ones are removed
+	objects, _ := os.ReadDir(filepath.Join(dir, manifestsDir, "objects"))
+	if len(objects) != historyDepth+1 {
+		t.Fatalf("%d manifests stored, want %d", len(objects), historyDepth+1)
+	}
+
+	s.DeleteFile("b.txt")
+	s, err = LoadBlockStore(NewCache(1<<20), dir)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if s.Manifest("a.txt") == nil || s.Manifest("b.txt") != nil {
+		t.Fatal("current manifests differ after reload")
+	}
+	if got := len(s.versions("b.txt")); got != historyDepth {
+		t.Fatalf("%d versions of a deleted path after reload, want %d", got, historyDepth)
+	}
+}
+
+func TestManifestSnapshotMigrated(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewBlockStore(NewCache(1<<20)).PutFile("old.txt", []byte("kept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ := m.Marshal()
+	data, _ := json.Marshal(storeSnapshot{
+		Manifests: []json.RawMessage{record},
+		History:   map[string][]json.RawMessage{"old.txt": {record}},
+	})
+	if err := os.WriteFile(filepath.Join(dir, snapshotFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadBlockStore(NewCache(1<<20), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); !os.IsNotExist(err) {
+		t.Fatalf("old manifests file kept: %v", err)
+	}
+	s, err := LoadBlockStore(NewCache(1<<20), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Manifest("old.txt"); got == nil || got.ID() != m.ID() {
+		t.Fatal("migrated manifest lost")
+	}
+}
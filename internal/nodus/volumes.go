@@ -0,0 +1,203 @@
+// Package nodus - Named volumes: separate roots with their own quota, replication and key
+package nodus
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// VolumeDir holds the root directory of each named volume. The default
+// volume is the rest of the namespace; its mounts don't show VolumeDir.
+const VolumeDir = ".volumes"
+
+var (
+	// ErrVolumeFull is returned when a write would take a volume past its quota
+	ErrVolumeFull = errors.New("volume quota exceeded")
+	// ErrCrossVolume is returned when a rename would move a file to another volume
+	ErrCrossVolume = errors.New("can't move between volumes")
+)
+
+// VolumeSpec holds a named volume's settings. It is kept in the signed
+// manifest of the volume's root directory, so every peer applies the same.
+type VolumeSpec struct {
+	Quota       uint64 `json:"quota,omitempty"`       // bytes of file content, 0 for no limit
+	Replication int    `json:"replication,omitempty"` // copies of each block, 0 for the node's default
+	Encrypted   bool   `json:"encrypted,omitempty"`   // files are sealed with the volume's key
+}
+
+// VolumeInfo describes a named volume
+type VolumeInfo struct {
+	Name string `json:"name"`
+	VolumeSpec
+	Used  uint64 `json:"used"` // bytes of file content
+	Files int    `json:"files"`
+}
+
+// checkVolumeName accepts names that are a single path component
+func checkVolumeName(name string) error {
+	if err := checkPath(name); err != nil || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: bad volume name %q", os.ErrInvalid, name)
+	}
+	return nil
+}
+
+// volumeRoot returns the path of a named volume's root ("" for the default)
+func volumeRoot(volume string) string {
+	if volume == "" {
+		return ""
+	}
+	return VolumeDir + "/" + volume
+}
+
+// volumeOf returns the named volume p belongs to ("" for the default)
+func volumeOf(p string) string {
+	rest, ok := strings.CutPrefix(p, VolumeDir+"/")
+	if !ok {
+		return ""
+	}
+	volume, _, _ := strings.Cut(rest, "/")
+	return volume
+}
+
+// volumeSpec returns the settings of a named volume (nil if it doesn't exist)
+func (s *BlockStore) volumeSpec(volume string) *VolumeSpec {
+	if volume == "" {
+		return nil
+	}
+	m := s.Manifest(volumeRoot(volume))
+	if m == nil || m.Kind != KindDir {
+		return nil
+	}
+	return m.Volume
+}
+
+// seals reports whether a new file at name is encrypted: in a named volume
+// when the volume says so, elsewhere whenever there is a master key
+func (s *BlockStore) seals(name string) (bool, error) {
+	volume := volumeOf(name)
+	if volume == "" {
+		return s.masterKey() != nil, nil
+	}
+	spec := s.volumeSpec(volume)
+	if spec == nil || !spec.Encrypted {
+		return false, nil
+	}
+	if s.masterKey() == nil {
+		return false, fmt.Errorf("volume '%s': %w", volume, ErrNoMasterKey)
+	}
+	return true, nil
+}
+
+// volumeUsage sums the content of the files in a volume's root, leaving out skip
+func (n *Node) volumeUsage(root, skip string) (used uint64, files int) {
+	for _, name := range n.store.Files() {
+		if !strings.HasPrefix(name, root+"/") || name == skip {
+			continue
+		}
+		if m := n.store.Manifest(name); m != nil && m.Kind == "" {
+			used += m.Size
+			files++
+		}
+	}
+	return used, files
+}
+
+// checkVolumeQuota refuses a write of size bytes to name that would take its
+// volume past its quota
+func (n *Node) checkVolumeQuota(name string, size uint64) error {
+	volume := volumeOf(name)
+	spec := n.store.volumeSpec(volume)
+	if spec == nil || spec.Quota == 0 {
+		return nil
+	}
+	used, _ := n.volumeUsage(volumeRoot(volume), name)
+	if used+size > spec.Quota {
+		return fmt.Errorf("'%s': %w (%d of %d bytes used)", name, ErrVolumeFull, used, spec.Quota)
+	}
+	return nil
+}
+
+// replicationFactor returns how many copies of name's blocks to keep
+func (n *Node) replicationFactor(name string) int {
+	if spec := n.store.volumeSpec(volumeOf(name)); spec != nil && spec.Replication > 0 {
+		return spec.Replication
+	}
+	return n.cfg.ReplicationFactor
+}
+
+// Volumes lists the named volumes, by name (ReadDir sorts them)
+func (n *Node) Volumes() []VolumeInfo {
+	children, _ := n.ReadDir(VolumeDir)
+	var volumes []VolumeInfo
+	for _, child := range children {
+		if info, err := n.VolumeInfo(child.Name); err == nil {
+			volumes = append(volumes, *info)
+		}
+	}
+	return volumes
+}
+
+// VolumeInfo describes a named volume
+func (n *Node) VolumeInfo(name string) (*VolumeInfo, error) {
+	spec := n.store.volumeSpec(name)
+	if spec == nil {
+		return nil, fmt.Errorf("volume '%s': %w", name, os.ErrNotExist)
+	}
+	info := &VolumeInfo{Name: name, VolumeSpec: *spec}
+	info.Used, info.Files = n.volumeUsage(volumeRoot(name), "")
+	return info, nil
+}
+
+// CreateVolume creates a named volume with an empty root
+func (n *Node) CreateVolume(name string, spec VolumeSpec) (*VolumeInfo, error) {
+	if err := checkVolumeName(name); err != nil {
+		return nil, err
+	}
+	if name == DefaultVolume {
+		return nil, fmt.Errorf("%w: '%s' names the default volume", os.ErrInvalid, name)
+	}
+	if spec.Replication < 0 {
+		return nil, fmt.Errorf("%w: replication factor %d", os.ErrInvalid, spec.Replication)
+	}
+	if spec.Encrypted && n.store.masterKey() == nil {
+		return nil, fmt.Errorf("volume '%s': %w", name, ErrNoMasterKey)
+	}
+	root := volumeRoot(name)
+	if n.statLocal(root) != nil {
+		return nil, fmt.Errorf("volume '%s': %w", name, os.ErrExist)
+	}
+
+	m := &FileManifest{Name: root, Kind: KindDir, Volume: &spec, Meta: newMeta(KindDir, nil)}
+	if err := n.publishObject(m); err != nil {
+		return nil, err
+	}
+	return &VolumeInfo{Name: name, VolumeSpec: spec}, nil
+}
+
+// DeleteVolume deletes a named volume and everything in it. Its files go to
+// the trash like any deleted file.
+func (n *Node) DeleteVolume(name string) error {
+	if err := checkVolumeName(name); err != nil {
+		return err
+	}
+	root := volumeRoot(name)
+	m := n.store.Manifest(root)
+	if m == nil || m.Volume == nil {
+		return fmt.Errorf("volume '%s': %w", name, os.ErrNotExist)
+	}
+
+	// Deepest first, so no directory is buried before its children
+	paths := n.descendants(root)
+	sort.Slice(paths, func(i, j int) bool { return strings.Count(paths[i], "/") > strings.Count(paths[j], "/") })
+	for _, p := range paths {
+		if child := n.store.Manifest(p); child != nil {
+			if err := n.bury(child, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return n.bury(m, "")
+}
@@ -0,0 +1,154 @@
+package nodus
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestVolumeQuota(t *testing.T) {
+	n := newTestNode(t)
+	if _, err := n.CreateVolume("small", VolumeSpec{Quota: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.CreateVolume("small", VolumeSpec{}); !errors.Is(err, os.ErrExist) {
+		t.Errorf("creating a volume twice: %v", err)
+	}
+
+	if _, err := n.WriteFile(".volumes/small/a", filled(60, 1)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := n.WriteFile(".volumes/small/b", filled(60, 2))
+	if !errors.Is(err, ErrVolumeFull) {
+		t.Fatalf("write past the quota: %v, want ErrVolumeFull", err)
+	}
+	if errno(err) != syscall.EDQUOT {
+		t.Errorf("full volume maps to %v, want EDQUOT", errno(err))
+	}
+	// Rewriting a file only counts its new size
+	if _, err := n.WriteFile(".volumes/small/a", filled(90, 3)); err != nil {
+		t.Fatalf("rewrite within the quota: %v", err)
+	}
+	// The default volume has no quota
+	if _, err := n.WriteFile("big", filled(500, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := n.VolumeInfo("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Used != 90 || info.Files != 1 || info.Quota != 100 {
+		t.Errorf("volume info %+v", info)
+	}
+	if err := n.Rename(".volumes/small/a", "a"); !errors.Is(err, ErrCrossVolume) {
+		t.Errorf("rename out of the volume: %v, want ErrCrossVolume", err)
+	}
+}
+
+func TestVolumeSettings(t *testing.T) {
+	n := newTestNode(t, func(cfg *Config) { cfg.ReplicationFactor = 2 })
+	if _, err := n.CreateVolume("images", VolumeSpec{Replication: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.CreateVolume("scratch", VolumeSpec{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.replicationFactor(".volumes/images/disk.img"); got != 3 {
+		t.Errorf("volume replication %d, want 3", got)
+	}
+	if got := n.replicationFactor(".volumes/scratch/tmp"); got != 2 {
+		t.Errorf("volume without a factor replicates %d times, want the node's 2", got)
+	}
+	if _, err := n.CreateVolume("bad", VolumeSpec{Replication: -1}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("negative replication: %v", err)
+	}
+	if _, err := n.CreateVolume("a/b", VolumeSpec{}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("nested volume name: %v", err)
+	}
+
+	var names []string
+	for _, v := range n.Volumes() {
+		names = append(names, v.Name)
+	}
+	if len(names) != 2 || names[0] != "images" || names[1] != "scratch" {
+		t.Errorf("volumes %v", names)
+	}
+
+	if _, err := n.WriteFile(".volumes/scratch/tmp", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DeleteVolume("scratch"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.VolumeInfo("scratch"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleted volume: %v", err)
+	}
+	if n.store.Manifest(".volumes/scratch/tmp") != nil {
+		t.Error("file outlived its volume")
+	}
+}
+
+func TestVolumeKeys(t *testing.T) {
+	n := newTestNode(t)
+	if _, err := n.CreateVolume("vault", VolumeSpec{Encrypted: true}); !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("encrypted volume without a master key: %v", err)
+	}
+	key, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.store.SetMasterKey(key)
+	for _, name := range []string{"vault", "other"} {
+		if _, err := n.CreateVolume(name, VolumeSpec{Encrypted: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := n.CreateVolume("open", VolumeSpec{}); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := testData(BlockSize+10, 5)
+	m, err := n.WriteFile(".volumes/vault/secret", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Encrypted() {
+		t.Fatal("file in an encrypted volume not sealed")
+	}
+	if open, err := n.WriteFile(".volumes/open/notes", plain); err != nil || open.Encrypted() {
+		t.Fatalf("file in an unencrypted volume: %v, encrypted %v", err, open != nil && open.Encrypted())
+	}
+	if got, err := n.store.ReadFile(".volumes/vault/secret"); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("reading back: %v", err)
+	}
+
+	// Each volume derives its own keys: the same salt under another volume,
+	// or outside any, doesn't open the blocks
+	sealed, err := n.store.GetBlock(m.Blocks[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := *m
+	moved.Name = ".volumes/other/secret"
+	otherKey, err := n.store.fileKey(&moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBlock(otherKey, sealed); err == nil {
+		t.Error("another volume's key opened the block")
+	}
+	masterKey, err := key.fileKey(m.Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBlock(masterKey, sealed); err == nil {
+		t.Error("the master key opened a volume's block directly")
+	}
+	ownKey, _ := n.store.fileKey(m)
+	if _, err := openBlock(ownKey, sealed); err != nil {
+		t.Errorf("the volume's own key: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Package nodus - Framed wire protocol for file and broadcast streams
+package nodus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// wireVersion is the first byte of every frame
+const wireVersion = 2
+
+// MaxFrameSize bounds a single frame payload (large manifests included)
+const MaxFrameSize = 8 * 1024 * 1024 // 8MB
+
+// ErrFrameTooLarge is returned for a frame over the local size limit; a peer
+// that refused ours replies TOO_LARGE, a RemoteError, instead
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// MaxBroadcastSize bounds what a peer may push unasked: announce and replicate
+// requests, and whole files from 1.0.0 peers
+const MaxBroadcastSize = 4 * 1024 * 1024 // 4MB
+
+// Frame message types
+const (
+	msgManifestRequest uint8 = iota + 1
+	msgBlockRequest
+	msgManifest
+	msgBlock
+	msgAnnounce
+	msgAck
+	msgRangeRequest
+	msgRange
+	msgHandoverRequest
+	msgHandover
+	msgReplicate
+	msgLease
+	msgLeaseRelease
+	msgJournalOp
+	msgBootRequest
+	msgBoot
+	msgReplicaBlocks
+)
+
+// Status is the result code carried by every reply frame
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusTooLarge
+	StatusError
+	StatusBadRequest
+	StatusForbidden
+	StatusLocked
+)
+
+// String returns the status name
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusNotFound:
+		return "NOT_FOUND"
+	case StatusTooLarge:
+		return "TOO_LARGE"
+	case StatusError:
+		return "ERROR"
+	case StatusBadRequest:
+		return "BAD_REQUEST"
+	case StatusForbidden:
+		return "FORBIDDEN"
+	case StatusLocked:
+		return "LOCKED"
+	}
+	return fmt.Sprintf("STATUS(%d)", uint8(s))
+}
+
+// RemoteError is returned when a peer replies with a non-OK status
+type RemoteError struct {
+	Status  Status
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	if e.Message == "" {
+		return "peer replied " + e.Status.String()
+	}
+	return fmt.Sprintf("peer replied %s: %s", e.Status, e.Message)
+}
+
+// IsNotFound reports whether err is a NOT_FOUND reply from a peer
+func IsNotFound(err error) bool {
+	var re *RemoteError
+	return errors.As(err, &re) && re.Status == StatusNotFound
+}
+
+// frame is one message on a Nodus stream:
+// version(1) | type(1) | status(1) | uvarint payload length | payload
+type frame struct {
+	Type    uint8
+	Status  Status
+	Payload []byte
+}
+
+// errorFrame builds a negative reply carrying a human-readable message
+func errorFrame(typ uint8, status Status, msg string) frame {
+	return frame{Type: typ, Status: status, Payload: []byte(msg)}
+}
+
+// err converts a non-OK reply into a RemoteError
+func (f frame) err() error {
+	if f.Status == StatusOK {
+		return nil
+	}
+	return &RemoteError{Status: f.Status, Message: string(f.Payload)}
+}
+
+// badRequest is the reply to a request frame that couldn't be read
+func badRequest(typ uint8, err error) frame {
+	if errors.Is(err, ErrFrameTooLarge) {
+		return errorFrame(typ, StatusTooLarge, err.Error())
+	}
+	return errorFrame(typ, StatusBadRequest, err.Error())
+}
+
+// writeFrame encodes a frame onto w
+func writeFrame(w io.Writer, f frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(f.Payload))
+	}
+
+	header := make([]byte, 3, 3+binary.MaxVarintLen64)
+	header[0] = wireVersion
+	header[1] = f.Type
+	header[2] = uint8(f.Status)
+	header = binary.AppendUvarint(header, uint64(len(f.Payload)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+// readFrame decodes a frame from r, rejecting payloads above max bytes
+func readFrame(r *bufio.Reader, max int) (frame, error) {
+	var f frame
+
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return f, err
+	}
+	if header[0] != wireVersion {
+		return f, fmt.Errorf("unsupported wire version %d", header[0])
+	}
+	f.Type = header[1]
+	f.Status = Status(header[2])
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return f, fmt.Errorf("bad frame length: %w", err)
+	}
+	if size > uint64(max) {
+		return f, fmt.Errorf("%w: %d bytes exceeds %d", ErrFrameTooLarge, size, max)
+	}
+
+	f.Payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// roundTrip sends a request frame and waits for the reply
+func roundTrip(stream network.Stream, req frame) (frame, error) {
+	if err := writeFrame(stream, req); err != nil {
+		return frame{}, err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return frame{}, err
+	}
+
+	reply, err := readFrame(bufio.NewReader(stream), MaxFrameSize)
+	if err != nil {
+		return frame{}, err
+	}
+	return reply, reply.err()
+}
+
+// setStreamDeadline applies the context deadline to a stream
+func setStreamDeadline(ctx context.Context, stream network.Stream) {
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+}
@@ -0,0 +1,101 @@
+package nodus
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(msgManifestRequest, uint8(StatusOK), []byte("docs/report.txt"))
+	f.Add(msgBlock, uint8(StatusNotFound), []byte{})
+	f.Add(msgReplicaBlocks, uint8(StatusForbidden), bytes.Repeat([]byte{0xff}, 300))
+
+	f.Fuzz(func(t *testing.T, typ, status uint8, payload []byte) {
+		var buf bytes.Buffer
+		in := frame{Type: typ, Status: Status(status), Payload: payload}
+		if err := writeFrame(&buf, in); err != nil {
+			t.Fatal(err)
+		}
+		out, err := readFrame(bufio.NewReader(&buf), MaxFrameSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Type != in.Type || out.Status != in.Status || !bytes.Equal(out.Payload, in.Payload) {
+			t.Fatalf("frame changed on the wire: %+v != %+v", out, in)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes left after the frame", buf.Len())
+		}
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	var valid bytes.Buffer
+	writeFrame(&valid, frame{Type: msgAnnounce, Payload: []byte(`{"name":"a"}`)})
+	f.Add(valid.Bytes())
+	f.Add([]byte{wireVersion, msgAck, 0})
+	f.Add([]byte{1, msgAck, 0, 0})
+	f.Add([]byte{wireVersion, msgAck, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	const max = 1024
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := readFrame(bufio.NewReader(bytes.NewReader(data)), max)
+		if err != nil {
+			return
+		}
+		if len(out.Payload) > max {
+			t.Fatalf("accepted a %d byte payload over the %d limit", len(out.Payload), max)
+		}
+		if data[0] != wireVersion {
+			t.Fatalf("accepted wire version %d", data[0])
+		}
+	})
+}
+
+func TestReadFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, frame{Type: msgBlock, Payload: make([]byte, 100)})
+	_, err := readFrame(bufio.NewReader(&buf), 99)
+	var re *RemoteError
+	if !errors.Is(err, ErrFrameTooLarge) || errors.As(err, &re) {
+		t.Fatalf("oversized frame: %v, want ErrFrameTooLarge", err)
+	}
+	if reply := badRequest(msgAck, err); reply.Status != StatusTooLarge {
+		t.Errorf("oversized request answered %s, want TOO_LARGE", reply.Status)
+	}
+
+	if err := writeFrame(&buf, frame{Payload: make([]byte, MaxFrameSize+1)}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("writing a frame over MaxFrameSize: %v", err)
+	}
+}
+
+func FuzzReadLegacyLine(f *testing.F) {
+	f.Add([]byte("docs/report.txt\n1234\n"))
+	f.Add([]byte(strings.Repeat("a", maxLegacyLine+10) + "\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		line, err := readLegacyLine(bufio.NewReaderSize(bytes.NewReader(data), 16))
+		if err == nil && len(line) > maxLegacyLine {
+			t.Fatalf("accepted a %d byte line", len(line))
+		}
+	})
+}
+
+func TestCheckLegacyName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"docs/report.txt":         true,
+		"volumes":                 true,
+		"":                        false,
+		"../etc/passwd":           false,
+		"docs//x":                 false,
+		"/abs":                    false,
+		VolumeDir:                 false,
+		VolumeDir + "/boot/x.img": false,
+	} {
+		if err := checkLegacyName(name); (err == nil) != ok {
+			t.Errorf("checkLegacyName(%q) = %v", name, err)
+		}
+	}
+}
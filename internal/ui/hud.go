@@ -6,9 +6,12 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
+
+	"spirit/internal/nodus"
 )
 
 // HUD displays system status information
@@ -17,12 +20,17 @@ type HUD struct {
 	ScreenHeight int32
 
 	// Cached values (update periodically)
-	memUsed     uint64
-	memTotal    uint64
-	cpuUsage    float32
-	nodusStatus string
-	nodusInfo   string
-	lastUpdate  time.Time
+	memUsed    uint64
+	memTotal   uint64
+	cpuUsage   float32
+	lastUpdate time.Time
+
+	// Nodus state, refreshed from the daemon in the background
+	nodusMu       sync.Mutex
+	nodusStatus   string
+	nodusInfo     string
+	nodusChecking bool
+	control       *nodus.ControlClient
 }
 
 // NewHUD creates a new HUD
@@ -31,6 +39,7 @@ func NewHUD(width, height int32) *HUD {
 		ScreenWidth:  width,
 		ScreenHeight: height,
 		nodusStatus:  "Checking...",
+		control:      nodus.NewControlClient(nodus.DefaultConfig().ControlSocket),
 	}
 }
 
@@ -49,8 +58,16 @@ func (h *HUD) Update() {
 	// Try to get total memory from /proc/meminfo
 	h.memTotal = h.getTotalMemory()
 
-	// Check Nodus status by looking for socket/process
-	h.nodusStatus, h.nodusInfo = h.checkNodusStatus()
+	// Ask the Nodus daemon without blocking the frame
+	h.nodusMu.Lock()
+	if !h.nodusChecking {
+		h.nodusChecking = true
+		go func() {
+			status, info := h.checkNodusStatus()
+			h.SetNodusStatus(status, info)
+		}()
+	}
+	h.nodusMu.Unlock()
 }
 
 // getTotalMemory reads from /proc/meminfo
@@ -71,11 +88,12 @@ func (h *HUD) getTotalMemory() uint64 {
 	return 0
 }
 
-// checkNodusStatus checks if Nodus daemon is running
+// checkNodusStatus asks the Nodus daemon for its peers, cache and traffic
 func (h *HUD) checkNodusStatus() (string, string) {
-	// Check for Nodus socket or process
-	if _, err := os.Stat("/run/nodus.sock"); err == nil {
-		return "Online", "P2P Active"
+	st, err := h.control.Status()
+	if err == nil {
+		return fmt.Sprintf("Online, %d peers, %.0f%% hits", st.Peers, st.Cache.HitRatio()*100),
+			fmt.Sprintf("%d MB in / %d MB out", st.Traffic.Total.In>>20, st.Traffic.Total.Out>>20)
 	}
 
 	// Check /mnt/nodus mount
@@ -101,12 +119,16 @@ func (h *HUD) Draw() {
 		memInfo = fmt.Sprintf("RAM: %d/%dMB", h.memUsed, h.memTotal)
 	}
 
+	h.nodusMu.Lock()
+	nodusStatus := h.nodusStatus
+	h.nodusMu.Unlock()
+
 	nodusColor := rl.NewColor(100, 255, 150, 255)
-	if h.nodusStatus == "Offline" {
+	if nodusStatus == "Offline" {
 		nodusColor = rl.NewColor(255, 100, 100, 255)
 	}
 
-	infoText := fmt.Sprintf("%s | Nodus: %s", memInfo, h.nodusStatus)
+	infoText := fmt.Sprintf("%s | Nodus: %s", memInfo, nodusStatus)
 	textWidth := rl.MeasureText(infoText, 16)
 	rl.DrawText(infoText, h.ScreenWidth-textWidth-15, 12, 16, nodusColor)
 
@@ -118,6 +140,9 @@ func (h *HUD) Draw() {
 
 // SetNodusStatus manually sets Nodus status (for external updates)
 func (h *HUD) SetNodusStatus(status, info string) {
+	h.nodusMu.Lock()
+	defer h.nodusMu.Unlock()
 	h.nodusStatus = status
 	h.nodusInfo = info
+	h.nodusChecking = false
 }